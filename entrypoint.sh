@@ -87,12 +87,14 @@ start_application() {
     cp -n "$dir_np2md/config.ini" "$dir_data/"
     # 复制附件配置文件
     cp -n "./attachment.ini" "$dir_data/attachment.ini"
+    # 复制主配置文件
+    cp -n "./ngamm.ini" "$dir_data/ngamm.ini"
 
     cd "$dir_work"
     chmod +x ngamm
 
     export GIN_MODE=release
-    local CMD="./ngamm -p 5842 -m $dir_data/ngapost2md"
+    local CMD="./ngamm -p 5842 -m $dir_data/ngapost2md -c $dir_data/ngamm.ini"
     if [ "$NET_PAN" = "true" ]; then
         mkdir -p "$dir_pan"
         # 用户可能会在外部修改配置文件
@@ -24,7 +24,7 @@ type Option struct {
 	Pan     string   `short:"n" long:"pan" description:"网盘配置根目录, 如果不设置则不使用网盘相关功能:\n如果设置, 在此目录下放置 config.ini 配置网盘"`
 	Log     []string `short:"l" long:"log" env:"LOG" env-delim:"," description:"哪些分组的日志可以输出, 可选值: all, simple, topic, nga, pan, gin\n如果不设置则输出所有分组的日志, 可以多次使用此参数"`
 	Version bool     `short:"v" long:"version" description:"显示版本信息"`
-	// Config  string `short:"c" long:"config" description:"配置文件路径(ini), 如果不设置则使用默认配置, 优先级: 命令行参数 > 配置文件 > 默认值"`
+	Config  string   `short:"c" long:"config" description:"配置文件路径(ini), 如果不设置则使用默认配置, 优先级: 命令行参数 > 配置文件 > 默认值"`
 }
 
 func main() {
@@ -60,19 +60,39 @@ func main() {
 	log.Println("作者: i2534 [ https://github.com/i2534/ngamm ]")
 
 	global := &mgr.Config{}
-	// if opts.Config != "" {
-	// 	log.Printf("加载配置文件: %s\n", opts.Config)
-	// 	cfg, e := mgr.LoadConfig(mgr.JoinPath(wd, opts.Config))
-	// 	if e != nil {
-	// 		log.Fatalln("加载配置文件出现问题:", e.Error())
-	// 	}
-	// 	global = cfg
-	// }
-	mgr.CopyValue(&global.Port, opts.Port)
-	mgr.CopyValue(&global.Program, opts.Program)
-	mgr.CopyValue(&global.Token, opts.Token)
-	mgr.CopyValue(&global.Smile, opts.Smile)
-	mgr.CopyValue(&global.Pan, opts.Pan)
+	fromFile := false
+	if opts.Config != "" {
+		log.Printf("加载配置文件: %s\n", opts.Config)
+		cfg, e := mgr.LoadConfig(mgr.JoinPath(wd, opts.Config))
+		if e != nil {
+			log.Fatalln("加载配置文件出现问题:", e.Error())
+		}
+		global = cfg
+		fromFile = true
+	}
+	// 使用配置文件时, 只有明确设置的参数或配置文件中没有的值才会被覆盖
+	override := func(name string, empty bool) bool {
+		if !fromFile || empty {
+			return true
+		}
+		o := parser.FindOptionByLongName(name)
+		return o != nil && o.IsSet() && !o.IsSetDefault()
+	}
+	if override("port", global.Port == 0) {
+		mgr.CopyValue(&global.Port, opts.Port)
+	}
+	if override("program", global.Program == "") {
+		mgr.CopyValue(&global.Program, opts.Program)
+	}
+	if override("token", global.Token == "") {
+		mgr.CopyValue(&global.Token, opts.Token)
+	}
+	if override("smile", global.Smile == "") {
+		mgr.CopyValue(&global.Smile, opts.Smile)
+	}
+	if override("pan", global.Pan == "") {
+		mgr.CopyValue(&global.Pan, opts.Pan)
+	}
 
 	if len(opts.Log) > 0 {
 		log.Printf("设置输出日志分组: %s\n", opts.Log)
@@ -0,0 +1,358 @@
+package mgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ALIYUN_AUTH_URL   = "https://auth.alipan.com"
+	ALIYUN_API_URL    = "https://api.alipan.com"
+	ALIYUN_ROOT_ID    = "root"
+	ALIYUN_PAGE_SIZE  = 100
+	ALIYUN_TOKEN_SKEW = 5 * time.Minute // 访问令牌提前刷新的时间
+)
+
+var regexAliyunShare = regexp.MustCompile(`(?:alipan|aliyundrive)\.com/s/([a-zA-Z0-9]+)(?:/folder/([a-zA-Z0-9]+))?`)
+
+// 阿里云盘接口返回的错误
+type AliyunError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *AliyunError) Error() string {
+	return fmt.Sprintf("阿里云盘接口错误 %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *AliyunError) tokenInvalid() bool {
+	return e.Status == http.StatusUnauthorized || strings.HasPrefix(e.Code, "AccessToken")
+}
+
+type AliyunFile struct {
+	FileId       string `json:"file_id"`
+	ParentFileId string `json:"parent_file_id"`
+	Name         string `json:"name"`
+	Type         string `json:"type"` // file 或 folder
+	Size         int64  `json:"size"`
+}
+
+type aliyunList struct {
+	Items      []AliyunFile `json:"items"`
+	NextMarker string       `json:"next_marker"`
+}
+
+// 阿里云盘客户端, 使用刷新令牌登录
+type Aliyun struct {
+	AuthURL      string
+	APIURL       string
+	RefreshToken string
+	DriveId      string
+	UserId       string
+	Nickname     string
+	OnRefresh    func(token string) // 刷新令牌变化后调用, 用于保存新的刷新令牌
+	accessToken  string
+	expireAt     time.Time
+	mutex        *sync.Mutex
+	client       *http.Client
+}
+
+func NewAliyun(refreshToken string) *Aliyun {
+	return &Aliyun{
+		AuthURL:      ALIYUN_AUTH_URL,
+		APIURL:       ALIYUN_API_URL,
+		RefreshToken: strings.TrimSpace(refreshToken),
+		mutex:        &sync.Mutex{},
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// 解析分享链接, 返回分享 ID 和分享中的目录 ID
+func ParseAliyunShare(url string) (string, string, error) {
+	m := regexAliyunShare.FindStringSubmatch(url)
+	if m == nil {
+		return "", "", fmt.Errorf("不是阿里云盘的分享链接: %s", url)
+	}
+	return m[1], m[2], nil
+}
+
+func (a *Aliyun) post(url string, body any, headers map[string]string, out any) error {
+	data, e := json.Marshal(body)
+	if e != nil {
+		return e
+	}
+	req, e := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, e := a.client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	data, e = io.ReadAll(resp.Body)
+	if e != nil {
+		return e
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		ae := &AliyunError{Status: resp.StatusCode}
+		json.Unmarshal(data, ae)
+		return ae
+	}
+	if out == nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// 使用刷新令牌获取访问令牌, 刷新令牌每次都会变化
+func (a *Aliyun) Refresh() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.refresh()
+}
+
+func (a *Aliyun) refresh() error {
+	if a.RefreshToken == "" {
+		return fmt.Errorf("阿里云盘 refresh_token 为空")
+	}
+	ret := struct {
+		AccessToken    string `json:"access_token"`
+		RefreshToken   string `json:"refresh_token"`
+		ExpiresIn      int    `json:"expires_in"`
+		DefaultDriveId string `json:"default_drive_id"`
+		UserId         string `json:"user_id"`
+		NickName       string `json:"nick_name"`
+	}{}
+	e := a.post(a.AuthURL+"/v2/account/token", map[string]string{
+		"grant_type":    "refresh_token",
+		"refresh_token": a.RefreshToken,
+	}, nil, &ret)
+	if e != nil {
+		return e
+	}
+	if ret.AccessToken == "" {
+		return fmt.Errorf("阿里云盘刷新令牌失败")
+	}
+	a.accessToken = ret.AccessToken
+	a.expireAt = time.Now().Add(time.Duration(ret.ExpiresIn)*time.Second - ALIYUN_TOKEN_SKEW)
+	a.DriveId = ret.DefaultDriveId
+	a.UserId = ret.UserId
+	a.Nickname = ret.NickName
+	if ret.RefreshToken != "" && ret.RefreshToken != a.RefreshToken {
+		a.RefreshToken = ret.RefreshToken
+		if a.OnRefresh != nil {
+			a.OnRefresh(ret.RefreshToken)
+		}
+	}
+	return nil
+}
+
+func (a *Aliyun) token() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.accessToken == "" || time.Now().After(a.expireAt) {
+		if e := a.refresh(); e != nil {
+			return "", e
+		}
+	}
+	return a.accessToken, nil
+}
+
+// 调用需要登录的接口, 访问令牌失效时刷新后重试一次
+func (a *Aliyun) call(path string, body any, headers map[string]string, out any) error {
+	for i := 0; ; i++ {
+		token, e := a.token()
+		if e != nil {
+			return e
+		}
+		hs := map[string]string{"Authorization": "Bearer " + token}
+		for k, v := range headers {
+			hs[k] = v
+		}
+		e = a.post(a.APIURL+path, body, hs, out)
+		if ae, ok := e.(*AliyunError); ok && ae.tokenInvalid() && i == 0 {
+			a.mutex.Lock()
+			a.accessToken = ""
+			a.mutex.Unlock()
+			continue
+		}
+		return e
+	}
+}
+
+// 获取当前用户的信息, 用于检查登录状态
+func (a *Aliyun) User() (map[string]any, error) {
+	ret := make(map[string]any)
+	if e := a.call("/v2/user/get", map[string]any{}, nil, &ret); e != nil {
+		return nil, e
+	}
+	return ret, nil
+}
+
+// 获取分享令牌, pwd 为提取码
+func (a *Aliyun) ShareToken(shareId, pwd string) (string, error) {
+	ret := struct {
+		ShareToken string `json:"share_token"`
+	}{}
+	e := a.post(a.APIURL+"/v2/share_link/get_share_token", map[string]string{
+		"share_id":  shareId,
+		"share_pwd": pwd,
+	}, nil, &ret)
+	if e != nil {
+		return "", e
+	}
+	if ret.ShareToken == "" {
+		return "", fmt.Errorf("获取分享 %s 的令牌失败", shareId)
+	}
+	return ret.ShareToken, nil
+}
+
+func (a *Aliyun) list(path string, body map[string]any, headers map[string]string) ([]AliyunFile, error) {
+	files := make([]AliyunFile, 0)
+	body["limit"] = ALIYUN_PAGE_SIZE
+	for {
+		ret := aliyunList{}
+		if e := a.call(path, body, headers, &ret); e != nil {
+			return nil, e
+		}
+		files = append(files, ret.Items...)
+		if ret.NextMarker == "" {
+			return files, nil
+		}
+		body["marker"] = ret.NextMarker
+	}
+}
+
+// 列出分享中的文件, parentId 为空时列出分享的根目录
+func (a *Aliyun) ListShare(shareToken, shareId, parentId string) ([]AliyunFile, error) {
+	if parentId == "" {
+		parentId = ALIYUN_ROOT_ID
+	}
+	return a.list("/adrive/v2/file/list_by_share", map[string]any{
+		"share_id":       shareId,
+		"parent_file_id": parentId,
+	}, map[string]string{"X-Share-Token": shareToken})
+}
+
+// 列出网盘中目录下的文件
+func (a *Aliyun) List(parentId string) ([]AliyunFile, error) {
+	return a.list("/adrive/v3/file/list", map[string]any{
+		"drive_id":       a.DriveId,
+		"parent_file_id": parentId,
+	}, nil)
+}
+
+// 根据路径获取文件, 不存在时返回 nil
+func (a *Aliyun) GetByPath(path string) (*AliyunFile, error) {
+	f := &AliyunFile{}
+	e := a.call("/v2/file/get_by_path", map[string]string{
+		"drive_id":  a.DriveId,
+		"file_path": path,
+	}, nil, f)
+	if ae, ok := e.(*AliyunError); ok && ae.Status == http.StatusNotFound {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, e
+	}
+	return f, nil
+}
+
+// 逐级创建目录, 已存在时直接使用, 返回最后一级目录的 ID
+func (a *Aliyun) Mkdir(path string) (string, error) {
+	parent := ALIYUN_ROOT_ID
+	for name := range strings.SplitSeq(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		f := AliyunFile{}
+		e := a.call("/adrive/v2/file/createWithFolders", map[string]string{
+			"drive_id":        a.DriveId,
+			"parent_file_id":  parent,
+			"name":            name,
+			"type":            "folder",
+			"check_name_mode": "refuse",
+		}, nil, &f)
+		if e != nil {
+			return "", e
+		}
+		parent = f.FileId
+	}
+	return parent, nil
+}
+
+// 保存分享中的文件到目录
+func (a *Aliyun) CopyShare(shareToken, shareId string, fileIds []string, toParentId string) error {
+	requests := make([]map[string]any, 0, len(fileIds))
+	for i, id := range fileIds {
+		requests = append(requests, map[string]any{
+			"id":      fmt.Sprint(i),
+			"method":  http.MethodPost,
+			"url":     "/file/copy",
+			"headers": map[string]string{"Content-Type": "application/json"},
+			"body": map[string]any{
+				"file_id":           id,
+				"share_id":          shareId,
+				"auto_rename":       true,
+				"to_parent_file_id": toParentId,
+				"to_drive_id":       a.DriveId,
+			},
+		})
+	}
+	ret := struct {
+		Responses []struct {
+			Id     string `json:"id"`
+			Status int    `json:"status"`
+			Body   struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"body"`
+		} `json:"responses"`
+	}{}
+	e := a.call("/adrive/v2/batch", map[string]any{
+		"requests": requests,
+		"resource": "file",
+	}, map[string]string{"X-Share-Token": shareToken}, &ret)
+	if e != nil {
+		return e
+	}
+	failed := make([]string, 0)
+	for _, r := range ret.Responses {
+		if r.Status >= http.StatusBadRequest {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.Body.Code, r.Body.Message))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d/%d 个文件保存失败: %s", len(failed), len(fileIds), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (a *Aliyun) Move(fileId, toParentId string) error {
+	return a.call("/v2/file/move", map[string]string{
+		"drive_id":          a.DriveId,
+		"file_id":           fileId,
+		"to_parent_file_id": toParentId,
+	}, nil, nil)
+}
+
+// 移动到回收站
+func (a *Aliyun) Trash(fileId string) error {
+	return a.call("/v2/recyclebin/trash", map[string]string{
+		"drive_id": a.DriveId,
+		"file_id":  fileId,
+	}, nil, nil)
+}
@@ -0,0 +1,239 @@
+package mgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"gopkg.in/ini.v1"
+)
+
+// 阿里云盘接口的本地模拟, 只实现转存用到的接口
+type aliyunStub struct {
+	mutex    sync.Mutex
+	refresh  int                    // 刷新令牌的版本
+	expired  bool                   // 下一次调用返回访问令牌失效
+	files    map[string]*AliyunFile // 网盘中的文件
+	shared   []AliyunFile           // 分享中的文件
+	sharePwd string
+	seq      int
+}
+
+func newAliyunStub() *aliyunStub {
+	return &aliyunStub{
+		files: map[string]*AliyunFile{},
+		shared: []AliyunFile{
+			{FileId: "s1", Name: "a.zip", Type: "file", Size: 10},
+			{FileId: "s2", Name: "b.zip", Type: "file", Size: 20},
+		},
+		sharePwd: "abcd",
+	}
+}
+
+func (s *aliyunStub) path(f *AliyunFile) string {
+	if f.ParentFileId == ALIYUN_ROOT_ID {
+		return "/" + f.Name
+	}
+	parent, has := s.files[f.ParentFileId]
+	if !has { // 父目录已删除
+		return ""
+	}
+	return s.path(parent) + "/" + f.Name
+}
+
+func (s *aliyunStub) add(parent, name, typ string, size int64) *AliyunFile {
+	s.seq++
+	f := &AliyunFile{FileId: fmt.Sprint("f", s.seq), ParentFileId: parent, Name: name, Type: typ, Size: size}
+	s.files[f.FileId] = f
+	return f
+}
+
+func (s *aliyunStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	body := make(map[string]any)
+	json.NewDecoder(r.Body).Decode(&body)
+	str := func(k string) string {
+		v, _ := body[k].(string)
+		return v
+	}
+	reply := func(status int, v any) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(status int, code string) {
+		reply(status, map[string]string{"code": code, "message": code})
+	}
+
+	if r.URL.Path == "/v2/account/token" {
+		if str("refresh_token") != fmt.Sprint("rt", s.refresh) {
+			fail(http.StatusBadRequest, "InvalidParameter.RefreshToken")
+			return
+		}
+		s.refresh++
+		reply(http.StatusOK, map[string]any{
+			"access_token":     fmt.Sprint("at", s.refresh),
+			"refresh_token":    fmt.Sprint("rt", s.refresh),
+			"expires_in":       7200,
+			"default_drive_id": "d1",
+			"nick_name":        "测试",
+		})
+		return
+	}
+	if r.URL.Path == "/v2/share_link/get_share_token" {
+		if str("share_id") != "share1" || str("share_pwd") != s.sharePwd {
+			fail(http.StatusBadRequest, "ShareLink.InvalidSharePwd")
+			return
+		}
+		reply(http.StatusOK, map[string]string{"share_token": "st"})
+		return
+	}
+
+	if s.expired || r.Header.Get("Authorization") != fmt.Sprint("Bearer at", s.refresh) {
+		s.expired = false
+		fail(http.StatusUnauthorized, "AccessTokenInvalid")
+		return
+	}
+	children := func(parent string) []AliyunFile {
+		items := make([]AliyunFile, 0)
+		for _, f := range s.files {
+			if f.ParentFileId == parent {
+				items = append(items, *f)
+			}
+		}
+		return items
+	}
+	switch r.URL.Path {
+	case "/v2/user/get":
+		reply(http.StatusOK, map[string]string{"user_id": "u1"})
+	case "/adrive/v2/file/list_by_share":
+		if r.Header.Get("X-Share-Token") != "st" {
+			fail(http.StatusUnauthorized, "ShareLinkTokenInvalid")
+			return
+		}
+		// 分两页返回, 检查翻页
+		if _, has := body["marker"]; has {
+			reply(http.StatusOK, aliyunList{Items: s.shared[1:]})
+		} else {
+			reply(http.StatusOK, aliyunList{Items: s.shared[:1], NextMarker: "m1"})
+		}
+	case "/adrive/v3/file/list":
+		reply(http.StatusOK, aliyunList{Items: children(str("parent_file_id"))})
+	case "/v2/file/get_by_path":
+		for _, f := range s.files {
+			if s.path(f) == str("file_path") {
+				reply(http.StatusOK, f)
+				return
+			}
+		}
+		fail(http.StatusNotFound, "NotFound.File")
+	case "/adrive/v2/file/createWithFolders":
+		for _, f := range children(str("parent_file_id")) {
+			if f.Name == str("name") {
+				reply(http.StatusCreated, f)
+				return
+			}
+		}
+		reply(http.StatusCreated, s.add(str("parent_file_id"), str("name"), "folder", 0))
+	case "/adrive/v2/batch":
+		responses := make([]map[string]any, 0)
+		for _, req := range body["requests"].([]any) {
+			rb := req.(map[string]any)["body"].(map[string]any)
+			for _, sf := range s.shared {
+				if sf.FileId == rb["file_id"] {
+					s.add(rb["to_parent_file_id"].(string), sf.Name, sf.Type, sf.Size)
+				}
+			}
+			responses = append(responses, map[string]any{"id": req.(map[string]any)["id"], "status": http.StatusCreated})
+		}
+		reply(http.StatusOK, map[string]any{"responses": responses})
+	case "/v2/file/move":
+		s.files[str("file_id")].ParentFileId = str("to_parent_file_id")
+		reply(http.StatusOK, map[string]string{"file_id": str("file_id")})
+	case "/v2/recyclebin/trash":
+		delete(s.files, str("file_id"))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fail(http.StatusNotFound, "NotFound")
+	}
+}
+
+func TestParseAliyunShare(t *testing.T) {
+	id, folder, e := ParseAliyunShare("https://www.alipan.com/s/AbC123/folder/F456")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, id, "AbC123")
+	assert.Equal(t, folder, "F456")
+	id, folder, e = ParseAliyunShare("https://www.aliyundrive.com/s/xyz")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, id, "xyz")
+	assert.Equal(t, folder, "")
+	_, _, e = ParseAliyunShare("https://pan.quark.cn/s/abc")
+	assert.NotEqual(t, e, nil)
+
+	assert.Equal(t, extractText("![](https://img.nga.cn/1.jpg) [url](https://www.alipan.com/s/AbC123) 提取码: abcd")[0].URL, "https://www.alipan.com/s/AbC123")
+}
+
+func TestAliyunPan(t *testing.T) {
+	stub := newAliyunStub()
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	ap := NewAliyunPan(AliyunCfg{Name: "aliyun", Root: dir, RefreshToken: "rt0"})
+	ap.root = dir
+	ap.aliyun = NewAliyun(ap.cfg.RefreshToken)
+	ap.aliyun.AuthURL, ap.aliyun.APIURL = ts.URL, ts.URL
+	assert.Equal(t, ap.Init(), nil)
+	defer ap.Close()
+	assert.Equal(t, ap.aliyun.Nickname, "测试")
+	assert.Equal(t, ap.Check(), nil)
+
+	// 刷新令牌变化后保存到工作目录
+	cfg, e := ini.Load(filepath.Join(dir, AliyunUserINI))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, cfg.Section("").Key("refresh_token").String(), "rt1")
+	assert.Equal(t, ap.loadToken(), "rt1")
+
+	record := TransferRecord{URL: "https://www.alipan.com/s/share1", Tqm: "abcd"}
+	assert.Equal(t, ap.Support(record), true)
+	assert.Equal(t, ap.IsExist(100), false)
+
+	// 访问令牌失效时刷新后重试
+	stub.expired = true
+	assert.Equal(t, ap.doTransfer(aliyunTask{100, record, PAN_OPT_SAVE}), nil)
+	assert.Equal(t, stub.refresh, 2)
+	assert.Equal(t, ap.IsExist(100), true)
+	names := make([]string, 0)
+	for _, f := range stub.files {
+		if f.Type == "file" {
+			names = append(names, stub.path(f))
+		}
+	}
+	assert.Equal(t, len(names), 2)
+	assert.Equal(t, strings.HasPrefix(names[0], AliyunBaseTransferDest+"/100/"), true)
+
+	e = ap.doTransfer(aliyunTask{100, record, PAN_OPT_SAVE})
+	assert.Equal(t, e.Error(), "AliyunPan: 文件都已存在")
+
+	e = ap.doTransfer(aliyunTask{101, TransferRecord{URL: record.URL, Tqm: "0000"}, PAN_OPT_SAVE})
+	assert.NotEqual(t, e, nil)
+	assert.Equal(t, ap.IsExist(101), false)
+
+	assert.Equal(t, ap.Move(100), nil)
+	assert.Equal(t, ap.IsExist(100), false)
+	f, e := ap.aliyun.GetByPath(AliyunBaseMoveDest + "/100")
+	assert.Equal(t, e, nil)
+	assert.NotEqual(t, f, nil)
+
+	ap.cfg.TransferDest = AliyunBaseMoveDest
+	assert.Equal(t, ap.Delete(100), nil)
+	assert.Equal(t, ap.IsExist(100), false)
+	assert.NotEqual(t, ap.Delete(100), nil)
+}
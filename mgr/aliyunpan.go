@@ -0,0 +1,318 @@
+package mgr
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/i2534/ngamm/mgr/log"
+
+	"gopkg.in/ini.v1"
+)
+
+var (
+	AliyunUserINI          = "user.ini"
+	AliyunBaseTransferDest = "/来自分享"
+	AliyunBaseMoveDest     = "/Tidy"
+)
+
+var aliyunDriver = RegisterPanDriver(PanDriver{
+	Name:     "aliyun",
+	Patterns: []*regexp.Regexp{regexAliyunShare},
+	New: func(name, root string, sec *ini.Section) (Pan, error) {
+		ac := new(AliyunCfg)
+		if e := sec.MapTo(ac); e != nil {
+			return nil, e
+		}
+		if ac.Transfer == "" {
+			ac.Transfer = TRANSFER_TYPE_AUTO
+		}
+		ac.Name, ac.Root = name, root
+		return NewAliyunPan(*ac), nil
+	},
+})
+
+type aliyunTask struct {
+	topicId int
+	record  TransferRecord
+	opt     PanOpt
+}
+
+type AliyunCfg struct {
+	Name         string // 网盘实例名称, 即配置段名称
+	Root         string // 工作目录
+	Enable       bool   `ini:"enable"`        // 是否启用
+	Transfer     string `ini:"transfer"`      // 转存方式: auto, manual
+	TransferDest string `ini:"directory"`     // 转存的根目录
+	MoveDest     string `ini:"move_dir"`      // 移动的根目录
+	RefreshToken string `ini:"refresh_token"` // 阿里云盘 refresh_token
+}
+
+type AliyunPan struct {
+	cfg    AliyunCfg
+	root   string
+	aliyun *Aliyun
+	mutex  *sync.Mutex
+	tasks  chan aliyunTask
+	holder *PanHolder
+}
+
+func NewAliyunPan(cfg AliyunCfg) *AliyunPan {
+	a := &AliyunPan{
+		cfg:   cfg,
+		mutex: &sync.Mutex{},
+	}
+	if a.cfg.TransferDest == "" {
+		a.cfg.TransferDest = AliyunBaseTransferDest
+	}
+	if a.cfg.MoveDest == "" {
+		a.cfg.MoveDest = AliyunBaseMoveDest
+	}
+	return a
+}
+
+func (a *AliyunPan) Name() string {
+	if a.cfg.Name == "" {
+		return aliyunDriver.Name
+	}
+	return a.cfg.Name
+}
+
+func (a *AliyunPan) SetHolder(holder *PanHolder) {
+	a.holder = holder
+}
+
+func (a *AliyunPan) Support(record TransferRecord) bool {
+	return aliyunDriver.Match(record.URL)
+}
+
+func (a *AliyunPan) TransferType() string {
+	return a.cfg.Transfer
+}
+
+// 刷新令牌每次使用后都会变化, 保存到工作目录下, 优先于配置文件中的令牌
+func (a *AliyunPan) loadToken() string {
+	fp := filepath.Join(a.root, AliyunUserINI)
+	if IsExist(fp) {
+		if cfg, e := ini.Load(fp); e == nil {
+			if token := cfg.Section("").Key("refresh_token").String(); token != "" {
+				return token
+			}
+		}
+	}
+	return a.cfg.RefreshToken
+}
+
+func (a *AliyunPan) saveToken(token string) {
+	if e := os.MkdirAll(a.root, COMMON_DIR_MODE); e != nil {
+		log.Printf("AliyunPan: 创建目录 %s 失败: %s\n", a.root, e.Error())
+		return
+	}
+	cfg := ini.Empty()
+	cfg.Section("").Key("refresh_token").SetValue(token)
+	if e := cfg.SaveTo(filepath.Join(a.root, AliyunUserINI)); e != nil {
+		log.Printf("AliyunPan: 保存 refresh_token 失败: %s\n", e.Error())
+	}
+}
+
+func (a *AliyunPan) Init() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.root == "" {
+		wd, e := os.Getwd()
+		if e != nil {
+			return fmt.Errorf("获取当前工作目录出现问题: %s", e.Error())
+		}
+		if a.cfg.Root == "" {
+			return fmt.Errorf("请设置阿里云盘配置目录")
+		}
+		a.root = JoinPath(wd, a.cfg.Root)
+	}
+
+	if a.aliyun == nil {
+		a.aliyun = NewAliyun(a.loadToken())
+	}
+	a.aliyun.OnRefresh = a.saveToken
+	if e := a.aliyun.Refresh(); e != nil {
+		return fmt.Errorf("AliyunPan: 登录失败: %s", e.Error())
+	}
+	log.Printf("AliyunPan: 登录成功, 用户名: %s\n", a.aliyun.Nickname)
+
+	if a.tasks == nil {
+		a.tasks = make(chan aliyunTask, 99)
+		tasks := a.tasks
+		go func() {
+			log.Println("AliyunPan: 启动任务处理协程")
+			for task := range tasks {
+				var e error
+				var status string
+				switch task.opt {
+				case PAN_OPT_DELETE:
+					e = a.Delete(task.topicId)
+					status = TRANSFER_STATUS_PENDING
+				case PAN_OPT_SAVE:
+					e = a.doTransfer(task)
+					status = TRANSFER_STATUS_SUCCESS
+				}
+				if a.holder != nil {
+					if e != nil {
+						a.holder.notify(task.topicId, task.record.URL, TRANSFER_STATUS_FAILED, e.Error())
+					} else {
+						a.holder.notify(task.topicId, task.record.URL, status, "")
+					}
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func (a *AliyunPan) Check() error {
+	if a.aliyun == nil {
+		return fmt.Errorf("AliyunPan: 未初始化")
+	}
+	if _, e := a.aliyun.User(); e != nil {
+		return fmt.Errorf("AliyunPan: %s", e.Error())
+	}
+	return nil
+}
+
+func (a *AliyunPan) topicDir(topicId int) string {
+	return fmt.Sprintf("%s/%d", a.cfg.TransferDest, topicId)
+}
+
+func (a *AliyunPan) doTransfer(task aliyunTask) error {
+	aliyun := a.aliyun
+	url := task.record.URL
+	log.Group(groupPan).Printf("AliyunPan: 处理转存任务: %d, %s\n", task.topicId, url)
+
+	shareId, folderId, e := ParseAliyunShare(url)
+	if e != nil {
+		return fmt.Errorf("AliyunPan: %s", e.Error())
+	}
+	shareToken, e := aliyun.ShareToken(shareId, task.record.Tqm)
+	if e != nil {
+		return fmt.Errorf("AliyunPan: 获取分享令牌失败, %s", e.Error())
+	}
+	shared, e := aliyun.ListShare(shareToken, shareId, folderId)
+	if e != nil {
+		return fmt.Errorf("AliyunPan: 获取分享文件失败, %s", e.Error())
+	}
+	if len(shared) == 0 {
+		return fmt.Errorf("AliyunPan: 分享链接 %s 中没有有效文件", url)
+	}
+
+	dir := a.topicDir(task.topicId)
+	dirId, e := aliyun.Mkdir(dir)
+	if e != nil {
+		return fmt.Errorf("AliyunPan: 创建目录 %s 失败, %s", dir, e.Error())
+	}
+	existed, e := aliyun.List(dirId)
+	if e != nil {
+		return fmt.Errorf("AliyunPan: 获取目录 %s 失败, %s", dir, e.Error())
+	}
+	sizes := make(map[string]int64, len(existed))
+	for _, f := range existed {
+		sizes[f.Name] = f.Size
+	}
+	ids := make([]string, 0, len(shared))
+	for _, f := range shared {
+		if size, has := sizes[f.Name]; has && size == f.Size {
+			log.Group(groupPan).Printf("AliyunPan: 文件 %s 已存在, 跳过", f.Name)
+			continue
+		}
+		ids = append(ids, f.FileId)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("AliyunPan: 文件都已存在")
+	}
+
+	if e := aliyun.CopyShare(shareToken, shareId, ids, dirId); e != nil {
+		if len(existed) == 0 { // 保存前为空目录, 保存又失败, 删除目录
+			if files, le := aliyun.List(dirId); le == nil && len(files) == 0 {
+				log.Group(groupPan).Printf("AliyunPan: 目录 %s 为空, 删除", dir)
+				aliyun.Trash(dirId)
+			}
+		}
+		return fmt.Errorf("AliyunPan: 保存文件失败, %s", e.Error())
+	}
+
+	log.Group(groupPan).Printf("AliyunPan: 处理转存任务完成: %d, %s\n", task.topicId, url)
+	return nil
+}
+
+func (a *AliyunPan) Transfer(topicId int, record TransferRecord) error {
+	a.tasks <- aliyunTask{
+		topicId,
+		record,
+		PAN_OPT_SAVE,
+	}
+	return nil
+}
+
+func (a *AliyunPan) TransferOpt(topicId int, record *TransferRecord, opt PanOpt) error {
+	a.tasks <- aliyunTask{
+		topicId,
+		*record,
+		opt,
+	}
+	return nil
+}
+
+// 获取帖子目录的 ID, 不存在时返回空
+func (a *AliyunPan) getTopicDirId(topicId int) string {
+	f, e := a.aliyun.GetByPath(a.topicDir(topicId))
+	if e != nil {
+		log.Printf("AliyunPan: 获取帖子 %d 的目录失败: %s\n", topicId, e.Error())
+		return ""
+	}
+	if f == nil {
+		return ""
+	}
+	return f.FileId
+}
+
+func (a *AliyunPan) IsExist(topicId int) bool {
+	return a.getTopicDirId(topicId) != ""
+}
+
+func (a *AliyunPan) Move(topicId int) error {
+	srcId := a.getTopicDirId(topicId)
+	if srcId == "" {
+		return fmt.Errorf("AliyunPan: 获取帖子 %d 的目录失败", topicId)
+	}
+	dstId, e := a.aliyun.Mkdir(a.cfg.MoveDest)
+	if e != nil {
+		return fmt.Errorf("AliyunPan: 创建移动目标目录失败, %s", e.Error())
+	}
+	if e := a.aliyun.Move(srcId, dstId); e != nil {
+		return fmt.Errorf("AliyunPan: 移动文件失败, %s", e.Error())
+	}
+	return nil
+}
+
+func (a *AliyunPan) Delete(topicId int) error {
+	srcId := a.getTopicDirId(topicId)
+	if srcId == "" {
+		return fmt.Errorf("AliyunPan: 获取帖子 %d 的目录失败", topicId)
+	}
+	if e := a.aliyun.Trash(srcId); e != nil {
+		return fmt.Errorf("AliyunPan: 删除文件失败, %s", e.Error())
+	}
+	return nil
+}
+
+func (a *AliyunPan) queueLen() int {
+	return len(a.tasks)
+}
+
+func (a *AliyunPan) Close() error {
+	if a.tasks != nil {
+		close(a.tasks)
+		a.tasks = nil
+	}
+	return nil
+}
@@ -3,11 +3,15 @@ function init(hasToken, ngaBase) {
     const ngaPostBase = `${ngaBase}/read.php?tid=`;
     const headers = {};
     const sorts = { key: 'Id', order: 'desc' };
+    // 表头对应的服务端排序字段
+    const sortKeys = { 'Id': 'id', 'Title': 'title', 'Author': 'author', 'MaxFloor': 'maxfloor', 'Storage': 'storage', 'Result.Time': 'updated' };
     const pageSize = 15;
-    let lastList = new Date();
-    let topics = [];
+    let topics = []; // 当前页的帖子
+    let total = 0;
     let currentPage = 1;
     let searchText = ''; // 添加搜索文本变量
+    let searchTimer = null;
+    let eventsConnected = false; // 是否已连接到事件流, 连接时不再轮询
 
     function dealTopic(id, callback) {
         if (!id || !topics || topics.length === 0) {
@@ -48,14 +52,19 @@ function init(hasToken, ngaBase) {
     }
 
     async function fetchTopics(id) {
-        const hs = { ...headers };
-        const inc = !id && topics && topics.length > 0;
-        if (inc) {
-            hs['If-Modified-Since'] = lastList.toUTCString();
-        }
-        const response = await fetch(`${origin}/topic${id ? ('/' + id) : ''}`
-            , { headers: hs }
-        );
+        let url = `${origin}/topic/${id}`;
+        if (!id) {
+            const params = new URLSearchParams({
+                page: currentPage,
+                size: pageSize,
+                sort: (sorts.order === 'desc' ? '-' : '') + sortKeys[sorts.key],
+            });
+            if (searchText) {
+                params.set('q', searchText);
+            }
+            url = `${origin}/topic?${params}`;
+        }
+        const response = await fetch(url, { headers });
         if (response.status === 401) {
             showTokenSection();
             throw new Error('需要设置 Token');
@@ -64,67 +73,148 @@ function init(hasToken, ngaBase) {
             throw new Error('获取帖子列表失败');
         }
         const ret = await response.json();
-        if (!id) {
-            lastList = new Date();
-        }
-        if (!inc) {
+        if (id) {
             return ret;
         }
+        total = ret.Total;
+        return ret.Items;
+    }
+
+    async function refreshTopic(id) {
+        const topic = await fetchTopics(id);
+        if (!topic || !topic.Id) {
+            return;
+        }
+        const index = topics.findIndex(t => t.Id === topic.Id);
+        if (index >= 0) {
+            topics[index] = topic;
+            renderTopics();
+        } else {
+            listTopics(); // 新帖子的位置由服务端排序决定
+        }
+    }
+
+    function onEvent(type, event) {
+        const id = event.TopicId;
+        switch (type) {
+            case 'ping':
+                break;
+            case 'topic.deleted':
+                dealTopic(id, () => listTopics());
+                break;
+            case 'topic.added':
+            case 'download.finished':
+            case 'topic.metadata':
+            case 'topic.abandoned':
+            case 'subscribe.found':
+                refreshTopic(id).catch(e => console.log('刷新帖子失败', id, e));
+                break;
+            default:
+                console.log('事件', type, event);
+        }
+    }
 
-        const cache = new Map(ret.map(t => [t.Id, t]));
-        const ts = [...topics];
-        ts.forEach(t => {
-            const ct = cache.get(t.Id);
-            if (ct) {
-                Object.assign(t, ct);
-                cache.delete(t.Id);
+    // 使用 fetch 读取事件流, 因为 EventSource 无法设置 Authorization 头
+    async function listenEvents() {
+        try {
+            const response = await fetch(`${origin}/events`, { headers });
+            if (!response.ok || !response.body) {
+                throw new Error(`连接事件流失败: ${response.status}`);
             }
-        });
-        ts.push(...cache.values());
-        return ts;
+            eventsConnected = true;
+            const reader = response.body.pipeThrough(new TextDecoderStream()).getReader();
+            let buffer = '';
+            while (true) {
+                const { value, done } = await reader.read();
+                if (done) {
+                    break;
+                }
+                buffer += value;
+                let i;
+                while ((i = buffer.indexOf('\n\n')) >= 0) {
+                    const chunk = buffer.slice(0, i);
+                    buffer = buffer.slice(i + 2);
+                    let type = 'message', data = '';
+                    chunk.split('\n').forEach(line => {
+                        if (line.startsWith('event:')) {
+                            type = line.slice(6).trim();
+                        } else if (line.startsWith('data:')) {
+                            data += line.slice(5).trim();
+                        }
+                    });
+                    if (data) {
+                        onEvent(type, JSON.parse(data));
+                    }
+                }
+            }
+        } catch (error) {
+            console.log(error.message);
+        } finally {
+            if (eventsConnected) {
+                eventsConnected = false;
+                listTopics(); // 断开期间可能错过事件
+            }
+            setTimeout(listenEvents, 10000);
+        }
     }
 
     // 添加搜索函数
     function searchTopics(text) {
-        searchText = text.toLowerCase();
+        searchText = text.trim();
         currentPage = 1; // 重置为第一页
-        renderTopics();
+        clearTimeout(searchTimer);
+        searchTimer = setTimeout(listTopics, 300);
     }
 
-    function renderTopics() {
-        // 过滤列表
-        const filteredTopics = searchText ? topics.filter(topic =>
-            String(topic.Id).includes(searchText) ||
-            topic.Title.toLowerCase().includes(searchText) ||
-            topic.Author.toLowerCase().includes(searchText)
-        ) : topics;
+    function formatSize(size) {
+        const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+        let i = 0;
+        while (size >= 1024 && i < units.length - 1) {
+            size /= 1024;
+            i++;
+        }
+        return `${i === 0 ? size : size.toFixed(1)} ${units[i]}`;
+    }
 
-        const start = (currentPage - 1) * pageSize;
-        const paginated = filteredTopics.slice(start, start + pageSize);
+    function storageCell(storage) {
+        if (!storage) {
+            return '';
+        }
+        const title = `文本: ${formatSize(storage.Markdown)}\n附件: ${formatSize(storage.Attachment)}\n视频: ${formatSize(storage.Video)}\n其他: ${formatSize(storage.Other)}`;
+        return `<span class="${storage.OverQuota ? 'over-quota' : ''}" title="${storage.OverQuota ? '超过存储配额\n' : ''}${title}">${formatSize(storage.Total)}</span>`;
+    }
 
+    function renderTopics() {
         const ths = `
         <tr>
             <th key="Id" onclick="sortTopics('Id')">ID</th>
             <th key="Title" onclick="sortTopics('Title')">标题</th>
             <th key="Author" onclick="sortTopics('Author')">楼主</th>
             <th key="MaxFloor" onclick="sortTopics('MaxFloor')">楼层数</th>
+            <th key="Storage" onclick="sortTopics('Storage')">占用</th>
             <th key="Result.Time" onclick="sortTopics('Result.Time')">最后更新于</th>
             <th>更新计划</th>
             <th>操作</th>
         </tr>`;
 
-        const rows = paginated.map(topic => `
+        const rows = topics.map(topic => `
         <tr>
             <td><a href="${ngaPostBase}${topic.Id}" target="_blank">${topic.Id}</a></td>
-            <td><span class="title" title="${topic.Title}">${topic.Title}</span></td>
-            <td><span class="author" uid="${topic.Uid}"><a href="${ngaBase}/nuke.php?func=ucp&uid=${topic.Uid}}" target="_blank">${topic.Author}<a></span></td>
-            <td>${topic.MaxFloor}</td>
+            <td>
+                <span class="title" title="${topic.Metadata.Note || topic.Title}">${topic.Title}</span>
+                ${topic.Metadata.Folder ? `<span class="folder" title="文件夹">${topic.Metadata.Folder}</span>` : ''}
+                ${(topic.Metadata.Tags || []).map(tag => `<span class="tag">${tag}</span>`).join('')}
+            </td>
+            <td><span class="author" uid="${topic.Uid}"><a href="${ngaBase}/nuke.php?func=ucp&uid=${topic.Uid}}" target="_blank">${topic.Author}<a></span><a class="user-link" href="${origin}/u/${topic.Uid}" target="_blank" title="查看归档的用户帖子和回复">&#9776;</a></td>
+            <td>${topic.MaxFloor}${topic.Unread > 0 && topic.Metadata.Reading ? ` <span class="unread" title="未读楼层">+${topic.Unread}</span>` : ''}</td>
+            <td>${storageCell(topic.Storage)}</td>
             <td><span class="update-${topic.Result.Success ? 'success' : 'failed'}">${topic.Result.Time}</span></td>
             <td>${topic.Metadata.UpdateCron}</td>
             <td>
                 <button onclick="viewTopic(${topic.Id}, ${topic.MaxFloor})" title="查看帖子内容">查看</button>
                 <button class="fresh-button" onclick="freshTopic(${topic.Id})" title="立即更新帖子">更新</button>
                 <button class="sched-button" onclick="schedTopic(${topic.Id})" title="任务计划更新帖子">计划</button>
+                <button onclick="organizeTopic(${topic.Id})" title="设置标签, 文件夹和备注">整理</button>
                 <button class="delete-button" onclick="deleteTopic(${topic.Id})" title="删除帖子到回收站">删除</button>
             </td>
         </tr>`).join('');
@@ -140,7 +230,7 @@ function init(hasToken, ngaBase) {
 
         renderSubscribe(container);
 
-        renderPagination(filteredTopics);
+        renderPagination();
     }
 
     const userSpans = new Map(), userInfos = new Map();;
@@ -187,6 +277,7 @@ function init(hasToken, ngaBase) {
                         document.getElementById('uid').value = uid;
                         const user = userInfos.get(uid);
                         document.getElementById('subFilter').value = (user && user.filter) ? user.filter.join('\n') : '';
+                        document.getElementById('subTags').value = (user && user.tags) ? user.tags.join(', ') : '';
                         dialog.showModal();
                     }
                 }
@@ -219,44 +310,45 @@ function init(hasToken, ngaBase) {
         });
     }
 
-    function renderPagination(topics) {
-        const totalPages = Math.ceil(topics.length / pageSize);
+    function changePage(page) {
+        currentPage = page;
+        listTopics();
+    }
+
+    function renderPagination() {
+        const totalPages = Math.max(1, Math.ceil(total / pageSize));
         const pagination = document.getElementById('pagination');
         pagination.innerHTML = '';
 
         const totalTopics = document.createElement('span');
-        totalTopics.innerText = `共 ${topics.length} 条 `;
+        totalTopics.innerText = `共 ${total} 条 `;
         pagination.appendChild(totalTopics);
 
         const firstButton = document.createElement('button');
         firstButton.innerText = '⏮';
         firstButton.onclick = () => {
-            currentPage = 1;
-            renderTopics();
+            changePage(1);
         }
         pagination.appendChild(firstButton);
 
         const prevButton = document.createElement('button');
         prevButton.innerText = '◀';
         prevButton.onclick = () => {
-            currentPage = Math.max(1, currentPage - 1);
-            renderTopics();
+            changePage(Math.max(1, currentPage - 1));
         }
         pagination.appendChild(prevButton);
 
         const nextButton = document.createElement('button');
         nextButton.innerText = '▶';
         nextButton.onclick = () => {
-            currentPage = Math.min(totalPages, currentPage + 1);
-            renderTopics();
+            changePage(Math.min(totalPages, currentPage + 1));
         }
         pagination.appendChild(nextButton);
 
         const lastButton = document.createElement('button');
         lastButton.innerText = '⏭';
         lastButton.onclick = () => {
-            currentPage = totalPages;
-            renderTopics();
+            changePage(totalPages);
         }
         pagination.appendChild(lastButton);
 
@@ -297,8 +389,7 @@ function init(hasToken, ngaBase) {
             const pb = document.createElement('button');
             pb.innerText = i;
             pb.onclick = () => {
-                currentPage = i;
-                renderTopics();
+                changePage(i);
             };
             if (i === currentPage) {
                 pb.classList.add('active');
@@ -323,57 +414,45 @@ function init(hasToken, ngaBase) {
                 sorts.key = key;
                 sorts.order = 'asc';
             }
-        } else {
-            key = sorts.key;
         }
-
-        topics.sort((a, b) => {
-            let av = a[key], bv = b[key];
-            if (av < bv) return sorts.order === 'asc' ? -1 : 1;
-            if (av > bv) return sorts.order === 'asc' ? 1 : -1;
-            return 0;
-        });
-
-        renderTopics();
+        currentPage = 1;
+        listTopics();
     }
 
     async function listTopics() {
         try {
             topics = await fetchTopics();
-            sortTopics();
+            // 删除后当前页可能已经不存在
+            const totalPages = Math.max(1, Math.ceil(total / pageSize));
+            if (currentPage > totalPages) {
+                currentPage = totalPages;
+                topics = await fetchTopics();
+            }
+            renderTopics();
         } catch (error) {
             showAlert(error.message);
         }
     }
 
     async function createTopic() {
-        let id = document.getElementById('createId').value.trim();
-        if (!id) {
+        const text = document.getElementById('createId').value.trim();
+        if (!text) {
             showAlert('请输入帖子 ID 或链接');
             return;
         }
-        if (!/^\d+$/.test(id)) {
-            const match = id.match(/tid=(\d+)/);
-            if (match) {
-                id = match[1];
-            } else {
-                showAlert('帖子 ID 格式错误');
-                return;
-            }
-        }
         try {
-            const response = await fetch(`${origin}/topic/${id}`, { method: 'PUT', headers });
+            // 可以包含多个链接, 由服务端解析
+            const response = await fetch(`${origin}/topic`, {
+                method: 'POST',
+                headers: { ...headers, 'Content-Type': 'text/plain' },
+                body: text
+            });
             const data = await response.json();
             if (!response.ok) {
                 throw new Error(data.error);
             }
-            showAlert(`帖子 ${data} 创建成功`);
-            // listTopics();
-            const topic = await fetchTopics(id);
-            if (topic) {
-                topics.push(topic);
-                renderTopics();
-            }
+            showAlert(data.map(r => r.Ok ? `帖子 ${r.Id} 创建成功` : `${r.Input}: ${r.Error}`).join('\n'));
+            listTopics();
         } catch (error) {
             showAlert(error.message);
         }
@@ -388,11 +467,7 @@ function init(hasToken, ngaBase) {
                     throw new Error(data.error);
                 }
                 showAlert(`删除帖子 ${data} 成功`);
-                // listTopics();
-                dealTopic(id, (_, index) => {
-                    topics.splice(index, 1);
-                    renderTopics();
-                });
+                listTopics();
             } catch (error) {
                 showAlert(error.message);
             }
@@ -441,6 +516,47 @@ function init(hasToken, ngaBase) {
         }
     }
 
+    function organizeTopic(id) {
+        const dialog = document.getElementById('orgDialog');
+        if (dialog) {
+            const md = topics.find(t => t.Id === id).Metadata;
+            document.getElementById('OrgTopicID').value = id;
+            document.getElementById('OrgTags').value = (md.Tags || []).join(', ');
+            document.getElementById('OrgFolder').value = md.Folder || '';
+            document.getElementById('OrgNote').value = md.Note || '';
+            dialog.showModal();
+        }
+    }
+
+    async function submitOrganize() {
+        closeDialog('orgDialog');
+        const id = parseInt(document.getElementById('OrgTopicID').value);
+        const body = {
+            Ids: [id],
+            Tags: document.getElementById('OrgTags').value.split(/[,，]/).map(s => s.trim()).filter(s => s.length > 0),
+            Folder: document.getElementById('OrgFolder').value.trim(),
+            Note: document.getElementById('OrgNote').value.trim(),
+        };
+        try {
+            const response = await fetch(`${origin}/topic/org`, {
+                method: 'POST',
+                headers: { ...headers, 'Content-Type': 'application/json' },
+                body: JSON.stringify(body)
+            });
+            const data = await response.json();
+            if (!response.ok) {
+                throw new Error(data.error);
+            }
+            const failed = data.filter(r => !r.Ok);
+            if (failed.length) {
+                throw new Error(failed.map(r => `${r.Id}: ${r.Error}`).join('\n'));
+            }
+            await refreshTopic(id);
+        } catch (error) {
+            showAlert(error.message);
+        }
+    }
+
     async function hashToken(token) {
         if (crypto && crypto.subtle) {// 这坑爹的API, 只在 https 下才能用
             return crypto.subtle.digest('SHA-1', new TextEncoder().encode(token))
@@ -509,6 +625,65 @@ function init(hasToken, ngaBase) {
         }
     }
 
+    async function showFeeds() {
+        try {
+            const response = await fetch(`${origin}/feeds`, { headers });
+            const data = await response.json();
+            if (!response.ok) {
+                throw new Error(data.error);
+            }
+            showAlert(`最新帖子订阅源:\n${data.topics}\n\n帖子新楼层: /feed/topic/帖子ID, 用户帖子: /feed/author/用户ID, 启用 token 时可以通过 /feeds?topic=帖子ID&uid=用户ID 获取带签名的地址`);
+        } catch (error) {
+            showAlert(error.message);
+        }
+    }
+
+    async function loadStats() {
+        const container = document.getElementById('stats');
+        try {
+            const response = await fetch(`${origin}/stats`, { headers });
+            const data = await response.json();
+            if (!response.ok) {
+                throw new Error(data.error);
+            }
+            container.innerHTML = renderStats(data);
+        } catch (error) {
+            container.textContent = `加载统计失败: ${error.message}`;
+        }
+    }
+
+    function renderStats(data) {
+        const percent = (rate) => `${(rate * 100).toFixed(1)}%`;
+        const rateText = (r) => `${percent(r.Rate)} (成功 ${r.Success}, 失败 ${r.Failed}, 未完成 ${r.Pending})`;
+        const maxDaily = Math.max(1, ...data.Daily.map(d => d.Count));
+        const daily = data.Daily.map(d => `<span class="stats-bar" title="${d.Date}: ${d.Count}" style="height: ${Math.round(d.Count / maxDaily * 100)}%"></span>`).join('');
+        const authors = data.Authors.map(a => `<tr><td>${a.Author}</td><td>${a.Topics}</td><td>${a.Floors}</td></tr>`).join('');
+        const pans = data.Pans.map(p => `<tr><td>${p.Name}</td><td>${p.Total}</td><td>${rateText(p)}</td></tr>`).join('');
+        const storage = data.Storage.map(t => `<tr><td>${t.Id}</td><td>${t.Title}</td><td>${formatSize(t.Total)}</td></tr>`).join('');
+        return `
+        <div class="stats-summary">
+            <span>帖子: ${data.Topics}</span>
+            <span>楼层: ${data.Floors}</span>
+            <span>平均楼层: ${data.AvgFloors.toFixed(1)}</span>
+            <span>下载成功率: ${rateText(data.Download)}</span>
+        </div>
+        <h3>最近 ${data.Daily.length} 天添加的帖子</h3>
+        <div class="stats-daily">${daily}</div>
+        <div class="stats-tables">
+            <table><tr><th>作者</th><th>帖子</th><th>楼层</th></tr>${authors}</table>
+            <table><tr><th>网盘</th><th>链接</th><th>转存成功率</th></tr>${pans}</table>
+            <table><tr><th>ID</th><th>标题</th><th>占用</th></tr>${storage}</table>
+        </div>`;
+    }
+
+    function toggleStats() {
+        const container = document.getElementById('stats');
+        if (container.classList.toggle('hidden')) {
+            return;
+        }
+        loadStats();
+    }
+
     function showAlert(message) {
         closeDialog('alertDialog');
         const dialog = document.getElementById('alertDialog');
@@ -524,19 +699,24 @@ function init(hasToken, ngaBase) {
     window.schedTopic = schedTopic;
     window.viewTopic = viewTopic;
     window.freshTopic = freshTopic;
+    window.showFeeds = showFeeds;
+    window.toggleStats = toggleStats;
     window.showAlert = showAlert;
     window.submitSched = submitSched;
+    window.organizeTopic = organizeTopic;
+    window.submitOrganize = submitOrganize;
     window.closeDialog = closeDialog;
     window.clearInput = (id) => document.getElementById(id).value = '';
     window.submitSubscribe = async () => {
         closeDialog('subscribeDialog');
         const uv = document.getElementById('uid').value;
         const filter = document.getElementById('subFilter').value.split('\n').map(s => s.trim()).filter(s => s.length > 0);
+        const tags = document.getElementById('subTags').value.split(/[,，]/).map(s => s.trim()).filter(s => s.length > 0);
         try {
             const response = await fetch(`${origin}/subscribe/${uv}`, {
                 headers,
                 method: 'POST',
-                body: JSON.stringify(filter)
+                body: JSON.stringify({ Filter: filter, Tags: tags })
             });
             const data = await response.json();
             if (!response.ok) {
@@ -578,7 +758,12 @@ function init(hasToken, ngaBase) {
             vwm.checked = true;
         }
 
-        setInterval(listTopics, 60000);
+        listenEvents();
+        setInterval(() => {
+            if (!eventsConnected) {
+                listTopics();
+            }
+        }, 60000);
     });
 }
 
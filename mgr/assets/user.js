@@ -0,0 +1,87 @@
+function initUser(hasToken, ngaBase, uid) {
+    const origin = window.location.origin;
+    const ngaPostBase = `${ngaBase}/read.php?tid=`;
+    const headers = {};
+    if (hasToken) {
+        const token = localStorage.getItem('token');
+        if (token) {
+            headers.Authorization = token;
+        }
+    }
+
+    function escapeHtml(text) {
+        const div = document.createElement('div');
+        div.textContent = text || '';
+        return div.innerHTML;
+    }
+
+    function renderProfile(data) {
+        const name = data.Name || `UID${uid}`;
+        document.title = `${name} - 用户`;
+        document.getElementById('userName').innerHTML = `<a href="${ngaBase}/nuke.php?func=ucp&uid=${uid}" target="_blank">${escapeHtml(name)}</a> (${uid})`;
+
+        const rows = [];
+        if (data.Profile) {
+            rows.push(['属地', data.Profile.loc]);
+            rows.push(['注册时间', data.Profile.regDate]);
+            rows.push(['信息更新于', data.Profile.refreshed]);
+        } else if (data.ProfileError) {
+            rows.push(['用户信息', data.ProfileError]);
+        }
+        if (data.Names.length > 0) {
+            rows.push(['曾用名', data.Names.map(n => `${n.name} (${n.until} 之前)`).join(', ')]);
+        }
+        const sub = data.Subscription;
+        rows.push(['订阅', sub.Subscribed ? '已订阅' : '未订阅']);
+        if (sub.Subscribed) {
+            rows.push(['过滤条件', (sub.Filter || []).join(', ') || '全部新帖']);
+            rows.push(['自动标签', (sub.Tags || []).join(', ')]);
+        }
+        rows.push(['帖子', data.Topics.length]);
+        rows.push(['回复', data.FloorsTotal]);
+        document.getElementById('userProfile').innerHTML = `<table>${rows.map(([k, v]) => `<tr><th>${k}</th><td>${escapeHtml(String(v ?? ''))}</td></tr>`).join('')}</table>`;
+    }
+
+    function renderTopics(data) {
+        const rows = data.Topics.map(topic => `
+        <tr>
+            <td><a href="${ngaPostBase}${topic.Id}" target="_blank">${topic.Id}</a></td>
+            <td><a href="${origin}${data.View}${topic.Id}" target="_blank">${escapeHtml(topic.Title)}</a></td>
+            <td>${topic.MaxFloor}</td>
+            <td>${topic.Create}</td>
+            <td><span class="update-${topic.Result.Success ? 'success' : 'failed'}">${topic.Result.Time}</span></td>
+        </tr>`).join('');
+        document.getElementById('userTopics').innerHTML = `<table>
+            <tr><th>ID</th><th>标题</th><th>楼层数</th><th>发帖时间</th><th>最后更新于</th></tr>${rows}</table>`;
+    }
+
+    function renderFloors(data) {
+        const rows = data.Floors.map(f => `
+        <tr>
+            <td><a href="${origin}${data.View}${f.TopicId}#pid${f.Pid}" target="_blank">${escapeHtml(f.Title)}</a></td>
+            <td>#${f.Floor}</td>
+            <td>${f.Time}</td>
+            <td class="floor-content" title="${escapeHtml(f.Content)}">${escapeHtml(f.Content)}</td>
+        </tr>`).join('');
+        const more = data.FloorsTotal > data.Floors.length ? `<p>只显示最近的 ${data.Floors.length} 条, 共 ${data.FloorsTotal} 条</p>` : '';
+        document.getElementById('userFloors').innerHTML = `<table>
+            <tr><th>帖子</th><th>楼层</th><th>时间</th><th>内容</th></tr>${rows}</table>${more}`;
+    }
+
+    async function loadUser() {
+        try {
+            const response = await fetch(`${origin}/user/${uid}`, { headers });
+            const data = await response.json();
+            if (!response.ok) {
+                throw new Error(data.error);
+            }
+            renderProfile(data);
+            renderTopics(data);
+            renderFloors(data);
+        } catch (error) {
+            document.getElementById('userProfile').textContent = `加载用户失败: ${error.message}`;
+        }
+    }
+
+    window.addEventListener('load', loadUser);
+}
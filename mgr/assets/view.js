@@ -843,47 +843,67 @@ function render(ngaBase, id, token, content, replaceAttachment, hasMoreContent)
         container.appendChild(frag);
     }
 
+    // 分段加载的帖子, 下一段的索引
+    let nextIndex = 2;
+    let hasNext = hasMoreContent + '' == 'true';
+    let loadingPart = null;
+
+    // 加载下一段内容, 返回是否加载到了内容
+    function loadPart(container, loadImg) {
+        if (!hasNext) {
+            return Promise.resolve(false);
+        }
+        if (loadingPart) {
+            return loadingPart;
+        }
+        loadingPart = fetch(`${origin}/view/${token}/${id}`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ index: nextIndex })
+        })
+            .then(r => r.json())
+            .then(data => {
+                let loaded = false;
+                if (data.markdown) {
+                    let md = data.markdown.trim();
+                    if (md.startsWith('----')) {
+                        md = md.substring(4).trim();
+                    }
+                    appendContent(container, md, loadImg);
+                    renderBookmarks(container);
+                    nextIndex++;
+                    loaded = true;
+                }
+                hasNext = !!data.next;
+                return loaded;
+            })
+            .finally(() => {
+                loadingPart = null;
+            });
+        return loadingPart;
+    }
+
     // 解析更多内容
     function loadMoreContent(container, loadImg) {
-        if (hasMoreContent + '' != 'true') {
+        if (!hasNext) {
             return;
         }
         // 当滚动到页面底部时, 加载更多内容
-        let index = 2;
-        let loading = false;
         let task = null;
         let noMore = 0;
 
         const load = () => {
-            if (loading) return;
             if (window.innerHeight + window.scrollY < document.body.offsetHeight - 50) return;
             if (Date.now() - noMore < 5 * 60 * 1000) return; // 5 分钟内不再加载
 
-            loading = true;
-            fetch(`${origin}/view/${token}/${id}`, {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json'
-                },
-                body: JSON.stringify({ index })
-            })
-                .then(r => r.json())
-                .then(data => {
-                    if (data.markdown) {
-                        let md = data.markdown.trim();
-                        if (md.startsWith('----')) {
-                            md = md.substring(4).trim();
-                        }
-                        appendContent(container, md, loadImg);
-                        index++;
-                    }
-                    if (!data.next) {
-                        noMore = Date.now();
-                    }
-                })
-                .finally(() => {
-                    loading = false;
-                });
+            loadPart(container, loadImg).then(() => {
+                if (!hasNext) {
+                    noMore = Date.now();
+                    hasNext = true; // 5 分钟后再尝试, 帖子可能已更新
+                }
+            });
         };
 
         window.addEventListener('scroll', () => {
@@ -892,6 +912,126 @@ function render(ngaBase, id, token, content, replaceAttachment, hasMoreContent)
         });
     }
 
+    // 阅读进度和书签
+    const readingUrl = `${origin}/read/${token}/${id}`;
+    const bookmarks = new Map();
+    let savedFloor = -1;
+
+    function renderBookmarks(container) {
+        container.querySelectorAll('h5[floor]').forEach(h => {
+            const floor = parseInt(h.getAttribute('floor'));
+            let mark = h.querySelector('.bookmark');
+            if (!mark) {
+                const div = h.querySelector('.floor');
+                if (!div) {
+                    return;
+                }
+                mark = document.createElement('span');
+                mark.className = 'bookmark';
+                mark.innerHTML = '&#9873;';
+                mark.addEventListener('click', () => toggleBookmark(floor));
+                div.appendChild(mark);
+            }
+            const has = bookmarks.has(floor);
+            mark.classList.toggle('marked', has);
+            mark.title = has ? `书签: ${bookmarks.get(floor) || '无备注'}\n点击删除书签` : '点击添加书签';
+        });
+    }
+
+    function applyReading(data) {
+        bookmarks.clear();
+        (data.Reading.Bookmarks || []).forEach(b => bookmarks.set(b.Floor, b.Note));
+        renderBookmarks(document.querySelector('#content'));
+    }
+
+    function toggleBookmark(floor) {
+        let req;
+        if (bookmarks.has(floor)) {
+            if (!confirm(`确认删除 ${floor} 楼的书签?`)) {
+                return;
+            }
+            req = fetch(`${readingUrl}/bookmark/${floor}`, { method: 'DELETE' });
+        } else {
+            const note = prompt(`为 ${floor} 楼添加书签, 可以输入备注`, '');
+            if (note === null) {
+                return;
+            }
+            req = fetch(`${readingUrl}/bookmark/${floor}`, {
+                method: 'PUT',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ Note: note })
+            });
+        }
+        req.then(async r => {
+            const data = await r.json();
+            if (!r.ok) {
+                throw new Error(data.error || r.statusText);
+            }
+            applyReading(data);
+        }).catch(e => alert(`操作书签失败: ${e.message}`));
+    }
+
+    // 当前屏幕顶部的楼层
+    function currentFloor(container) {
+        let floor = -1;
+        for (const h of container.querySelectorAll('h5[floor]')) {
+            if (h.getBoundingClientRect().top > 100) {
+                break;
+            }
+            floor = parseInt(h.getAttribute('floor'));
+        }
+        return floor;
+    }
+
+    function trackProgress(container) {
+        let task = null;
+        window.addEventListener('scroll', () => {
+            if (task) clearTimeout(task);
+            task = setTimeout(() => {
+                const floor = currentFloor(container);
+                if (floor < 0 || floor === savedFloor) {
+                    return;
+                }
+                savedFloor = floor;
+                fetch(readingUrl, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ Floor: floor })
+                }).catch(e => console.error('保存阅读进度失败:', e));
+            }, 2000);
+        });
+    }
+
+    // 跳转到上次阅读的位置, 需要时加载后续的内容
+    async function restoreProgress(container, loadImg) {
+        try {
+            const r = await fetch(readingUrl);
+            if (!r.ok) {
+                return;
+            }
+            const data = await r.json();
+            applyReading(data);
+            savedFloor = data.Reading.LastFloor;
+            if (savedFloor <= 0 || window.location.hash) {
+                return;
+            }
+            for (let i = 0; i < 100; i++) {
+                const target = container.querySelector(`h5[floor="${savedFloor}"]`);
+                if (target) {
+                    target.scrollIntoView();
+                    return;
+                }
+                if (!await loadPart(container, loadImg)) {
+                    return;
+                }
+            }
+        } catch (e) {
+            console.error('获取阅读进度失败:', e);
+        } finally {
+            trackProgress(container);
+        }
+    }
+
     window.addEventListener('load', () => {
         if (vwm) {
             const btn = document.querySelector('#toggleViewMedia');
@@ -910,9 +1050,12 @@ function render(ngaBase, id, token, content, replaceAttachment, hasMoreContent)
             const loadImg = URL.createObjectURL(new Blob([document.querySelector('#loading').innerHTML], { type: 'image/svg+xml' }));
 
             appendContent(c, content, loadImg);
+            renderBookmarks(c);
 
             loadMoreContent(c, loadImg);
 
+            restoreProgress(c, loadImg);
+
             processNetPan(c);
         }
     });
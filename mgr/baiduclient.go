@@ -0,0 +1,356 @@
+package mgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BAIDU_PAN_URL   = "https://pan.baidu.com"
+	BAIDU_PCS_URL   = "https://d.pcs.baidu.com"
+	BAIDU_APP_ID    = "250528"
+	BAIDU_PAGE_SIZE = 1000
+	BAIDU_UA        = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+)
+
+var regexBaiduSurl = regexp.MustCompile(`pan\.baidu\.com/(?:s/1|share/init\?surl=)([\w-]+)`)
+
+// 百度网盘接口的错误码说明
+var baiduErrnos = map[int]string{
+	-6:  "身份验证失败, 请重新设置 bduss 和 stoken",
+	-7:  "文件或目录名非法",
+	-8:  "文件或目录已存在",
+	-9:  "文件或目录不存在",
+	-12: "提取码错误",
+	-21: "分享已取消",
+	-62: "需要输入验证码",
+	2:   "参数错误",
+	12:  "转存失败, 文件已存在或超过数量限制",
+	105: "分享链接不存在",
+	115: "分享文件违规",
+	117: "分享已过期",
+	145: "分享链接违规",
+}
+
+// 百度网盘接口返回的错误
+type BaiduError struct {
+	Errno   int
+	Message string
+}
+
+func (e *BaiduError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = baiduErrnos[e.Errno]
+	}
+	return fmt.Sprintf("百度网盘接口错误 %d: %s", e.Errno, msg)
+}
+
+type BaiduFile struct {
+	FsId  int64  `json:"fs_id"`
+	Path  string `json:"path"`
+	Name  string `json:"server_filename"`
+	IsDir int    `json:"isdir"`
+	Size  int64  `json:"size"`
+}
+
+// 分享的信息和根目录下的文件
+type BaiduShare struct {
+	ShareId int64       `json:"share_id"`
+	Uk      int64       `json:"uk"`
+	List    []BaiduFile `json:"list"`
+}
+
+// 百度网盘客户端, 使用 BDUSS 和 STOKEN 登录
+type BaiduClient struct {
+	PanURL   string
+	PCSURL   string
+	Bduss    string
+	Stoken   string
+	Username string
+	bdstoken string
+	client   *http.Client
+}
+
+func NewBaiduClient(bduss, stoken string) *BaiduClient {
+	return &BaiduClient{
+		PanURL: BAIDU_PAN_URL,
+		PCSURL: BAIDU_PCS_URL,
+		Bduss:  strings.TrimSpace(bduss),
+		Stoken: strings.TrimSpace(stoken),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// 解析分享链接, 返回不带开头 1 的短链接
+func ParseBaiduShare(url string) (string, error) {
+	m := regexBaiduSurl.FindStringSubmatch(url)
+	if m == nil {
+		return "", fmt.Errorf("不是百度网盘的分享链接: %s", url)
+	}
+	return m[1], nil
+}
+
+// 发送请求并解析结果, errno 不为 0 时返回 BaiduError, cookies 为额外的 cookie
+func (b *BaiduClient) do(method, path string, query, form url.Values, cookies map[string]string, out any) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("channel", "chunlei")
+	query.Set("web", "1")
+	query.Set("app_id", BAIDU_APP_ID)
+	query.Set("clienttype", "0")
+	if b.bdstoken != "" {
+		query.Set("bdstoken", b.bdstoken)
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, e := http.NewRequest(method, b.PanURL+path+"?"+query.Encode(), body)
+	if e != nil {
+		return e
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	b.header(req, cookies)
+
+	resp, e := b.client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	data, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return e
+	}
+	ret := struct {
+		Errno   int    `json:"errno"`
+		ShowMsg string `json:"show_msg"`
+	}{}
+	if e := json.Unmarshal(data, &ret); e != nil {
+		return fmt.Errorf("解析百度网盘返回失败: %d, %s", resp.StatusCode, e.Error())
+	}
+	if ret.Errno != 0 {
+		return &BaiduError{ret.Errno, ret.ShowMsg}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (b *BaiduClient) header(req *http.Request, cookies map[string]string) {
+	req.Header.Set("User-Agent", BAIDU_UA)
+	req.Header.Set("Referer", b.PanURL+"/disk/home")
+	req.AddCookie(&http.Cookie{Name: "BDUSS", Value: b.Bduss})
+	req.AddCookie(&http.Cookie{Name: "STOKEN", Value: b.Stoken})
+	for k, v := range cookies {
+		req.AddCookie(&http.Cookie{Name: k, Value: v})
+	}
+}
+
+// 获取用户名和修改文件需要的 bdstoken, 用于登录
+func (b *BaiduClient) Init() error {
+	bdstoken, username, e := b.templateVariable()
+	if e != nil {
+		return e
+	}
+	b.bdstoken = bdstoken
+	b.Username = username
+	return nil
+}
+
+// 检查登录状态, 不修改客户端, 可以在处理任务时调用
+func (b *BaiduClient) Check() error {
+	_, _, e := b.templateVariable()
+	return e
+}
+
+func (b *BaiduClient) templateVariable() (string, string, error) {
+	if b.Bduss == "" || b.Stoken == "" {
+		return "", "", fmt.Errorf("请设置 bduss 和 stoken")
+	}
+	ret := struct {
+		Result struct {
+			Bdstoken string `json:"bdstoken"`
+			Username string `json:"username"`
+		} `json:"result"`
+	}{}
+	q := url.Values{"fields": {`["bdstoken","username"]`}}
+	if e := b.do(http.MethodGet, "/api/gettemplatevariable", q, nil, nil, &ret); e != nil {
+		return "", "", e
+	}
+	if ret.Result.Bdstoken == "" {
+		return "", "", &BaiduError{Errno: -6}
+	}
+	return ret.Result.Bdstoken, ret.Result.Username, nil
+}
+
+// 验证提取码, 返回访问分享需要的 randsk
+func (b *BaiduClient) VerifyShare(surl, pwd string) (string, error) {
+	ret := struct {
+		Randsk string `json:"randsk"`
+	}{}
+	q := url.Values{"surl": {surl}, "t": {strconv.FormatInt(time.Now().UnixMilli(), 10)}}
+	form := url.Values{"pwd": {pwd}, "vcode": {""}, "vcode_str": {""}}
+	if e := b.do(http.MethodPost, "/share/verify", q, form, nil, &ret); e != nil {
+		return "", e
+	}
+	return ret.Randsk, nil
+}
+
+func shareCookies(randsk string) map[string]string {
+	if randsk == "" {
+		return nil
+	}
+	return map[string]string{"BDCLND": randsk}
+}
+
+// 获取分享的信息和根目录下的文件, randsk 为验证提取码的结果, 没有提取码时为空
+func (b *BaiduClient) ListShare(surl, randsk string) (*BaiduShare, error) {
+	share := &BaiduShare{List: make([]BaiduFile, 0)}
+	for page := 1; ; page++ {
+		ret := BaiduShare{}
+		q := url.Values{
+			"shorturl": {surl},
+			"root":     {"1"},
+			"page":     {strconv.Itoa(page)},
+			"num":      {strconv.Itoa(BAIDU_PAGE_SIZE)},
+		}
+		if e := b.do(http.MethodGet, "/share/list", q, nil, shareCookies(randsk), &ret); e != nil {
+			return nil, e
+		}
+		share.ShareId, share.Uk = ret.ShareId, ret.Uk
+		share.List = append(share.List, ret.List...)
+		if len(ret.List) < BAIDU_PAGE_SIZE {
+			return share, nil
+		}
+	}
+}
+
+// 保存分享中的文件到目录
+func (b *BaiduClient) Transfer(share *BaiduShare, randsk string, fsIds []int64, dir string) error {
+	ids, _ := json.Marshal(fsIds)
+	q := url.Values{
+		"shareid": {strconv.FormatInt(share.ShareId, 10)},
+		"from":    {strconv.FormatInt(share.Uk, 10)},
+		"ondup":   {"newcopy"},
+		"async":   {"1"},
+	}
+	if randsk != "" {
+		q.Set("sekey", randsk)
+	}
+	form := url.Values{"fsidlist": {string(ids)}, "path": {dir}}
+	return b.do(http.MethodPost, "/share/transfer", q, form, shareCookies(randsk), nil)
+}
+
+// 列出目录下的文件, 目录不存在时返回 nil
+func (b *BaiduClient) List(dir string) ([]BaiduFile, error) {
+	files := make([]BaiduFile, 0)
+	for page := 1; ; page++ {
+		ret := struct {
+			List []BaiduFile `json:"list"`
+		}{}
+		q := url.Values{
+			"dir":   {dir},
+			"order": {"name"},
+			"page":  {strconv.Itoa(page)},
+			"num":   {strconv.Itoa(BAIDU_PAGE_SIZE)},
+		}
+		e := b.do(http.MethodGet, "/api/list", q, nil, nil, &ret)
+		if be, ok := e.(*BaiduError); ok && be.Errno == -9 {
+			return nil, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+		files = append(files, ret.List...)
+		if len(ret.List) < BAIDU_PAGE_SIZE {
+			return files, nil
+		}
+	}
+}
+
+// 创建目录, 会同时创建上级目录, 已存在时不报错
+func (b *BaiduClient) Mkdir(dir string) error {
+	form := url.Values{"path": {dir}, "isdir": {"1"}, "rtype": {"0"}, "block_list": {"[]"}}
+	e := b.do(http.MethodPost, "/api/create", url.Values{"a": {"commit"}}, form, nil, nil)
+	if be, ok := e.(*BaiduError); ok && be.Errno == -8 {
+		return nil
+	}
+	return e
+}
+
+func (b *BaiduClient) fileManager(opera string, list any) error {
+	data, e := json.Marshal(list)
+	if e != nil {
+		return e
+	}
+	q := url.Values{"opera": {opera}, "async": {"0"}, "onnest": {"fail"}}
+	return b.do(http.MethodPost, "/api/filemanager", q, url.Values{"filelist": {string(data)}}, nil, nil)
+}
+
+// 移动文件或目录到 dest, dest 为完整的新路径
+func (b *BaiduClient) Move(src, dest string) error {
+	i := strings.LastIndex(dest, "/")
+	dir, name := dest[:i], dest[i+1:]
+	if dir == "" {
+		dir = "/"
+	}
+	if e := b.Mkdir(dir); e != nil {
+		return e
+	}
+	return b.fileManager("move", []map[string]string{{"path": src, "dest": dir, "newname": name}})
+}
+
+// 删除文件或目录到回收站
+func (b *BaiduClient) Delete(paths ...string) error {
+	return b.fileManager("delete", paths)
+}
+
+// 上传小文件, 已存在时覆盖
+func (b *BaiduClient) Upload(path string, data []byte) error {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	fw, e := w.CreateFormFile("file", path[strings.LastIndex(path, "/")+1:])
+	if e != nil {
+		return e
+	}
+	fw.Write(data)
+	w.Close()
+
+	q := url.Values{"method": {"upload"}, "app_id": {BAIDU_APP_ID}, "path": {path}, "ondup": {"overwrite"}}
+	req, e := http.NewRequest(http.MethodPost, b.PCSURL+"/rest/2.0/pcs/file?"+q.Encode(), &buf)
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	b.header(req, nil)
+	resp, e := b.client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	ret := struct {
+		ErrorCode int    `json:"error_code"`
+		ErrorMsg  string `json:"error_msg"`
+	}{}
+	if e := json.NewDecoder(resp.Body).Decode(&ret); e != nil {
+		return fmt.Errorf("解析百度网盘返回失败: %d, %s", resp.StatusCode, e.Error())
+	}
+	if ret.ErrorCode != 0 {
+		return &BaiduError{ret.ErrorCode, ret.ErrorMsg}
+	}
+	return nil
+}
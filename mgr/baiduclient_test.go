@@ -0,0 +1,281 @@
+package mgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// 百度网盘接口的本地模拟, 只实现转存用到的接口
+type baiduStub struct {
+	mutex     sync.Mutex
+	files     map[string]*BaiduFile // 完整路径 -> 文件
+	contents  map[string]string     // 上传的文件内容
+	shared    []BaiduFile
+	seq       int64
+	transfers int
+}
+
+func (s *baiduStub) add(p string, isDir int, size int64) {
+	if _, has := s.files[p]; has {
+		return
+	}
+	if dir := path.Dir(p); dir != "/" {
+		s.add(dir, 1, 0)
+	}
+	s.seq++
+	s.files[p] = &BaiduFile{FsId: s.seq, Path: p, Name: path.Base(p), IsDir: isDir, Size: size}
+}
+
+func (s *baiduStub) children(dir string) []BaiduFile {
+	ret := make([]BaiduFile, 0)
+	for p, f := range s.files {
+		if path.Dir(p) == dir {
+			ret = append(ret, *f)
+		}
+	}
+	return ret
+}
+
+func (s *baiduStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reply := func(errno int, data map[string]any) {
+		if data == nil {
+			data = map[string]any{}
+		}
+		data["errno"] = errno
+		json.NewEncoder(w).Encode(data)
+	}
+	cookie := func(name string) string {
+		c, e := r.Cookie(name)
+		if e != nil {
+			return ""
+		}
+		return c.Value
+	}
+	if cookie("BDUSS") != "bduss" || cookie("STOKEN") != "stoken" {
+		reply(-6, nil)
+		return
+	}
+	q := r.URL.Query()
+	if r.URL.Path != "/api/gettemplatevariable" && r.URL.Path != "/share/verify" && r.URL.Path != "/share/list" &&
+		r.URL.Path != "/rest/2.0/pcs/file" && q.Get("bdstoken") != "bds" {
+		reply(-6, nil)
+		return
+	}
+	if r.Method == http.MethodPost && !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		r.ParseForm()
+	}
+	switch r.URL.Path {
+	case "/api/gettemplatevariable":
+		reply(0, map[string]any{"result": map[string]string{"bdstoken": "bds", "username": "测试"}})
+	case "/share/verify":
+		if q.Get("surl") != "AbC" || r.PostForm.Get("pwd") != "abcd" {
+			reply(-9, nil)
+			return
+		}
+		reply(0, map[string]any{"randsk": "rsk"})
+	case "/share/list":
+		if q.Get("shorturl") != "AbC" || cookie("BDCLND") != "rsk" {
+			reply(-9, nil)
+			return
+		}
+		reply(0, map[string]any{"share_id": 11, "uk": 22, "list": s.shared})
+	case "/share/transfer":
+		dir := r.PostForm.Get("path")
+		if q.Get("shareid") != "11" || q.Get("from") != "22" || cookie("BDCLND") != "rsk" || s.files[dir] == nil {
+			reply(2, nil)
+			return
+		}
+		var ids []int64
+		json.Unmarshal([]byte(r.PostForm.Get("fsidlist")), &ids)
+		for _, id := range ids {
+			for _, f := range s.shared {
+				if f.FsId == id {
+					s.add(dir+"/"+f.Name, f.IsDir, f.Size)
+				}
+			}
+		}
+		s.transfers++
+		reply(0, nil)
+	case "/api/list":
+		dir := q.Get("dir")
+		if s.files[dir] == nil {
+			reply(-9, nil)
+			return
+		}
+		reply(0, map[string]any{"list": s.children(dir)})
+	case "/api/create":
+		p := r.PostForm.Get("path")
+		if s.files[p] != nil {
+			reply(-8, nil)
+			return
+		}
+		s.add(p, 1, 0)
+		reply(0, nil)
+	case "/api/filemanager":
+		switch q.Get("opera") {
+		case "move":
+			var list []map[string]string
+			json.Unmarshal([]byte(r.PostForm.Get("filelist")), &list)
+			for _, m := range list {
+				src, dest := m["path"], m["dest"]+"/"+m["newname"]
+				for p, f := range s.files {
+					if p == src || strings.HasPrefix(p, src+"/") {
+						delete(s.files, p)
+						f.Path = dest + strings.TrimPrefix(p, src)
+						s.files[f.Path] = f
+					}
+				}
+			}
+		case "delete":
+			var list []string
+			json.Unmarshal([]byte(r.PostForm.Get("filelist")), &list)
+			for _, src := range list {
+				for p := range s.files {
+					if p == src || strings.HasPrefix(p, src+"/") {
+						delete(s.files, p)
+					}
+				}
+			}
+		}
+		reply(0, nil)
+	case "/rest/2.0/pcs/file":
+		f, _, e := r.FormFile("file")
+		if e != nil {
+			json.NewEncoder(w).Encode(map[string]any{"error_code": 31061, "error_msg": e.Error()})
+			return
+		}
+		data, _ := io.ReadAll(f)
+		p := q.Get("path")
+		s.add(p, 0, int64(len(data)))
+		s.contents[p] = string(data)
+		fmt.Fprintf(w, `{"path":%q}`, p)
+	default:
+		reply(2, nil)
+	}
+}
+
+func newBaiduStub() (*baiduStub, *httptest.Server) {
+	stub := &baiduStub{
+		files:    map[string]*BaiduFile{},
+		contents: map[string]string{},
+		shared: []BaiduFile{
+			{FsId: 1001, Name: "a.zip", Size: 10},
+			{FsId: 1002, Name: "b", IsDir: 1},
+		},
+		seq: 2000,
+	}
+	return stub, httptest.NewServer(stub)
+}
+
+func TestBaiduClient(t *testing.T) {
+	surl, e := ParseBaiduShare("https://pan.baidu.com/s/1AbC?pwd=abcd")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, surl, "AbC")
+	surl, e = ParseBaiduShare("https://pan.baidu.com/share/init?surl=AbC")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, surl, "AbC")
+	_, e = ParseBaiduShare("https://pan.quark.cn/s/abc")
+	assert.NotEqual(t, e, nil)
+
+	stub, ts := newBaiduStub()
+	defer ts.Close()
+
+	bc := NewBaiduClient("bduss", "wrong")
+	bc.PanURL, bc.PCSURL = ts.URL, ts.URL
+	e = bc.Init()
+	assert.Equal(t, e.Error(), "百度网盘接口错误 -6: 身份验证失败, 请重新设置 bduss 和 stoken")
+
+	bc.Stoken = "stoken"
+	assert.Equal(t, bc.Init(), nil)
+	assert.Equal(t, bc.Username, "测试")
+
+	_, e = bc.VerifyShare("AbC", "0000")
+	assert.Equal(t, e.(*BaiduError).Errno, -9)
+	randsk, e := bc.VerifyShare("AbC", "abcd")
+	assert.Equal(t, e, nil)
+	share, e := bc.ListShare("AbC", randsk)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, share.ShareId, int64(11))
+	assert.Equal(t, len(share.List), 2)
+
+	files, e := bc.List("/x")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, files == nil, true)
+	assert.Equal(t, bc.Mkdir("/x/y"), nil)
+	assert.Equal(t, bc.Mkdir("/x/y"), nil)
+	assert.Equal(t, bc.Transfer(share, randsk, []int64{1001}, "/x/y"), nil)
+	files, e = bc.List("/x/y")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 1)
+	assert.Equal(t, files[0].Name, "a.zip")
+
+	assert.Equal(t, bc.Upload("/x/y/pwd.txt", []byte("123")), nil)
+	assert.Equal(t, stub.contents["/x/y/pwd.txt"], "123")
+
+	assert.Equal(t, bc.Move("/x/y", "/z/y"), nil)
+	files, e = bc.List("/z/y")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 2)
+	assert.Equal(t, bc.Delete("/z"), nil)
+	files, e = bc.List("/z/y")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, files == nil, true)
+}
+
+func TestBaiduPanAPI(t *testing.T) {
+	stub, ts := newBaiduStub()
+	defer ts.Close()
+
+	b := NewBaidu(BaiduCfg{Name: "baidu", Root: t.TempDir(), Bduss: "bduss", Stoken: "stoken"})
+	b.api = NewBaiduClient("bduss", "stoken")
+	b.api.PanURL, b.api.PCSURL = ts.URL, ts.URL
+	b.SetHolder(&PanHolder{msgCh: make(chan string, 9)})
+	assert.Equal(t, b.Init(), nil)
+	defer b.Close()
+	assert.Equal(t, b.api.Username, "测试")
+	// 检查登录状态不修改客户端
+	b.api.Username = "旧的"
+	assert.Equal(t, b.Check(), nil)
+	assert.Equal(t, b.api.Username, "旧的")
+	assert.Equal(t, b.IsExist(100), false)
+
+	record := TransferRecord{URL: "https://pan.baidu.com/s/1AbC", Tqm: "abcd", Pwd: "nga"}
+	assert.Equal(t, b.doTransfer(baiduTask{100, record, PAN_OPT_SAVE}), nil)
+	assert.Equal(t, b.IsExist(100), true)
+	names, e := b.Ls(b.topicDir(100))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(names), 3)
+	assert.Equal(t, stub.contents[b.topicDir(100)+"/"+PAN_PWD_FILE], "nga")
+
+	e = b.doTransfer(baiduTask{100, record, PAN_OPT_SAVE})
+	assert.Equal(t, e.Error(), "BaiduPan: 文件都已存在")
+	assert.Equal(t, stub.transfers, 1)
+
+	// 提取码错误时不创建目录
+	e = b.doTransfer(baiduTask{101, TransferRecord{URL: "https://pan.baidu.com/s/1AbC?pwd=0000"}, PAN_OPT_SAVE})
+	assert.Equal(t, strings.HasPrefix(e.Error(), "BaiduPan: 验证提取码失败"), true)
+	assert.Equal(t, b.IsExist(101), false)
+
+	assert.Equal(t, b.Move(100), nil)
+	assert.Equal(t, b.IsExist(100), false)
+	names, e = b.Ls(fmt.Sprintf("%s/%d", BdpcsBaseMoveDir, 100))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(names), 3)
+
+	assert.Equal(t, b.Delete(100), nil)
+	b.cfg.TransferDest = BdpcsBaseMoveDir
+	assert.Equal(t, b.Delete(100), nil)
+	assert.Equal(t, b.IsExist(100), false)
+}
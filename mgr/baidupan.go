@@ -2,7 +2,10 @@ package mgr
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -26,6 +29,12 @@ var (
 	BdpcsUserINI         = "user.ini"
 	BdpcsBaseTransferDir = "/我的资源"
 	BdpcsBaseMoveDir     = "/Tidy"
+	BaiduShareInfoURL    = "https://pan.baidu.com/api/shorturlinfo" // 分享链接信息
+)
+
+const (
+	BAIDU_CLIENT_API = "api" // 直接调用百度网盘接口
+	BAIDU_CLIENT_CLI = "cli" // 使用 BaiduPCS-Go
 )
 
 type baiduTask struct {
@@ -34,7 +43,24 @@ type baiduTask struct {
 	opt     PanOpt
 }
 
+var baiduDriver = RegisterPanDriver(PanDriver{
+	Name:     "baidu",
+	Patterns: []*regexp.Regexp{regexp.MustCompile(`pan\.baidu\.com`)},
+	New: func(name, root string, sec *ini.Section) (Pan, error) {
+		bc := new(BaiduCfg)
+		if e := sec.MapTo(bc); e != nil {
+			return nil, e
+		}
+		if bc.Transfer == "" {
+			bc.Transfer = TRANSFER_TYPE_AUTO
+		}
+		bc.Name, bc.Root = name, root
+		return NewBaidu(*bc), nil
+	},
+})
+
 type BaiduCfg struct {
+	Name         string // 网盘实例名称, 即配置段名称
 	Root         string // 工作目录
 	Enable       bool   `ini:"enable"`    // 是否启用
 	Transfer     string `ini:"transfer"`  // 转存方式: auto, manual
@@ -42,6 +68,7 @@ type BaiduCfg struct {
 	MoveDest     string `ini:"move_dir"`  // 移动的根目录
 	Bduss        string `ini:"bduss"`     // 百度网盘 bduss
 	Stoken       string `ini:"stoken"`    // 百度网盘 stoken
+	Client       string `ini:"client"`    // 客户端: api, cli, 默认为 api
 }
 
 type Baidu struct {
@@ -52,6 +79,7 @@ type Baidu struct {
 	tasks   chan baiduTask
 	cron    *cron.Cron
 	holder  *PanHolder
+	api     *BaiduClient // 使用 cli 时为 nil
 }
 
 func NewBaidu(cfg BaiduCfg) *Baidu {
@@ -66,15 +94,21 @@ func NewBaidu(cfg BaiduCfg) *Baidu {
 	if b.cfg.MoveDest == "" {
 		b.cfg.MoveDest = BdpcsBaseMoveDir
 	}
+	if b.cfg.Client == "" {
+		b.cfg.Client = BAIDU_CLIENT_API
+	}
 	return b
 }
 
 func (b Baidu) Name() string {
-	return "baidu"
+	if b.cfg.Name == "" {
+		return baiduDriver.Name
+	}
+	return b.cfg.Name
 }
 
 func (b Baidu) Support(record TransferRecord) bool {
-	return strings.Contains(record.URL, "pan.baidu.com")
+	return baiduDriver.Match(record.URL)
 }
 
 func (b *Baidu) SetHolder(holder *PanHolder) {
@@ -94,10 +128,12 @@ func (b *Baidu) initPath() error {
 	if root == "" {
 		return fmt.Errorf("请设置百度网盘配置目录")
 	}
-	root = JoinPath(wd, root)
-	b.root = root
+	b.root = JoinPath(wd, root)
+	return nil
+}
 
-	program := filepath.Join(root, BaiduPCSName)
+func (b *Baidu) initProgram() error {
+	program := filepath.Join(b.root, BaiduPCSName)
 	if !IsExist(program) {
 		return fmt.Errorf("%s 程序不存在", program)
 	}
@@ -105,46 +141,57 @@ func (b *Baidu) initPath() error {
 	return nil
 }
 
+func (b *Baidu) useCli() bool {
+	return b.cfg.Client == BAIDU_CLIENT_CLI
+}
+
 func (b *Baidu) Init() error {
 	b.mutex.Lock()
 
-	if b.root == "" || b.program == "" {
+	if b.root == "" {
 		if e := b.initPath(); e != nil {
 			b.mutex.Unlock()
 			return e
 		}
 	}
 
-	c := filepath.Join(b.root, BdpcsCfgName)
-	if !IsExist(c) {
-		oc := filepath.Join(b.root, BdpcsOldDir, BdpcsCfgName)
-		if IsExist(oc) {
-			if e := os.Rename(oc, c); e != nil {
-				b.mutex.Unlock()
-				return fmt.Errorf("BaiduPan: 移动配置文件 %s 到 %s 出现问题: %s", oc, c, e.Error())
-			}
+	if b.useCli() {
+		if e := b.initCli(); e != nil {
+			b.mutex.Unlock()
+			return e
 		}
+	} else if b.api == nil {
+		// 在启动任务处理协程之前创建, 协程中会读取 b.api
+		bduss, stoken, e := b.credential()
+		if e != nil {
+			b.mutex.Unlock()
+			return e
+		}
+		b.api = NewBaiduClient(bduss, stoken)
 	}
 
 	b.mutex.Unlock()
 
-	if e := b.update(); e != nil {
-		return e
-	}
+	if b.useCli() {
+		if e := b.update(); e != nil {
+			return e
+		}
 
-	if v, e := b.version(); e != nil {
-		return e
-	} else {
-		log.Printf("BaiduPan: 版本号: %s\n", v)
+		if v, e := b.version(); e != nil {
+			return e
+		} else {
+			log.Printf("BaiduPan: 版本号: %s\n", v)
+		}
 	}
 
 	if b.tasks == nil {
 		b.mutex.Lock()
 		if b.tasks == nil {
 			b.tasks = make(chan baiduTask, 99)
+			tasks := b.tasks
 			go func() {
 				log.Println("BaiduPan: 启动任务处理协程")
-				for task := range b.tasks {
+				for task := range tasks {
 					var e error
 					var status string
 					switch task.opt {
@@ -163,20 +210,52 @@ func (b *Baidu) Init() error {
 				}
 			}()
 
-			b.cron.AddFunc("0 2 * * *", func() { //每天凌晨2点更新
-				if e := b.update(); e != nil {
-					log.Println(e.Error())
-				}
-			})
-			b.cron.Start()
+			if b.useCli() {
+				b.cron.AddFunc("0 2 * * *", func() { //每天凌晨2点更新
+					if e := b.update(); e != nil {
+						log.Println(e.Error())
+					}
+				})
+				b.cron.Start()
+			}
 		}
 		b.mutex.Unlock()
 	}
 
+	if !b.useCli() {
+		return b.loginAPI()
+	}
 	return b.login()
 }
 
+// 准备 BaiduPCS-Go 程序和配置文件
+func (b *Baidu) initCli() error {
+	if b.program == "" {
+		if e := b.initProgram(); e != nil {
+			return e
+		}
+	}
+
+	c := filepath.Join(b.root, BdpcsCfgName)
+	if !IsExist(c) {
+		oc := filepath.Join(b.root, BdpcsOldDir, BdpcsCfgName)
+		if IsExist(oc) {
+			if e := os.Rename(oc, c); e != nil {
+				return fmt.Errorf("BaiduPan: 移动配置文件 %s 到 %s 出现问题: %s", oc, c, e.Error())
+			}
+		}
+	}
+	return nil
+}
+
 func (b *Baidu) isExist(file string) bool {
+	if b.api != nil {
+		files, e := b.api.List(file)
+		if e != nil {
+			log.Printf("BaiduPan: 获取目录 %s 出现问题: %s", file, e.Error())
+		}
+		return files != nil
+	}
 	// https://github.com/qjfoidnh/BaiduPCS-Go/blob/main/internal/pcscommand/meta.go#RunGetMeta
 	if v, e := b.execute("meta", file); e != nil {
 		log.Printf("BaiduPan: cd %s 出现问题: %s", file, e.Error())
@@ -216,6 +295,20 @@ func (b *Baidu) safeCd(dir string) error {
 
 // https://github.com/qjfoidnh/BaiduPCS-Go/blob/main/internal/pcscommand/ls_search.go#RunLs
 func (b *Baidu) Ls(dir string) ([]string, error) {
+	if b.api != nil {
+		files, e := b.api.List(dir)
+		if e != nil {
+			return nil, fmt.Errorf("BaiduPan: ls %s 出现问题: %s", dir, e.Error())
+		}
+		if files == nil {
+			return nil, fmt.Errorf("BaiduPan: 目录 %s 不存在", dir)
+		}
+		names := make([]string, 0, len(files))
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		return names, nil
+	}
 	if v, e := b.execute("ls", dir); e != nil {
 		return nil, fmt.Errorf("BaiduPan: ls %s 出现问题: %s", dir, e.Error())
 	} else {
@@ -281,6 +374,13 @@ func (b *Baidu) IsExist(topicId int) bool {
 func (b *Baidu) Move(topicId int) error {
 	src := b.topicDir(topicId)
 	dst := fmt.Sprintf("%s/%d", b.cfg.MoveDest, topicId)
+	if b.api != nil {
+		if e := b.api.Move(src, dst); e != nil {
+			return fmt.Errorf("BaiduPan: mv %s 出现问题: %s", src, e.Error())
+		}
+		log.Group(groupPan).Printf("BaiduPan: mv %s %s\n", src, dst)
+		return nil
+	}
 	if v, e := b.execute("mv", src, dst); e != nil {
 		return fmt.Errorf("BaiduPan: mv %s 出现问题: %s", src, e.Error())
 	} else {
@@ -296,6 +396,13 @@ func (b *Baidu) Delete(topicId int) error {
 
 // https://github.com/qjfoidnh/BaiduPCS-Go/blob/main/internal/pcscommand/rm_mkdir.go#RunRemove
 func (b *Baidu) del(dir string) error {
+	if b.api != nil {
+		if e := b.api.Delete(dir); e != nil {
+			return fmt.Errorf("BaiduPan: rm %s 出现问题: %s", dir, e.Error())
+		}
+		log.Group(groupPan).Printf("BaiduPan: rm %s\n", dir)
+		return nil
+	}
 	if v, e := b.execute("rm", dir); e != nil {
 		return fmt.Errorf("BaiduPan: rm %s 出现问题: %s", dir, e.Error())
 	} else {
@@ -304,12 +411,60 @@ func (b *Baidu) del(dir string) error {
 	return nil
 }
 
+// 分享链接信息的错误码, 表示分享已失效
+var baiduShareExpired = map[int]string{
+	-21: "分享已取消",
+	105: "分享链接不存在",
+	115: "分享文件违规",
+	117: "分享已过期",
+	145: "分享链接违规",
+}
+
+// 通过分享链接信息检查链接是否有效, 需要提取码的链接也认为是有效的
+func (b *Baidu) CheckShare(record TransferRecord) error {
+	surl, e := ParseBaiduShare(record.URL)
+	if e != nil {
+		return fmt.Errorf("BaiduPan: %s", e.Error())
+	}
+	q := url.Values{"shorturl": {"1" + surl}, "root": {"1"}, "web": {"1"}}
+	req, e := http.NewRequest(http.MethodGet, BaiduShareInfoURL+"?"+q.Encode(), nil)
+	if e != nil {
+		return e
+	}
+	if b.cfg.Bduss != "" {
+		req.AddCookie(&http.Cookie{Name: "BDUSS", Value: b.cfg.Bduss})
+	}
+	resp, e := DoHttp(req)
+	if e != nil {
+		return fmt.Errorf("BaiduPan: 获取分享信息失败: %s", e.Error())
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errno int `json:"errno"`
+	}
+	if e := json.NewDecoder(resp.Body).Decode(&result); e != nil {
+		return fmt.Errorf("BaiduPan: 解析分享信息失败: %s", e.Error())
+	}
+	if msg, has := baiduShareExpired[result.Errno]; has {
+		return fmt.Errorf("%w: %s", ErrShareExpired, msg)
+	}
+	switch result.Errno {
+	case 0, -9, -12: // 需要提取码
+		return nil
+	}
+	return fmt.Errorf("BaiduPan: 获取分享信息失败, 错误码 %d", result.Errno)
+}
+
 func (b *Baidu) topicDir(topicId int) string {
 	return fmt.Sprintf("%s/%d", b.cfg.TransferDest, topicId)
 }
 
 // https://github.com/qjfoidnh/BaiduPCS-Go/blob/main/internal/pcscommand/transfer.go#RunShareTransfer
 func (b *Baidu) doTransfer(task baiduTask) error {
+	if b.api != nil {
+		return b.transferAPI(task)
+	}
 	url := task.record.URL
 	if !strings.Contains(url, "?pwd=") {
 		url = fmt.Sprintf("%s?pwd=%s", url, task.record.Tqm)
@@ -352,6 +507,79 @@ func (b *Baidu) doTransfer(task baiduTask) error {
 	return nil
 }
 
+func (b *Baidu) transferAPI(task baiduTask) error {
+	api := b.api
+	url := task.record.URL
+	log.Group(groupPan).Printf("BaiduPan: 处理转存任务: %d, %s\n", task.topicId, url)
+
+	surl, e := ParseBaiduShare(url)
+	if e != nil {
+		return fmt.Errorf("BaiduPan: %s", e.Error())
+	}
+	pwd := task.record.Tqm
+	if pwd == "" {
+		pwd = codeInURL(url)
+	}
+	randsk := ""
+	if pwd != "" {
+		if randsk, e = api.VerifyShare(surl, pwd); e != nil {
+			return fmt.Errorf("BaiduPan: 验证提取码失败, %s", e.Error())
+		}
+	}
+	share, e := api.ListShare(surl, randsk)
+	if e != nil {
+		return fmt.Errorf("BaiduPan: 获取分享文件失败, %s", e.Error())
+	}
+	if len(share.List) == 0 {
+		return fmt.Errorf("BaiduPan: 分享链接 %s 中没有有效文件", url)
+	}
+
+	dir := b.topicDir(task.topicId)
+	if e := api.Mkdir(dir); e != nil {
+		return fmt.Errorf("BaiduPan: 创建目录 %s 失败, %s", dir, e.Error())
+	}
+	existed, e := api.List(dir)
+	if e != nil {
+		return fmt.Errorf("BaiduPan: 获取目录 %s 失败, %s", dir, e.Error())
+	}
+	sizes := make(map[string]int64, len(existed))
+	for _, f := range existed {
+		sizes[f.Name] = f.Size
+	}
+	ids := make([]int64, 0, len(share.List))
+	for _, f := range share.List {
+		if size, has := sizes[f.Name]; has && size == f.Size {
+			log.Group(groupPan).Printf("BaiduPan: 文件 %s 已存在, 跳过", f.Name)
+			continue
+		}
+		ids = append(ids, f.FsId)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("BaiduPan: 文件都已存在")
+	}
+
+	if e := api.Transfer(share, randsk, ids, dir); e != nil {
+		if len(existed) == 0 { // 保存前为空目录, 保存又失败, 删除目录
+			if files, le := api.List(dir); le == nil && len(files) == 0 {
+				log.Group(groupPan).Printf("BaiduPan: 目录 %s 为空, 删除", dir)
+				api.Delete(dir)
+			}
+		}
+		return fmt.Errorf("BaiduPan: 保存文件失败, %s", e.Error())
+	}
+
+	if task.record.Pwd != "" {
+		if _, has := sizes[PAN_PWD_FILE]; !has {
+			if e := api.Upload(dir+"/"+PAN_PWD_FILE, []byte(task.record.Pwd)); e != nil {
+				log.Printf("BaiduPan: 上传解压密码文件出现问题: %s", e.Error())
+			}
+		}
+	}
+
+	log.Group(groupPan).Printf("BaiduPan: 处理转存任务完成: %d, %s\n", task.topicId, url)
+	return nil
+}
+
 func (b *Baidu) Transfer(topicId int, record TransferRecord) error {
 	if !strings.Contains(record.URL, "?pwd=") && record.Tqm == "" {
 		return fmt.Errorf("BaiduPan: 缺少提取码")
@@ -373,55 +601,99 @@ func (b *Baidu) TransferOpt(topicId int, record *TransferRecord, opt PanOpt) err
 	return nil
 }
 
-// https://github.com/qjfoidnh/BaiduPCS-Go/blob/main/internal/pcsconfig/maniper.go#SetupUserByBDUSS
-func (b *Baidu) login() error {
-	needLogin := true
-	if who, e := b.execute("who"); e != nil {
-		return fmt.Errorf("BaiduPan: who 出现问题: %s", e.Error())
-	} else {
-		re := regexp.MustCompile(`uid:\s+(\d+),\s+用户名:\s+([^,]*),`)
-		match := re.FindStringSubmatch(who)
-		if len(match) > 1 {
-			uid := match[1]
-			if uid != "" && uid != "0" {
-				username := match[2]
-				log.Printf("BaiduPan: 登录成功, uid: %s, 用户名: %s\n", uid, username)
-				needLogin = false
-			}
+var regexBaiduWho = regexp.MustCompile(`uid:\s+(\d+),\s+用户名:\s+([^,]*),`)
+
+// 返回当前登录的 uid 和用户名, 未登录时 uid 为空
+func (b *Baidu) who() (string, string, error) {
+	who, e := b.execute("who")
+	if e != nil {
+		return "", "", fmt.Errorf("BaiduPan: who 出现问题: %s", e.Error())
+	}
+	match := regexBaiduWho.FindStringSubmatch(who)
+	if len(match) > 1 {
+		uid := match[1]
+		if uid != "" && uid != "0" {
+			return uid, match[2], nil
 		}
 	}
-	if needLogin {
-		bduss := b.cfg.Bduss
-		stoken := b.cfg.Stoken
-
-		fpu := filepath.Join(b.root, BdpcsUserINI)
-		if !IsExist(fpu) {
-			oldDir := filepath.Join(b.root, BdpcsOldDir)
-			oldIni := filepath.Join(oldDir, BdpcsUserINI)
-			if IsExist(oldIni) {
-				os.WriteFile(filepath.Join(oldDir, "warning.txt"), []byte("配置现在转移到 data/pan/config.ini 中, 后续本版此文件夹不再受支持"), COMMON_FILE_MODE)
-				fpu = oldIni
-			}
+	return "", "", nil
+}
+
+func (b *Baidu) Check() error {
+	if b.api != nil {
+		if e := b.api.Check(); e != nil {
+			return fmt.Errorf("BaiduPan: %s", e.Error())
 		}
-		if IsExist(fpu) {
-			user, e := ini.Load(fpu)
-			if e != nil {
-				return fmt.Errorf("BaiduPan: 读取配置文件 %s 出现问题: %s", fpu, e.Error())
-			}
-			bduss = user.Section("").Key("bduss").String()
-			stoken = user.Section("").Key("stoken").String()
-		} else {
-			user := ini.Empty()
-			user.Section("").Key("bduss").SetValue(bduss)
-			user.Section("").Key("stoken").SetValue(stoken)
-			fp := filepath.Join(b.root, BdpcsUserINI)
-			if e := user.SaveTo(fp); e != nil {
-				return fmt.Errorf("BaiduPan: 创建配置文件 %s 出现问题: %s", fp, e.Error())
-			}
+		return nil
+	}
+	uid, _, e := b.who()
+	if e != nil {
+		return e
+	}
+	if uid == "" {
+		return fmt.Errorf("BaiduPan: 未登录")
+	}
+	return nil
+}
+
+// 读取 bduss 和 stoken, 有 user.ini 时优先使用其中的配置, 没有时根据网盘配置创建
+func (b *Baidu) credential() (string, string, error) {
+	bduss := b.cfg.Bduss
+	stoken := b.cfg.Stoken
+
+	fpu := filepath.Join(b.root, BdpcsUserINI)
+	if !IsExist(fpu) {
+		oldDir := filepath.Join(b.root, BdpcsOldDir)
+		oldIni := filepath.Join(oldDir, BdpcsUserINI)
+		if IsExist(oldIni) {
+			os.WriteFile(filepath.Join(oldDir, "warning.txt"), []byte("配置现在转移到 data/pan/config.ini 中, 后续本版此文件夹不再受支持"), COMMON_FILE_MODE)
+			fpu = oldIni
+		}
+	}
+	if IsExist(fpu) {
+		user, e := ini.Load(fpu)
+		if e != nil {
+			return "", "", fmt.Errorf("BaiduPan: 读取配置文件 %s 出现问题: %s", fpu, e.Error())
 		}
+		bduss = user.Section("").Key("bduss").String()
+		stoken = user.Section("").Key("stoken").String()
+	} else {
+		user := ini.Empty()
+		user.Section("").Key("bduss").SetValue(bduss)
+		user.Section("").Key("stoken").SetValue(stoken)
+		fp := filepath.Join(b.root, BdpcsUserINI)
+		if e := user.SaveTo(fp); e != nil {
+			return "", "", fmt.Errorf("BaiduPan: 创建配置文件 %s 出现问题: %s", fp, e.Error())
+		}
+	}
+
+	if bduss == "" || stoken == "" {
+		return "", "", fmt.Errorf("BaiduPan: 请设置 bduss 和 stoken")
+	}
+	return bduss, stoken, nil
+}
+
+func (b *Baidu) loginAPI() error {
+	if e := b.api.Init(); e != nil {
+		return fmt.Errorf("BaiduPan: 登录失败: %s", e.Error())
+	}
+	log.Printf("BaiduPan: 登录成功, 用户名: %s\n", b.api.Username)
+	return nil
+}
 
-		if bduss == "" || stoken == "" {
-			return fmt.Errorf("BaiduPan: 请设置 bduss 和 stoken")
+// https://github.com/qjfoidnh/BaiduPCS-Go/blob/main/internal/pcsconfig/maniper.go#SetupUserByBDUSS
+func (b *Baidu) login() error {
+	needLogin := true
+	if uid, username, e := b.who(); e != nil {
+		return e
+	} else if uid != "" {
+		log.Printf("BaiduPan: 登录成功, uid: %s, 用户名: %s\n", uid, username)
+		needLogin = false
+	}
+	if needLogin {
+		bduss, stoken, e := b.credential()
+		if e != nil {
+			return e
 		}
 		if v, e := b.execute("login",
 			fmt.Sprintf("-bduss=%s", bduss),
@@ -488,6 +760,10 @@ func (b *Baidu) execute(args ...string) (string, error) {
 	return strings.TrimSpace(out.String()), nil
 }
 
+func (b *Baidu) queueLen() int {
+	return len(b.tasks)
+}
+
 func (b *Baidu) Close() error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
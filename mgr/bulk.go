@@ -0,0 +1,230 @@
+package mgr
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/i2534/ngamm/mgr/log"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	BULK_ADD       = "add"
+	BULK_DELETE    = "delete"
+	BULK_REFRESH   = "refresh"
+	BULK_SET_CRON  = "set-cron"
+	BULK_SET_RETRY = "set-retry"
+	BULK_TAG       = "tag"
+	BULK_ABANDON   = "abandon"
+	BULK_REVIVE    = "revive"
+)
+
+// 批量操作帖子, Ids 和 Filter 二选一
+type bulkRequest struct {
+	organizeRequest        // tag 操作使用的标签, 文件夹和备注, add 操作时 Tags 为初始标签
+	Action          string // 操作
+	Filter          string // 过滤表达式, 与帖子列表的查询参数相同, 如 author=xxx&abandoned=true
+	UpdateCron      *string
+	MaxRetryCount   *int
+}
+
+// 需要加入更新队列的操作
+func (r *bulkRequest) enqueue() bool {
+	return r.Action == BULK_ADD || r.Action == BULK_REFRESH
+}
+
+func (r *bulkRequest) validate() error {
+	switch r.Action {
+	case BULK_ADD:
+		if r.Filter != "" {
+			return fmt.Errorf("添加帖子只能指定 ID")
+		}
+	case BULK_DELETE, BULK_REFRESH, BULK_ABANDON, BULK_REVIVE:
+	case BULK_SET_CRON:
+		if r.UpdateCron == nil {
+			return fmt.Errorf("没有指定 UpdateCron")
+		}
+		if uc := *r.UpdateCron; uc != "" {
+			if _, e := cron.ParseStandard(uc); e != nil {
+				return fmt.Errorf("无效的 cron 表达式")
+			}
+		}
+	case BULK_SET_RETRY:
+		if r.MaxRetryCount == nil {
+			return fmt.Errorf("没有指定 MaxRetryCount")
+		}
+	case BULK_TAG:
+		if r.Tags == nil && len(r.AddTags) == 0 && len(r.RemoveTags) == 0 && r.Folder == nil && r.Note == nil {
+			return fmt.Errorf("没有指定标签")
+		}
+	default:
+		return fmt.Errorf("不支持的操作: %s", r.Action)
+	}
+	if len(r.Ids) == 0 && r.Filter == "" {
+		return fmt.Errorf("没有指定帖子")
+	}
+	if len(r.Ids) > 0 && r.Filter != "" {
+		return fmt.Errorf("不能同时指定 ID 和过滤表达式")
+	}
+	return nil
+}
+
+// 过滤表达式支持的参数, 不支持分页
+var bulkFilterKeys = map[string]bool{
+	"q": true, "author": true, "uid": true, "tag": true, "folder": true,
+	"abandoned": true, "failed": true, "hasPan": true, "cursor": true,
+	"sort": true, "order": true,
+}
+
+// 根据 ID 或过滤表达式选择帖子 ID
+func (srv *Server) bulkSelect(r *bulkRequest) ([]int, error) {
+	if r.Filter == "" {
+		ids := make([]int, 0, len(r.Ids))
+		seen := make(map[int]bool)
+		for _, id := range r.Ids {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+
+	values, e := url.ParseQuery(strings.TrimPrefix(r.Filter, "?"))
+	if e != nil {
+		return nil, fmt.Errorf("无效的过滤表达式: %s", r.Filter)
+	}
+	// 拼错的参数会被查询忽略, 导致匹配所有帖子
+	for key := range values {
+		if !bulkFilterKeys[key] {
+			return nil, fmt.Errorf("不支持的过滤参数: %s", key)
+		}
+	}
+	q, e := parseTopicQuery(values)
+	if e != nil {
+		return nil, e
+	}
+	if !q.filtered() {
+		return nil, fmt.Errorf("过滤表达式没有有效的条件: %s", r.Filter)
+	}
+	topics := q.apply(srv.indexedTopics())
+	ids := make([]int, 0, len(topics))
+	for _, topic := range topics {
+		ids = append(ids, topic.Id)
+	}
+	return ids, nil
+}
+
+// 对单个帖子执行操作
+func (srv *Server) bulkApply(r *bulkRequest, id int) error {
+	cache := srv.cache
+	if r.Action == BULK_ADD {
+		if r.Tags != nil {
+			return srv.addTopic(id, *r.Tags...)
+		}
+		return srv.addTopic(id)
+	}
+
+	topic, has := cache.topics.Get(id)
+	if !has {
+		return fmt.Errorf("未找到帖子")
+	}
+	md := topic.Metadata
+	switch r.Action {
+	case BULK_DELETE:
+		if !srv.deleteTopic(id) {
+			return fmt.Errorf("未找到帖子")
+		}
+		return nil
+	case BULK_REFRESH:
+		if !cache.tryEnqueue(id) {
+			return fmt.Errorf("添加请求过多")
+		}
+		return nil
+	case BULK_SET_CRON:
+		md.mutex.Lock()
+		md.UpdateCron = *r.UpdateCron
+		abandon := md.Abandon
+		md.mutex.Unlock()
+		if !abandon {
+			srv.addCron(topic)
+		}
+		topic.Stop()
+	case BULK_SET_RETRY:
+		md.mutex.Lock()
+		md.MaxRetryCount = *r.MaxRetryCount
+		md.mutex.Unlock()
+	case BULK_TAG:
+		r.apply(md)
+	case BULK_ABANDON:
+		md.mutex.Lock()
+		md.Abandon = true
+		md.mutex.Unlock()
+		srv.cron.Remove(md.updateCronId)
+		md.updateCronId = 0
+		topic.Stop()
+	case BULK_REVIVE:
+		md.mutex.Lock()
+		md.Abandon = false
+		md.retryCount = 0
+		md.mutex.Unlock()
+		srv.addCron(topic)
+	}
+
+	topic.Modify()
+	if e := topic.SaveMeta(); e != nil {
+		return e
+	}
+	srv.publish(EVENT_TOPIC_METADATA, id, topic.Metadata)
+	return nil
+}
+
+func (srv *Server) topicBulk() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		req := bulkRequest{}
+		if e := c.ShouldBindJSON(&req); e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
+			return
+		}
+		req.Action = strings.ToLower(strings.TrimSpace(req.Action))
+		if e := req.validate(); e != nil {
+			c.JSON(http.StatusBadRequest, toErr(e.Error()))
+			return
+		}
+
+		ids, e := srv.bulkSelect(&req)
+		if e != nil {
+			c.JSON(http.StatusBadRequest, toErr(e.Error()))
+			return
+		}
+		// 队列剩余空间不足时整体拒绝, 避免只处理了一部分
+		if req.enqueue() {
+			if free := cap(srv.cache.queue) - len(srv.cache.queue); len(ids) > free {
+				c.JSON(http.StatusServiceUnavailable, toErr(fmt.Sprintf("添加请求过多, 队列剩余 %d", free)))
+				return
+			}
+		}
+
+		ret := make([]organizeResult, 0, len(ids))
+		count := 0
+		for _, id := range ids {
+			if e := srv.bulkApply(&req, id); e != nil {
+				ret = append(ret, organizeResult{Id: id, Error: e.Error()})
+				continue
+			}
+			ret = append(ret, organizeResult{Id: id, Ok: true})
+			count++
+		}
+		log.Printf("批量操作 %s: %d/%d 成功\n", req.Action, count, len(ids))
+
+		c.JSON(http.StatusOK, gin.H{
+			"Action":  req.Action,
+			"Total":   len(ids),
+			"Ok":      count,
+			"Results": ret,
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package mgr
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+)
+
+func TestBulkValidate(t *testing.T) {
+	cron, retry := "@every 1h", 3
+	ok := []bulkRequest{
+		{Action: BULK_ADD, organizeRequest: organizeRequest{Ids: []int{1}}},
+		{Action: BULK_DELETE, Filter: "abandoned=true"},
+		{Action: BULK_SET_CRON, Filter: "author=a", UpdateCron: &cron},
+		{Action: BULK_SET_RETRY, Filter: "author=a", MaxRetryCount: &retry},
+		{Action: BULK_TAG, organizeRequest: organizeRequest{Ids: []int{1}, AddTags: []string{"a"}}},
+	}
+	for _, r := range ok {
+		assert.Equal(t, r.validate(), nil)
+	}
+
+	bad := "bad cron"
+	fails := []bulkRequest{
+		{Action: "unknown", Filter: "q=a"},
+		{Action: BULK_ADD, Filter: "q=a"},
+		{Action: BULK_REFRESH},
+		{Action: BULK_REFRESH, Filter: "q=a", organizeRequest: organizeRequest{Ids: []int{1}}},
+		{Action: BULK_SET_CRON, Filter: "q=a"},
+		{Action: BULK_SET_CRON, Filter: "q=a", UpdateCron: &bad},
+		{Action: BULK_SET_RETRY, Filter: "q=a"},
+		{Action: BULK_TAG, Filter: "q=a"},
+	}
+	for _, r := range fails {
+		assert.NotEqual(t, r.validate(), nil)
+	}
+}
+
+func TestBulkSelect(t *testing.T) {
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic](), queue: make(chan int, 1)}}
+	for id, author := range map[int]string{1: "甲", 2: "乙", 3: "甲"} {
+		srv.cache.topics.Put(id, &Topic{Id: id, Author: author, Metadata: NewMetadata()})
+	}
+
+	ids, e := srv.bulkSelect(&bulkRequest{organizeRequest: organizeRequest{Ids: []int{3, 1, 3}}})
+	assert.Equal(t, e, nil)
+	assert.Equal(t, ids, []int{3, 1})
+
+	ids, e = srv.bulkSelect(&bulkRequest{Filter: "?author=甲&sort=id"})
+	assert.Equal(t, e, nil)
+	assert.Equal(t, ids, []int{1, 3})
+
+	_, e = srv.bulkSelect(&bulkRequest{Filter: "sort=unknown"})
+	assert.NotEqual(t, e, nil)
+
+	// 队列空间不足时整体拒绝
+	gin.SetMode(gin.TestMode)
+	bulk := func(body string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/topic/bulk", bytes.NewBufferString(body))
+		c.Request.Header.Set("Content-Type", "application/json")
+		srv.topicBulk()(c)
+		return w.Code
+	}
+	assert.Equal(t, bulk(`{"Action":"refresh","Filter":"author=甲"}`), http.StatusServiceUnavailable)
+	assert.Equal(t, len(srv.cache.queue), 0)
+	assert.Equal(t, bulk(`{"Action":"refresh","Ids":[2]}`), http.StatusOK)
+	assert.Equal(t, <-srv.cache.queue, 2)
+	assert.Equal(t, bulk(`{"Action":"fly","Ids":[2]}`), http.StatusBadRequest)
+
+	// 未知参数或没有条件的过滤表达式不能匹配所有帖子
+	for _, filter := range []string{"autor=甲", "page=1", "&", "sort=id", "q=", "author=甲&size=10"} {
+		_, e = srv.bulkSelect(&bulkRequest{Filter: filter})
+		assert.NotEqual(t, e, nil)
+		assert.Equal(t, bulk(`{"Action":"delete","Filter":"`+filter+`"}`), http.StatusBadRequest)
+	}
+	assert.Equal(t, srv.cache.topics.Size(), 3)
+}
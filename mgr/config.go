@@ -7,12 +7,16 @@ import (
 )
 
 type Config struct {
-	Port      int
-	Program   string
-	Smile     string
-	Token     string
-	Pan       string
-	TopicRoot string
+	Port        int
+	Program     string
+	Smile       string
+	Token       string
+	Pan         string
+	TopicRoot   string
+	TopicQuota  string    // 单个帖子的存储配额, 如 2GB, 为空不限制
+	TotalQuota  string    // 所有帖子的存储配额
+	RecycleKeep string    // 回收站保留时间, 如 72h, 7d, 为空默认 7 天, 0 不自动清理
+	raw         *ini.File // 原始配置, 供通知等子系统读取各自的配置段
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -30,5 +34,6 @@ func LoadConfig(path string) (*Config, error) {
 	}
 	c.BlockMode = true
 	e = c.MapTo(cfg)
+	cfg.raw = c
 	return cfg, e
 }
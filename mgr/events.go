@@ -0,0 +1,155 @@
+package mgr
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	EVENT_TOPIC_ADDED      = "topic.added"      // 添加帖子
+	EVENT_TOPIC_DELETED    = "topic.deleted"    // 删除帖子
+	EVENT_DOWN_STARTED     = "download.started" // 开始下载帖子
+	EVENT_DOWN_FINISHED    = "download.finished"
+	EVENT_TOPIC_METADATA   = "topic.metadata"  // 元数据变更
+	EVENT_TOPIC_ABANDONED  = "topic.abandoned" // 达到最大重试次数, 放弃更新
+	EVENT_PAN_TRANSFER     = "pan.transfer"    // 网盘转存状态变更
+	EVENT_PAN_SIGN         = "pan.sign"        // 网盘签到
+	EVENT_SUBSCRIBE_FOUND  = "subscribe.found" // 订阅发现新帖子
+	EVENT_COOKIE_EXPIRED   = "cookie.expired"  // NGA cookie 失效
+	EVENT_RECYCLE_PURGED   = "recycle.purged"  // 回收站中的帖子被永久删除
+	EVENT_STORAGE_QUOTA    = "storage.quota"   // 帖子占用超过存储配额
+	EVENT_PING             = "ping"
+	EVENT_PING_INTERVAL    = 30 * time.Second
+	eventSubscriberBufSize = 64
+)
+
+type Event struct {
+	Type    string
+	TopicId int `json:",omitempty"`
+	Data    any `json:",omitempty"`
+	Time    CustomTime
+}
+
+// 事件分发, 客户端处理过慢时丢弃事件, 不阻塞发布者
+type eventHub struct {
+	lock   *sync.RWMutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		lock: &sync.RWMutex{},
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+func (h *eventHub) Subscribe() chan Event {
+	return h.subscribe(eventSubscriberBufSize)
+}
+
+func (h *eventHub) subscribe(size int) chan Event {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ch := make(chan Event, size)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) Unsubscribe(ch chan Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, has := h.subs[ch]; has {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) Publish(ev Event) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) Size() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.subs)
+}
+
+func (h *eventHub) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.closed = true
+	for ch := range h.subs {
+		close(ch)
+	}
+	h.subs = make(map[chan Event]struct{})
+	return nil
+}
+
+func (srv *Server) publish(typ string, topicId int, data any) {
+	if srv == nil {
+		return
+	}
+	srv.indexEvent(typ, topicId)
+	if srv.events == nil {
+		return
+	}
+	srv.events.Publish(Event{
+		Type:    typ,
+		TopicId: topicId,
+		Data:    data,
+		Time:    Now(),
+	})
+}
+
+func (srv *Server) eventStream() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ch := srv.events.Subscribe()
+		defer srv.events.Unsubscribe(ch)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(EVENT_PING_INTERVAL)
+		defer ticker.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case ev, ok := <-ch:
+				if !ok {
+					return false
+				}
+				c.SSEvent(ev.Type, ev)
+				return true
+			case <-ticker.C:
+				c.SSEvent(EVENT_PING, Event{Type: EVENT_PING, Time: Now()})
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package mgr
+
+import (
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestEventHub(t *testing.T) {
+	hub := newEventHub()
+
+	a := hub.Subscribe()
+	b := hub.Subscribe()
+	assert.Equal(t, hub.Size(), 2)
+
+	hub.Publish(Event{Type: EVENT_TOPIC_ADDED, TopicId: 1})
+	assert.Equal(t, (<-a).TopicId, 1)
+	assert.Equal(t, (<-b).Type, EVENT_TOPIC_ADDED)
+
+	hub.Unsubscribe(a)
+	assert.Equal(t, hub.Size(), 1)
+	_, ok := <-a
+	assert.Equal(t, ok, false)
+
+	// 客户端处理过慢时丢弃, 不阻塞
+	for i := 0; i < eventSubscriberBufSize*2; i++ {
+		hub.Publish(Event{Type: EVENT_PING})
+	}
+	assert.Equal(t, len(b), eventSubscriberBufSize)
+
+	hub.Close()
+	assert.Equal(t, hub.Size(), 0)
+	hub.Unsubscribe(b)
+
+	c := hub.Subscribe()
+	_, ok = <-c
+	assert.Equal(t, ok, false)
+}
@@ -0,0 +1,257 @@
+package mgr
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+const EXTRACT_SECTION = "extract" // 网盘配置文件中的提取配置段
+
+// 分享链接的提取选项
+type ExtractOptions struct {
+	AuthorOnly bool `ini:"author_only"` // 只提取楼主发布的楼层
+	MaxFloor   int  `ini:"max_floor"`   // 只提取到此楼层, 0 为不限制
+}
+
+func DefaultExtractOptions() ExtractOptions {
+	return ExtractOptions{AuthorOnly: true}
+}
+
+func newExtractOptions(cfg *ini.File) ExtractOptions {
+	opts := DefaultExtractOptions()
+	if cfg != nil && cfg.HasSection(EXTRACT_SECTION) {
+		cfg.Section(EXTRACT_SECTION).MapTo(&opts)
+	}
+	return opts
+}
+
+// 分享链接的提供方, 用于识别链接和判断提取码
+type shareProvider struct {
+	Name    string
+	Pattern *regexp.Regexp // 分享链接, 不含协议
+	Code    *regexp.Regexp // 有效的提取码
+}
+
+var (
+	code4 = regexp.MustCompile(`^[a-zA-Z0-9]{4}$`)
+
+	shareProviders = []shareProvider{
+		{"baidu", regexp.MustCompile(`^pan\.baidu\.com/(?:s/[\w-]+|share/init\?surl=[\w-]+)`), code4},
+		{"quark", regexp.MustCompile(`^pan\.quark\.cn/s/\w+`), code4},
+		{"aliyun", regexp.MustCompile(`^(?:www\.)?(?:alipan|aliyundrive)\.com/s/\w+`), code4},
+		{"123pan", regexp.MustCompile(`^(?:www\.)?123(?:pan|684|865|912)\.(?:com|cn)/s/[\w-]+`), code4},
+		{"lanzou", regexp.MustCompile(`^(?:[\w-]+\.)?lanzou[a-z]*\.com/[\w-]+`), regexp.MustCompile(`^[a-zA-Z0-9]{2,8}$`)},
+		{"xunlei", regexp.MustCompile(`^pan\.xunlei\.com/s/[\w-]+`), code4},
+		{"189", regexp.MustCompile(`^cloud\.189\.cn/(?:t/|web/share\?code=)\w+`), code4},
+		{"pan", regexp.MustCompile(`^pan\.[\w.-]+/`), code4}, // 其它 pan. 开头的网盘
+	}
+
+	regexShareURL  = regexp.MustCompile(`https?://[A-Za-z0-9\-._~:/?#@!$&*+,;=%]+`)
+	regexShareCode = regexp.MustCompile(`(?i)(?:提取码|提取密码|访问码|取件码|分享码|密码|\bpwd|\bpasscode)\s*(?:是|为)?\s*[:：=]?\s*([a-zA-Z0-9]+)\b`)
+	regexNGATag    = regexp.MustCompile(`\[/?[a-z]+(?:=[^\]]*)?\]`)
+	urlCodeParams  = []string{"pwd", "password", "passcode"}
+	// 密码遇到中日文字符和全角标点时结束, 如 "解压密码：abc下载后解压"
+	regexUnzipPwd = regexp.MustCompile(`(?:解压缩?密?码|压缩包?密码)[^\S\n]*(统一|通用|均|都|全部)?[^\S\n]*(?:是|为)?[^\S\n]*[:：]?[^\S\n]*([^\s\p{Han}\p{Hiragana}\p{Katakana}\x{3000}-\x{303F}\x{FF00}-\x{FFEF}]+)`)
+)
+
+// 链接对应的提供方, 不是分享链接时返回 nil
+func shareProviderOf(link string) *shareProvider {
+	rest := link[strings.Index(link, "://")+3:]
+	for i := range shareProviders {
+		if shareProviders[i].Pattern.MatchString(rest) {
+			return &shareProviders[i]
+		}
+	}
+	for _, d := range panDrivers {
+		if d.Match(link) {
+			return &shareProvider{Name: d.Name, Code: code4}
+		}
+	}
+	return nil
+}
+
+// 楼层中的一处内容, 用于按距离配对
+type extractSpan struct {
+	start, end int
+}
+
+func (s extractSpan) distance(o extractSpan) int {
+	if o.start >= s.end {
+		return o.start - s.end
+	}
+	if s.start >= o.end {
+		return s.start - o.end
+	}
+	return 0
+}
+
+type extractLink struct {
+	extractSpan
+	record   *TransferRecord
+	provider *shareProvider
+}
+
+// 清理提取到的密码, 去掉 markdown 和 NGA 标签以及结尾的标点
+func cleanExtracted(s string) string {
+	s = regexNGATag.ReplaceAllString(s, "")
+	return strings.Trim(s, "*`'\"“”‘’,，.。;；!！)）]】")
+}
+
+// 链接中的提取码, 如 ?pwd=xxxx
+func codeInURL(link string) string {
+	u, e := url.Parse(link)
+	if e != nil {
+		return ""
+	}
+	q := u.Query()
+	for _, k := range urlCodeParams {
+		if v := q.Get(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// 离 span 最近的链接, 同一行中前面的链接优先, 距离相同时前面的链接优先, accept 为 nil 时不限制
+func nearestLink(text string, links []*extractLink, span extractSpan, accept func(*extractLink) bool) *extractLink {
+	var best *extractLink
+	bestTier, bestDist := 0, -1
+	for _, l := range links {
+		if accept != nil && !accept(l) {
+			continue
+		}
+		tier, d := 1, l.distance(span)
+		if l.end <= span.start && !strings.Contains(text[l.end:span.start], "\n") {
+			tier = 0
+		}
+		if best == nil || tier < bestTier || (tier == bestTier && d < bestDist) {
+			best, bestTier, bestDist = l, tier, d
+		}
+	}
+	return best
+}
+
+// 从楼层中提取分享链接, 提取码和解压密码
+// 提取码和解压密码只和同一楼层中距离最近的链接配对, 没有配对的解压密码在声明了统一或者只有一个时用于所有链接
+func ExtractShares(floors []Floor) []*TransferRecord {
+	records := make([]*TransferRecord, 0)
+	byURL := make(map[string]*TransferRecord)
+	pwds := make(map[string]bool)
+	common := ""
+
+	for _, floor := range floors {
+		content := html.UnescapeString(floor.Content)
+		masked := []byte(content)
+
+		links := make([]*extractLink, 0)
+		for _, loc := range regexShareURL.FindAllStringIndex(content, -1) {
+			link := strings.TrimRight(content[loc[0]:loc[1]], ".,;:!?*")
+			span := extractSpan{loc[0], loc[0] + len(link)}
+			for i := span.start; i < span.end; i++ {
+				masked[i] = ' '
+			}
+			provider := shareProviderOf(link)
+			if provider == nil {
+				continue
+			}
+			record, has := byURL[link]
+			if !has {
+				record = &TransferRecord{URL: link, Tqm: codeInURL(link)}
+				byURL[link] = record
+				records = append(records, record)
+			}
+			links = append(links, &extractLink{span, record, provider})
+		}
+
+		text := string(masked)
+		for _, loc := range regexUnzipPwd.FindAllStringSubmatchIndex(text, -1) {
+			pwd := cleanExtracted(text[loc[4]:loc[5]])
+			if pwd == "" || pwd == "无" || pwd == "没有" {
+				continue
+			}
+			pwds[pwd] = true
+			if loc[2] >= 0 {
+				common = pwd
+			}
+			span := extractSpan{loc[0], loc[1]}
+			if l := nearestLink(text, links, span, func(l *extractLink) bool { return l.record.Pwd == "" }); l != nil {
+				l.record.Pwd = pwd
+			}
+			// 解压密码中可能有提取码的关键字, 不再作为提取码
+			for i := loc[0]; i < loc[1]; i++ {
+				masked[i] = ' '
+			}
+		}
+
+		text = string(masked)
+		for _, loc := range regexShareCode.FindAllStringSubmatchIndex(text, -1) {
+			code := text[loc[2]:loc[3]]
+			span := extractSpan{loc[0], loc[1]}
+			near := nearestLink(text, links, span, func(l *extractLink) bool { return l.provider.Code.MatchString(code) })
+			if near == nil || near.record.Tqm == code { // 链接中已经带有此提取码
+				continue
+			}
+			if l := nearestLink(text, links, span, func(l *extractLink) bool {
+				return l.record.Tqm == "" && l.provider.Code.MatchString(code)
+			}); l != nil {
+				l.record.Tqm = code
+			}
+		}
+	}
+
+	if common == "" && len(pwds) == 1 {
+		for pwd := range pwds {
+			common = pwd
+		}
+	}
+	if common != "" {
+		for _, r := range records {
+			if r.Pwd == "" {
+				r.Pwd = common
+			}
+		}
+	}
+	return records
+}
+
+// 根据选项选择需要提取的楼层
+func (opts ExtractOptions) filter(floors []Floor) []Floor {
+	if len(floors) == 0 {
+		return floors
+	}
+	op := floors[0]
+	ret := make([]Floor, 0, len(floors))
+	for _, f := range floors {
+		if opts.MaxFloor > 0 && f.Floor > opts.MaxFloor {
+			break
+		}
+		if opts.AuthorOnly && f.Floor != op.Floor {
+			if op.Uid > 0 && f.Uid > 0 {
+				if f.Uid != op.Uid {
+					continue
+				}
+			} else if f.Author != op.Author {
+				continue
+			}
+		}
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// 提取帖子中的分享链接
+func (t *Topic) extractTransferRecords(opts ExtractOptions) ([]*TransferRecord, error) {
+	content, e := t.fullContent()
+	if e != nil {
+		return nil, e
+	}
+	floors := parseFloors(content)
+	if len(floors) == 0 { // 没有楼层信息, 全部作为主楼
+		floors = []Floor{{Content: content}}
+	}
+	return ExtractShares(opts.filter(floors)), nil
+}
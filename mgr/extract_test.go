@@ -0,0 +1,152 @@
+package mgr
+
+import (
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func extractText(text string) []*TransferRecord {
+	return ExtractShares([]Floor{{Content: text}})
+}
+
+func TestExtractShares(t *testing.T) {
+	type want struct {
+		URL, Tqm, Pwd string
+	}
+	cases := []struct {
+		name string
+		text string
+		want []want
+	}{
+		{
+			"markdown 链接",
+			"[url]链接: [https://pan.baidu.com/s/1AbCdEfG](https://pan.baidu.com/s/1AbCdEfG) 提取码: x7k2",
+			[]want{{"https://pan.baidu.com/s/1AbCdEfG", "x7k2", ""}},
+		},
+		{
+			"裸链接和 pwd 参数",
+			"百度:https://pan.baidu.com/s/1AbCdEfG?pwd=ab12 复制这段内容后打开百度网盘手机App，操作更方便哦",
+			[]want{{"https://pan.baidu.com/s/1AbCdEfG?pwd=ab12", "ab12", ""}},
+		},
+		{
+			"pwd 参数和重复的提取码",
+			"https://pan.baidu.com/s/1AAA?pwd=ab12 提取码：ab12\nhttps://pan.baidu.com/s/1BBB 提取码：cd34",
+			[]want{
+				{"https://pan.baidu.com/s/1AAA?pwd=ab12", "ab12", ""},
+				{"https://pan.baidu.com/s/1BBB", "cd34", ""},
+			},
+		},
+		{
+			"share/init 链接",
+			"链接：https://pan.baidu.com/share/init?surl=AbCdEfG&amp;pwd=9z9z",
+			[]want{{"https://pan.baidu.com/share/init?surl=AbCdEfG&pwd=9z9z", "9z9z", ""}},
+		},
+		{
+			"密码, 访问码和 pwd",
+			"夸克 https://pan.quark.cn/s/0a1b2c3d4e5f 密码:Qk12\n阿里 https://www.alipan.com/s/AbC123dEf 访问码 7u8i\n123 https://www.123pan.com/s/key1-AbC pwd=p123",
+			[]want{
+				{"https://pan.quark.cn/s/0a1b2c3d4e5f", "Qk12", ""},
+				{"https://www.alipan.com/s/AbC123dEf", "7u8i", ""},
+				{"https://www.123pan.com/s/key1-AbC", "p123", ""},
+			},
+		},
+		{
+			"提取码在下一行",
+			"下载地址：\nhttps://pan.quark.cn/s/abcdef123456\n\n提取码：\nq1w2",
+			[]want{{"https://pan.quark.cn/s/abcdef123456", "q1w2", ""}},
+		},
+		{
+			"提取码在链接前面",
+			"**提取码：a1b2**\n链接：https://pan.baidu.com/s/1xyz",
+			[]want{{"https://pan.baidu.com/s/1xyz", "a1b2", ""}},
+		},
+		{
+			"多个链接各自的提取码和解压密码",
+			"v1.0 https://pan.baidu.com/s/1v10 提取码: aaaa 解压密码: nga111\nv2.0 https://pan.quark.cn/s/v20 提取码: bbbb 解压密码: nga222",
+			[]want{
+				{"https://pan.baidu.com/s/1v10", "aaaa", "nga111"},
+				{"https://pan.quark.cn/s/v20", "bbbb", "nga222"},
+			},
+		},
+		{
+			"统一的解压密码",
+			"[b]解压密码统一为：[/b]www.nga.cn\n百度 https://pan.baidu.com/s/1one 提取码 1111\n夸克 https://pan.quark.cn/s/two",
+			[]want{
+				{"https://pan.baidu.com/s/1one", "1111", "www.nga.cn"},
+				{"https://pan.quark.cn/s/two", "", "www.nga.cn"},
+			},
+		},
+		{
+			"解压密码不是提取码",
+			"https://pan.quark.cn/s/abc 解压密码：abcd",
+			[]want{{"https://pan.quark.cn/s/abc", "", "abcd"}},
+		},
+		{
+			"解压密码后紧跟中文",
+			"https://pan.quark.cn/s/abc 解压密码：abc下载后解压，https://pan.quark.cn/s/def 解压密码：def（全角括号）",
+			[]want{{"https://pan.quark.cn/s/abc", "", "abc"}, {"https://pan.quark.cn/s/def", "", "def"}},
+		},
+		{
+			"蓝奏云的提取码长度",
+			"蓝奏：https://wwi.lanzoui.com/iAbc123 密码:6b9",
+			[]want{{"https://wwi.lanzoui.com/iAbc123", "6b9", ""}},
+		},
+		{
+			"不接受格式不对的提取码",
+			"https://pan.baidu.com/s/1abc 提取码: abcdef",
+			[]want{{"https://pan.baidu.com/s/1abc", "", ""}},
+		},
+		{
+			"忽略图片和普通链接",
+			"![img](https://img.nga.178.com/attachments/mon_202502/1.jpg) 原帖 https://bbs.nga.cn/read.php?tid=123 资源 [url=https://pan.xunlei.com/s/VAbC]迅雷[/url] 提取码：xl12。",
+			[]want{{"https://pan.xunlei.com/s/VAbC", "xl12", ""}},
+		},
+		{
+			"去除引用中重复的链接",
+			"https://pan.quark.cn/s/same 提取码: 1234\n> 引用: https://pan.quark.cn/s/same",
+			[]want{{"https://pan.quark.cn/s/same", "1234", ""}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rs := extractText(c.text)
+			got := make([]want, 0, len(rs))
+			for _, r := range rs {
+				got = append(got, want{r.URL, r.Tqm, r.Pwd})
+			}
+			assert.Equal(t, got, c.want)
+		})
+	}
+}
+
+func TestExtractFloors(t *testing.T) {
+	floors := parseFloors(`# 资源帖
+
+##### <span id="pid0">0.[0] \<pid:0\> 2025-02-27 03:02:58 by 楼主(100)</span>
+https://pan.baidu.com/s/1main 提取码: main
+
+----
+##### <span id="pid11">1.[1] \<pid:11\> 2025-02-27 04:00:00 by 路人(200)</span>
+求补档 https://pan.quark.cn/s/other 提取码: othr
+
+----
+##### <span id="pid12">2.[2] \<pid:12\> 2025-02-28 05:00:00 by 楼主(100)</span>
+补档: https://pan.quark.cn/s/fix 提取码: fix1 解压密码: 2025
+`)
+	urls := func(opts ExtractOptions) []string {
+		ret := make([]string, 0)
+		for _, r := range ExtractShares(opts.filter(floors)) {
+			ret = append(ret, r.URL)
+		}
+		return ret
+	}
+	assert.Equal(t, urls(DefaultExtractOptions()), []string{"https://pan.baidu.com/s/1main", "https://pan.quark.cn/s/fix"})
+	assert.Equal(t, urls(ExtractOptions{}), []string{"https://pan.baidu.com/s/1main", "https://pan.quark.cn/s/other", "https://pan.quark.cn/s/fix"})
+	assert.Equal(t, urls(ExtractOptions{AuthorOnly: true, MaxFloor: 1}), []string{"https://pan.baidu.com/s/1main"})
+
+	// 解压密码只有一个时用于所有链接
+	rs := ExtractShares(DefaultExtractOptions().filter(floors))
+	assert.Equal(t, rs[0].Pwd, "2025")
+	assert.Equal(t, rs[1].Tqm, "fix1")
+}
@@ -0,0 +1,297 @@
+package mgr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	FEED_TOPICS_SIZE = 50  // 帖子订阅源的条目数量
+	FEED_FLOORS_SIZE = 100 // 楼层订阅源的条目数量
+	ATOM_CONTENT     = "application/atom+xml; charset=utf-8"
+	atomNS           = "http://www.w3.org/2005/Atom"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	NS      string      `xml:"xmlns,attr"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  *atomPerson `xml:"author,omitempty"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published,omitempty"`
+	Links     []atomLink  `xml:"link"`
+	Author    *atomPerson `xml:"author,omitempty"`
+	Content   *atomText   `xml:"content,omitempty"`
+}
+
+func atomTime(t CustomTime) string {
+	if t.IsZero() {
+		return time.Unix(0, 0).UTC().Format(time.RFC3339)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// 订阅源的签名, 阅读器无法发送 Authorization 头, 所以将签名放在 URL 中
+func (srv *Server) feedToken(path string) string {
+	token := srv.Cfg.Config.Token
+	if token == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(path))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func (srv *Server) feedURL(path string) string {
+	if token := srv.feedToken(path); token != "" {
+		return path + "?token=" + token
+	}
+	return path
+}
+
+func (srv *Server) feedMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expect := srv.feedToken(c.Request.URL.Path)
+		if !hmac.Equal([]byte(c.Query("token")), []byte(expect)) {
+			c.JSON(http.StatusUnauthorized, toErr("未授权"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 请求的来源地址, 用于生成订阅源中的绝对链接
+func requestOrigin(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if p := c.GetHeader("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+func (srv *Server) viewURL(origin string, id int) string {
+	token := srv.Cfg.tokenHash
+	if token == "" {
+		token = "-"
+	}
+	return fmt.Sprintf("%s/view/%s/%d", origin, token, id)
+}
+
+func (srv *Server) newFeed(c *gin.Context, title string) *atomFeed {
+	origin := requestOrigin(c)
+	return &atomFeed{
+		NS:    atomNS,
+		Id:    origin + c.Request.URL.Path,
+		Title: title,
+		Links: []atomLink{
+			{Href: origin + srv.feedURL(c.Request.URL.Path), Rel: "self", Type: "application/atom+xml"},
+			{Href: origin + "/", Rel: "alternate", Type: "text/html"},
+		},
+		Updated: atomTime(Now()),
+		Entries: make([]atomEntry, 0),
+	}
+}
+
+func (srv *Server) topicEntry(origin string, topic *Topic) atomEntry {
+	return atomEntry{
+		Id:        fmt.Sprintf("%s/topic/%d", origin, topic.Id),
+		Title:     topic.Title,
+		Updated:   atomTime(topic.modAt),
+		Published: atomTime(topic.Create),
+		Links:     []atomLink{{Href: srv.viewURL(origin, topic.Id), Rel: "alternate", Type: "text/html"}},
+		Author:    &atomPerson{Name: topic.Author},
+		Content: &atomText{
+			Type: "text",
+			Body: fmt.Sprintf("%s\n作者: %s\n楼层: %d\n原帖: %s/read.php?tid=%d",
+				topic.Title, topic.Author, topic.MaxFloor, srv.nga.BaseURL(), topic.Id),
+		},
+	}
+}
+
+func writeFeed(c *gin.Context, feed *atomFeed) {
+	data, e := xml.MarshalIndent(feed, "", "  ")
+	if e != nil {
+		c.JSON(http.StatusInternalServerError, toErr("生成订阅源失败: "+e.Error()))
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Data(http.StatusOK, ATOM_CONTENT, append([]byte(xml.Header), data...))
+}
+
+// 按修改时间倒序的最新帖子
+func (srv *Server) feedTopics() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		topics := srv.cache.topics.Values()
+		slices.SortFunc(topics, func(a, b *Topic) int {
+			return b.modAt.Compare(a.modAt.Time)
+		})
+		if len(topics) > FEED_TOPICS_SIZE {
+			topics = topics[:FEED_TOPICS_SIZE]
+		}
+
+		feed := srv.newFeed(c, "NGA 帖子更新")
+		origin := requestOrigin(c)
+		for _, topic := range topics {
+			feed.Entries = append(feed.Entries, srv.topicEntry(origin, topic))
+		}
+		if len(topics) > 0 {
+			feed.Updated = atomTime(topics[0].modAt)
+		}
+		writeFeed(c, feed)
+	}
+}
+
+// 帖子最近一次下载的新楼层
+func (srv *Server) feedTopic() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, e := strconv.Atoi(c.Param("id"))
+		if e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的帖子 ID"))
+			return
+		}
+		topic, has := srv.cache.topics.Get(id)
+		if !has {
+			c.JSON(http.StatusNotFound, toErr("未找到帖子"))
+			return
+		}
+		floors, e := topic.Floors()
+		if e != nil {
+			c.JSON(http.StatusInternalServerError, toErr(e.Error()))
+			return
+		}
+
+		from := topic.Metadata.LastMaxFloor
+		news := make([]Floor, 0)
+		for _, f := range floors {
+			if f.Floor > from {
+				news = append(news, f)
+			}
+		}
+		if len(news) > FEED_FLOORS_SIZE {
+			news = news[len(news)-FEED_FLOORS_SIZE:]
+		}
+		slices.Reverse(news)
+
+		feed := srv.newFeed(c, topic.Title)
+		feed.Author = &atomPerson{Name: topic.Author}
+		origin := requestOrigin(c)
+		view := srv.viewURL(origin, id)
+		for _, f := range news {
+			feed.Entries = append(feed.Entries, atomEntry{
+				Id:        fmt.Sprintf("%s/topic/%d/%d", origin, id, f.Floor),
+				Title:     fmt.Sprintf("%s #%d", topic.Title, f.Floor),
+				Updated:   atomTime(f.Time),
+				Published: atomTime(f.Time),
+				Links:     []atomLink{{Href: fmt.Sprintf("%s#pid%d", view, f.Pid), Rel: "alternate", Type: "text/html"}},
+				Author:    &atomPerson{Name: f.Author},
+				Content:   &atomText{Type: "text", Body: f.Content},
+			})
+		}
+		if len(news) > 0 {
+			feed.Updated = atomTime(news[0].Time)
+		}
+		writeFeed(c, feed)
+	}
+}
+
+// 用户的帖子, 按发帖时间倒序
+func (srv *Server) feedAuthor() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		uid, e := strconv.Atoi(c.Param("uid"))
+		if e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的用户 ID"))
+			return
+		}
+
+		topics := make([]*Topic, 0)
+		srv.cache.topics.Each(func(_ int, topic *Topic) {
+			if topic.Uid == uid {
+				topics = append(topics, topic)
+			}
+		})
+		slices.SortFunc(topics, func(a, b *Topic) int {
+			return b.Create.Compare(a.Create.Time)
+		})
+		if len(topics) > FEED_TOPICS_SIZE {
+			topics = topics[:FEED_TOPICS_SIZE]
+		}
+
+		name := ""
+		if len(topics) > 0 {
+			name = topics[0].Author
+		} else if u, e := srv.nga.GetUserById(uid); e == nil {
+			name = u.Name
+		} else {
+			name = "UID" + strconv.Itoa(uid)
+		}
+
+		feed := srv.newFeed(c, name+" 的帖子")
+		feed.Author = &atomPerson{
+			Name: name,
+			URI:  fmt.Sprintf("%s/nuke.php?func=ucp&uid=%d", srv.nga.BaseURL(), uid),
+		}
+		origin := requestOrigin(c)
+		for _, topic := range topics {
+			feed.Entries = append(feed.Entries, srv.topicEntry(origin, topic))
+		}
+		if len(topics) > 0 {
+			feed.Updated = atomTime(topics[0].Create)
+		}
+		writeFeed(c, feed)
+	}
+}
+
+// 返回带签名的订阅源地址
+func (srv *Server) feedLinks() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		origin := requestOrigin(c)
+		ret := gin.H{
+			"topics": origin + srv.feedURL("/feed/topics"),
+		}
+		if id, e := strconv.Atoi(c.Query("topic")); e == nil {
+			ret["topic"] = origin + srv.feedURL("/feed/topic/"+strconv.Itoa(id))
+		}
+		if uid, e := strconv.Atoi(c.Query("uid")); e == nil {
+			ret["author"] = origin + srv.feedURL("/feed/author/"+strconv.Itoa(uid))
+		}
+		c.JSON(http.StatusOK, ret)
+	}
+}
@@ -0,0 +1,57 @@
+package mgr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+)
+
+func TestParseFloors(t *testing.T) {
+	content := `# 标题
+
+##### <span id="pid0">0.[0] \<pid:0\> 2025-02-27 03:02:58 by lukaka_1901(66412753)</span>
+主楼内容
+
+----
+##### <span id="pid812345">1.[1] \<pid:812345\> 2025-02-27 04:00:00 by 慕容巽</span>
+第一行
+第二行
+
+----
+`
+	floors := parseFloors(content)
+	assert.Equal(t, len(floors), 2)
+	assert.Equal(t, floors[0].Floor, 0)
+	assert.Equal(t, floors[0].Uid, 66412753)
+	assert.Equal(t, floors[0].Author, "lukaka_1901")
+	assert.Equal(t, floors[0].Content, "主楼内容")
+	assert.Equal(t, floors[1].Floor, 1)
+	assert.Equal(t, floors[1].Pid, 812345)
+	assert.Equal(t, floors[1].Author, "慕容巽")
+	assert.Equal(t, floors[1].Content, "第一行\n第二行")
+	assert.Equal(t, floors[1].Time.Format("15:04"), "04:00")
+}
+
+func TestFeedMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	srv := &Server{Cfg: &SrvCfg{Config: &Config{Token: "secret"}}}
+
+	r := gin.New()
+	r.GET("/feed/topic/:id", srv.feedMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	get := func(url string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, get(srv.feedURL("/feed/topic/1")), http.StatusOK)
+	assert.Equal(t, get("/feed/topic/1"), http.StatusUnauthorized)
+	// 签名与路径绑定, 不能用于其他订阅源
+	assert.Equal(t, get("/feed/topic/2?token="+srv.feedToken("/feed/topic/1")), http.StatusUnauthorized)
+}
@@ -1,7 +1,9 @@
 package mgr
 
 import (
+	"bytes"
 	"embed"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,7 +12,6 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -32,7 +33,7 @@ func (srv *Server) regHandlers() {
 	has := srv.Cfg.Config.Token != ""
 
 	r := srv.Raw.Handler.(*gin.Engine)
-	r.Use(gzip.Gzip(gzip.DefaultCompression))
+	r.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/events"})))
 	r.Use(func(c *gin.Context) {
 		c.Header("Cache-Control", "max-age=604800")
 		c.Next()
@@ -49,8 +50,13 @@ func (srv *Server) regHandlers() {
 		})
 		tg.GET("", srv.topicList())
 		tg.GET("/", srv.topicList())
+		tg.GET("/org", srv.topicOrganizeStats())
+		tg.POST("/org", srv.topicOrganize())
+		tg.POST("/bulk", srv.topicBulk())
 		tg.GET("/:id/:floor", srv.topicFloor())
 		tg.GET("/:id", srv.topicInfo())
+		tg.POST("", srv.topicAddText())
+		tg.POST("/", srv.topicAddText())
 		tg.PUT("/:id", srv.topicAdd())
 		tg.POST("/:id", srv.topicUpdate())
 		tg.DELETE("/:id", srv.topicDel())
@@ -111,7 +117,108 @@ func (srv *Server) regHandlers() {
 		}
 	}
 
+	fg := r.Group("/feed")
+	{
+		if has {
+			fg.Use(srv.feedMiddleware())
+		}
+		fg.GET("/topics", srv.feedTopics())
+		fg.GET("/topic/:id", srv.feedTopic())
+		fg.GET("/author/:uid", srv.feedAuthor())
+	}
+	if has {
+		r.GET("/feeds", srv.topicMiddleware(), srv.feedLinks())
+	} else {
+		r.GET("/feeds", srv.feedLinks())
+	}
+
+	rg := r.Group("/read")
+	{
+		if has {
+			rg.Use(srv.viewMiddleware())
+		}
+		rg.Use(func(c *gin.Context) {
+			c.Header("Cache-Control", "no-cache")
+			c.Next()
+		})
+		rg.GET("/:token/:id", srv.readingGet())
+		rg.POST("/:token/:id", srv.readingUpdate())
+		rg.PUT("/:token/:id/bookmark/:floor", srv.bookmarkSet())
+		rg.DELETE("/:token/:id/bookmark/:floor", srv.bookmarkDel())
+	}
+
+	stg := r.Group("/stats")
+	{
+		if has {
+			stg.Use(srv.topicMiddleware())
+		}
+		stg.Use(func(c *gin.Context) {
+			c.Header("Cache-Control", "no-cache")
+			c.Next()
+		})
+		stg.GET("", srv.topicStats())
+		stg.GET("/", srv.topicStats())
+		stg.GET("/storage", srv.storageStats())
+	}
+
+	sig := r.Group("/sign")
+	{
+		if has {
+			sig.Use(srv.topicMiddleware())
+		}
+		sig.Use(func(c *gin.Context) {
+			c.Header("Cache-Control", "no-cache")
+			c.Next()
+		})
+		sig.GET("", srv.quarkSignList())
+		sig.GET("/", srv.quarkSignList())
+		sig.POST("/:name", srv.quarkSignRun())
+	}
+
+	rcg := r.Group("/recycle")
+	{
+		if has {
+			rcg.Use(srv.topicMiddleware())
+		}
+		rcg.Use(func(c *gin.Context) {
+			c.Header("Cache-Control", "no-cache")
+			c.Next()
+		})
+		rcg.GET("", srv.recycleList())
+		rcg.GET("/", srv.recycleList())
+		rcg.POST("/:id/restore", srv.recycleRestore())
+		rcg.DELETE("/:id", srv.recyclePurge())
+	}
+
+	ug := r.Group("/user")
+	{
+		if has {
+			ug.Use(srv.topicMiddleware())
+		}
+		ug.Use(func(c *gin.Context) {
+			c.Header("Cache-Control", "no-cache")
+			c.Next()
+		})
+		ug.GET("/:uid", srv.userInfo())
+	}
+
+	if has {
+		r.GET("/events", srv.topicMiddleware(), srv.eventStream())
+	} else {
+		r.GET("/events", srv.eventStream())
+	}
+
+	if has {
+		r.GET("/metrics", srv.topicMiddleware(), srv.metrics())
+	} else {
+		r.GET("/metrics", srv.metrics())
+	}
+
+	r.GET("/healthz", srv.healthz())
+	r.GET("/readyz", srv.readyz())
+
 	r.GET("/", srv.homePage())
+	r.GET("/u/:uid", srv.userPage())
 	r.GET("/favicon.ico", srv.favicon())
 	r.GET("/asset/:name", srv.asset())
 
@@ -149,24 +256,34 @@ func (srv *Server) viewMiddleware() gin.HandlerFunc {
 
 func (srv *Server) topicList() func(c *gin.Context) {
 	return func(c *gin.Context) {
-		topics := srv.cache.topics
+		// 使用分页, 排序, 过滤或游标时返回分页结果
+		for _, key := range []string{"page", "size", "sort", "cursor", "q", "author", "uid", "abandoned", "failed", "hasPan"} {
+			if _, has := c.GetQuery(key); has {
+				srv.topicQuery(c)
+				return
+			}
+		}
+
+		topics := srv.indexedTopics()
+		tags := c.QueryArray("tag")
+		folder := c.Query("folder")
 
 		ims := c.GetHeader("If-Modified-Since")
 		if ims != "" {
 			if t, e := time.Parse(time.RFC1123, ims); e == nil {
-				ret := make([]*Topic, 0, topics.Size())
-				topics.Each(func(_ int, topic *Topic) {
+				ret := make([]*Topic, 0, len(topics))
+				for _, topic := range topics {
 					if topic.modAt.After(t) {
 						ret = append(ret, topic)
 					}
-				})
+				}
 
-				c.JSON(http.StatusOK, ret)
+				c.JSON(http.StatusOK, filterTopics(ret, tags, folder))
 				return
 			}
 		}
 
-		c.JSON(http.StatusOK, topics.Values())
+		c.JSON(http.StatusOK, filterTopics(topics, tags, folder))
 	}
 }
 
@@ -214,7 +331,8 @@ func (srv *Server) topicFloor() func(c *gin.Context) {
 	}
 }
 
-func (srv *Server) addTopic(id int) error {
+// 添加帖子, tags 为初始标签, 如订阅时设置的标签
+func (srv *Server) addTopic(id int, tags ...string) error {
 	cache := srv.cache
 	if cache.topics.Has(id) {
 		return fmt.Errorf("帖子已存在")
@@ -230,44 +348,47 @@ func (srv *Server) addTopic(id int) error {
 	topic := NewTopic(r, id)
 	topic.Create = Now()
 	topic.Metadata.UpdateCron = DEFAULT_CRON
+	topic.Metadata.SetTags(tags)
 
 	cache.topics.Put(id, topic)
 
-	select {
-	case cache.queue <- id:
-		srv.addCron(topic)
-		go topic.SaveMeta()
-
-		// 刚创建的帖子, 先更新几次, 以便快速获取内容
-		intervals := []time.Duration{
-			5,
-			10,
-			15,
-			25,
-			40,
-		}
-		for _, interval := range intervals {
-			timer := time.AfterFunc(interval*time.Minute, func() {
-				srv.cache.queue <- id
-				topic.timers.Delete(interval)
-			})
-			topic.timers.Put(interval, timer)
-		}
-
-		log.Println("添加帖子", id)
-
-		return nil
-	default:
+	if !cache.tryEnqueue(id) {
 		return fmt.Errorf("添加请求过多")
 	}
+	srv.addCron(topic)
+	go topic.SaveMeta()
+
+	// 刚创建的帖子, 先更新几次, 以便快速获取内容
+	intervals := []time.Duration{
+		5,
+		10,
+		15,
+		25,
+		40,
+	}
+	for _, interval := range intervals {
+		timer := time.AfterFunc(interval*time.Minute, func() {
+			srv.cache.enqueue(id)
+			topic.timers.Delete(interval)
+		})
+		topic.timers.Put(interval, timer)
+	}
+
+	log.Println("添加帖子", id)
+	srv.publish(EVENT_TOPIC_ADDED, id, nil)
+
+	return nil
 }
 
 func (srv *Server) topicAdd() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id, e := strconv.Atoi(c.Param("id"))
 		if e != nil {
-			c.JSON(http.StatusBadRequest, toErr("无效的帖子 ID"))
-			return
+			// 也可以是编码后的帖子链接
+			if id, e = srv.nga.ResolveLink(c.Param("id")); e != nil {
+				c.JSON(http.StatusBadRequest, toErr("无效的帖子 ID"))
+				return
+			}
 		}
 
 		e = srv.addTopic(id)
@@ -279,6 +400,64 @@ func (srv *Server) topicAdd() func(c *gin.Context) {
 	}
 }
 
+type addTextResult struct {
+	Input string
+	Id    int `json:",omitempty"`
+	Ok    bool
+	Error string `json:",omitempty"`
+}
+
+// 从文本中找出所有的帖子链接和 ID 并添加, 请求体为纯文本或 {"Text": "...", "Tags": [...]}
+func (srv *Server) topicAddText() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		req := struct {
+			Text string
+			Tags []string
+		}{}
+		if c.ContentType() == gin.MIMEJSON {
+			if e := c.ShouldBindJSON(&req); e != nil {
+				c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
+				return
+			}
+		} else {
+			data, e := c.GetRawData()
+			if e != nil {
+				c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
+				return
+			}
+			req.Text = string(data)
+		}
+
+		links := FindNGALinks(req.Text)
+		if len(links) == 0 {
+			c.JSON(http.StatusBadRequest, toErr("没有找到帖子链接或 ID"))
+			return
+		}
+
+		ret := make([]addTextResult, 0, len(links))
+		added := make(map[int]bool)
+		for _, link := range links {
+			r := addTextResult{Input: link}
+			id, e := srv.nga.ResolveLink(link)
+			if e == nil && added[id] {
+				continue
+			}
+			if e == nil {
+				r.Id = id
+				added[id] = true
+				e = srv.addTopic(id, req.Tags...)
+			}
+			if e != nil {
+				r.Error = e.Error()
+			} else {
+				r.Ok = true
+			}
+			ret = append(ret, r)
+		}
+		c.JSON(http.StatusOK, ret)
+	}
+}
+
 func (srv *Server) topicDel() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		id, e := strconv.Atoi(c.Param("id"))
@@ -304,6 +483,9 @@ func (srv *Server) deleteTopic(id int) bool {
 	}
 
 	cache.topics.Delete(id)
+	floorAuthorCache.Delete(id)
+	cache.deleted.Put(id, time.Now())
+	srv.publish(EVENT_TOPIC_DELETED, id, nil)
 
 	go func() {
 		log.Println("删除帖子", id)
@@ -375,6 +557,7 @@ func (srv *Server) topicUpdate() func(c *gin.Context) {
 		topic.Stop()
 		topic.Modify()
 		go topic.SaveMeta()
+		srv.publish(EVENT_TOPIC_METADATA, id, topic.Metadata)
 
 		c.JSON(http.StatusOK, id)
 	}
@@ -395,10 +578,9 @@ func (srv *Server) topicFresh() func(c *gin.Context) {
 			return
 		}
 
-		select {
-		case cache.queue <- id:
+		if cache.tryEnqueue(id) {
 			c.JSON(http.StatusOK, id)
-		default:
+		} else {
 			c.JSON(http.StatusServiceUnavailable, toErr("添加请求过多"))
 		}
 	}
@@ -769,11 +951,26 @@ func (srv *Server) subscribe() func(c *gin.Context) {
 			return
 		}
 
-		cond := make([]string, 0)
-		if e := c.ShouldBindJSON(&cond); e != nil {
+		// 兼容只有过滤条件的数组
+		body, e := c.GetRawData()
+		if e != nil {
 			c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
 			return
 		}
+		req := struct {
+			Filter []string
+			Tags   *[]string
+		}{}
+		if len(bytes.TrimSpace(body)) > 0 && bytes.TrimSpace(body)[0] == '[' {
+			e = json.Unmarshal(body, &req.Filter)
+		} else {
+			e = json.Unmarshal(body, &req)
+		}
+		if e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
+			return
+		}
+		cond := req.Filter
 		if len(cond) > 0 {
 			for i, c := range cond {
 				cond[i] = strings.TrimSpace(c)
@@ -781,6 +978,12 @@ func (srv *Server) subscribe() func(c *gin.Context) {
 		}
 		if user, e := srv.nga.GetUserById(uid); e == nil {
 			if e = srv.nga.Subscribe(user.Id, true, cond...); e == nil {
+				if req.Tags != nil {
+					if e := srv.nga.SetSubTags(user.Id, *req.Tags); e != nil {
+						c.JSON(http.StatusInternalServerError, toErr(e.Error()))
+						return
+					}
+				}
 				user, _ = srv.nga.GetUserById(uid)
 				c.JSON(http.StatusOK, user)
 			} else {
@@ -818,6 +1021,14 @@ func (srv *Server) topicForceReload() func(c *gin.Context) {
 			return
 		}
 
+		var org *organizeRequest
+		if old, has := srv.cache.topics.Get(id); has {
+			md := old.Metadata
+			md.mutex.Lock()
+			org = &organizeRequest{Tags: &md.Tags, Folder: &md.Folder, Note: &md.Note}
+			md.mutex.Unlock()
+		}
+
 		if !srv.deleteTopic(id) {
 			c.JSON(http.StatusInternalServerError, toErr("删除帖子失败"))
 			return
@@ -827,6 +1038,12 @@ func (srv *Server) topicForceReload() func(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, toErr(e.Error()))
 			return
 		}
+		// 保留标签, 文件夹和备注
+		if topic, has := srv.cache.topics.Get(id); has && org != nil {
+			org.apply(topic.Metadata)
+			go topic.SaveMeta()
+			srv.publish(EVENT_TOPIC_METADATA, id, topic.Metadata)
+		}
 
 		c.JSON(http.StatusOK, id)
 	}
@@ -839,84 +1056,44 @@ func (srv *Server) markTopic() func(c *gin.Context) {
 			c.JSON(http.StatusBadRequest, toErr("无效的帖子 ID"))
 			return
 		}
-		rootAbs, e := srv.cache.topicRoot.AbsPath()
-		if e != nil {
-			c.JSON(http.StatusInternalServerError, toErr("获取帖子根目录失败"))
-			return
-		}
-		marksDir := filepath.Join(rootAbs, MARKS_DIR)
-		if e := os.MkdirAll(marksDir, COMMON_DIR_MODE); e != nil {
-			c.JSON(http.StatusInternalServerError, toErr("创建标记目录失败"))
+		topic, has := srv.cache.topics.Get(id)
+		if !has {
+			c.JSON(http.StatusNotFound, toErr("未找到帖子"))
 			return
 		}
-		fpath := filepath.Join(marksDir, time.Now().Format("2006-01-02")+".md")
-		idStr := strconv.Itoa(id)
-		if data, e := os.ReadFile(fpath); e == nil {
-			existing := make(map[string]bool)
-			for line := range strings.SplitSeq(strings.TrimSpace(string(data)), "\n") {
-				line = strings.TrimSpace(line)
-				if line != "" {
-					existing[line] = true
-				}
-			}
-			if existing[idStr] {
-				c.JSON(http.StatusOK, gin.H{"ok": true, "already": true})
-				return
-			}
-		}
-		f, e := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, COMMON_FILE_MODE)
-		if e != nil {
-			c.JSON(http.StatusInternalServerError, toErr("写入标记文件失败"))
+		md := topic.Metadata
+		md.mutex.Lock()
+		already := md.Reading != nil && !md.Reading.MarkedAt.IsZero() &&
+			md.Reading.MarkedAt.In(TIME_LOC).Format("2006-01-02") == time.Now().In(TIME_LOC).Format("2006-01-02")
+		md.mutex.Unlock()
+		if already {
+			c.JSON(http.StatusOK, gin.H{"ok": true, "already": true})
 			return
 		}
-		_, e = f.WriteString(idStr + "\n")
-		f.Close()
-		if e != nil {
-			c.JSON(http.StatusInternalServerError, toErr("写入标记文件失败"))
+		md.Mark(topic.MaxFloor)
+		topic.countUnread()
+		topic.Modify()
+		if e := topic.SaveMeta(); e != nil {
+			c.JSON(http.StatusInternalServerError, toErr("保存标记失败"))
 			return
 		}
+		srv.publish(EVENT_TOPIC_METADATA, id, md)
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
 }
 
+// 以以前的格式导出标记, 默认导出最新一天的标记, 可以通过 date 参数指定日期
 func (srv *Server) markLatest() func(c *gin.Context) {
 	return func(c *gin.Context) {
-		rootAbs, e := srv.cache.topicRoot.AbsPath()
+		date, data, e := srv.exportMarks(c.Query("date"))
 		if e != nil {
-			c.JSON(http.StatusInternalServerError, toErr("获取帖子根目录失败"))
-			return
-		}
-		marksDir := filepath.Join(rootAbs, MARKS_DIR)
-		entries, e := os.ReadDir(marksDir)
-		if e != nil {
-			if os.IsNotExist(e) {
-				c.JSON(http.StatusNotFound, toErr("暂无标记文件"))
-				return
-			}
-			c.JSON(http.StatusInternalServerError, toErr("读取标记目录失败"))
-			return
-		}
-		var mdFiles []string
-		for _, e := range entries {
-			if !e.IsDir() && strings.HasSuffix(e.Name(), ".md") {
-				mdFiles = append(mdFiles, e.Name())
-			}
-		}
-		if len(mdFiles) == 0 {
-			c.JSON(http.StatusNotFound, toErr("暂无标记文件"))
-			return
-		}
-		sort.Sort(sort.Reverse(sort.StringSlice(mdFiles)))
-		latestName := mdFiles[0]
-		date := strings.TrimSuffix(latestName, ".md")
-		fpath := filepath.Join(marksDir, latestName)
-		data, e := os.ReadFile(fpath)
-		if e != nil {
-			c.JSON(http.StatusInternalServerError, toErr("读取标记文件失败"))
+			c.JSON(http.StatusNotFound, toErr(e.Error()))
 			return
 		}
+		name := date + ".md"
+		c.Header("Cache-Control", "no-cache")
 		c.Header("X-Mark-Date", date)
-		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", latestName))
+		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", name))
 		c.Data(http.StatusOK, "text/markdown; charset=utf-8", data)
 	}
 }
@@ -0,0 +1,160 @@
+package mgr
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HEALTH_CACHE_TTL = 30 * time.Second // 就绪检查结果缓存时间, 避免探针频繁请求 NGA 和网盘
+	HEALTH_TIMEOUT   = 10 * time.Second // 单项检查超时时间
+)
+
+// 单项检查的状态
+type checkState struct {
+	Ok          bool
+	Latency     string
+	Error       string     `json:",omitempty"`
+	LastError   string     `json:",omitempty"` // 最近一次失败的原因, 成功后也会保留
+	LastErrorAt CustomTime `json:",omitzero"`
+	CheckedAt   CustomTime
+}
+
+type healthChecker struct {
+	lock    *sync.Mutex
+	states  map[string]*checkState
+	checkAt time.Time
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		lock:   &sync.Mutex{},
+		states: make(map[string]*checkState),
+	}
+}
+
+type healthCheck struct {
+	name string
+	fx   func() error
+}
+
+func (srv *Server) readyChecks() []healthCheck {
+	checks := []healthCheck{
+		{"topics", func() error {
+			if !srv.cache.loaded.Load() {
+				return fmt.Errorf("帖子尚未加载完成")
+			}
+			return nil
+		}},
+		{"ngapost2md", func() error {
+			v, e := srv.nga.probe()
+			if e != nil {
+				return e
+			}
+			if v == "" {
+				return fmt.Errorf("无法获取 ngapost2md 版本")
+			}
+			return nil
+		}},
+		{"cookie", srv.nga.CheckCookie},
+	}
+	if ph := srv.cache.pans; ph != nil {
+		for _, pan := range ph.Pans {
+			checks = append(checks, healthCheck{"pan." + pan.Name(), pan.Check})
+		}
+	}
+	return checks
+}
+
+// 执行检查, 在缓存时间内直接返回上次的结果
+func (h *healthChecker) run(checks []healthCheck) (bool, map[string]checkState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if time.Since(h.checkAt) > HEALTH_CACHE_TTL {
+		wg := sync.WaitGroup{}
+		results := make([]error, len(checks))
+		latencies := make([]time.Duration, len(checks))
+		for i, check := range checks {
+			wg.Go(func() {
+				start := time.Now()
+				results[i] = withTimeout(check.fx, HEALTH_TIMEOUT)
+				latencies[i] = time.Since(start)
+			})
+		}
+		wg.Wait()
+
+		now := Now()
+		states := make(map[string]*checkState, len(checks))
+		for i, check := range checks {
+			state, has := h.states[check.name]
+			if !has {
+				state = &checkState{}
+			}
+			state.Ok = results[i] == nil
+			state.Latency = latencies[i].Truncate(time.Millisecond).String()
+			state.CheckedAt = now
+			state.Error = ""
+			if e := results[i]; e != nil {
+				state.Error = e.Error()
+				state.LastError = e.Error()
+				state.LastErrorAt = now
+			}
+			states[check.name] = state
+		}
+		h.states = states
+		// 失败的结果同样缓存, 接口无需认证, 避免未就绪时每次请求都去检查 NGA 和网盘
+		h.checkAt = time.Now()
+	}
+
+	ok := true
+	ret := make(map[string]checkState, len(h.states))
+	for name, state := range h.states {
+		ok = ok && state.Ok
+		ret[name] = *state
+	}
+	return ok, ret
+}
+
+func withTimeout(fx func() error, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- fx()
+	}()
+	select {
+	case e := <-ch:
+		return e
+	case <-ctx.Done():
+		return fmt.Errorf("检查超时 (%s)", timeout)
+	}
+}
+
+func (srv *Server) healthz() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-cache")
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func (srv *Server) readyz() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-cache")
+
+		ok, states := srv.health.run(srv.readyChecks())
+		code := http.StatusOK
+		status := "ok"
+		if !ok {
+			code = http.StatusServiceUnavailable
+			status = "unavailable"
+		}
+		c.JSON(code, gin.H{"status": status, "checks": states})
+	}
+}
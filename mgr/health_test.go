@@ -0,0 +1,55 @@
+package mgr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestHealthCheckerRun(t *testing.T) {
+	h := newHealthChecker()
+
+	fail := true
+	checks := []healthCheck{
+		{"ok", func() error { return nil }},
+		{"flaky", func() error {
+			if fail {
+				return errors.New("boom")
+			}
+			return nil
+		}},
+	}
+
+	ok, states := h.run(checks)
+	assert.Equal(t, ok, false)
+	assert.Equal(t, states["ok"].Ok, true)
+	assert.Equal(t, states["flaky"].Error, "boom")
+	assert.Equal(t, states["flaky"].LastError, "boom")
+
+	// 失败的结果同样缓存
+	fail = false
+	ok, _ = h.run(checks)
+	assert.Equal(t, ok, false)
+
+	// 缓存过期后重新检查, 并保留上次的错误
+	h.checkAt = time.Now().Add(-HEALTH_CACHE_TTL - time.Second)
+	ok, states = h.run(checks)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, states["flaky"].Error, "")
+	assert.Equal(t, states["flaky"].LastError, "boom")
+
+	// 成功时缓存结果
+	fail = true
+	ok, _ = h.run(checks)
+	assert.Equal(t, ok, true)
+}
+
+func TestWithTimeout(t *testing.T) {
+	e := withTimeout(func() error {
+		time.Sleep(time.Second)
+		return nil
+	}, 10*time.Millisecond)
+	assert.NotEqual(t, e, nil)
+}
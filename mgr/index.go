@@ -0,0 +1,478 @@
+package mgr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/i2534/ngamm/mgr/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	INDEX_FILE       = "index.db" // 位于帖子根目录下
+	INDEX_VERSION    = "2"        // 索引格式变化时修改, 旧的索引会被清空重建
+	INDEX_BATCH_SIZE = 100        // 对账时每个事务写入的帖子数量
+)
+
+var (
+	bucketTopics = []byte("topics")
+	bucketMeta   = []byte("meta")
+	keyVersion   = []byte("version")
+)
+
+// 帖子摘要, 启动时直接从索引加载, 不再解析每个帖子的文件
+type topicSummary struct {
+	Id       int
+	Uid      int
+	MaxPage  int
+	MaxFloor int
+	Title    string
+	Author   string
+	Create   CustomTime
+	ModAt    CustomTime
+	Result   DownResult
+	Metadata *Metadata
+	Unread   int
+	Storage  *StorageUsage
+	HasPan   bool
+	Pans     []TransferRecord `json:",omitempty"` // 网盘记录的名称, 链接和状态, 用于统计
+	Stamp    uint64           // 帖子文件的修改时间和大小的摘要, 用于和文件系统对账
+}
+
+// 帖子的元数据索引, 保存在 bbolt 中
+type topicIndex struct {
+	db     *bolt.DB
+	lock   sync.Mutex
+	topics []*Topic // 解析后的摘要, 写入时清空
+}
+
+func openTopicIndex(path string) (*topicIndex, error) {
+	db, e := bolt.Open(path, COMMON_FILE_MODE, &bolt.Options{Timeout: 3 * time.Second})
+	if e != nil {
+		return nil, fmt.Errorf("打开索引 %s 失败: %w", path, e)
+	}
+	e = db.Update(func(tx *bolt.Tx) error {
+		meta, e := tx.CreateBucketIfNotExists(bucketMeta)
+		if e != nil {
+			return e
+		}
+		if string(meta.Get(keyVersion)) != INDEX_VERSION {
+			if tx.Bucket(bucketTopics) != nil {
+				if e := tx.DeleteBucket(bucketTopics); e != nil {
+					return e
+				}
+			}
+			if e := meta.Put(keyVersion, []byte(INDEX_VERSION)); e != nil {
+				return e
+			}
+		}
+		_, e = tx.CreateBucketIfNotExists(bucketTopics)
+		return e
+	})
+	if e != nil {
+		db.Close()
+		return nil, fmt.Errorf("初始化索引失败: %w", e)
+	}
+	return &topicIndex{db: db}, nil
+}
+
+func indexKey(id int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+// 帖子文件的摘要, 任意一个文件变化都会改变
+func topicStamp(root *ExtRoot) uint64 {
+	h := fnv.New64a()
+	for _, name := range []string{POST_MARKDOWN, POST_MARKDOWN_1ST, PROCESS_INI, METADATA_JSON, PAN_JSON} {
+		if fi, e := root.Stat(name); e == nil {
+			h.Write([]byte(name))
+			h.Write(binary.BigEndian.AppendUint64(nil, uint64(fi.ModTime().UnixNano())))
+			h.Write(binary.BigEndian.AppendUint64(nil, uint64(fi.Size())))
+		}
+	}
+	return h.Sum64()
+}
+
+func (t *Topic) summary() *topicSummary {
+	s := &topicSummary{
+		Id:       t.Id,
+		Uid:      t.Uid,
+		MaxPage:  t.MaxPage,
+		MaxFloor: t.MaxFloor,
+		Title:    t.Title,
+		Author:   t.Author,
+		Create:   t.Create,
+		ModAt:    t.modAt,
+		Result:   t.Result,
+		Metadata: t.Metadata,
+		Unread:   t.Unread,
+		Storage:  t.Storage,
+		HasPan:   t.HasPan(),
+		Pans:     t.panSummary(),
+	}
+	if t.root != nil {
+		s.Stamp = topicStamp(t.root)
+	}
+	return s
+}
+
+// 网盘记录的名称, 链接和状态, 从索引中读取的帖子使用索引中的记录
+func (t *Topic) panSummary() []TransferRecord {
+	if t.root == nil {
+		return t.pans
+	}
+	records, e := readPanRecords(t.root)
+	if e != nil {
+		return nil
+	}
+	ret := make([]TransferRecord, 0, len(records))
+	for _, r := range records {
+		ret = append(ret, TransferRecord{Name: r.Name, URL: r.URL, Status: r.Status, Saved: r.Saved})
+	}
+	return ret
+}
+
+// 根据摘要创建帖子, root 为空时只能用于列表和查询
+func (s *topicSummary) topic(root *ExtRoot) *Topic {
+	t := NewTopic(root, s.Id)
+	t.Uid = s.Uid
+	t.MaxPage = s.MaxPage
+	t.MaxFloor = s.MaxFloor
+	t.Title = s.Title
+	t.Author = s.Author
+	t.Create = s.Create
+	t.modAt = s.ModAt
+	t.Result = s.Result
+	t.Metadata = s.Metadata
+	t.Unread = s.Unread
+	t.Storage = s.Storage
+	t.hasPan = s.HasPan
+	t.pans = s.Pans
+	return t
+}
+
+func (idx *topicIndex) Put(topics ...*Topic) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	values := make([][]byte, 0, len(topics))
+	for _, t := range topics {
+		s := t.summary()
+		md := t.Metadata
+		md.mutex.Lock()
+		data, e := json.Marshal(s)
+		md.mutex.Unlock()
+		if e != nil {
+			return e
+		}
+		values = append(values, data)
+	}
+	defer idx.invalidate()
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTopics)
+		for i, t := range topics {
+			if e := b.Put(indexKey(t.Id), values[i]); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (idx *topicIndex) Delete(ids ...int) error {
+	defer idx.invalidate()
+	return idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketTopics)
+		for _, id := range ids {
+			if e := b.Delete(indexKey(id)); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+func (idx *topicIndex) Get(id int) (*topicSummary, error) {
+	var s *topicSummary
+	e := idx.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketTopics).Get(indexKey(id))
+		if data == nil {
+			return nil
+		}
+		s = &topicSummary{Metadata: NewMetadata()}
+		return json.Unmarshal(data, s)
+	})
+	return s, e
+}
+
+// 按 ID 顺序遍历所有摘要, 解析失败的摘要会被跳过
+func (idx *topicIndex) Each(fx func(*topicSummary)) error {
+	return idx.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTopics).ForEach(func(k, v []byte) error {
+			s := &topicSummary{Metadata: NewMetadata()}
+			if e := json.Unmarshal(v, s); e != nil {
+				log.Printf("解析索引中的帖子 %d 失败: %s\n", binary.BigEndian.Uint64(k), e)
+				return nil
+			}
+			fx(s)
+			return nil
+		})
+	})
+}
+
+func (idx *topicIndex) invalidate() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.topics = nil
+}
+
+// 索引中的所有帖子, 只能用于列表和查询. 解析结果会被缓存, 返回的帖子不能修改
+func (idx *topicIndex) Topics() ([]*Topic, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if idx.topics == nil {
+		ret := make([]*Topic, 0)
+		e := idx.Each(func(s *topicSummary) {
+			ret = append(ret, s.topic(nil))
+		})
+		if e != nil {
+			return nil, e
+		}
+		idx.topics = ret
+	}
+	return slices.Clone(idx.topics), nil
+}
+
+func (idx *topicIndex) Close() error {
+	return idx.db.Close()
+}
+
+// 列表, 搜索和统计使用的帖子, 优先从索引读取
+func (srv *Server) indexedTopics() []*Topic {
+	if srv.index != nil {
+		topics, e := srv.index.Topics()
+		if e == nil {
+			return topics
+		}
+		log.Println("读取索引失败:", e)
+	}
+	return srv.cache.topics.Values()
+}
+
+// 帖子变化时同步更新索引, 在 publish 中调用
+func (srv *Server) indexEvent(typ string, id int) {
+	if srv.index == nil || id <= 0 {
+		return
+	}
+	var e error
+	switch typ {
+	case EVENT_TOPIC_DELETED:
+		e = srv.index.Delete(id)
+	case EVENT_TOPIC_ADDED, EVENT_TOPIC_METADATA, EVENT_TOPIC_ABANDONED, EVENT_DOWN_FINISHED, EVENT_PAN_TRANSFER:
+		if topic, has := srv.cache.topics.Get(id); has {
+			srv.indexTopic(topic)
+		}
+		return
+	}
+	if e != nil {
+		log.Printf("更新帖子 %d 的索引失败: %s\n", id, e)
+	}
+}
+
+func (srv *Server) indexTopic(topic *Topic) {
+	if srv == nil || srv.index == nil {
+		return
+	}
+	if e := srv.index.Put(topic); e != nil {
+		log.Printf("更新帖子 %d 的索引失败: %s\n", topic.Id, e)
+	}
+}
+
+// 将帖子放入缓存并添加定时任务, 替换已有的帖子时保留其定时任务和下载结果
+func (srv *Server) registerTopic(topic *Topic) {
+	cache := srv.cache
+	id := topic.Id
+	if old, has := cache.topics.Get(id); has && old != topic {
+		old.Stop()
+		topic.Metadata.updateCronId = old.Metadata.updateCronId
+		if topic.Result.Time.IsZero() {
+			topic.Result = old.Result
+		}
+	}
+	cache.topics.Put(id, topic)
+
+	if topic.Metadata.Abandon {
+		log.Group(groupTopic).Printf("帖子 %d 已放弃更新\n", id)
+		srv.cron.Remove(topic.Metadata.updateCronId)
+		topic.Metadata.updateCronId = 0
+		return
+	}
+
+	next := srv.addCron(topic)
+	// 在第一次更新时间段(必须超过30分钟)的一半内随机更新一次
+	if !next.IsZero() {
+		d := time.Until(next)
+		if d > time.Minute*30 {
+			d = time.Duration(rand.Int64N(int64(d) / 2))
+			log.Group(groupTopic).Printf("随机更新帖子 <%s> 在 %s 后\n", topic.Title, d)
+			timer := time.AfterFunc(d, func() {
+				log.Group(groupTopic).Println("随机更新帖子", topic.Title)
+				cache.enqueue(id)
+				topic.timers.Delete(d)
+			})
+			topic.timers.Put(d, timer)
+		}
+	}
+}
+
+// 从索引加载帖子, 返回加载的数量
+func (srv *Server) loadIndex() int {
+	cache := srv.cache
+	count := 0
+	e := srv.index.Each(func(s *topicSummary) {
+		name := strconv.Itoa(s.Id)
+		if !cache.topicRoot.IsExist(name) {
+			return // 对账时删除
+		}
+		root, e := cache.topicRoot.SafeOpenRoot(name)
+		if e != nil {
+			log.Println("打开帖子目录失败:", e)
+			return
+		}
+		topic := s.topic(root)
+		srv.nga.SetTopicUser(topic.Uid, topic.Author)
+		srv.registerTopic(topic)
+		count++
+	})
+	if e != nil {
+		log.Println("读取索引失败:", e)
+	}
+	return count
+}
+
+// 与文件系统对账: 加载新的和有变化的帖子, 删除已经不存在的帖子
+func (srv *Server) reconcile() {
+	if !srv.reconciling.CompareAndSwap(false, true) {
+		return
+	}
+	defer srv.reconciling.Store(false)
+
+	cache := srv.cache
+	files, e := cache.topicRoot.ReadDir()
+	if e != nil {
+		log.Println("读取帖子根目录失败:", e)
+		return
+	}
+
+	stamps := make(map[int]uint64)
+	if srv.index != nil {
+		srv.index.Each(func(s *topicSummary) {
+			stamps[s.Id] = s.Stamp
+		})
+	}
+
+	start := time.Now()
+	exists := make(map[int]bool)
+	batch := make([]*Topic, 0, INDEX_BATCH_SIZE)
+	flush := func() {
+		if srv.index != nil && len(batch) > 0 {
+			if e := srv.index.Put(batch...); e != nil {
+				log.Println("写入索引失败:", e)
+			}
+		}
+		batch = batch[:0]
+	}
+	loaded := 0
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		name := file.Name()
+		id, e := strconv.Atoi(name)
+		if e != nil {
+			log.Println("不是帖子目录:", name)
+			continue
+		}
+		exists[id] = true
+		// 排队和正在下载的帖子由下载完成后更新, 避免读到写了一半的文件
+		if cache.pending.has(id) {
+			continue
+		}
+
+		if stamp, has := stamps[id]; has && cache.topics.Has(id) {
+			root, e := cache.topicRoot.OpenRoot(name)
+			if e != nil {
+				continue
+			}
+			same := topicStamp(&ExtRoot{Root: root}) == stamp
+			root.Close()
+			if same {
+				continue
+			}
+		}
+
+		topic, e := LoadTopic(cache.topicRoot, id, srv.nga)
+		if e != nil {
+			log.Println("加载帖子失败:", e)
+			continue
+		}
+		if cache.pending.has(id) {
+			continue
+		}
+		old, _ := cache.topics.Get(id)
+		srv.updateStorage(topic, old)
+		srv.registerTopic(topic)
+		loaded++
+
+		batch = append(batch, topic)
+		if len(batch) >= INDEX_BATCH_SIZE {
+			flush()
+		}
+	}
+	flush()
+
+	// 目录已经不存在的帖子, 再次检查目录, 避免删除对账期间新添加的帖子
+	missing := make(map[int]bool)
+	for id := range stamps {
+		missing[id] = !exists[id]
+	}
+	cache.topics.Each(func(id int, _ *Topic) {
+		missing[id] = !exists[id]
+	})
+	removed := make([]int, 0)
+	for id, miss := range missing {
+		if miss && !cache.topicRoot.IsExist(strconv.Itoa(id)) {
+			removed = append(removed, id)
+		}
+	}
+	for _, id := range removed {
+		if topic, has := cache.topics.Get(id); has {
+			cache.topics.Delete(id)
+			floorAuthorCache.Delete(id)
+			srv.cron.Remove(topic.Metadata.updateCronId)
+			topic.Close()
+		}
+	}
+	if srv.index != nil && len(removed) > 0 {
+		if e := srv.index.Delete(removed...); e != nil {
+			log.Println("删除索引失败:", e)
+		}
+	}
+	log.Printf("对账完成, 加载 %d 个帖子, 删除 %d 个, 耗时 %s\n", loaded, len(removed), time.Since(start).Truncate(time.Millisecond))
+}
+
+func indexPath(root *ExtRoot) (string, error) {
+	dir, e := root.AbsPath()
+	if e != nil {
+		return "", e
+	}
+	return filepath.Join(dir, INDEX_FILE), nil
+}
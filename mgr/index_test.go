@@ -0,0 +1,119 @@
+package mgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/robfig/cron/v3"
+)
+
+func TestTopicIndex(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	writeTopic := func(id, title string) {
+		assert.Equal(t, os.MkdirAll(filepath.Join(dir, id), COMMON_DIR_MODE), nil)
+		os.WriteFile(filepath.Join(dir, id, POST_MARKDOWN), []byte("# "+title+"\n"), COMMON_FILE_MODE)
+		os.WriteFile(filepath.Join(dir, id, PROCESS_INI), []byte("[local]\nmax_page = 1\nmax_floor = 5\n"), COMMON_FILE_MODE)
+	}
+	writeTopic("1", "第一")
+	writeTopic("2", "第二")
+
+	path, e := indexPath(root)
+	assert.Equal(t, e, nil)
+	idx, e := openTopicIndex(path)
+	assert.Equal(t, e, nil)
+
+	newServer := func() *Server {
+		return &Server{
+			cache: &cache{
+				topicRoot: root,
+				topics:    NewSyncMap[int, *Topic](),
+				queue:     make(chan int, 10),
+			},
+			cron:  cron.New(),
+			index: idx,
+		}
+	}
+
+	// 第一次启动时索引为空, 对账后写入索引
+	srv := newServer()
+	srv.loadTopics()
+	assert.Equal(t, srv.cache.topics.Size(), 2)
+	topics, e := idx.Topics()
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(topics), 2)
+	assert.Equal(t, topics[0].Title, "第一")
+	assert.Equal(t, topics[1].MaxFloor, 5)
+
+	// 下载结果和元数据变更通过事件写入索引
+	topic, _ := srv.cache.topics.Get(1)
+	topic.Result = DownResult{Success: true, Time: Now()}
+	topic.Metadata.SetTags([]string{"攻略"})
+	assert.Equal(t, topic.SaveMeta(), nil)
+	srv.publish(EVENT_TOPIC_METADATA, 1, nil)
+	s, e := idx.Get(1)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, s.Result.Success, true)
+	assert.Equal(t, s.Metadata.Tags, []string{"攻略"})
+
+	// 重新启动时从索引加载, 并对账文件系统的变化
+	assert.Equal(t, idx.Close(), nil)
+	idx, e = openTopicIndex(path)
+	assert.Equal(t, e, nil)
+	defer idx.Close()
+
+	os.RemoveAll(filepath.Join(dir, "2"))
+	writeTopic("3", "第三")
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(filepath.Join(dir, "1", PROCESS_INI), []byte("[local]\nmax_page = 1\nmax_floor = 9\n"), COMMON_FILE_MODE)
+	os.Chtimes(filepath.Join(dir, "1", PROCESS_INI), later, later)
+
+	srv = newServer()
+	assert.Equal(t, srv.loadIndex(), 1)
+	topic, _ = srv.cache.topics.Get(1)
+	assert.Equal(t, topic.MaxFloor, 5)
+	assert.Equal(t, topic.Result.Success, true)
+
+	srv.reconcile()
+	assert.Equal(t, srv.cache.topics.Has(2), false)
+	assert.Equal(t, srv.cache.topics.Has(3), true)
+	topic, _ = srv.cache.topics.Get(1)
+	assert.Equal(t, topic.MaxFloor, 9)
+	// 重新加载后保留下载结果和元数据
+	assert.Equal(t, topic.Result.Success, true)
+	assert.Equal(t, topic.Metadata.Tags, []string{"攻略"})
+
+	topics, _ = idx.Topics()
+	ids := make([]int, 0)
+	for _, topic := range topics {
+		ids = append(ids, topic.Id)
+	}
+	assert.Equal(t, ids, []int{1, 3})
+
+	// 没有写入时使用缓存的摘要
+	again, _ := idx.Topics()
+	assert.Equal(t, again[0] == topics[0], true)
+
+	// 排队和正在下载的帖子不参与对账
+	srv.cache.pending = newPendingSet()
+	srv.cache.pending.add(3)
+	third, _ := srv.cache.topics.Get(3)
+	os.WriteFile(filepath.Join(dir, "3", POST_MARKDOWN), []byte("# 写了一半"), COMMON_FILE_MODE)
+	os.Chtimes(filepath.Join(dir, "3", POST_MARKDOWN), later, later)
+	srv.reconcile()
+	topic, _ = srv.cache.topics.Get(3)
+	assert.Equal(t, topic == third, true)
+	assert.Equal(t, topic.Title, "第三")
+
+	srv.publish(EVENT_TOPIC_DELETED, 3, nil)
+	s, _ = idx.Get(3)
+	assert.Equal(t, s == nil, true)
+	topics, _ = idx.Topics()
+	assert.Equal(t, len(topics), 1)
+}
@@ -0,0 +1,196 @@
+package mgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	regexLanzouShare  = regexp.MustCompile(`lanzou[a-z]*\.com/(?:[\w-]+/)*([\w-]+)`)
+	regexLanzouIframe = regexp.MustCompile(`<iframe[^>]+src="(/fn\?[^"]+)"`)
+	regexLanzouAjax   = regexp.MustCompile(`(/ajaxm\.php\?file=\d+)`)
+	regexLanzouSign   = regexp.MustCompile(`[?&']sign=([\w-]+)`)
+)
+
+// 蓝奏云的下载信息
+type LanzouFile struct {
+	Name string // 文件名, 可能为空
+	URL  string // 下载地址
+}
+
+// 蓝奏云没有转存, 只解析分享页面得到下载地址
+type Lanzou struct {
+	UserAgent string
+	client    *http.Client
+}
+
+func NewLanzou() *Lanzou {
+	jar, _ := cookiejar.New(nil)
+	return &Lanzou{
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+		client:    &http.Client{Jar: jar, Timeout: 30 * time.Second},
+	}
+}
+
+// 解析分享链接, 返回分享 ID
+func ParseLanzouShare(url string) (string, error) {
+	m := regexLanzouShare.FindStringSubmatch(url)
+	if m == nil {
+		return "", fmt.Errorf("不是蓝奏云的分享链接: %s", url)
+	}
+	return m[1], nil
+}
+
+// 页面中 js 对象的值, 'key':'value' 或 'key':变量, 变量由 var 变量 = 'value' 定义
+func lanzouValue(page, key string) string {
+	m := regexp.MustCompile(`'` + regexp.QuoteMeta(key) + `'\s*:\s*(?:'([^']*)'|([A-Za-z_]\w*))`).FindStringSubmatch(page)
+	if m == nil {
+		return ""
+	}
+	if m[2] == "" {
+		return m[1]
+	}
+	v := regexp.MustCompile(`var\s+` + m[2] + `\s*=\s*'([^']*)'`).FindStringSubmatch(page)
+	if v == nil {
+		return ""
+	}
+	return v[1]
+}
+
+func (l *Lanzou) request(method, api, referer string, form url.Values) (*http.Response, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, e := http.NewRequest(method, api, body)
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("User-Agent", l.UserAgent)
+	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
+	if referer != "" {
+		req.Header.Set("Referer", referer)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return l.client.Do(req)
+}
+
+func (l *Lanzou) page(api, referer string) (string, *url.URL, error) {
+	resp, e := l.request(http.MethodGet, api, referer, nil)
+	if e != nil {
+		return "", nil, e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("打开页面 %s 失败, 状态码: %d", api, resp.StatusCode)
+	}
+	data, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return "", nil, e
+	}
+	return string(data), resp.Request.URL, nil
+}
+
+// 解析分享链接得到下载地址, pwd 为提取码
+func (l *Lanzou) Resolve(share, pwd string) (*LanzouFile, error) {
+	page, base, e := l.page(share, "")
+	if e != nil {
+		return nil, e
+	}
+	if strings.Contains(page, "文件取消分享了") || strings.Contains(page, "来晚啦") {
+		return nil, fmt.Errorf("分享已失效")
+	}
+
+	referer := base.String()
+	form := url.Values{"action": {"downprocess"}}
+	if strings.Contains(page, `id="pwd"`) { // 需要提取码, 提交表单在分享页面中
+		if pwd == "" {
+			return nil, fmt.Errorf("需要提取码")
+		}
+		sign := lanzouValue(page, "sign")
+		if m := regexLanzouSign.FindStringSubmatch(page); sign == "" && m != nil {
+			sign = m[1]
+		}
+		form.Set("sign", sign)
+		form.Set("p", pwd)
+		form.Set("kd", "1")
+	} else { // 下载按钮在 iframe 中
+		m := regexLanzouIframe.FindStringSubmatch(page)
+		if m == nil {
+			return nil, fmt.Errorf("没有找到下载页面")
+		}
+		fn := base.ResolveReference(&url.URL{Path: "/fn", RawQuery: strings.TrimPrefix(m[1], "/fn?")})
+		page, _, e = l.page(fn.String(), referer)
+		if e != nil {
+			return nil, e
+		}
+		referer = fn.String()
+		form.Set("signs", lanzouValue(page, "signs"))
+		form.Set("sign", lanzouValue(page, "sign"))
+		form.Set("websign", lanzouValue(page, "websign"))
+		form.Set("websignkey", lanzouValue(page, "websignkey"))
+		form.Set("ves", "1")
+	}
+	if form.Get("sign") == "" {
+		return nil, fmt.Errorf("没有找到下载签名")
+	}
+	m := regexLanzouAjax.FindStringSubmatch(page)
+	if m == nil {
+		return nil, fmt.Errorf("没有找到下载接口")
+	}
+	ajax := base.ResolveReference(&url.URL{Path: "/ajaxm.php", RawQuery: strings.TrimPrefix(m[1], "/ajaxm.php?")})
+
+	resp, e := l.request(http.MethodPost, ajax.String(), referer, form)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+	ret := struct {
+		Zt  int    `json:"zt"`
+		Dom string `json:"dom"`
+		URL string `json:"url"`
+		Inf any    `json:"inf"` // 成功时为文件名, 失败时为错误信息, 有时为数字
+	}{}
+	if e := json.NewDecoder(resp.Body).Decode(&ret); e != nil {
+		return nil, fmt.Errorf("解析下载接口返回失败: %s", e.Error())
+	}
+	if ret.Zt != 1 {
+		return nil, fmt.Errorf("获取下载地址失败: %v", ret.Inf)
+	}
+	name, _ := ret.Inf.(string)
+	return &LanzouFile{
+		Name: name,
+		URL:  strings.TrimSuffix(ret.Dom, "/") + "/file/" + ret.URL,
+	}, nil
+}
+
+// 下载文件, 返回响应中的文件名
+func (l *Lanzou) Download(file *LanzouFile, w io.Writer) (string, int64, error) {
+	resp, e := l.request(http.MethodGet, file.URL, file.URL, nil)
+	if e != nil {
+		return "", 0, e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("下载失败, 状态码: %d", resp.StatusCode)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return "", 0, fmt.Errorf("下载失败, 返回了网页")
+	}
+	name := ""
+	if _, params, e := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); e == nil {
+		name = params["filename"]
+	}
+	n, e := io.Copy(w, resp.Body)
+	return name, n, e
+}
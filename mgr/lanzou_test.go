@@ -0,0 +1,153 @@
+package mgr
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// 蓝奏云分享页面的本地模拟
+func lanzouStub() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/iopen", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><div class="n_box_3fn">a.zip</div><iframe class="ifr2" name="1" src="/fn?ABC_1" frameborder="0" scrolling="no"></iframe></html>`)
+	})
+	mux.HandleFunc("/fn", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<script>
+var ajaxdata = '?ctdf';
+var wp_sign = 'SIGN_OPEN';
+$.ajax({
+	type : 'post',
+	url : '/ajaxm.php?file=101',
+	data : { 'action':'downprocess','signs':ajaxdata,'sign':wp_sign,'websign':'','websignkey':'KEY','ves':1 },
+});
+</script>`)
+	})
+	mux.HandleFunc("/ipwd", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<input type="text" name="pwd" id="pwd"><script>
+function down_p(){
+	var pwd = document.getElementById('pwd').value;
+	$.ajax({
+		type : 'post',
+		url : '/ajaxm.php?file=102',
+		data : 'action=downprocess&sign=SIGN_PWD&p='+pwd+'&kd=1',
+	});
+}
+</script>`)
+	})
+	var ts *httptest.Server
+	mux.HandleFunc("/ajaxm.php", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		file, sign := r.URL.Query().Get("file"), r.PostForm.Get("sign")
+		switch {
+		case file == "101" && sign == "SIGN_OPEN" && r.PostForm.Get("signs") == "?ctdf" && r.PostForm.Get("websignkey") == "KEY":
+			fmt.Fprintf(w, `{"zt":1,"dom":"%s","url":"?open","inf":0}`, ts.URL)
+		case file == "102" && sign == "SIGN_PWD" && r.PostForm.Get("p") == "abcd":
+			fmt.Fprintf(w, `{"zt":1,"dom":"%s","url":"?pwd","inf":"b.zip"}`, ts.URL)
+		default:
+			fmt.Fprint(w, `{"zt":0,"inf":"密码不正确"}`)
+		}
+	})
+	mux.HandleFunc("/file/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery == "open" {
+			w.Header().Set("Content-Disposition", `attachment; filename="a.zip"`)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprint(w, r.URL.RawQuery)
+	})
+	ts = httptest.NewServer(mux)
+	return ts
+}
+
+// 把请求都转发到本地模拟
+type lanzouTransport struct {
+	target *url.URL
+}
+
+func (t lanzouTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestLanzouPan(t *testing.T) {
+	id, e := ParseLanzouShare("https://wwi.lanzoui.com/b/iAbc123")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, id, "iAbc123")
+	assert.Equal(t, extractText("[下载](https://wwi.lanzoui.com/iAbc123) 密码:abcd")[0].URL, "https://wwi.lanzoui.com/iAbc123")
+	assert.Equal(t, lanzouFileName("../../x.zip", "def"), "x.zip")
+	assert.Equal(t, lanzouFileName(".hidden", "def"), "def")
+
+	ts := lanzouStub()
+	defer ts.Close()
+
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+	tr, e := root.SafeOpenRoot("100")
+	assert.Equal(t, e, nil)
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	topic := NewTopic(tr, 100)
+	srv.cache.topics.Put(100, topic)
+	records := []*TransferRecord{
+		{URL: "https://wwi.lanzoui.com/iopen"},
+		{URL: "https://wwi.lanzoui.com/ipwd"},
+	}
+	assert.Equal(t, topic.savePanRecords(records), nil)
+	// 附件目录中的其他文件不受影响
+	assert.Equal(t, tr.MkdirAll(LANZOU_DIR, COMMON_DIR_MODE), nil)
+	assert.Equal(t, tr.WriteAll(filepath.Join(LANZOU_DIR, "other.txt"), []byte("x")), nil)
+
+	lp := NewLanzouPan(LanzouCfg{Name: "lanzou"})
+	lp.lanzou = NewLanzou()
+	target, _ := url.Parse(ts.URL)
+	lp.lanzou.client.Transport = lanzouTransport{target}
+	lp.SetHolder(&PanHolder{srv: srv, msgCh: make(chan string, 9)})
+	assert.Equal(t, lp.Init(), nil)
+	defer lp.Close()
+	assert.Equal(t, lp.IsExist(100), false)
+
+	assert.Equal(t, lp.doTransfer(lanzouTask{100, TransferRecord{URL: "https://wwi.lanzoui.com/iopen"}, PAN_OPT_SAVE}), nil)
+	data, e := tr.ReadAll(filepath.Join(LANZOU_DIR, "a.zip"))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, string(data), "open")
+
+	e = lp.doTransfer(lanzouTask{100, TransferRecord{URL: "https://wwi.lanzoui.com/ipwd"}, PAN_OPT_SAVE})
+	assert.Equal(t, e.Error(), "LanzouPan: 解析分享链接失败, 需要提取码")
+	e = lp.doTransfer(lanzouTask{100, TransferRecord{URL: "https://wwi.lanzoui.com/ipwd", Tqm: "0000"}, PAN_OPT_SAVE})
+	assert.Equal(t, e.Error(), "LanzouPan: 解析分享链接失败, 获取下载地址失败: 密码不正确")
+	assert.Equal(t, lp.doTransfer(lanzouTask{100, TransferRecord{URL: "https://wwi.lanzoui.com/ipwd", Tqm: "abcd"}, PAN_OPT_SAVE}), nil)
+	data, e = tr.ReadAll(filepath.Join(LANZOU_DIR, "b.zip"))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, string(data), "pwd")
+	assert.Equal(t, tr.IsExist(LANZOU_DIR, LANZOU_DOWNLOAD), false)
+
+	records, e = topic.loadPanRecords()
+	assert.Equal(t, e, nil)
+	assert.Equal(t, records[0].File, "a.zip")
+	assert.Equal(t, records[1].File, "b.zip")
+
+	assert.Equal(t, lp.IsExist(100), true)
+	assert.NotEqual(t, lp.Move(100), nil)
+	// 删除任务只删除对应记录的文件
+	assert.Equal(t, lp.deleteTask(lanzouTask{100, *records[0], PAN_OPT_DELETE}), nil)
+	assert.Equal(t, tr.IsExist(LANZOU_DIR, "a.zip"), false)
+	assert.Equal(t, tr.IsExist(LANZOU_DIR, "b.zip"), true)
+	assert.Equal(t, lp.Delete(100), nil)
+	assert.Equal(t, lp.IsExist(100), false)
+	assert.Equal(t, tr.IsExist(LANZOU_DIR, "other.txt"), true)
+	assert.NotEqual(t, lp.Delete(100), nil)
+
+	// 超过配额时不再下载
+	srv.quota = storageQuota{topic: 1}
+	topic.Storage = &StorageUsage{Total: 10}
+	e = lp.doTransfer(lanzouTask{100, TransferRecord{URL: "https://wwi.lanzoui.com/iopen"}, PAN_OPT_SAVE})
+	assert.Equal(t, e.Error(), "LanzouPan: 帖子 100 超过存储配额, 不再下载文件")
+	assert.Equal(t, tr.IsExist(LANZOU_DIR, "a.zip"), false)
+}
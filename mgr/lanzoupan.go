@@ -0,0 +1,340 @@
+package mgr
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/i2534/ngamm/mgr/log"
+
+	"gopkg.in/ini.v1"
+)
+
+var (
+	LANZOU_DIR      = ATTACH_DIR + "/lanzou" // 下载的文件保存在帖子的此目录下
+	LANZOU_DOWNLOAD = ".download"            // 下载中的临时文件
+)
+
+var lanzouDriver = RegisterPanDriver(PanDriver{
+	Name:     "lanzou",
+	Patterns: []*regexp.Regexp{regexLanzouShare},
+	New: func(name, root string, sec *ini.Section) (Pan, error) {
+		lc := new(LanzouCfg)
+		if e := sec.MapTo(lc); e != nil {
+			return nil, e
+		}
+		if lc.Transfer == "" {
+			lc.Transfer = TRANSFER_TYPE_AUTO
+		}
+		lc.Name, lc.Root = name, root
+		return NewLanzouPan(*lc), nil
+	},
+})
+
+type lanzouTask struct {
+	topicId int
+	record  TransferRecord
+	opt     PanOpt
+}
+
+type LanzouCfg struct {
+	Name     string // 网盘实例名称, 即配置段名称
+	Root     string // 工作目录
+	Enable   bool   `ini:"enable"`   // 是否启用
+	Transfer string `ini:"transfer"` // 转存方式: auto, manual
+}
+
+// 蓝奏云不能转存, 下载文件到帖子的附件目录中
+type LanzouPan struct {
+	cfg    LanzouCfg
+	lanzou *Lanzou
+	mutex  *sync.Mutex
+	tasks  chan lanzouTask
+	holder *PanHolder
+}
+
+func NewLanzouPan(cfg LanzouCfg) *LanzouPan {
+	return &LanzouPan{
+		cfg:   cfg,
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (l *LanzouPan) Name() string {
+	if l.cfg.Name == "" {
+		return lanzouDriver.Name
+	}
+	return l.cfg.Name
+}
+
+func (l *LanzouPan) SetHolder(holder *PanHolder) {
+	l.holder = holder
+}
+
+func (l *LanzouPan) Support(record TransferRecord) bool {
+	return lanzouDriver.Match(record.URL)
+}
+
+func (l *LanzouPan) TransferType() string {
+	return l.cfg.Transfer
+}
+
+func (l *LanzouPan) Init() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.lanzou == nil {
+		l.lanzou = NewLanzou()
+	}
+	if l.tasks == nil {
+		l.tasks = make(chan lanzouTask, 99)
+		tasks := l.tasks
+		go func() {
+			log.Println("LanzouPan: 启动任务处理协程")
+			for task := range tasks {
+				var e error
+				var status string
+				switch task.opt {
+				case PAN_OPT_DELETE:
+					e = l.deleteTask(task)
+					status = TRANSFER_STATUS_PENDING
+				case PAN_OPT_SAVE:
+					e = l.doTransfer(task)
+					status = TRANSFER_STATUS_SUCCESS
+				}
+				if l.holder != nil {
+					if e != nil {
+						l.holder.notify(task.topicId, task.record.URL, TRANSFER_STATUS_FAILED, e.Error())
+					} else {
+						l.holder.notify(task.topicId, task.record.URL, status, "")
+					}
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// 没有登录状态
+func (l *LanzouPan) Check() error {
+	return nil
+}
+
+func (l *LanzouPan) topic(topicId int) (*Topic, error) {
+	if l.holder == nil || l.holder.srv == nil {
+		return nil, fmt.Errorf("LanzouPan: 未初始化")
+	}
+	topic, has := l.holder.srv.cache.topics.Get(topicId)
+	if !has {
+		return nil, fmt.Errorf("LanzouPan: 未找到帖子 %d", topicId)
+	}
+	return topic, nil
+}
+
+// 文件名只保留最后一部分, 避免写到附件目录之外
+func lanzouFileName(name, def string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "" || name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		return def
+	}
+	return name
+}
+
+// 网盘记录中的文件在帖子目录中的路径, 文件名无效时为空
+func lanzouFilePath(fname string) string {
+	if fname = lanzouFileName(fname, ""); fname == "" {
+		return ""
+	}
+	return filepath.Join(LANZOU_DIR, fname)
+}
+
+func (l *LanzouPan) doTransfer(task lanzouTask) error {
+	url := task.record.URL
+	log.Group(groupPan).Printf("LanzouPan: 处理下载任务: %d, %s\n", task.topicId, url)
+
+	shareId, e := ParseLanzouShare(url)
+	if e != nil {
+		return fmt.Errorf("LanzouPan: %s", e.Error())
+	}
+	topic, e := l.topic(task.topicId)
+	if e != nil {
+		return e
+	}
+	if l.holder.srv.checkQuota(topic) {
+		return fmt.Errorf("LanzouPan: 帖子 %d 超过存储配额, 不再下载文件", task.topicId)
+	}
+	file, e := l.lanzou.Resolve(url, task.record.Tqm)
+	if e != nil {
+		return fmt.Errorf("LanzouPan: 解析分享链接失败, %s", e.Error())
+	}
+	if file.Name != "" {
+		fname := lanzouFileName(file.Name, shareId)
+		if name := filepath.Join(LANZOU_DIR, fname); topic.root.IsExist(name) {
+			log.Group(groupPan).Printf("LanzouPan: 文件 %s 已存在, 跳过", name)
+			return l.saveFile(topic, url, fname)
+		}
+	}
+
+	if e := topic.root.MkdirAll(LANZOU_DIR, COMMON_DIR_MODE); e != nil {
+		return fmt.Errorf("LanzouPan: 创建目录失败, %s", e.Error())
+	}
+	tmp := filepath.Join(LANZOU_DIR, LANZOU_DOWNLOAD)
+	w, e := topic.root.OpenWriter(tmp)
+	if e != nil {
+		return fmt.Errorf("LanzouPan: 创建文件失败, %s", e.Error())
+	}
+	fname, size, e := l.lanzou.Download(file, w)
+	w.Close()
+	if e != nil {
+		topic.root.Remove(tmp)
+		return fmt.Errorf("LanzouPan: 下载文件失败, %s", e.Error())
+	}
+	if fname == "" {
+		fname = file.Name
+	}
+	fname = lanzouFileName(fname, shareId)
+	name := filepath.Join(LANZOU_DIR, fname)
+	if e := topic.root.Rename(tmp, name); e != nil {
+		topic.root.Remove(tmp)
+		return fmt.Errorf("LanzouPan: 保存文件失败, %s", e.Error())
+	}
+	if l.holder.srv.addStorage(topic, name, size) {
+		log.Printf("LanzouPan: 帖子 %d 的占用超过配额\n", task.topicId)
+	}
+	if e := l.saveFile(topic, url, fname); e != nil {
+		return e
+	}
+
+	log.Group(groupPan).Printf("LanzouPan: 处理下载任务完成: %d, %s, %s\n", task.topicId, url, name)
+	return nil
+}
+
+func (l *LanzouPan) Transfer(topicId int, record TransferRecord) error {
+	l.tasks <- lanzouTask{
+		topicId,
+		record,
+		PAN_OPT_SAVE,
+	}
+	return nil
+}
+
+func (l *LanzouPan) TransferOpt(topicId int, record *TransferRecord, opt PanOpt) error {
+	l.tasks <- lanzouTask{
+		topicId,
+		*record,
+		opt,
+	}
+	return nil
+}
+
+// 在网盘记录中保存下载的文件名, 删除时只删除记录中的文件
+func (l *LanzouPan) saveFile(topic *Topic, url, fname string) error {
+	topic.Metadata.mutex.Lock()
+	defer topic.Metadata.mutex.Unlock()
+
+	records, e := topic.loadPanRecords()
+	if e != nil {
+		return fmt.Errorf("LanzouPan: %s", e.Error())
+	}
+	for _, r := range records {
+		if r.URL == url {
+			r.File = fname
+			if e := topic.savePanRecords(records); e != nil {
+				return fmt.Errorf("LanzouPan: %s", e.Error())
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("LanzouPan: 未找到链接 %s 的网盘记录", url)
+}
+
+// 网盘记录中由蓝奏云下载的文件, 调用方持有元数据锁
+func (l *LanzouPan) files(topic *Topic) []string {
+	records, e := topic.loadPanRecords()
+	if e != nil {
+		return nil
+	}
+	ret := make([]string, 0)
+	for _, r := range records {
+		if name := lanzouFilePath(r.File); name != "" && l.Support(*r) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func (l *LanzouPan) IsExist(topicId int) bool {
+	topic, e := l.topic(topicId)
+	if e != nil {
+		return false
+	}
+	for _, name := range l.files(topic) {
+		if topic.root.IsExist(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 文件保存在本地, 不支持移动
+func (l *LanzouPan) Move(topicId int) error {
+	return fmt.Errorf("LanzouPan: 不支持移动")
+}
+
+// 删除网盘记录中的所有文件, 附件目录中的其他文件不受影响. 调用方持有元数据锁
+func (l *LanzouPan) Delete(topicId int) error {
+	topic, e := l.topic(topicId)
+	if e != nil {
+		return e
+	}
+	return l.deleteFiles(topic, l.files(topic))
+}
+
+// 删除任务只删除对应记录的文件
+func (l *LanzouPan) deleteTask(task lanzouTask) error {
+	topic, e := l.topic(task.topicId)
+	if e != nil {
+		return e
+	}
+	names := make([]string, 0, 1)
+	if name := lanzouFilePath(task.record.File); name != "" {
+		names = append(names, name)
+	}
+	return l.deleteFiles(topic, names)
+}
+
+func (l *LanzouPan) deleteFiles(topic *Topic, names []string) error {
+	found := false
+	for _, name := range names {
+		fi, e := topic.root.Stat(name)
+		if os.IsNotExist(e) {
+			continue
+		}
+		found = true
+		if e := topic.root.Remove(name); e != nil {
+			return fmt.Errorf("LanzouPan: 删除文件失败, %s", e.Error())
+		}
+		if fi != nil {
+			l.holder.srv.removeStorage(topic, name, fi.Size())
+		}
+	}
+	if !found {
+		return fmt.Errorf("LanzouPan: 帖子 %d 没有下载的文件", topic.Id)
+	}
+	return nil
+}
+
+func (l *LanzouPan) queueLen() int {
+	return len(l.tasks)
+}
+
+func (l *LanzouPan) Close() error {
+	if l.tasks != nil {
+		close(l.tasks)
+		l.tasks = nil
+	}
+	return nil
+}
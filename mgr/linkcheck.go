@@ -0,0 +1,198 @@
+package mgr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/i2534/ngamm/mgr/log"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/ini.v1"
+)
+
+const LINKCHECK_SECTION = "linkcheck" // 网盘配置文件中的链接检查配置段
+
+var ErrShareExpired = errors.New("分享已失效")
+
+// 可以检查分享链接是否有效的网盘
+type ShareChecker interface {
+	// 链接失效时返回包装了 ErrShareExpired 的错误, 其它错误表示检查失败
+	CheckShare(record TransferRecord) error
+}
+
+// 分享链接的检查结果
+type LinkHealth struct {
+	Alive   bool       // 链接是否有效
+	Message string     // 失效原因
+	Time    CustomTime // 检查时间
+}
+
+// 分享链接的检查选项
+type LinkCheckOptions struct {
+	Interval time.Duration `ini:"interval"` // 检查间隔, 0 为不检查
+	Delay    time.Duration `ini:"delay"`    // 两次检查之间的间隔, 避免请求过快
+}
+
+func DefaultLinkCheckOptions() LinkCheckOptions {
+	return LinkCheckOptions{Interval: 24 * time.Hour, Delay: 3 * time.Second}
+}
+
+func newLinkCheckOptions(cfg *ini.File) LinkCheckOptions {
+	opts := DefaultLinkCheckOptions()
+	if cfg != nil && cfg.HasSection(LINKCHECK_SECTION) {
+		cfg.Section(LINKCHECK_SECTION).MapTo(&opts)
+	}
+	return opts
+}
+
+var shareExpiredWords = []string{"失效", "取消", "不存在", "违规", "过期", "删除"}
+
+// 根据网盘返回的信息判断链接是否失效
+func shareError(msg string) error {
+	for _, w := range shareExpiredWords {
+		if strings.Contains(msg, w) {
+			return fmt.Errorf("%w: %s", ErrShareExpired, msg)
+		}
+	}
+	return errors.New(msg)
+}
+
+// 检查记录的网盘, 优先使用记录中保存的网盘
+func (p *PanHolder) checkerFor(record TransferRecord) ShareChecker {
+	var first ShareChecker
+	for _, pan := range p.Pans {
+		checker, ok := pan.(ShareChecker)
+		if !ok || !pan.Support(record) {
+			continue
+		}
+		if pan.Name() == record.Name {
+			return checker
+		}
+		if first == nil {
+			first = checker
+		}
+	}
+	return first
+}
+
+// 检查所有帖子中的分享链接, 失效的未转存链接标记为 expired
+func (p *PanHolder) checkLinks() {
+	if p.srv == nil {
+		return
+	}
+	log.Group(groupPan).Println("开始检查分享链接")
+	for _, topic := range p.srv.cache.topics.Values() {
+		p.checkTopicLinks(topic)
+	}
+	log.Group(groupPan).Println("分享链接检查完成")
+}
+
+func (p *PanHolder) checkTopicLinks(topic *Topic) {
+	if !topic.root.IsExist(PAN_JSON) {
+		return
+	}
+	// 检查需要请求网盘, 不在锁内进行
+	topic.Metadata.mutex.Lock()
+	records, e := topic.loadPanRecords()
+	checks := make([]TransferRecord, 0, len(records))
+	if e == nil {
+		for _, r := range records {
+			if r.Status != TRANSFER_STATUS_EXPIRED {
+				checks = append(checks, *r)
+			}
+		}
+	}
+	topic.Metadata.mutex.Unlock()
+	if e != nil {
+		log.Printf("读取帖子 %d 的网盘记录失败: %s\n", topic.Id, e.Error())
+		return
+	}
+
+	results := make(map[string]*LinkHealth)
+	for _, r := range checks {
+		checker := p.checkerFor(r)
+		if checker == nil {
+			continue
+		}
+		e := checker.CheckShare(r)
+		if e == nil {
+			results[r.URL] = &LinkHealth{Alive: true, Time: Now()}
+		} else if errors.Is(e, ErrShareExpired) {
+			results[r.URL] = &LinkHealth{Message: e.Error(), Time: Now()}
+		} else {
+			log.Printf("检查分享链接 %s 失败: %s\n", r.URL, e.Error())
+		}
+		if p.linkCheck.Delay > 0 {
+			time.Sleep(p.linkCheck.Delay)
+		}
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	// 事件和消息在释放锁之后发送, 更新索引和消息队列满时都需要等待
+	expired := make([]TransferRecord, 0)
+	topic.Metadata.mutex.Lock()
+	if records, e = topic.loadPanRecords(); e != nil {
+		topic.Metadata.mutex.Unlock()
+		log.Printf("读取帖子 %d 的网盘记录失败: %s\n", topic.Id, e.Error())
+		return
+	}
+	for _, r := range records {
+		health, has := results[r.URL]
+		if !has {
+			continue
+		}
+		r.Health = health
+		if health.Alive || r.Status == TRANSFER_STATUS_SUCCESS || r.Status == TRANSFER_STATUS_EXPIRED {
+			continue
+		}
+		r.ChangeStatus(TRANSFER_STATUS_EXPIRED, health.Message)
+		log.Group(groupPan).Printf("帖子 %d 的分享链接 %s: %s\n", topic.Id, r.URL, health.Message)
+		expired = append(expired, *r)
+	}
+	if e := topic.savePanRecords(records); e != nil {
+		log.Println("保存网盘记录失败:", e.Error())
+	}
+	topic.Metadata.mutex.Unlock()
+
+	for _, r := range expired {
+		p.srv.publish(EVENT_PAN_TRANSFER, topic.Id, gin.H{
+			"Pan":     r.Name,
+			"URL":     r.URL,
+			"Status":  r.Status,
+			"Message": r.Message,
+		})
+		p.msgCh <- fmt.Sprintf("帖子 %d 的分享链接 %s: %s", topic.Id, r.URL, r.Message)
+	}
+}
+
+// 把新增的链接作为失效链接的替代, 只配对同一网盘的链接
+func pairReplacements(records, added []*TransferRecord) {
+	expired := make([]*TransferRecord, 0)
+	for _, r := range records {
+		if r.Status == TRANSFER_STATUS_EXPIRED && r.ReplacedBy == "" {
+			expired = append(expired, r)
+		}
+	}
+	provider := func(r *TransferRecord) string {
+		if sp := shareProviderOf(r.URL); sp != nil {
+			return sp.Name
+		}
+		return ""
+	}
+	for _, r := range added {
+		if r.Replaces != "" {
+			continue
+		}
+		for _, old := range expired {
+			if old.ReplacedBy != "" || provider(old) != provider(r) {
+				continue
+			}
+			old.ReplacedBy, r.Replaces = r.URL, old.URL
+			break
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package mgr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestShareCheckers(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/shorturlinfo":
+			errno := map[string]int{"1alive": 0, "1code": -9, "1gone": -21, "1ban": 115}[r.URL.Query().Get("shorturl")]
+			if r.URL.Query().Get("shorturl") == "1busy" {
+				errno = -6
+			}
+			fmt.Fprintf(w, `{"errno":%d}`, errno)
+		case "/1/clouddrive/share/sharepage/token":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			switch body["pwd_id"] {
+			case "alive":
+				fmt.Fprint(w, `{"status":200,"data":{"stoken":"st"}}`)
+			case "gone":
+				fmt.Fprint(w, `{"status":404,"message":"好友已取消了分享"}`)
+			default:
+				fmt.Fprint(w, `{"status":400,"message":"提取码错误"}`)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	url := BaiduShareInfoURL
+	BaiduShareInfoURL = ts.URL + "/api/shorturlinfo"
+	defer func() { BaiduShareInfoURL = url }()
+
+	b := NewBaidu(BaiduCfg{})
+	assert.Equal(t, b.CheckShare(TransferRecord{URL: "https://pan.baidu.com/s/1alive"}), nil)
+	assert.Equal(t, b.CheckShare(TransferRecord{URL: "https://pan.baidu.com/share/init?surl=code"}), nil)
+	assert.Equal(t, errors.Is(b.CheckShare(TransferRecord{URL: "https://pan.baidu.com/s/1gone"}), ErrShareExpired), true)
+	assert.Equal(t, errors.Is(b.CheckShare(TransferRecord{URL: "https://pan.baidu.com/s/1ban"}), ErrShareExpired), true)
+	e := b.CheckShare(TransferRecord{URL: "https://pan.baidu.com/s/1busy"})
+	assert.NotEqual(t, e, nil)
+	assert.Equal(t, errors.Is(e, ErrShareExpired), false)
+
+	q := NewQuarkPan(QuarkCfg{})
+	assert.NotEqual(t, q.CheckShare(TransferRecord{URL: "https://pan.quark.cn/s/alive"}), nil)
+	q.quark = NewQuark("")
+	q.quark.BaseURL = ts.URL
+	assert.Equal(t, q.CheckShare(TransferRecord{URL: "https://pan.quark.cn/s/alive"}), nil)
+	e = q.CheckShare(TransferRecord{URL: "https://pan.quark.cn/s/gone"})
+	assert.Equal(t, errors.Is(e, ErrShareExpired), true)
+	assert.Equal(t, e.Error(), "分享已失效: 好友已取消了分享")
+	e = q.CheckShare(TransferRecord{URL: "https://pan.quark.cn/s/wrong", Tqm: "0000"})
+	assert.Equal(t, errors.Is(e, ErrShareExpired), false)
+}
+
+// 可以检查链接的网盘, gone 中的链接已失效
+type checkPan struct {
+	*fakePan
+	gone map[string]bool
+}
+
+func (c *checkPan) CheckShare(r TransferRecord) error {
+	if c.gone[r.URL] {
+		return fmt.Errorf("%w: 分享已取消", ErrShareExpired)
+	}
+	return nil
+}
+
+func TestCheckLinksAndReplace(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	post := `# 资源帖
+
+##### <span id="pid0">0.[0] \<pid:0\> 2025-02-27 03:02:58 by 楼主(100)</span>
+https://fake.pan/s/1 提取码: aaaa
+https://fake.pan/s/2 提取码: bbbb
+https://fake.pan/s/3 提取码: cccc
+`
+	assert.Equal(t, root.WriteAll(POST_MARKDOWN, []byte(post)), nil)
+	topic := NewTopic(root, 1)
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	srv.cache.topics.Put(1, topic)
+
+	manual := &checkPan{&fakePan{name: "fake.manual", transfer: TRANSFER_TYPE_MANUAL}, map[string]bool{}}
+	auto := &fakePan{name: "fake.auto", transfer: TRANSFER_TYPE_AUTO}
+	ph := &PanHolder{Pans: []Pan{manual, auto}, extract: DefaultExtractOptions(), msgCh: make(chan string, 9), srv: srv}
+
+	topic.AutoTransfer(ph)
+	assert.Equal(t, len(auto.urls), 3)
+	rs, e := readPanRecords(root)
+	assert.Equal(t, e, nil)
+	rs[0].Name = "fake.manual"
+	rs[0].ChangeStatus(TRANSFER_STATUS_FAILED, "转存失败")
+	rs[1].ChangeStatus(TRANSFER_STATUS_SUCCESS, "")
+	assert.Equal(t, topic.savePanRecords(rs), nil)
+	panTopicCache.Delete(1)
+
+	// 失效的链接中, 已转存的只记录检查结果
+	manual.gone["https://fake.pan/s/1"] = true
+	manual.gone["https://fake.pan/s/2"] = true
+	ph.checkTopicLinks(topic)
+	rs, e = readPanRecords(root)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, rs[0].Status, TRANSFER_STATUS_EXPIRED)
+	assert.Equal(t, rs[0].Health.Alive, false)
+	assert.Equal(t, rs[0].Message, "分享已失效: 分享已取消")
+	assert.Equal(t, rs[1].Status, TRANSFER_STATUS_SUCCESS)
+	assert.Equal(t, rs[1].Health.Alive, false)
+	assert.Equal(t, rs[2].Status, TRANSFER_STATUS_PENDING)
+	assert.Equal(t, rs[2].Health.Alive, true)
+	assert.Equal(t, <-ph.msgCh, "帖子 1 的分享链接 https://fake.pan/s/1: 分享已失效: 分享已取消")
+	assert.Equal(t, len(ph.msgCh), 0)
+
+	// 补档的链接作为失效链接的替代, 由原来的网盘转存
+	post += `
+----
+##### <span id="pid11">1.[1] \<pid:11\> 2025-02-28 04:00:00 by 楼主(100)</span>
+补档 https://fake.pan/s/4 提取码: dddd
+`
+	assert.Equal(t, root.WriteAll(POST_MARKDOWN, []byte(post)), nil)
+	topic.AutoTransfer(ph)
+	assert.Equal(t, manual.urls, []string{"https://fake.pan/s/4"})
+	assert.Equal(t, len(auto.urls), 3)
+	rs, e = readPanRecords(root)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(rs), 4)
+	assert.Equal(t, rs[0].ReplacedBy, "https://fake.pan/s/4")
+	assert.Equal(t, rs[3].Replaces, "https://fake.pan/s/1")
+	assert.Equal(t, rs[3].Name, "fake.manual")
+	assert.Equal(t, rs[3].Status, TRANSFER_STATUS_PENDING)
+
+	// 不同网盘的链接不作为替代
+	old := &TransferRecord{URL: "https://pan.baidu.com/s/1old", Status: TRANSFER_STATUS_EXPIRED}
+	added := &TransferRecord{URL: "https://pan.quark.cn/s/new"}
+	pairReplacements([]*TransferRecord{old, added}, []*TransferRecord{added})
+	assert.Equal(t, old.ReplacedBy, "")
+	assert.Equal(t, added.Replaces, "")
+}
@@ -0,0 +1,187 @@
+package mgr
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	METRICS_NAMESPACE = "ngamm"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	metricDownTopic = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "down_topic_total",
+		Help:      "ngapost2md 下载帖子的次数, 按结果分类",
+	}, []string{"result"})
+	metricDownTopicDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "down_topic_duration_seconds",
+		Help:      "ngapost2md 下载帖子的耗时",
+		Buckets:   []float64{1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"result"})
+	metricFixDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "fix_dropped_total",
+		Help:      "附件修复队列已满时丢弃的数量",
+	}, []string{"kind"}) // kind: record, asset
+	metricAttachment = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "attachment_requests_total",
+		Help:      "获取 NGA 附件的请求次数, 按状态码分类, 0 表示请求失败",
+	}, []string{"code"})
+	metricPanTransfer = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "pan_transfer_total",
+		Help:      "网盘转存任务的结果",
+	}, []string{"pan", "status"})
+	metricWebhookFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "webhook_failures_total",
+		Help:      "webhook 发送失败的次数",
+	}, []string{"hook"})
+	metricHTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP 请求耗时, 按路由分类",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricDownTopic,
+		metricDownTopicDuration,
+		metricFixDropped,
+		metricAttachment,
+		metricPanTransfer,
+		metricWebhookFailed,
+		metricHTTPDuration,
+	)
+}
+
+// 需要在采集时实时计算的指标
+type srvCollector struct {
+	srv        *Server
+	queue      *prometheus.Desc
+	topics     *prometheus.Desc
+	fixBacklog *prometheus.Desc
+	panQueue   *prometheus.Desc
+}
+
+var (
+	srvCollectorLock sync.Mutex
+	srvCollectorCur  *srvCollector
+)
+
+func registerSrvCollector(srv *Server) {
+	srvCollectorLock.Lock()
+	defer srvCollectorLock.Unlock()
+
+	if srvCollectorCur != nil {
+		metricsRegistry.Unregister(srvCollectorCur)
+	}
+	c := &srvCollector{
+		srv: srv,
+		queue: prometheus.NewDesc(METRICS_NAMESPACE+"_queue_depth",
+			"等待处理的帖子数量", nil, nil),
+		topics: prometheus.NewDesc(METRICS_NAMESPACE+"_topics",
+			"帖子数量, 按状态分类", []string{"state"}, nil),
+		fixBacklog: prometheus.NewDesc(METRICS_NAMESPACE+"_fix_queue_depth",
+			"等待修复附件的帖子数量", nil, nil),
+		panQueue: prometheus.NewDesc(METRICS_NAMESPACE+"_pan_queue_depth",
+			"网盘任务队列中等待的任务数量", []string{"pan"}, nil),
+	}
+	metricsRegistry.MustRegister(c)
+	srvCollectorCur = c
+}
+
+func (c *srvCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queue
+	ch <- c.topics
+	ch <- c.fixBacklog
+	ch <- c.panQueue
+}
+
+func (c *srvCollector) Collect(ch chan<- prometheus.Metric) {
+	cache := c.srv.cache
+
+	ch <- prometheus.MustNewConstMetric(c.queue, prometheus.GaugeValue, float64(len(cache.queue)))
+
+	active, abandoned, missing := 0, 0, 0
+	for _, topic := range c.srv.indexedTopics() {
+		if topic.Metadata.Abandon {
+			abandoned++
+		} else {
+			active++
+		}
+		if topic.Title == "" {
+			missing++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.topics, prometheus.GaugeValue, float64(active), "active")
+	ch <- prometheus.MustNewConstMetric(c.topics, prometheus.GaugeValue, float64(abandoned), "abandoned")
+	ch <- prometheus.MustNewConstMetric(c.topics, prometheus.GaugeValue, float64(missing), "missing_title")
+
+	if nga := c.srv.nga; nga != nil {
+		ch <- prometheus.MustNewConstMetric(c.fixBacklog, prometheus.GaugeValue, float64(len(nga.fixCh)))
+	}
+
+	if ph := cache.pans; ph != nil {
+		for _, pan := range ph.Pans {
+			if q, ok := pan.(queuedPan); ok {
+				ch <- prometheus.MustNewConstMetric(c.panQueue, prometheus.GaugeValue, float64(q.queueLen()), pan.Name())
+			}
+		}
+	}
+}
+
+// 有任务队列的网盘
+type queuedPan interface {
+	queueLen() int
+}
+
+func observeDownTopic(ok bool, start time.Time) {
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	metricDownTopic.WithLabelValues(result).Inc()
+	metricDownTopicDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unknown"
+		}
+		metricHTTPDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+func (srv *Server) metrics() func(c *gin.Context) {
+	h := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{
+		DisableCompression: true, // 由 gzip 中间件负责压缩
+	})
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-cache")
+		h.ServeHTTP(c.Writer, c.Request)
+	}
+}
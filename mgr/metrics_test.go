@@ -0,0 +1,41 @@
+package mgr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(metricsMiddleware())
+	r.GET("/topic/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	before := testutil.CollectAndCount(metricHTTPDuration)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/topic/123", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	assert.Equal(t, testutil.CollectAndCount(metricHTTPDuration), before+1)
+
+	expected := `ngamm_http_request_duration_seconds_count{method="GET",route="/topic/:id",status="200"} 1`
+	w = httptest.NewRecorder()
+	r.GET("/metrics", (&Server{}).metrics())
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, strings.Contains(w.Body.String(), expected), true)
+}
+
+func TestObserveDownTopic(t *testing.T) {
+	before := testutil.ToFloat64(metricDownTopic.WithLabelValues("failure"))
+	observeDownTopic(false, Now().Time)
+	assert.Equal(t, testutil.ToFloat64(metricDownTopic.WithLabelValues("failure")), before+1)
+}
@@ -2,6 +2,7 @@ package mgr
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
@@ -28,24 +29,52 @@ const (
 	ATTACHMENT_CFG  = "attachment.ini"
 	USER_DIR        = "users"
 	ATTACHMENT_BASE = "https://img.nga.178.com/attachments/"
+
+	USER_REFRESH_AGE   = 7 * 24 * time.Hour // 用户信息超过这个时间后重新获取
+	USER_REFRESH_DELAY = 3 * time.Second    // 刷新每个用户之间的间隔
 )
 
 var (
 	groupNGA = log.GROUP_NGA
+
+	ErrCookieExpired = errors.New("NGA cookie 已失效")
 )
 
 type User struct {
 	Id         int          `json:"id"`
 	SubFilter  *[]string    `json:"filter,omitempty"`
+	SubTags    *[]string    `json:"tags,omitempty"` // 订阅添加的帖子自动带上这些标签
 	subCronId  cron.EntryID // 订阅任务的 ID
 	forSubTask *time.Timer  // 启动后准备开始订阅任务的定时器
 	Name       string       `json:"name"`
 	Loc        string       `json:"loc"`
 	RegDate    CustomTime   `json:"regDate"`
 	Subscribed bool         `json:"subscribed"`
+	Names      []UserName   `json:"names,omitempty"`    // 曾用名
+	Refreshed  CustomTime   `json:"refreshed,omitzero"` // 最近一次从 NGA 获取信息的时间
 	saved      bool         // 是否已经保存到文件
 }
 
+// 用户的曾用名, Until 为发现改名的时间
+type UserName struct {
+	Name  string     `json:"name"`
+	Until CustomTime `json:"until"`
+}
+
+// 修改用户名, 旧的用户名记入曾用名, 返回是否有变化
+func (u *User) rename(name string) bool {
+	if name == "" || name == u.Name {
+		return false
+	}
+	if old := u.Name; old != "" && old != fmt.Sprintf("UID%d", u.Id) {
+		log.Printf("用户 %d 改名: %s -> %s\n", u.Id, old, name)
+		u.Names = append(u.Names, UserName{Name: old, Until: Now()})
+	}
+	u.Name = name
+	u.saved = false
+	return true
+}
+
 type userState int
 
 const (
@@ -325,6 +354,7 @@ func InitNGA(global Config) (*Client, error) {
 		SetCommonRetryBackoffInterval(1*time.Second, 3*time.Second).
 		DisableAutoDecode()
 
+	client.cron.AddFunc("@every 24h", client.refreshUsers)
 	client.cron.Start()
 
 	go client.doFixAsset()
@@ -446,6 +476,29 @@ func updateConfig(cfg *ini.File, path string) {
 	}
 }
 
+// 确保帖子目录的配置只使用媒体文件的网络地址, 配置可能在启动后被手动修改
+func (c *Client) keepNetworkMedia() {
+	fp := filepath.Join(c.topics, NGA_CFG)
+	cfg, e := ini.Load(fp)
+	if e != nil {
+		log.Println("加载 ngapost2md 配置文件失败:", e)
+		return
+	}
+	changed := false
+	for _, key := range []string{"use_network_pic_url", "use_network_media_url"} {
+		c, e := changeConfigValue(cfg, "post", key, "True")
+		if e != nil {
+			log.Printf("修改 post.%s 配置项失败: %s\n", key, e)
+		}
+		changed = changed || c
+	}
+	if changed {
+		if e := cfg.SaveTo(fp); e != nil {
+			log.Println("保存 ngapost2md 配置文件失败:", e)
+		}
+	}
+}
+
 func changeConfigValue(cfg *ini.File, section, key, value string) (bool, error) {
 	sec := cfg.Section(section)
 	if !sec.HasKey(key) {
@@ -488,22 +541,46 @@ func (c Client) GetTopicRoot() string {
 	return c.topics
 }
 
+var regexVersion = regexp.MustCompile(`ngapost2md\s+(\d+\.\d+\.\d+)`)
+
+func parseVersion(out string) (string, error) {
+	for line := range strings.SplitSeq(out, "\n") {
+		if matches := regexVersion.FindStringSubmatch(line); len(matches) > 1 {
+			return matches[1], nil
+		}
+	}
+	return "", errors.New("无输出")
+}
+
 func (c *Client) version() (string, error) {
 	out, e := c.execute([]string{"-v"}, "")
 	if e != nil {
 		return "", e
 	}
-	lines := strings.SplitSeq(out, "\n")
-	regex := regexp.MustCompile(`ngapost2md\s+(\d+\.\d+\.\d+)`)
-	for line := range lines {
-		if matches := regex.FindStringSubmatch(line); len(matches) > 1 {
-			return matches[1], nil
+	return parseVersion(out)
+}
+
+// 检查 ngapost2md 是否能正常响应, 不占用执行锁, 以免被正在进行的下载阻塞
+func (c *Client) probe() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.program, "-v")
+	cmd.Dir = c.dir
+	out, e := cmd.CombinedOutput()
+	if e != nil {
+		if _, ok := e.(*exec.ExitError); !ok {
+			return "", e
 		}
 	}
-	return "", errors.New("无输出")
+	return parseVersion(string(out))
 }
 
-func (c *Client) DownTopic(tid int) (bool, string) {
+// 下载帖子, media 为 false 时 (超过存储配额) 只保留媒体文件的网络地址, 不下载到本地
+func (c *Client) DownTopic(tid int, media bool) (bool, string) {
+	if !media {
+		c.keepNetworkMedia()
+	}
 	out, e := c.execute([]string{strconv.Itoa(tid)}, c.topics)
 	if e != nil {
 		log.Printf("下载帖子 %d 出现问题: %s\n", tid, e.Error())
@@ -603,10 +680,11 @@ func (c *Client) extractUserInfo(html string) (*User, error) {
 		log.Printf("获取到用户 %s[%d] 的信息\n", name, uid)
 
 		u := User{
-			Id:      uid,
-			Name:    name,
-			Loc:     ipLoc,
-			RegDate: CustomTime{time.Unix(regDate, 0)},
+			Id:        uid,
+			Name:      name,
+			Loc:       ipLoc,
+			RegDate:   CustomTime{time.Unix(regDate, 0)},
+			Refreshed: Now(),
 		}
 
 		return &u, nil
@@ -614,6 +692,29 @@ func (c *Client) extractUserInfo(html string) (*User, error) {
 	return nil, fmt.Errorf("匹配到空的用户信息")
 }
 
+// 检查 NGA 的 cookie 是否有效, 请求当前登录用户的信息页
+func (c *Client) CheckCookie() error {
+	uid, e := strconv.Atoi(c.uid)
+	if e != nil {
+		return fmt.Errorf("无效的 ngaPassportUid: %s", c.uid)
+	}
+	html, e := c.getHTML(fmt.Sprintf("%s/nuke.php?func=ucp&uid=%d", c.baseURL, uid))
+	if e != nil {
+		return e
+	}
+	if strings.Contains(html, "请登录") || strings.Contains(html, "未登录") {
+		return ErrCookieExpired
+	}
+	u, e := c.extractUserInfo(html)
+	if e != nil {
+		return fmt.Errorf("%w: %w", ErrCookieExpired, e)
+	}
+	if u.Id != uid {
+		return fmt.Errorf("%w: 用户不匹配 %d != %d", ErrCookieExpired, u.Id, uid)
+	}
+	return nil
+}
+
 func (c *Client) getUserById(uid int) (*User, error) {
 	url := fmt.Sprintf("%s/nuke.php?func=ucp&uid=%d", c.baseURL, uid)
 	html, e := c.getHTML(url)
@@ -650,10 +751,33 @@ func (c *Client) SetTopicUser(uid int, username string) {
 		return
 	}
 	user, s := c.users.GetByUid(uid)
-	if s == state_have && user.Name != username {
-		user.Name = username
+	if s == state_have && user.rename(username) {
+		c.users.PutAndSave(user)
+	}
+}
+
+// 定期从 NGA 刷新用户信息, 每次只刷新超过 USER_REFRESH_AGE 的用户
+func (c *Client) refreshUsers() {
+	seen := make(map[int]bool)
+	for _, user := range c.users.data.Values() {
+		if seen[user.Id] || time.Since(user.Refreshed.Time) < USER_REFRESH_AGE {
+			continue
+		}
+		seen[user.Id] = true
+
+		u, e := c.getUserById(user.Id)
+		if e != nil {
+			log.Printf("刷新用户 %s[%d] 的信息失败: %s\n", user.Name, user.Id, e.Error())
+			continue
+		}
+		user.rename(u.Name)
+		user.Loc = u.Loc
+		user.RegDate = u.RegDate
+		user.Refreshed = u.Refreshed
 		user.saved = false
 		c.users.PutAndSave(user)
+
+		time.Sleep(USER_REFRESH_DELAY) // 避免请求过快
 	}
 }
 
@@ -789,8 +913,18 @@ func (c *Client) doSubscribe(user *User) error {
 					}
 				}
 
-				e = c.srv.addTopic(topic.Id)
-				if e != nil {
+				var tags []string
+				if user.SubTags != nil {
+					tags = *user.SubTags
+				}
+				e = c.srv.addTopic(topic.Id, tags...)
+				if e == nil {
+					c.srv.publish(EVENT_SUBSCRIBE_FOUND, topic.Id, map[string]any{
+						"Uid":   user.Id,
+						"Name":  user.Name,
+						"Title": topic.Title,
+					})
+				} else {
 					log.Printf("添加帖子 %d 失败: %s\n", topic.Id, e.Error())
 				}
 			}
@@ -839,6 +973,23 @@ func (c *Client) Subscribe(uid int, status bool, filter ...string) error {
 	return fmt.Errorf("用户信息加载失败")
 }
 
+// 设置订阅添加的帖子的标签
+func (c *Client) SetSubTags(uid int, tags []string) error {
+	u, s := c.users.GetByUid(uid)
+	if s != state_have {
+		return fmt.Errorf("用户信息加载失败")
+	}
+	tags = normalizeTags(tags)
+	if len(tags) == 0 {
+		u.SubTags = nil
+	} else {
+		u.SubTags = &tags
+	}
+	u.saved = false
+	c.users.PutAndSave(u)
+	return nil
+}
+
 func (c *Client) Close() error {
 	c.users.Close()
 	c.cron.Stop()
@@ -861,6 +1012,8 @@ func (c *Client) AddFixAsset(topic *Topic, fixes map[string]string) {
 	select {
 	case c.fixCh <- fixRecord{topic: topic, fixes: fixes}:
 	default:
+		metricFixDropped.WithLabelValues("record").Inc()
+		metricFixDropped.WithLabelValues("asset").Add(float64(len(fixes)))
 		log.Printf("附件修复队列已满，丢弃帖子 %d 的 %d 个修复任务\n", topic.Id, len(fixes))
 	}
 }
@@ -950,10 +1103,12 @@ func (c *Client) GetAttachment(url string) (*ResponseReader, error) {
 	resp, e := r.Get(url)
 
 	if e != nil {
+		metricAttachment.WithLabelValues("0").Inc()
 		log.Group(groupNGA).Printf("请求 %s 失败: %s\n", url, e.Error())
 		return nil, e
 	}
 
+	metricAttachment.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
 	if resp.StatusCode != http.StatusOK {
 		log.Group(groupNGA).Printf("获取失败，状态码: %d, 响应内容: %s", resp.StatusCode, resp.String())
 		return nil, fmt.Errorf("获取失败，原因: %s", resp.Status)
@@ -968,7 +1123,19 @@ func (c *Client) GetAttachment(url string) (*ResponseReader, error) {
 }
 
 func (c *Client) processFixRecord(record fixRecord) {
+	// 统计使用最新加载的帖子, 下载后帖子会被重新加载
+	topic := record.topic
+	if c.srv != nil {
+		if t, has := c.srv.cache.topics.Get(topic.Id); has {
+			topic = t
+		}
+		defer c.srv.indexTopic(topic)
+	}
 	for name, src := range record.fixes {
+		if c.srv != nil && c.srv.overQuota(topic) {
+			log.Printf("帖子 %d 超过存储配额, 跳过剩余的附件\n", topic.Id)
+			return
+		}
 		if name == "" || src == "" {
 			continue
 		}
@@ -1000,5 +1167,8 @@ func (c *Client) processFixRecord(record fixRecord) {
 			continue
 		}
 		log.Printf("获取帖子 %d 的资源文件 %s 成功\n", record.topic.Id, name)
+		if c.srv != nil {
+			c.srv.addStorage(topic, name, int64(len(data)))
+		}
 	}
 }
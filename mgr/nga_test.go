@@ -51,7 +51,7 @@ func TestDownTopic(t *testing.T) {
 	defer nga.Close()
 
 	id := 43833908
-	b, v := nga.DownTopic(id)
+	b, v := nga.DownTopic(id, true)
 	assert.Equal(t, b, true)
 	t.Log(v)
 }
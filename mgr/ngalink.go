@@ -0,0 +1,178 @@
+package mgr
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// NGA 的各个域名, 包括镜像和手机版
+var ngaHosts = []string{
+	"ngabbs.com",
+	"nga.178.com",
+	"bbs.nga.cn",
+	"nga.cn",
+	"ngacn.cc",
+	"bbs.ngacn.cc",
+	"nga.donews.com",
+}
+
+var (
+	regexNGALink = regexp.MustCompile(`(?i)(?:https?://)?(?:[a-z0-9-]+\.)*(?:ngabbs\.com|nga\.178\.com|nga\.cn|ngacn\.cc|nga\.donews\.com)/[^\s"'<>()（）\[\]【】，。；]+`)
+	regexTidArg  = regexp.MustCompile(`(?:^|[?&#])tid=(\d+)`)
+	regexPidArg  = regexp.MustCompile(`(?:^|[?&#])pid=(\d+)`)
+	regexPidTid  = regexp.MustCompile(`read\.php\?tid=(\d+)`)
+)
+
+// 混在其他文字中的数字至少这么长才当作帖子 ID, 避免把年份, 楼层等当作帖子
+const NGA_TID_MIN_LEN = 7
+
+// 解析后的 NGA 链接, pid 链接需要请求页面才能得到 tid
+type NGALink struct {
+	Raw string
+	Tid int `json:",omitempty"`
+	Pid int `json:",omitempty"`
+}
+
+func isNGAHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range ngaHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// 解析 NGA 链接或帖子 ID, 支持各个域名, 手机分享链接, 以及 tid= 和 pid= 参数
+func ParseNGALink(raw string) (NGALink, error) {
+	link := NGALink{Raw: raw}
+	s := strings.TrimSpace(raw)
+	if id, e := strconv.Atoi(s); e == nil {
+		if id <= 0 {
+			return link, fmt.Errorf("无效的帖子 ID: %s", raw)
+		}
+		link.Tid = id
+		return link, nil
+	}
+
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, e := url.Parse(s)
+	if e != nil || !isNGAHost(u.Hostname()) {
+		return link, fmt.Errorf("不是 NGA 的链接: %s", raw)
+	}
+	// 参数可能在 # 之后, 如手机版的 /#/read.php?tid=
+	args := u.RawQuery + "#" + u.Fragment
+	if m := regexTidArg.FindStringSubmatch(args); m != nil {
+		link.Tid, _ = strconv.Atoi(m[1])
+	}
+	if m := regexPidArg.FindStringSubmatch(args); m != nil {
+		link.Pid, _ = strconv.Atoi(m[1])
+	}
+	if link.Tid <= 0 && link.Pid <= 0 {
+		return link, fmt.Errorf("链接中没有帖子 ID: %s", raw)
+	}
+	return link, nil
+}
+
+// 从任意文本中找出所有的 NGA 链接和单独的帖子 ID, 按出现的顺序.
+// 文本中还有其他文字时, 单独的数字需要至少 NGA_TID_MIN_LEN 位
+func FindNGALinks(text string) []string {
+	type found struct {
+		at  int
+		raw string
+	}
+	all := make([]found, 0)
+	for _, loc := range regexNGALink.FindAllStringIndex(text, -1) {
+		all = append(all, found{loc[0], strings.TrimRight(text[loc[0]:loc[1]], ".,;!?")})
+	}
+	// 去掉链接后再找单独的数字, 避免匹配到链接中的数字
+	rest := regexNGALink.ReplaceAllStringFunc(text, func(s string) string {
+		return strings.Repeat(" ", len(s))
+	})
+	numbers := make([]found, 0)
+	onlyIds := true
+	start := -1
+	for i, r := range rest + " " {
+		if unicode.IsSpace(r) || strings.ContainsRune(",，;；、|", r) {
+			if start >= 0 {
+				if isDigits(rest[start:i]) {
+					numbers = append(numbers, found{start, rest[start:i]})
+				} else {
+					onlyIds = false
+				}
+			}
+			start = -1
+		} else if start < 0 {
+			start = i
+		}
+	}
+	// 只有整个输入都是链接和数字时才接受较短的数字
+	for _, n := range numbers {
+		if onlyIds || len(n.raw) >= NGA_TID_MIN_LEN {
+			all = append(all, n)
+		}
+	}
+	slices.SortStableFunc(all, func(a, b found) int {
+		return a.at - b.at
+	})
+	ret := make([]string, 0, len(all))
+	for _, f := range all {
+		ret = append(ret, f.raw)
+	}
+	return ret
+}
+
+// 解析链接得到帖子 ID, pid 链接通过请求回复所在的页面得到 tid
+func (c *Client) ResolveLink(raw string) (int, error) {
+	link, e := ParseNGALink(raw)
+	if e != nil {
+		return 0, e
+	}
+	if link.Tid > 0 {
+		return link.Tid, nil
+	}
+	html, e := c.getHTML(fmt.Sprintf("%s/read.php?pid=%d", c.baseURL, link.Pid))
+	if e != nil {
+		return 0, e
+	}
+	tid := findPidTid(html, link.Pid)
+	if tid <= 0 {
+		return 0, fmt.Errorf("未找到回复 %d 所在的帖子", link.Pid)
+	}
+	return tid, nil
+}
+
+// 页面中其他帖子的链接可能在回复之前, 只找指向回复本身或在回复容器中的链接
+func findPidTid(html string, pid int) int {
+	anchor := fmt.Sprintf("pid%dAnchor", pid)
+	self := regexp.MustCompile(`read\.php\?tid=(\d+)[^'"<>\s]*#` + anchor + `\b`)
+	if m := self.FindStringSubmatch(html); m != nil {
+		tid, _ := strconv.Atoi(m[1])
+		return tid
+	}
+	at := regexp.MustCompile(`id=['"]?` + anchor + `\b`).FindStringIndex(html)
+	if at == nil {
+		return 0
+	}
+	if m := regexPidTid.FindStringSubmatch(html[at[1]:]); m != nil {
+		tid, _ := strconv.Atoi(m[1])
+		return tid
+	}
+	return 0
+}
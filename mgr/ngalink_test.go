@@ -0,0 +1,91 @@
+package mgr
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/imroc/req/v3"
+)
+
+func TestParseNGALink(t *testing.T) {
+	cases := []struct {
+		raw string
+		tid int
+		pid int
+		ok  bool
+	}{
+		{"45678901", 45678901, 0, true},
+		{"https://ngabbs.com/read.php?tid=123&page=3", 123, 0, true},
+		{"http://nga.178.com/read.php?tid=456#pid789Anchor", 456, 0, true},
+		{"bbs.nga.cn/read.php?tid=789", 789, 0, true},
+		{"https://m.ngabbs.com/read.php?tid=10&_fp=2", 10, 0, true},
+		{"https://g.nga.cn/read.php?&tid=11&rand=1", 11, 0, true},
+		{"https://ngabbs.com/#/read.php?tid=12", 12, 0, true},
+		{"https://nga.178.com/read.php?pid=654321&opt=128", 0, 654321, true},
+		{"https://ngabbs.com/read.php?stid=1", 0, 0, false},
+		{"https://example.com/read.php?tid=1", 0, 0, false},
+		{"https://ngabbs.com/thread.php?fid=-7", 0, 0, false},
+		{"0", 0, 0, false},
+	}
+	for _, c := range cases {
+		link, e := ParseNGALink(c.raw)
+		assert.Equal(t, e == nil, c.ok)
+		assert.Equal(t, link.Tid, c.tid)
+		assert.Equal(t, link.Pid, c.pid)
+	}
+}
+
+func TestFindNGALinks(t *testing.T) {
+	text := `看这个https://ngabbs.com/read.php?tid=1&page=2，还有 bbs.nga.cn/read.php?pid=3.
+	45678901, 123456 2025
+	第2个 (nga.178.com/read.php?tid=4)`
+	assert.Equal(t, FindNGALinks(text), []string{
+		"https://ngabbs.com/read.php?tid=1&page=2",
+		"bbs.nga.cn/read.php?pid=3",
+		"45678901",
+		"nga.178.com/read.php?tid=4",
+	})
+	assert.Equal(t, len(FindNGALinks("没有链接 abc123")), 0)
+	assert.Equal(t, len(FindNGALinks("第 3 楼 2025 年")), 0)
+	// 只有 ID 时接受较短的数字
+	assert.Equal(t, FindNGALinks("123, 456\n789 ngabbs.com/read.php?tid=1"), []string{"123", "456", "789", "ngabbs.com/read.php?tid=1"})
+}
+
+func TestResolveLink(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hot := `<a href='/read.php?tid=999'>热门</a>`
+		switch r.URL.Query().Get("pid") {
+		case "100":
+			fmt.Fprint(w, hot+`<a href='/read.php?tid=200&page=3#pid100Anchor'>回复</a>`)
+			return
+		case "102":
+			fmt.Fprint(w, hot+`<a id='pid102Anchor'></a><div class='postcontent'><a href='/read.php?tid=201'>主题</a></div>`)
+			return
+		case "101":
+			fmt.Fprint(w, hot)
+			return
+		}
+		fmt.Fprint(w, `<html></html>`)
+	}))
+	defer ts.Close()
+
+	c := &Client{baseURL: ts.URL, reqClient: req.C()}
+	id, e := c.ResolveLink("https://ngabbs.com/read.php?tid=300")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, id, 300)
+
+	id, e = c.ResolveLink("https://ngabbs.com/read.php?pid=100")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, id, 200)
+
+	id, e = c.ResolveLink("https://ngabbs.com/read.php?pid=102")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, id, 201)
+
+	// 不能取页面中其他帖子的链接
+	_, e = c.ResolveLink("https://ngabbs.com/read.php?pid=101")
+	assert.NotEqual(t, e, nil)
+}
@@ -0,0 +1,441 @@
+package mgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/i2534/ngamm/mgr/log"
+	"gopkg.in/ini.v1"
+)
+
+// 通知事件类型, 可以在 events 中过滤, 支持 * 和 pan.* 这样的前缀匹配
+const (
+	NOTIFY_TOPIC_SUBSCRIBED = "topic.subscribed" // 订阅发现新帖子
+	NOTIFY_TOPIC_ABANDONED  = "topic.abandoned"  // 帖子放弃更新
+	NOTIFY_DOWN_FAILED      = "download.failed"  // 帖子下载失败
+	NOTIFY_COOKIE_EXPIRED   = "cookie.expired"   // NGA cookie 失效
+	NOTIFY_PAN_SUCCESS      = "pan.success"      // 网盘转存成功
+	NOTIFY_PAN_FAILED       = "pan.failed"       // 网盘转存失败
+	NOTIFY_PAN_SIGN         = "pan.sign"         // 网盘签到
+	NOTIFY_RECYCLE_PURGED   = "recycle.purged"   // 回收站中的帖子被永久删除
+	NOTIFY_STORAGE_QUOTA    = "storage.quota"    // 帖子占用超过存储配额
+
+	NOTIFY_SECTION          = "notify"          // 通知根配置, 子配置为 [notify.xxx]
+	NOTIFY_TEMPLATE_SECTION = "notify-template" // 自定义各事件的消息模板
+	NOTIFY_DEFAULT_RETRY    = 3
+	NOTIFY_DEFAULT_BACKOFF  = 5 * time.Second
+	notifyQueueSize         = 256
+)
+
+var (
+	notifyTitles = map[string]string{
+		NOTIFY_TOPIC_SUBSCRIBED: "订阅发现新帖子",
+		NOTIFY_TOPIC_ABANDONED:  "帖子放弃更新",
+		NOTIFY_DOWN_FAILED:      "帖子下载失败",
+		NOTIFY_COOKIE_EXPIRED:   "NGA cookie 失效",
+		NOTIFY_PAN_SUCCESS:      "网盘转存成功",
+		NOTIFY_PAN_FAILED:       "网盘转存失败",
+		NOTIFY_PAN_SIGN:         "网盘签到",
+		NOTIFY_RECYCLE_PURGED:   "回收站清理",
+		NOTIFY_STORAGE_QUOTA:    "超过存储配额",
+	}
+	notifyTemplates = map[string]string{
+		NOTIFY_TOPIC_SUBSCRIBED: `订阅 {{.Data.Name}} 发现新帖子 <{{.Data.Title}}> ({{.Topic.Id}})`,
+		NOTIFY_TOPIC_ABANDONED:  `帖子 <{{.Topic.Title}}> ({{.Topic.Id}}) 连续失败 {{.Data}} 次, 已放弃更新`,
+		NOTIFY_DOWN_FAILED:      `帖子 <{{.Topic.Title}}> ({{.Topic.Id}}) 下载失败: {{.Data.Message}}`,
+		NOTIFY_COOKIE_EXPIRED:   `NGA cookie 已失效, 请及时更新: {{.Data}}`,
+		NOTIFY_PAN_SUCCESS:      `帖子 <{{.Topic.Title}}> ({{.Topic.Id}}) 中的 {{.Data.URL}} 已转存到 {{.Data.Pan}}`,
+		NOTIFY_PAN_FAILED:       `帖子 <{{.Topic.Title}}> ({{.Topic.Id}}) 中的 {{.Data.URL}} 转存到 {{.Data.Pan}} 失败: {{.Data.Message}}`,
+		NOTIFY_PAN_SIGN:         `{{.Data.Pan}}{{if .Data.Nickname}} ({{.Data.Nickname}}){{end}} {{if .Data.Success}}签到成功{{else}}签到失败{{end}}: {{.Data.Message}}`,
+		NOTIFY_RECYCLE_PURGED:   `回收站中的帖子 <{{.Topic.Title}}> ({{.Topic.Id}}) 已被永久删除`,
+		NOTIFY_STORAGE_QUOTA:    `帖子 <{{.Topic.Title}}> ({{.Topic.Id}}) 占用 {{.Data.Usage}}, 超过{{if eq .Data.Scope "total"}}总{{end}}配额 {{.Data.Quota}}, 已停止下载媒体文件`,
+	}
+	notifyFuncs = template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, e := json.Marshal(v)
+			return string(data), e
+		},
+	}
+)
+
+// 预置的推送服务, 未配置的 url/method/header/body 使用预置值
+var notifyPresets = map[string]notifyHook{
+	"wecom": {
+		Method: http.MethodPost,
+		Header: "Content-Type: application/json",
+		Body:   `{"msgtype":"text","text":{"content":{{json .Text}}}}`,
+	},
+	"dingtalk": {
+		Method: http.MethodPost,
+		Header: "Content-Type: application/json",
+		Body:   `{"msgtype":"text","text":{"content":{{json .Text}}}}`,
+	},
+	"telegram": {
+		URL:    "https://api.telegram.org/bot{{.Token}}/sendMessage",
+		Method: http.MethodPost,
+		Header: "Content-Type: application/json",
+		Body:   `{"chat_id":{{json .To}},"text":{{json .Text}},"disable_web_page_preview":true}`,
+	},
+	"bark": {
+		URL:    "https://api.day.app/push",
+		Method: http.MethodPost,
+		Header: "Content-Type: application/json",
+		Body:   `{"device_key":{{json .Token}},"title":{{json .Title}},"body":{{json .Message}},"group":"ngamm"}`,
+	},
+	"ntfy": {
+		URL:    "https://ntfy.sh",
+		Method: http.MethodPost,
+		Header: "Content-Type: application/json;{{if .Token}}Authorization: Bearer {{.Token}}{{end}}",
+		Body:   `{"topic":{{json .To}},"title":{{json .Title}},"message":{{json .Message}}}`,
+	},
+	"json": {
+		Method: http.MethodPost,
+		Header: "Content-Type: application/json",
+		Body:   `{{json .}}`,
+	},
+}
+
+// 发送给推送服务的数据, 也是模板的数据
+type Notification struct {
+	Event   string
+	Title   string // 事件标题
+	Message string // 根据事件模板生成的消息
+	Text    string `json:"-"` // 标题 + 消息, 用于只支持纯文本的服务
+	Topic   NotifyTopic
+	Data    any
+	Time    CustomTime
+	Token   string `json:"-"` // 推送服务的令牌, 来自配置
+	To      string `json:"-"` // 推送目标, 如 Telegram 的 chat_id, ntfy 的 topic
+}
+
+// 通知中的帖子信息, 复制自缓存中的帖子, 通知协程不会修改缓存
+type NotifyTopic struct {
+	Id     int
+	Title  string
+	Author string
+	Uid    int
+}
+
+type notifyHook struct {
+	Enable  bool          `ini:"enable"`  // 是否启用
+	Name    string        `ini:"name"`    // 名称
+	Preset  string        `ini:"preset"`  // 预置服务: wecom, dingtalk, telegram, bark, ntfy, json
+	URL     string        `ini:"url"`     // 地址, 支持模板
+	Method  string        `ini:"method"`  // 请求方法
+	Header  string        `ini:"header"`  // 请求头, 以 ; 分隔, 支持模板
+	Body    string        `ini:"body"`    // 请求体, 支持模板
+	Token   string        `ini:"token"`   // 令牌
+	To      string        `ini:"to"`      // 推送目标
+	Events  []string      `ini:"events"`  // 订阅的事件, 为空时订阅全部
+	Retry   int           `ini:"retry"`   // 失败重试次数
+	Backoff time.Duration `ini:"backoff"` // 首次重试的等待时间, 之后每次翻倍
+	url     *template.Template
+	header  *template.Template
+	body    *template.Template
+	ch      chan Notification
+}
+
+func (h *notifyHook) init() error {
+	if h.Preset != "" {
+		p, has := notifyPresets[h.Preset]
+		if !has {
+			return fmt.Errorf("未知的预置服务: %s", h.Preset)
+		}
+		for _, v := range []struct {
+			tar *string
+			val string
+		}{
+			{&h.URL, p.URL},
+			{&h.Method, p.Method},
+			{&h.Header, p.Header},
+			{&h.Body, p.Body},
+		} {
+			if *v.tar == "" {
+				*v.tar = v.val
+			}
+		}
+	}
+	if h.URL == "" {
+		return fmt.Errorf("通知 %s 没有设置 url", h.Name)
+	}
+	if h.Method == "" {
+		h.Method = http.MethodPost
+	}
+
+	var e error
+	if h.url, e = template.New("url").Funcs(notifyFuncs).Parse(h.URL); e != nil {
+		return e
+	}
+	if h.header, e = template.New("header").Funcs(notifyFuncs).Parse(h.Header); e != nil {
+		return e
+	}
+	if h.body, e = template.New("body").Funcs(notifyFuncs).Parse(h.Body); e != nil {
+		return e
+	}
+	return nil
+}
+
+func (h *notifyHook) accept(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, ev := range h.Events {
+		ev = strings.TrimSpace(ev)
+		if ev == "*" || ev == event {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(ev, "*"); ok && strings.HasPrefix(event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *notifyHook) send(n Notification) error {
+	n.Token = h.Token
+	n.To = h.To
+
+	url, e := execTemplate(h.url, n)
+	if e != nil {
+		return e
+	}
+	header, e := execTemplate(h.header, n)
+	if e != nil {
+		return e
+	}
+	body, e := execTemplate(h.body, n)
+	if e != nil {
+		return e
+	}
+
+	req, e := http.NewRequest(h.Method, url, strings.NewReader(body))
+	if e != nil {
+		return e
+	}
+	for _, kv := range strings.Split(header, ";") {
+		k, v, ok := strings.Cut(kv, ":")
+		if !ok {
+			continue
+		}
+		req.Header.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	resp, e := DoHttp(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("通知 %s 返回错误: %d, %s", h.Name, resp.StatusCode, string(data))
+	}
+	return nil
+}
+
+// 按指数退避重试发送
+func (h *notifyHook) loop() {
+	for n := range h.ch {
+		wait := h.Backoff
+		for i := 0; ; i++ {
+			e := h.send(n)
+			if e == nil {
+				log.Printf("通知 %s 已发送: %s\n", h.Name, n.Event)
+				break
+			}
+			metricWebhookFailed.WithLabelValues("notify." + h.Name).Inc()
+			if i >= h.Retry {
+				log.Printf("通知 %s 发送失败, 已放弃: %s\n", h.Name, e.Error())
+				break
+			}
+			log.Printf("通知 %s 发送失败, %s 后重试: %s\n", h.Name, wait, e.Error())
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+}
+
+func execTemplate(t *template.Template, data any) (string, error) {
+	var buf bytes.Buffer
+	if e := t.Execute(&buf, data); e != nil {
+		return "", e
+	}
+	return buf.String(), nil
+}
+
+// 将服务器事件转换为通知并发送到各个推送服务
+type notifier struct {
+	hooks     []*notifyHook
+	templates map[string]*template.Template
+}
+
+func newNotifier(cfg *ini.File) (*notifier, error) {
+	if cfg == nil || !cfg.HasSection(NOTIFY_SECTION) {
+		return nil, nil
+	}
+	root := cfg.Section(NOTIFY_SECTION)
+	if !root.Key("enable").MustBool(true) {
+		log.Println("通知未启用")
+		return nil, nil
+	}
+	retry := root.Key("retry").MustInt(NOTIFY_DEFAULT_RETRY)
+	backoff := root.Key("backoff").MustDuration(NOTIFY_DEFAULT_BACKOFF)
+
+	n := &notifier{
+		hooks:     make([]*notifyHook, 0),
+		templates: make(map[string]*template.Template),
+	}
+
+	custom := cfg.Section(NOTIFY_TEMPLATE_SECTION)
+	for event, text := range notifyTemplates {
+		if custom.HasKey(event) {
+			text = custom.Key(event).String()
+		}
+		t, e := template.New(event).Funcs(notifyFuncs).Option("missingkey=zero").Parse(text)
+		if e != nil {
+			return nil, fmt.Errorf("解析通知模板 %s 失败: %w", event, e)
+		}
+		n.templates[event] = t
+	}
+
+	for _, sec := range cfg.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), NOTIFY_SECTION+".")
+		if !ok {
+			continue
+		}
+		hook := &notifyHook{
+			Enable:  true,
+			Name:    name,
+			Retry:   retry,
+			Backoff: backoff,
+		}
+		if e := sec.MapTo(hook); e != nil {
+			log.Printf("解析通知 %s 配置失败: %s\n", name, e.Error())
+			continue
+		}
+		if !hook.Enable {
+			log.Println("未启用通知:", hook.Name)
+			continue
+		}
+		if e := hook.init(); e != nil {
+			log.Printf("初始化通知 %s 失败: %s\n", name, e.Error())
+			continue
+		}
+		hook.ch = make(chan Notification, notifyQueueSize)
+		log.Println("启用通知:", hook.Name)
+		n.hooks = append(n.hooks, hook)
+	}
+	if len(n.hooks) == 0 {
+		return nil, nil
+	}
+	return n, nil
+}
+
+// 将事件转换为通知, 不需要通知的事件返回 false
+func (n *notifier) convert(ev Event, lookup func(id int) *Topic) (Notification, bool) {
+	typ := ""
+	switch ev.Type {
+	case EVENT_SUBSCRIBE_FOUND:
+		typ = NOTIFY_TOPIC_SUBSCRIBED
+	case EVENT_TOPIC_ABANDONED:
+		typ = NOTIFY_TOPIC_ABANDONED
+	case EVENT_DOWN_FINISHED:
+		if r, ok := ev.Data.(DownResult); ok && !r.Success {
+			typ = NOTIFY_DOWN_FAILED
+		}
+	case EVENT_COOKIE_EXPIRED:
+		typ = NOTIFY_COOKIE_EXPIRED
+	case EVENT_PAN_TRANSFER:
+		data, _ := ev.Data.(gin.H)
+		switch data["Status"] {
+		case TRANSFER_STATUS_SUCCESS:
+			typ = NOTIFY_PAN_SUCCESS
+		case TRANSFER_STATUS_FAILED:
+			typ = NOTIFY_PAN_FAILED
+		}
+	case EVENT_PAN_SIGN:
+		typ = NOTIFY_PAN_SIGN
+	case EVENT_RECYCLE_PURGED:
+		typ = NOTIFY_RECYCLE_PURGED
+	case EVENT_STORAGE_QUOTA:
+		typ = NOTIFY_STORAGE_QUOTA
+	}
+	if typ == "" {
+		return Notification{}, false
+	}
+
+	topic := NotifyTopic{Id: ev.TopicId}
+	if t := lookup(ev.TopicId); t != nil {
+		topic.Title, topic.Author, topic.Uid = t.Title, t.Author, t.Uid
+	}
+	if topic.Title == "" {
+		switch data := ev.Data.(type) {
+		case map[string]any:
+			topic.Title, _ = data["Title"].(string)
+		case gin.H:
+			topic.Title, _ = data["Title"].(string)
+		}
+	}
+	ret := Notification{
+		Event: typ,
+		Title: notifyTitles[typ],
+		Topic: topic,
+		Data:  ev.Data,
+		Time:  ev.Time,
+	}
+	msg, e := execTemplate(n.templates[typ], ret)
+	if e != nil {
+		log.Printf("生成通知 %s 失败: %s\n", typ, e.Error())
+		msg = ret.Title
+	}
+	ret.Message = msg
+	ret.Text = ret.Title + "\n" + msg
+	return ret, true
+}
+
+func (n *notifier) dispatch(msg Notification) {
+	for _, hook := range n.hooks {
+		if !hook.accept(msg.Event) {
+			continue
+		}
+		select {
+		case hook.ch <- msg:
+		default:
+			log.Printf("通知 %s 队列已满, 丢弃: %s\n", hook.Name, msg.Event)
+		}
+	}
+}
+
+// 阻塞直到事件中心关闭
+func (n *notifier) run(srv *Server) {
+	for _, hook := range n.hooks {
+		go hook.loop()
+	}
+	defer func() {
+		for _, hook := range n.hooks {
+			close(hook.ch)
+		}
+	}()
+
+	lookup := func(id int) *Topic {
+		if id == 0 {
+			return nil
+		}
+		if topic, has := srv.cache.topics.Get(id); has {
+			return topic
+		}
+		return nil
+	}
+	ch := srv.events.subscribe(notifyQueueSize)
+	for ev := range ch {
+		if msg, ok := n.convert(ev, lookup); ok {
+			n.dispatch(msg)
+		}
+	}
+}
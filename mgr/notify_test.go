@@ -0,0 +1,131 @@
+package mgr
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"gopkg.in/ini.v1"
+)
+
+func TestNotifier(t *testing.T) {
+	var count atomic.Int32
+	bodies := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 第一次失败, 测试重试
+		if count.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		bodies <- string(data)
+	}))
+	defer ts.Close()
+
+	cfg, e := ini.Load([]byte(`
+[notify]
+retry = 2
+backoff = 10ms
+
+[notify-template]
+download.failed = 下载 {{.Topic.Title}} 失败: {{.Data.Message}}
+
+[notify.test]
+preset = wecom
+url = ` + ts.URL + `
+events = download.*, pan.failed
+
+[notify.off]
+enable = false
+url = ` + ts.URL))
+	assert.Equal(t, e, nil)
+
+	n, e := newNotifier(cfg)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(n.hooks), 1)
+
+	hook := n.hooks[0]
+	assert.Equal(t, hook.Name, "test")
+	assert.Equal(t, hook.Retry, 2)
+	assert.Equal(t, hook.Backoff, 10*time.Millisecond)
+	assert.Equal(t, hook.accept(NOTIFY_DOWN_FAILED), true)
+	assert.Equal(t, hook.accept(NOTIFY_PAN_FAILED), true)
+	assert.Equal(t, hook.accept(NOTIFY_PAN_SUCCESS), false)
+
+	lookup := func(id int) *Topic {
+		return &Topic{Id: id, Title: "测试帖子"}
+	}
+
+	// 下载成功不通知
+	_, ok := n.convert(Event{Type: EVENT_DOWN_FINISHED, TopicId: 1, Data: DownResult{Success: true}}, lookup)
+	assert.Equal(t, ok, false)
+
+	msg, ok := n.convert(Event{Type: EVENT_DOWN_FINISHED, TopicId: 1, Data: DownResult{Message: "timeout"}}, lookup)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, msg.Event, NOTIFY_DOWN_FAILED)
+	assert.Equal(t, msg.Message, "下载 测试帖子 失败: timeout")
+
+	pan, ok := n.convert(Event{Type: EVENT_PAN_TRANSFER, TopicId: 1, Data: gin.H{
+		"Pan": "Quark", "URL": "https://pan.quark.cn/s/abc", "Status": TRANSFER_STATUS_SUCCESS,
+	}}, lookup)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, pan.Event, NOTIFY_PAN_SUCCESS)
+	assert.Equal(t, pan.Message, "帖子 <测试帖子> (1) 中的 https://pan.quark.cn/s/abc 已转存到 Quark")
+
+	// 标题来自事件数据时不修改缓存中的帖子
+	cached := &Topic{Id: 2}
+	found, ok := n.convert(Event{Type: EVENT_SUBSCRIBE_FOUND, TopicId: 2, Data: map[string]any{"Name": "甲", "Title": "新帖"}},
+		func(int) *Topic { return cached })
+	assert.Equal(t, ok, true)
+	assert.Equal(t, found.Topic, NotifyTopic{Id: 2, Title: "新帖"})
+	assert.Equal(t, cached.Title, "")
+
+	// 已删除的帖子从事件数据中获取标题
+	purged, ok := n.convert(Event{Type: EVENT_RECYCLE_PURGED, TopicId: 3, Data: gin.H{"Title": "旧帖"}},
+		func(int) *Topic { return nil })
+	assert.Equal(t, ok, true)
+	assert.Equal(t, purged.Topic, NotifyTopic{Id: 3, Title: "旧帖"})
+
+	sign, ok := n.convert(Event{Type: EVENT_PAN_SIGN, Data: &QuarkSignResult{Pan: "quark", Nickname: "测试", Success: true, Message: "今日签到+20.00 MB"}}, lookup)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, sign.Event, NOTIFY_PAN_SIGN)
+	assert.Equal(t, sign.Message, "quark (测试) 签到成功: 今日签到+20.00 MB")
+
+	go hook.loop()
+	n.dispatch(pan) // 被过滤
+	n.dispatch(msg)
+	close(hook.ch)
+
+	select {
+	case body := <-bodies:
+		var data struct {
+			Text struct {
+				Content string `json:"content"`
+			} `json:"text"`
+		}
+		assert.Equal(t, json.Unmarshal([]byte(body), &data), nil)
+		assert.Equal(t, data.Text.Content, "帖子下载失败\n下载 测试帖子 失败: timeout")
+	case <-time.After(5 * time.Second):
+		t.Fatal("没有收到通知")
+	}
+	assert.Equal(t, count.Load(), int32(2))
+}
+
+func TestNotifyPreset(t *testing.T) {
+	hook := &notifyHook{Name: "tg", Preset: "telegram", Token: "123:abc", To: "42"}
+	assert.Equal(t, hook.init(), nil)
+
+	n := Notification{Title: "标题", Text: "标题\n内容", Token: hook.Token, To: hook.To}
+	url, _ := execTemplate(hook.url, n)
+	assert.Equal(t, url, "https://api.telegram.org/bot123:abc/sendMessage")
+	body, _ := execTemplate(hook.body, n)
+	assert.Equal(t, body, `{"chat_id":"42","text":"标题\n内容","disable_web_page_preview":true}`)
+
+	assert.NotEqual(t, (&notifyHook{Preset: "unknown"}).init(), nil)
+}
@@ -0,0 +1,122 @@
+package mgr
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 批量整理帖子, 未设置的字段保持不变
+type organizeRequest struct {
+	Ids        []int
+	Tags       *[]string // 替换全部标签
+	AddTags    []string  // 添加标签
+	RemoveTags []string  // 移除标签
+	Folder     *string   // 移动到文件夹, 空字符串表示移出文件夹
+	Note       *string   // 备注
+}
+
+type organizeResult struct {
+	Id    int
+	Ok    bool
+	Error string `json:",omitempty"`
+}
+
+func (r *organizeRequest) apply(md *Metadata) {
+	if r.Tags != nil {
+		md.SetTags(*r.Tags)
+	}
+	if len(r.AddTags) > 0 {
+		md.AddTags(normalizeTags(r.AddTags)...)
+	}
+	if len(r.RemoveTags) > 0 {
+		md.RemoveTags(normalizeTags(r.RemoveTags)...)
+	}
+	if r.Folder != nil {
+		md.SetFolder(*r.Folder)
+	}
+	if r.Note != nil {
+		md.SetNote(*r.Note)
+	}
+}
+
+func (srv *Server) topicOrganize() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		req := organizeRequest{}
+		if e := c.ShouldBindJSON(&req); e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
+			return
+		}
+		if len(req.Ids) == 0 {
+			c.JSON(http.StatusBadRequest, toErr("没有指定帖子"))
+			return
+		}
+
+		ret := make([]organizeResult, 0, len(req.Ids))
+		for _, id := range req.Ids {
+			topic, has := srv.cache.topics.Get(id)
+			if !has {
+				ret = append(ret, organizeResult{Id: id, Error: "未找到帖子"})
+				continue
+			}
+			req.apply(topic.Metadata)
+			topic.Modify()
+			if e := topic.SaveMeta(); e != nil {
+				ret = append(ret, organizeResult{Id: id, Error: e.Error()})
+				continue
+			}
+			srv.publish(EVENT_TOPIC_METADATA, id, topic.Metadata)
+			ret = append(ret, organizeResult{Id: id, Ok: true})
+		}
+		c.JSON(http.StatusOK, ret)
+	}
+}
+
+// 所有的标签和文件夹, 以及对应的帖子数量
+func (srv *Server) topicOrganizeStats() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		tags := make(map[string]int)
+		folders := make(map[string]int)
+		for _, topic := range srv.indexedTopics() {
+			md := topic.Metadata
+			for _, tag := range md.Tags {
+				tags[tag]++
+			}
+			if md.Folder != "" {
+				folders[md.Folder]++
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"Tags":    tags,
+			"Folders": folders,
+		})
+	}
+}
+
+// 按标签和文件夹过滤帖子, 多个标签需要同时满足
+func filterTopics(topics []*Topic, tags []string, folder string) []*Topic {
+	tags = normalizeTags(tags)
+	folder = normalizeFolder(folder)
+	if len(tags) == 0 && folder == "" {
+		return topics
+	}
+	ret := make([]*Topic, 0, len(topics))
+	for _, topic := range topics {
+		md := topic.Metadata
+		if folder != "" && !md.InFolder(folder) {
+			continue
+		}
+		matched := true
+		for _, tag := range tags {
+			if !md.HasTag(tag) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			ret = append(ret, topic)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,42 @@
+package mgr
+
+import (
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestOrganize(t *testing.T) {
+	assert.Equal(t, normalizeTags([]string{" a", "b", "", "a "}), []string{"a", "b"})
+	assert.Equal(t, normalizeFolder(" 游戏 / /攻略/ "), "游戏/攻略")
+
+	newTopic := func(id int) *Topic {
+		return &Topic{Id: id, Metadata: NewMetadata()}
+	}
+	t1, t2, t3 := newTopic(1), newTopic(2), newTopic(3)
+
+	folder := "游戏/攻略"
+	(&organizeRequest{Tags: &[]string{"攻略", "精华"}, Folder: &folder}).apply(t1.Metadata)
+	(&organizeRequest{AddTags: []string{"攻略"}}).apply(t2.Metadata)
+	(&organizeRequest{AddTags: []string{"精华", "水"}, RemoveTags: []string{"水"}}).apply(t3.Metadata)
+	folder = "游戏"
+	(&organizeRequest{Folder: &folder}).apply(t3.Metadata)
+
+	assert.Equal(t, t3.Metadata.Tags, []string{"精华"})
+
+	topics := []*Topic{t1, t2, t3}
+	ids := func(topics []*Topic) []int {
+		ret := make([]int, 0)
+		for _, topic := range topics {
+			ret = append(ret, topic.Id)
+		}
+		return ret
+	}
+	assert.Equal(t, ids(filterTopics(topics, nil, "")), []int{1, 2, 3})
+	assert.Equal(t, ids(filterTopics(topics, []string{"攻略"}, "")), []int{1, 2})
+	assert.Equal(t, ids(filterTopics(topics, []string{"攻略", "精华"}, "")), []int{1})
+	// 子文件夹也属于父文件夹
+	assert.Equal(t, ids(filterTopics(topics, nil, "游戏")), []int{1, 3})
+	assert.Equal(t, ids(filterTopics(topics, nil, "游戏/攻略/")), []int{1})
+	assert.Equal(t, ids(filterTopics(topics, nil, "游")), []int{})
+}
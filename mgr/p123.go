@@ -0,0 +1,344 @@
+package mgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	P123_LOGIN_URL = "https://login.123pan.com"
+	P123_API_URL   = "https://www.123pan.com"
+	P123_ROOT_ID   = 0
+	P123_PAGE_SIZE = 100
+	P123_FOLDER    = 1 // 文件类型: 目录
+)
+
+var regex123Share = regexp.MustCompile(`123(?:pan|684|865|912)\.(?:com|cn)/s/([\w-]+)`)
+
+// 123 云盘接口返回的错误
+type P123Error struct {
+	Code    int
+	Message string
+}
+
+func (e *P123Error) Error() string {
+	return fmt.Sprintf("123 云盘接口错误 %d: %s", e.Code, e.Message)
+}
+
+func (e *P123Error) tokenInvalid() bool {
+	return e.Code == http.StatusUnauthorized
+}
+
+type P123File struct {
+	FileId       int64  `json:"FileId"`
+	FileName     string `json:"FileName"`
+	Type         int    `json:"Type"` // 0: 文件, 1: 目录
+	Size         int64  `json:"Size"`
+	Etag         string `json:"Etag"`
+	ParentFileId int64  `json:"ParentFileId"`
+}
+
+type p123List struct {
+	InfoList []P123File `json:"InfoList"`
+	Next     string     `json:"Next"`
+}
+
+// 123 云盘客户端, 使用账号密码登录
+type P123 struct {
+	LoginURL string
+	APIURL   string
+	Passport string
+	Password string
+	Token    string
+	Nickname string
+	mutex    *sync.Mutex
+	client   *http.Client
+}
+
+func NewP123(passport, password string) *P123 {
+	return &P123{
+		LoginURL: P123_LOGIN_URL,
+		APIURL:   P123_API_URL,
+		Passport: strings.TrimSpace(passport),
+		Password: password,
+		mutex:    &sync.Mutex{},
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// 解析分享链接, 返回分享 key
+func Parse123Share(url string) (string, error) {
+	m := regex123Share.FindStringSubmatch(url)
+	if m == nil {
+		return "", fmt.Errorf("不是 123 云盘的分享链接: %s", url)
+	}
+	return m[1], nil
+}
+
+// 发送请求, token 为空时不带认证头
+func (p *P123) do(method, url, token string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, e := json.Marshal(body)
+		if e != nil {
+			return e
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, e := http.NewRequest(method, url, reader)
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Platform", "web")
+	req.Header.Set("App-Version", "3")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, e := p.client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	data, e := io.ReadAll(resp.Body)
+	if e != nil {
+		return e
+	}
+	ret := struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}{}
+	if e := json.Unmarshal(data, &ret); e != nil {
+		return fmt.Errorf("123 云盘接口返回无效的内容, 状态码: %d", resp.StatusCode)
+	}
+	// 登录接口成功时返回 200, 其它接口返回 0
+	if ret.Code != 0 && ret.Code != http.StatusOK {
+		return &P123Error{Code: ret.Code, Message: ret.Message}
+	}
+	if out == nil || len(ret.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(ret.Data, out)
+}
+
+func (p *P123) Login() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.login()
+}
+
+func (p *P123) login() error {
+	if p.Passport == "" || p.Password == "" {
+		return fmt.Errorf("123 云盘账号或密码为空")
+	}
+	p.Token = ""
+	ret := struct {
+		Token string `json:"token"`
+	}{}
+	e := p.do(http.MethodPost, p.LoginURL+"/api/user/sign_in", "", map[string]any{
+		"passport": p.Passport,
+		"password": p.Password,
+		"remember": true,
+	}, &ret)
+	if e != nil {
+		return e
+	}
+	if ret.Token == "" {
+		return fmt.Errorf("123 云盘登录失败")
+	}
+	p.Token = ret.Token
+	return nil
+}
+
+// 调用需要登录的接口, 令牌失效时重新登录后重试一次
+func (p *P123) call(method, path string, body any, out any) error {
+	for i := 0; ; i++ {
+		p.mutex.Lock()
+		if p.Token == "" {
+			if e := p.login(); e != nil {
+				p.mutex.Unlock()
+				return e
+			}
+		}
+		token := p.Token
+		p.mutex.Unlock()
+		e := p.do(method, p.APIURL+path, token, body, out)
+		if pe, ok := e.(*P123Error); ok && pe.tokenInvalid() && i == 0 {
+			p.mutex.Lock()
+			// 其他请求可能已经重新登录
+			if p.Token == token {
+				p.Token = ""
+			}
+			p.mutex.Unlock()
+			continue
+		}
+		return e
+	}
+}
+
+// 获取当前用户的信息, 用于检查登录状态
+func (p *P123) User() error {
+	ret := struct {
+		Nickname string `json:"Nickname"`
+	}{}
+	if e := p.call(http.MethodGet, "/b/api/user/info", nil, &ret); e != nil {
+		return e
+	}
+	p.Nickname = ret.Nickname
+	return nil
+}
+
+func (p *P123) list(path string, query url.Values) ([]P123File, error) {
+	files := make([]P123File, 0)
+	query.Set("limit", strconv.Itoa(P123_PAGE_SIZE))
+	for page := 1; ; page++ {
+		query.Set("Page", strconv.Itoa(page))
+		ret := p123List{}
+		if e := p.call(http.MethodGet, path+"?"+query.Encode(), nil, &ret); e != nil {
+			return nil, e
+		}
+		files = append(files, ret.InfoList...)
+		if ret.Next == "" || ret.Next == "-1" || len(ret.InfoList) == 0 {
+			return files, nil
+		}
+		query.Set("next", ret.Next)
+	}
+}
+
+// 列出分享中的文件, pwd 为提取码
+func (p *P123) ListShare(shareKey, pwd string, parentId int64) ([]P123File, error) {
+	return p.list("/b/api/share/get", url.Values{
+		"shareKey":       {shareKey},
+		"SharePwd":       {pwd},
+		"ParentFileId":   {strconv.FormatInt(parentId, 10)},
+		"next":           {"0"},
+		"orderBy":        {"file_name"},
+		"orderDirection": {"asc"},
+	})
+}
+
+// 列出网盘中目录下的文件
+func (p *P123) List(parentId int64) ([]P123File, error) {
+	return p.list("/b/api/file/list/new", url.Values{
+		"driveId":        {"0"},
+		"parentFileId":   {strconv.FormatInt(parentId, 10)},
+		"next":           {"0"},
+		"orderBy":        {"file_id"},
+		"orderDirection": {"desc"},
+		"trashed":        {"false"},
+	})
+}
+
+func (p *P123) find(parentId int64, name string) (*P123File, error) {
+	files, e := p.List(parentId)
+	if e != nil {
+		return nil, e
+	}
+	for _, f := range files {
+		if f.FileName == name {
+			return &f, nil
+		}
+	}
+	return nil, nil
+}
+
+// 根据路径获取文件, 不存在时返回 nil
+func (p *P123) GetByPath(path string) (*P123File, error) {
+	f := &P123File{FileId: P123_ROOT_ID, Type: P123_FOLDER}
+	for name := range strings.SplitSeq(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		var e error
+		if f, e = p.find(f.FileId, name); e != nil || f == nil {
+			return nil, e
+		}
+	}
+	return f, nil
+}
+
+// 逐级创建目录, 已存在时直接使用, 返回最后一级目录的 ID
+func (p *P123) Mkdir(path string) (int64, error) {
+	parent := int64(P123_ROOT_ID)
+	for name := range strings.SplitSeq(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		f, e := p.find(parent, name)
+		if e != nil {
+			return 0, e
+		}
+		if f == nil {
+			ret := struct {
+				Info P123File `json:"Info"`
+			}{}
+			e := p.call(http.MethodPost, "/b/api/file/upload_request", map[string]any{
+				"driveId":      0,
+				"etag":         "",
+				"fileName":     name,
+				"parentFileId": parent,
+				"size":         0,
+				"type":         P123_FOLDER,
+				"duplicate":    1,
+				"NotReuse":     true,
+				"event":        "newCreateFolder",
+			}, &ret)
+			if e != nil {
+				return 0, e
+			}
+			f = &ret.Info
+		}
+		parent = f.FileId
+	}
+	return parent, nil
+}
+
+// 保存分享中的文件到目录
+func (p *P123) CopyShare(shareKey, pwd string, files []P123File, toParentId int64) error {
+	list := make([]map[string]any, 0, len(files))
+	for _, f := range files {
+		list = append(list, map[string]any{
+			"fileId":       f.FileId,
+			"size":         f.Size,
+			"etag":         f.Etag,
+			"type":         f.Type,
+			"parentFileId": toParentId,
+			"fileName":     f.FileName,
+			"driveId":      0,
+		})
+	}
+	return p.call(http.MethodPost, "/b/api/file/copy/async", map[string]any{
+		"fileList":     list,
+		"shareKey":     shareKey,
+		"sharePwd":     pwd,
+		"currentLevel": 1,
+	}, nil)
+}
+
+func (p *P123) Move(fileId, toParentId int64) error {
+	return p.call(http.MethodPost, "/b/api/file/mod_pid", map[string]any{
+		"fileIdList":   []map[string]int64{{"FileId": fileId}},
+		"parentFileId": toParentId,
+		"event":        "fileMove",
+	}, nil)
+}
+
+// 移动到回收站
+func (p *P123) Trash(fileId int64) error {
+	return p.call(http.MethodPost, "/b/api/file/trash", map[string]any{
+		"driveId":           0,
+		"fileTrashInfoList": []map[string]int64{{"FileId": fileId}},
+		"operation":         true,
+		"event":             "intoRecycle",
+	}, nil)
+}
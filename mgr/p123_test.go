@@ -0,0 +1,157 @@
+package mgr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// 123 云盘接口的本地模拟, 只实现转存用到的接口
+type p123Stub struct {
+	mutex  sync.Mutex
+	logins int
+	files  map[int64]*P123File
+	shared []P123File
+	seq    int64
+}
+
+func (s *p123Stub) add(parent int64, name string, typ int, size int64) *P123File {
+	s.seq++
+	f := &P123File{FileId: s.seq, ParentFileId: parent, FileName: name, Type: typ, Size: size}
+	s.files[f.FileId] = f
+	return f
+}
+
+func (s *p123Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	body := make(map[string]any)
+	json.NewDecoder(r.Body).Decode(&body)
+	num := func(v any) int64 {
+		f, _ := v.(float64)
+		return int64(f)
+	}
+	reply := func(code int, data any) {
+		json.NewEncoder(w).Encode(map[string]any{"code": code, "message": "msg", "data": data})
+	}
+
+	if r.URL.Path == "/api/user/sign_in" {
+		if body["passport"] != "user" || body["password"] != "pass" {
+			reply(5113, nil)
+			return
+		}
+		s.logins++
+		reply(http.StatusOK, map[string]string{"token": "t" + strconv.Itoa(s.logins)})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer t"+strconv.Itoa(s.logins) {
+		reply(http.StatusUnauthorized, nil)
+		return
+	}
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/b/api/user/info":
+		reply(0, map[string]string{"Nickname": "测试"})
+	case "/b/api/share/get":
+		if q.Get("shareKey") != "key1" || q.Get("SharePwd") != "abcd" {
+			reply(5103, nil)
+			return
+		}
+		// 分两页返回, 检查翻页
+		if q.Get("Page") == "1" {
+			reply(0, p123List{InfoList: s.shared[:1], Next: "1"})
+		} else {
+			reply(0, p123List{InfoList: s.shared[1:], Next: "-1"})
+		}
+	case "/b/api/file/list/new":
+		parent, _ := strconv.ParseInt(q.Get("parentFileId"), 10, 64)
+		items := make([]P123File, 0)
+		for _, f := range s.files {
+			if f.ParentFileId == parent {
+				items = append(items, *f)
+			}
+		}
+		reply(0, p123List{InfoList: items, Next: "-1"})
+	case "/b/api/file/upload_request":
+		f := s.add(num(body["parentFileId"]), body["fileName"].(string), P123_FOLDER, 0)
+		reply(0, map[string]any{"Info": f})
+	case "/b/api/file/copy/async":
+		for _, v := range body["fileList"].([]any) {
+			m := v.(map[string]any)
+			s.add(num(m["parentFileId"]), m["fileName"].(string), int(num(m["type"])), num(m["size"]))
+		}
+		reply(0, nil)
+	case "/b/api/file/mod_pid":
+		for _, v := range body["fileIdList"].([]any) {
+			s.files[num(v.(map[string]any)["FileId"])].ParentFileId = num(body["parentFileId"])
+		}
+		reply(0, nil)
+	case "/b/api/file/trash":
+		for _, v := range body["fileTrashInfoList"].([]any) {
+			delete(s.files, num(v.(map[string]any)["FileId"]))
+		}
+		reply(0, nil)
+	default:
+		reply(404, nil)
+	}
+}
+
+func TestP123Pan(t *testing.T) {
+	key, e := Parse123Share("https://www.123684.com/s/key1-AbC?提取码:abcd")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, key, "key1-AbC")
+	assert.Equal(t, extractText("[链接](https://www.123pan.com/s/key1)")[0].URL, "https://www.123pan.com/s/key1")
+
+	stub := &p123Stub{
+		files: map[int64]*P123File{},
+		shared: []P123File{
+			{FileId: 1001, FileName: "a.zip", Size: 10},
+			{FileId: 1002, FileName: "b", Type: P123_FOLDER},
+		},
+		seq: 1,
+	}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	pp := NewP123Pan(P123Cfg{Name: "123pan", Passport: "user", Password: "pass"})
+	pp.p123 = NewP123(pp.cfg.Passport, pp.cfg.Password)
+	pp.p123.LoginURL, pp.p123.APIURL = ts.URL, ts.URL
+	assert.Equal(t, pp.Init(), nil)
+	defer pp.Close()
+	assert.Equal(t, pp.p123.Nickname, "测试")
+
+	record := TransferRecord{URL: "https://www.123pan.com/s/key1", Tqm: "abcd"}
+	assert.Equal(t, pp.Support(record), true)
+	assert.Equal(t, pp.IsExist(100), false)
+
+	// 令牌失效时重新登录后重试
+	pp.p123.Token = "expired"
+	assert.Equal(t, pp.doTransfer(p123Task{100, record, PAN_OPT_SAVE}), nil)
+	assert.Equal(t, stub.logins, 2)
+	assert.Equal(t, pp.IsExist(100), true)
+	dir, e := pp.p123.GetByPath(P123BaseTransferDest + "/100")
+	assert.Equal(t, e, nil)
+	files, e := pp.p123.List(dir.FileId)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 2)
+
+	e = pp.doTransfer(p123Task{100, record, PAN_OPT_SAVE})
+	assert.Equal(t, e.Error(), "P123Pan: 文件都已存在")
+	assert.NotEqual(t, pp.doTransfer(p123Task{101, TransferRecord{URL: record.URL}, PAN_OPT_SAVE}), nil)
+
+	assert.Equal(t, pp.Move(100), nil)
+	assert.Equal(t, pp.IsExist(100), false)
+	moved, e := pp.p123.GetByPath(P123BaseMoveDest + "/100")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, moved.FileId, dir.FileId)
+
+	pp.cfg.TransferDest = P123BaseMoveDest
+	assert.Equal(t, pp.Delete(100), nil)
+	assert.Equal(t, pp.IsExist(100), false)
+}
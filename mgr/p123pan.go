@@ -0,0 +1,276 @@
+package mgr
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/i2534/ngamm/mgr/log"
+
+	"gopkg.in/ini.v1"
+)
+
+var (
+	P123BaseTransferDest = "/来自分享"
+	P123BaseMoveDest     = "/Tidy"
+)
+
+var p123Driver = RegisterPanDriver(PanDriver{
+	Name:     "123pan",
+	Patterns: []*regexp.Regexp{regex123Share},
+	New: func(name, root string, sec *ini.Section) (Pan, error) {
+		pc := new(P123Cfg)
+		if e := sec.MapTo(pc); e != nil {
+			return nil, e
+		}
+		if pc.Transfer == "" {
+			pc.Transfer = TRANSFER_TYPE_AUTO
+		}
+		pc.Name, pc.Root = name, root
+		return NewP123Pan(*pc), nil
+	},
+})
+
+type p123Task struct {
+	topicId int
+	record  TransferRecord
+	opt     PanOpt
+}
+
+type P123Cfg struct {
+	Name         string // 网盘实例名称, 即配置段名称
+	Root         string // 工作目录
+	Enable       bool   `ini:"enable"`    // 是否启用
+	Transfer     string `ini:"transfer"`  // 转存方式: auto, manual
+	TransferDest string `ini:"directory"` // 转存的根目录
+	MoveDest     string `ini:"move_dir"`  // 移动的根目录
+	Passport     string `ini:"passport"`  // 登录账号, 手机号或邮箱
+	Password     string `ini:"password"`  // 登录密码
+}
+
+type P123Pan struct {
+	cfg    P123Cfg
+	p123   *P123
+	mutex  *sync.Mutex
+	tasks  chan p123Task
+	holder *PanHolder
+}
+
+func NewP123Pan(cfg P123Cfg) *P123Pan {
+	p := &P123Pan{
+		cfg:   cfg,
+		mutex: &sync.Mutex{},
+	}
+	if p.cfg.TransferDest == "" {
+		p.cfg.TransferDest = P123BaseTransferDest
+	}
+	if p.cfg.MoveDest == "" {
+		p.cfg.MoveDest = P123BaseMoveDest
+	}
+	return p
+}
+
+func (p *P123Pan) Name() string {
+	if p.cfg.Name == "" {
+		return p123Driver.Name
+	}
+	return p.cfg.Name
+}
+
+func (p *P123Pan) SetHolder(holder *PanHolder) {
+	p.holder = holder
+}
+
+func (p *P123Pan) Support(record TransferRecord) bool {
+	return p123Driver.Match(record.URL)
+}
+
+func (p *P123Pan) TransferType() string {
+	return p.cfg.Transfer
+}
+
+func (p *P123Pan) Init() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.p123 == nil {
+		p.p123 = NewP123(p.cfg.Passport, p.cfg.Password)
+	}
+	if e := p.p123.Login(); e != nil {
+		return fmt.Errorf("P123Pan: 登录失败: %s", e.Error())
+	}
+	if e := p.p123.User(); e != nil {
+		return fmt.Errorf("P123Pan: 获取用户信息失败: %s", e.Error())
+	}
+	log.Printf("P123Pan: 登录成功, 用户名: %s\n", p.p123.Nickname)
+
+	if p.tasks == nil {
+		p.tasks = make(chan p123Task, 99)
+		tasks := p.tasks
+		go func() {
+			log.Println("P123Pan: 启动任务处理协程")
+			for task := range tasks {
+				var e error
+				var status string
+				switch task.opt {
+				case PAN_OPT_DELETE:
+					e = p.Delete(task.topicId)
+					status = TRANSFER_STATUS_PENDING
+				case PAN_OPT_SAVE:
+					e = p.doTransfer(task)
+					status = TRANSFER_STATUS_SUCCESS
+				}
+				if p.holder != nil {
+					if e != nil {
+						p.holder.notify(task.topicId, task.record.URL, TRANSFER_STATUS_FAILED, e.Error())
+					} else {
+						p.holder.notify(task.topicId, task.record.URL, status, "")
+					}
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func (p *P123Pan) Check() error {
+	if p.p123 == nil {
+		return fmt.Errorf("P123Pan: 未初始化")
+	}
+	if e := p.p123.User(); e != nil {
+		return fmt.Errorf("P123Pan: %s", e.Error())
+	}
+	return nil
+}
+
+func (p *P123Pan) topicDir(topicId int) string {
+	return fmt.Sprintf("%s/%d", p.cfg.TransferDest, topicId)
+}
+
+func (p *P123Pan) doTransfer(task p123Task) error {
+	p123 := p.p123
+	url := task.record.URL
+	log.Group(groupPan).Printf("P123Pan: 处理转存任务: %d, %s\n", task.topicId, url)
+
+	shareKey, e := Parse123Share(url)
+	if e != nil {
+		return fmt.Errorf("P123Pan: %s", e.Error())
+	}
+	pwd := task.record.Tqm
+	shared, e := p123.ListShare(shareKey, pwd, P123_ROOT_ID)
+	if e != nil {
+		return fmt.Errorf("P123Pan: 获取分享文件失败, %s", e.Error())
+	}
+	if len(shared) == 0 {
+		return fmt.Errorf("P123Pan: 分享链接 %s 中没有有效文件", url)
+	}
+
+	dir := p.topicDir(task.topicId)
+	dirId, e := p123.Mkdir(dir)
+	if e != nil {
+		return fmt.Errorf("P123Pan: 创建目录 %s 失败, %s", dir, e.Error())
+	}
+	existed, e := p123.List(dirId)
+	if e != nil {
+		return fmt.Errorf("P123Pan: 获取目录 %s 失败, %s", dir, e.Error())
+	}
+	sizes := make(map[string]int64, len(existed))
+	for _, f := range existed {
+		sizes[f.FileName] = f.Size
+	}
+	files := make([]P123File, 0, len(shared))
+	for _, f := range shared {
+		if size, has := sizes[f.FileName]; has && size == f.Size {
+			log.Group(groupPan).Printf("P123Pan: 文件 %s 已存在, 跳过", f.FileName)
+			continue
+		}
+		files = append(files, f)
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("P123Pan: 文件都已存在")
+	}
+
+	if e := p123.CopyShare(shareKey, pwd, files, dirId); e != nil {
+		if len(existed) == 0 { // 保存前为空目录, 保存又失败, 删除目录
+			log.Group(groupPan).Printf("P123Pan: 目录 %s 为空, 删除", dir)
+			p123.Trash(dirId)
+		}
+		return fmt.Errorf("P123Pan: 保存文件失败, %s", e.Error())
+	}
+
+	log.Group(groupPan).Printf("P123Pan: 处理转存任务完成: %d, %s\n", task.topicId, url)
+	return nil
+}
+
+func (p *P123Pan) Transfer(topicId int, record TransferRecord) error {
+	p.tasks <- p123Task{
+		topicId,
+		record,
+		PAN_OPT_SAVE,
+	}
+	return nil
+}
+
+func (p *P123Pan) TransferOpt(topicId int, record *TransferRecord, opt PanOpt) error {
+	p.tasks <- p123Task{
+		topicId,
+		*record,
+		opt,
+	}
+	return nil
+}
+
+// 获取帖子目录的 ID, 不存在时返回 0
+func (p *P123Pan) getTopicDirId(topicId int) int64 {
+	f, e := p.p123.GetByPath(p.topicDir(topicId))
+	if e != nil {
+		log.Printf("P123Pan: 获取帖子 %d 的目录失败: %s\n", topicId, e.Error())
+		return 0
+	}
+	if f == nil {
+		return 0
+	}
+	return f.FileId
+}
+
+func (p *P123Pan) IsExist(topicId int) bool {
+	return p.getTopicDirId(topicId) != 0
+}
+
+func (p *P123Pan) Move(topicId int) error {
+	srcId := p.getTopicDirId(topicId)
+	if srcId == 0 {
+		return fmt.Errorf("P123Pan: 获取帖子 %d 的目录失败", topicId)
+	}
+	dstId, e := p.p123.Mkdir(p.cfg.MoveDest)
+	if e != nil {
+		return fmt.Errorf("P123Pan: 创建移动目标目录失败, %s", e.Error())
+	}
+	if e := p.p123.Move(srcId, dstId); e != nil {
+		return fmt.Errorf("P123Pan: 移动文件失败, %s", e.Error())
+	}
+	return nil
+}
+
+func (p *P123Pan) Delete(topicId int) error {
+	srcId := p.getTopicDirId(topicId)
+	if srcId == 0 {
+		return fmt.Errorf("P123Pan: 获取帖子 %d 的目录失败", topicId)
+	}
+	if e := p.p123.Trash(srcId); e != nil {
+		return fmt.Errorf("P123Pan: 删除文件失败, %s", e.Error())
+	}
+	return nil
+}
+
+func (p *P123Pan) queueLen() int {
+	return len(p.tasks)
+}
+
+func (p *P123Pan) Close() error {
+	if p.tasks != nil {
+		close(p.tasks)
+		p.tasks = nil
+	}
+	return nil
+}
@@ -3,17 +3,16 @@ package mgr
 import (
 	"encoding/json"
 	"fmt"
-	"html"
 	"io"
 	"net/http"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/i2534/ngamm/mgr/log"
 
 	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
 	"gopkg.in/ini.v1"
 )
 
@@ -26,19 +25,17 @@ const (
 	TRANSFER_STATUS_PENDING = "pending" // 待处理
 	TRANSFER_STATUS_SUCCESS = "success" // 成功
 	TRANSFER_STATUS_FAILED  = "failed"  // 失败
+	TRANSFER_STATUS_EXPIRED = "expired" // 分享已失效
 
 	PAN_OPT_SAVE   PanOpt = iota // 保存
 	PAN_OPT_DELETE PanOpt = iota // 删除
 )
 
 var (
-	PAN_CONFIG   = "config.ini"
-	PAN_JSON     = "pan.json"
-	PAN_PWD_FILE = "_uzp.txt"
-
-	panURLRegex *regexp.Regexp = regexp.MustCompile(`\((https://pan\..+)\)`)
-	panTqmRegex *regexp.Regexp = regexp.MustCompile(`提取码[：:\s]*([a-zA-Z0-9]{4})`)
-	panPwdRegex *regexp.Regexp = regexp.MustCompile(`解压密?码[：:\s统一为]*(.+)`)
+	PAN_CONFIG      = "config.ini"
+	PAN_JSON        = "pan.json"
+	PAN_PWD_FILE    = "_uzp.txt"
+	PAN_README_FILE = "README.txt"
 
 	groupPan = log.GROUP_PAN
 )
@@ -49,6 +46,8 @@ type Pan interface {
 	Name() string
 	SetHolder(holder *PanHolder)
 	Init() error
+	// 检查登录状态
+	Check() error
 	Support(record TransferRecord) bool
 	TransferType() string
 	// 保存分享到网盘, 实现自行处理队列
@@ -70,6 +69,11 @@ type TransferRecord struct {
 	Saved   *bool  `json:"Saved,omitempty"` // 是否已保存, 旧属性, 由 Status 代替
 	Status  string // 状态
 	Message string // 错误信息
+
+	Health     *LinkHealth `json:",omitempty"` // 最近一次的链接检查结果
+	Replaces   string      `json:",omitempty"` // 替代的失效链接
+	ReplacedBy string      `json:",omitempty"` // 替代此链接的新链接
+	File       string      `json:",omitempty"` // 下载到本地的文件名, 只用于蓝奏云
 }
 
 func (r *TransferRecord) ChangeStatus(status string, message string) {
@@ -139,14 +143,20 @@ func cachePanTopic(topic *Topic, records []*TransferRecord) {
 }
 
 type PanHolder struct {
-	Root  string      // 网盘根目录
-	Pans  []Pan       // 网盘列表
-	hooks []webhook   // 网盘钩子
-	msgCh chan string // 网盘消息
-	srv   *Server
+	Root        string           // 网盘根目录
+	Pans        []Pan            // 网盘列表
+	hooks       []webhook        // 网盘钩子
+	extract     ExtractOptions   // 分享链接的提取选项
+	linkCheck   LinkCheckOptions // 分享链接的检查选项
+	linkCheckId cron.EntryID     // 链接检查任务的 ID
+	msgCh       chan string      // 网盘消息
+	srv         *Server
 }
 
 func (p *PanHolder) Close() error {
+	if p.linkCheckId != 0 {
+		p.srv.cron.Remove(p.linkCheckId)
+	}
 	for _, pan := range p.Pans {
 		pan.Close()
 	}
@@ -171,15 +181,25 @@ func NewPanHolder(root string, srv *Server) (*PanHolder, error) {
 		msgCh: make(chan string, 99),
 	}
 
+	ph.extract = newExtractOptions(cfg)
+	ph.linkCheck = newLinkCheckOptions(cfg)
 	ph.initHook(cfg)
-	ph.initBaidu(cfg.Section("baidu"))
-	ph.initQuark(cfg.Section("quark"))
+	ph.initPans(cfg)
+
+	if srv != nil && srv.cron != nil && ph.linkCheck.Interval > 0 {
+		if id, e := srv.cron.AddFunc("@every "+ph.linkCheck.Interval.String(), ph.checkLinks); e != nil {
+			log.Println("添加分享链接检查任务失败:", e.Error())
+		} else {
+			ph.linkCheckId = id
+		}
+	}
 
 	go func() {
 		for msg := range ph.msgCh {
 			log.Println("准备发送网盘消息:", msg)
 			for _, hook := range ph.hooks {
 				if e := hook.send(msg); e != nil {
+					metricWebhookFailed.WithLabelValues(hook.Name).Inc()
 					log.Printf("发送网盘消息到 %s 失败: %s\n", hook.Name, e.Error())
 				}
 			}
@@ -189,62 +209,6 @@ func NewPanHolder(root string, srv *Server) (*PanHolder, error) {
 	return ph, nil
 }
 
-func (p *PanHolder) initBaidu(cfg *ini.Section) {
-	if cfg == nil {
-		return
-	}
-
-	bc := new(BaiduCfg)
-	if e := cfg.MapTo(bc); e != nil {
-		log.Println("BaiduPan 配置解析失败:", e.Error())
-	} else {
-		if bc.Enable {
-			if bc.Transfer == "" {
-				bc.Transfer = TRANSFER_TYPE_AUTO
-			}
-			bc.Root = filepath.Join(p.Root, "baidu")
-			baidu := NewBaidu(*bc)
-			if e := baidu.Init(); e != nil {
-				log.Println("初始化失败:", e.Error())
-				p.msgCh <- e.Error()
-			} else {
-				log.Println("BaiduPan 初始化完成")
-				baidu.SetHolder(p)
-				p.Pans = append(p.Pans, baidu)
-			}
-		} else {
-			log.Println("BaiduPan 未启用")
-		}
-	}
-}
-func (p *PanHolder) initQuark(cfg *ini.Section) {
-	if cfg == nil {
-		return
-	}
-	qc := new(QuarkCfg)
-	if e := cfg.MapTo(qc); e != nil {
-		log.Println("QuarkPan 配置解析失败:", e.Error())
-	} else {
-		if qc.Enable {
-			if qc.Transfer == "" {
-				qc.Transfer = TRANSFER_TYPE_AUTO
-			}
-			qc.Root = filepath.Join(p.Root, "quark")
-			quark := NewQuarkPan(*qc)
-			if e := quark.Init(); e != nil {
-				log.Println("初始化失败:", e.Error())
-				p.msgCh <- e.Error()
-			} else {
-				log.Println("QuarkPan 初始化完成")
-				quark.SetHolder(p)
-				p.Pans = append(p.Pans, quark)
-			}
-		} else {
-			log.Println("QuarkPan 未启用")
-		}
-	}
-}
-
 func (p *PanHolder) initHook(cfg *ini.File) {
 	if cfg == nil {
 		return
@@ -268,140 +232,266 @@ func (p *PanHolder) initHook(cfg *ini.File) {
 	}
 }
 
+// 帖子的说明, 包括标题, 链接和作者, 帖子未加载时为空
+func (p *PanHolder) topicReadme(topicId int) string {
+	if p.srv == nil || p.srv.cache == nil {
+		return ""
+	}
+	topic, has := p.srv.cache.topics.Get(topicId)
+	if !has {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "标题: %s\n", topic.Title)
+	if p.srv.nga != nil {
+		fmt.Fprintf(&sb, "链接: %s/read.php?tid=%d\n", p.srv.nga.BaseURL(), topic.Id)
+	}
+	fmt.Fprintf(&sb, "作者: %s\n", topic.Author)
+	return sb.String()
+}
+
+// 处理旧的网盘记录: 补全网盘名称, 将 Saved 转换为 Status, 返回是否有修改
+func (p *PanHolder) normalizeRecord(r *TransferRecord) bool {
+	changed := false
+	if r.Name == "" && p != nil {
+		for _, pan := range p.Pans {
+			if pan.Support(*r) {
+				r.Name = pan.Name()
+				changed = true
+				break
+			}
+		}
+	}
+	if r.Status == "" && r.Saved != nil {
+		if *r.Saved {
+			r.ChangeStatus(TRANSFER_STATUS_SUCCESS, "")
+		} else {
+			r.ChangeStatus(TRANSFER_STATUS_PENDING, "")
+		}
+		changed = true
+	}
+	return changed
+}
+
+// 根据链接找到对应的网盘名称
+func (p *PanHolder) panName(url string) string {
+	if pan := p.panFor(TransferRecord{URL: url}); pan != nil {
+		return pan.Name()
+	}
+	return "unknown"
+}
+
+// 先保存网盘记录的状态, 再在释放元数据锁之后发布事件, 发布时会根据 pan.json 更新索引
 func (p *PanHolder) notify(topicId int, url, status, msg string) {
+	name := p.panName(url)
+	metricPanTransfer.WithLabelValues(name, status).Inc()
+
+	if topic, has := p.srv.cache.topics.Get(topicId); has {
+		p.saveStatus(topic, url, status, msg)
+	} else {
+		log.Println("未找到帖子:", topicId)
+	}
+
+	p.srv.publish(EVENT_PAN_TRANSFER, topicId, gin.H{
+		"Pan":     name,
+		"URL":     url,
+		"Status":  status,
+		"Message": msg,
+	})
+
 	if status == TRANSFER_STATUS_FAILED && msg != "" {
 		p.msgCh <- msg
 	}
+}
 
-	if topic, has := p.srv.cache.topics.Get(topicId); has {
-		topic.Metadata.mutex.Lock()
-		defer topic.Metadata.mutex.Unlock()
+func (p *PanHolder) saveStatus(topic *Topic, url, status, msg string) {
+	topic.Metadata.mutex.Lock()
+	defer topic.Metadata.mutex.Unlock()
 
-		if records, e := topic.loadPanRecords(); e != nil {
-			log.Println("加载网盘记录失败:", e.Error())
-		} else {
-			changed := false
-			for _, r := range records {
-				if r.URL == url {
-					r.ChangeStatus(status, msg)
-					changed = true
-					break
-				}
+	records, e := topic.loadPanRecords()
+	if e != nil {
+		log.Println("加载网盘记录失败:", e.Error())
+		return
+	}
+	for _, r := range records {
+		if r.URL == url {
+			r.ChangeStatus(status, msg)
+			if e := topic.savePanRecords(records); e != nil {
+				log.Println("保存网盘记录失败:", e.Error())
 			}
-			if changed {
-				if e := topic.savePanRecords(records); e != nil {
-					log.Println("保存网盘记录失败:", e.Error())
-				}
+			return
+		}
+	}
+}
+
+// 按链接合并网盘记录, 已有的记录保持原来的状态, 只补充缺少的提取码和解压密码
+// 返回合并后的记录, 新增的记录, 以及已有的记录是否有变化
+func mergeTransferRecords(olds, news []*TransferRecord) ([]*TransferRecord, []*TransferRecord, bool) {
+	byURL := make(map[string]*TransferRecord, len(olds))
+	for _, r := range olds {
+		byURL[r.URL] = r
+	}
+	merged := append(make([]*TransferRecord, 0, len(olds)+len(news)), olds...)
+	added := make([]*TransferRecord, 0)
+	changed := false
+	for _, r := range news {
+		if old, has := byURL[r.URL]; has {
+			if old.Tqm == "" && r.Tqm != "" {
+				old.Tqm = r.Tqm
+				changed = true
+			}
+			if old.Pwd == "" && r.Pwd != "" {
+				old.Pwd = r.Pwd
+				changed = true
 			}
+			continue
 		}
-	} else {
-		log.Println("未找到帖子:", topicId)
+		byURL[r.URL] = r
+		merged = append(merged, r)
+		added = append(added, r)
 	}
+	return merged, added, changed
 }
 
-// 自动转存
+// 自动转存, 帖子更新后重新提取链接, 只转存新增的链接, 以及之前失败但补充了提取码的链接.
+// 网盘的队列满时 Transfer 会阻塞, 而处理任务时需要元数据锁, 所以在释放锁之后再加入队列
 func (t *Topic) AutoTransfer(ph *PanHolder) {
 	if ph == nil {
 		return
 	}
-	t.Metadata.mutex.Lock()
-	defer t.Metadata.mutex.Unlock()
+	jobs, changed := t.autoTransferJobs(ph)
+	// 新发现的网盘记录需要更新到索引中, 索引时会获取元数据锁, 所以在释放锁之后更新
+	if changed {
+		ph.srv.indexTopic(t)
+	}
 
-	if t.root.IsExist(PAN_JSON) {
+	failed := make(map[string]string)
+	for _, j := range jobs {
+		if e := j.pan.Transfer(t.Id, j.record); e != nil {
+			log.Printf("保存 %d 到网盘 %s 失败: %s\n", t.Id, j.pan.Name(), e.Error())
+			failed[j.record.URL] = e.Error()
+		}
+	}
+	if len(failed) == 0 {
 		return
 	}
+	if t.saveFailed(failed) {
+		ph.srv.indexTopic(t)
+	}
+}
 
-	rs, e := t.ParseTransferRecord()
+// 将加入队列失败的链接标记为失败, 返回是否保存成功
+func (t *Topic) saveFailed(failed map[string]string) bool {
+	t.Metadata.mutex.Lock()
+	defer t.Metadata.mutex.Unlock()
+	records, e := t.loadPanRecords()
 	if e != nil {
-		log.Printf("获取网盘链接信息失败: %s\n", e.Error())
-		return
+		log.Printf("读取帖子 %d 的网盘记录失败: %s\n", t.Id, e.Error())
+		return false
 	}
-
-	cachePanTopic(t, rs)
-
-	changed := false
-	for _, r := range rs {
-		for _, pan := range ph.Pans {
-			if pan.TransferType() != TRANSFER_TYPE_AUTO || !pan.Support(*r) {
-				continue
-			}
-			r.Name = pan.Name()
-			r.Status = TRANSFER_STATUS_PENDING
-			if e := pan.Transfer(t.Id, *r); e != nil {
-				r.ChangeStatus(TRANSFER_STATUS_FAILED, e.Error())
-				log.Printf("保存 %d 到网盘 %s 失败: %s\n", t.Id, pan.Name(), e.Error())
-			}
-			changed = true
+	for _, r := range records {
+		if msg, has := failed[r.URL]; has {
+			r.ChangeStatus(TRANSFER_STATUS_FAILED, msg)
 		}
 	}
-
-	if changed {
-		if e := t.savePanRecords(rs); e != nil {
-			log.Printf("保存网盘记录失败: %s\n", e.Error())
-		}
+	if e := t.savePanRecords(records); e != nil {
+		log.Printf("保存网盘记录失败: %s\n", e.Error())
+		return false
 	}
+	return true
 }
 
-func (t *Topic) ParseTransferRecord() ([]*TransferRecord, error) {
-	records := make([]*TransferRecord, 0)
+type transferJob struct {
+	pan    Pan
+	record TransferRecord
+}
 
-	floor := 0
-	pwd := ""
-	var record *TransferRecord
+// 合并网盘记录并选出需要转存的链接, 保存为等待中的状态, 返回需要转存的链接和网盘记录是否已保存
+func (t *Topic) autoTransferJobs(ph *PanHolder) ([]transferJob, bool) {
+	t.Metadata.mutex.Lock()
+	defer t.Metadata.mutex.Unlock()
 
-	seq, e := t.readPostCore()
+	rs, e := t.extractTransferRecords(ph.extract)
 	if e != nil {
-		return nil, e
+		log.Printf("获取网盘链接信息失败: %s\n", e.Error())
+		return nil, false
 	}
-	for line := range seq {
-		line = strings.TrimSpace(line)
-
-		m := panURLRegex.FindStringSubmatch(line)
-		if len(m) > 1 {
-			url := strings.TrimSpace(m[1])
-			// 去除重复的, 因为可能有引用
-			exists := false
-			for _, rec := range records {
-				if rec.URL == url {
-					exists = true
-					break
-				}
-			}
-			if exists {
-				continue
-			}
-			record = &TransferRecord{
-				URL: url,
-			}
-			records = append(records, record)
+
+	var olds []*TransferRecord
+	if t.root.IsExist(PAN_JSON) {
+		if olds, e = readPanRecords(t.root); e != nil {
+			log.Printf("读取帖子 %d 的网盘记录失败: %s\n", t.Id, e.Error())
+			return nil, false
 		}
-		m = panTqmRegex.FindStringSubmatch(line)
-		if len(m) > 1 {
-			tqm := strings.TrimSpace(m[1])
-			if record != nil {
-				record.Tqm = tqm
+	}
+	// 之前因为没有提取码失败的链接, 合并后补充了提取码时重新转存
+	noTqm := make(map[*TransferRecord]bool)
+	for _, r := range olds {
+		if r.Status == TRANSFER_STATUS_FAILED && r.Tqm == "" {
+			noTqm[r] = true
+		}
+	}
+	records, added, changed := mergeTransferRecords(olds, rs)
+	cachePanTopic(t, records)
+	if olds != nil && len(added) > 0 {
+		log.Group(groupPan).Printf("帖子 %d 发现 %d 个新的网盘链接\n", t.Id, len(added))
+		pairReplacements(records, added)
+		changed = true
+	}
+
+	byURL := make(map[string]*TransferRecord, len(records))
+	for _, r := range records {
+		byURL[r.URL] = r
+	}
+	jobs := make([]transferJob, 0)
+	for _, r := range added {
+		pan := ph.autoPan(*r)
+		// 替代失效链接时, 优先使用原来转存的网盘, 即使是手动转存的
+		if old, has := byURL[r.Replaces]; has && old.Name != "" {
+			if p := ph.panFor(TransferRecord{Name: old.Name, URL: r.URL}); p != nil && p.Name() == old.Name {
+				pan = p
 			}
 		}
-		m = panPwdRegex.FindStringSubmatch(line)
-		if len(m) > 1 {
-			pwd = strings.TrimSpace(m[1])
+		if pan == nil {
+			continue
 		}
-		if line == "----" {
-			floor++
+		r.Name = pan.Name()
+		r.ChangeStatus(TRANSFER_STATUS_PENDING, "")
+		jobs = append(jobs, transferJob{pan, *r})
+		changed = true
+	}
+	for _, r := range olds {
+		if !noTqm[r] || r.Tqm == "" {
+			continue
 		}
-		if floor > 3 {
-			break
+		// 使用原来转存的网盘
+		pan := ph.autoPan(*r)
+		if r.Name != "" {
+			if p := ph.panFor(*r); p != nil && p.Name() == r.Name {
+				pan = p
+			}
 		}
+		if pan == nil {
+			continue
+		}
+		log.Group(groupPan).Printf("帖子 %d 的链接 %s 补充了提取码, 重新转存\n", t.Id, r.URL)
+		r.Name = pan.Name()
+		r.ChangeStatus(TRANSFER_STATUS_PENDING, "")
+		jobs = append(jobs, transferJob{pan, *r})
 	}
 
-	if pwd != "" {
-		pwd = html.UnescapeString(pwd)
+	if changed {
+		if e := t.savePanRecords(records); e != nil {
+			log.Printf("保存网盘记录失败: %s\n", e.Error())
+			changed = false
+		}
 	}
+	return jobs, changed
+}
 
-	for _, rec := range records {
-		rec.Pwd = pwd
-	}
-	return records, e
+// 使用默认选项提取帖子中的分享链接
+func (t *Topic) ParseTransferRecord() ([]*TransferRecord, error) {
+	return t.extractTransferRecords(DefaultExtractOptions())
 }
 
 func (t *Topic) loadPanRecords() ([]*TransferRecord, error) {
@@ -409,11 +499,23 @@ func (t *Topic) loadPanRecords() ([]*TransferRecord, error) {
 		return cache.records, nil
 	}
 
-	if !t.root.IsExist(PAN_JSON) {
+	records, e := readPanRecords(t.root)
+	if e != nil {
+		return nil, e
+	}
+
+	cachePanTopic(t, records)
+
+	return records, nil
+}
+
+// 读取帖子目录下的网盘记录, 不经过缓存
+func readPanRecords(root *ExtRoot) ([]*TransferRecord, error) {
+	if !root.IsExist(PAN_JSON) {
 		return nil, fmt.Errorf("未找到网盘记录")
 	}
 
-	c, e := t.root.ReadAll(PAN_JSON)
+	c, e := root.ReadAll(PAN_JSON)
 	if e != nil {
 		return nil, fmt.Errorf("读取网盘 JSON 失败: %s", e.Error())
 	}
@@ -422,9 +524,6 @@ func (t *Topic) loadPanRecords() ([]*TransferRecord, error) {
 	if e := json.Unmarshal(c, &records); e != nil {
 		return nil, fmt.Errorf("解析网盘 JSON 失败: %s", e.Error())
 	}
-
-	cachePanTopic(t, records)
-
 	return records, nil
 }
 
@@ -471,21 +570,7 @@ func (srv *Server) topicPanRecords() func(c *gin.Context) {
 			// 处理下旧数据
 			changed := false
 			for _, r := range records {
-				if r.Name == "" {
-					for _, pan := range srv.cache.pans.Pans {
-						if pan.Support(*r) {
-							r.Name = pan.Name()
-							changed = true
-							break
-						}
-					}
-				}
-				if r.Status == "" && r.Saved != nil {
-					if *r.Saved {
-						r.ChangeStatus(TRANSFER_STATUS_SUCCESS, "")
-					} else {
-						r.ChangeStatus(TRANSFER_STATUS_PENDING, "")
-					}
+				if srv.cache.pans.normalizeRecord(r) {
 					changed = true
 				}
 			}
@@ -568,13 +653,10 @@ func (srv *Server) topicPanOperate() func(c *gin.Context) {
 			return
 		}
 
-		for _, pan := range srv.cache.pans.Pans {
-			if pan.Support(*record) {
-				if e := pan.TransferOpt(topic.Id, record, opt); e != nil {
-					c.JSON(http.StatusInternalServerError, toErr(e.Error()))
-					return
-				}
-				break
+		if pan := srv.cache.pans.panFor(*record); pan != nil {
+			if e := pan.TransferOpt(topic.Id, record, opt); e != nil {
+				c.JSON(http.StatusInternalServerError, toErr(e.Error()))
+				return
 			}
 		}
 
@@ -0,0 +1,109 @@
+package mgr
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/i2534/ngamm/mgr/log"
+	"gopkg.in/ini.v1"
+)
+
+// 网盘驱动, 配置段 [驱动名称] 或 [驱动名称.账户名] 对应一个网盘实例
+type PanDriver struct {
+	Name     string           // 驱动名称, 同时也是配置段名称
+	Patterns []*regexp.Regexp // 支持的分享链接
+	// 根据配置段创建网盘实例, name 为实例名称, root 为实例的工作目录
+	New func(name, root string, sec *ini.Section) (Pan, error)
+}
+
+// 链接是否由此驱动处理
+func (d *PanDriver) Match(url string) bool {
+	for _, p := range d.Patterns {
+		if p.MatchString(url) {
+			return true
+		}
+	}
+	return false
+}
+
+var panDrivers = make(map[string]*PanDriver)
+
+// 注册网盘驱动, 只应在包初始化时调用
+func RegisterPanDriver(d PanDriver) *PanDriver {
+	if d.Name == "" || strings.Contains(d.Name, ".") {
+		panic(fmt.Sprintf("无效的网盘驱动名称: %q", d.Name))
+	}
+	if _, has := panDrivers[d.Name]; has {
+		panic(fmt.Sprintf("网盘驱动 %s 已注册", d.Name))
+	}
+	panDrivers[d.Name] = &d
+	return &d
+}
+
+// 配置段对应的驱动, 没有注册的返回 nil
+func panDriverOf(section string) *PanDriver {
+	name, _, _ := strings.Cut(section, ".")
+	return panDrivers[name]
+}
+
+// 根据配置文件中的配置段创建网盘实例
+// 有账户子配置段时, 如 [baidu.main], [baidu.backup], [baidu] 只作为子配置段的公共配置, 不单独创建实例
+func (p *PanHolder) initPans(cfg *ini.File) {
+	for _, sec := range cfg.Sections() {
+		name := sec.Name()
+		driver := panDriverOf(name)
+		if driver == nil {
+			continue
+		}
+		if name == driver.Name && len(sec.ChildSections()) > 0 {
+			continue
+		}
+		if !sec.Key("enable").MustBool(false) {
+			log.Println("网盘未启用:", name)
+			continue
+		}
+
+		pan, e := driver.New(name, filepath.Join(p.Root, name), sec)
+		if e != nil {
+			log.Printf("网盘 %s 配置解析失败: %s\n", name, e.Error())
+			continue
+		}
+		if e := pan.Init(); e != nil {
+			log.Println("初始化失败:", e.Error())
+			p.msgCh <- e.Error()
+			continue
+		}
+		log.Println("网盘初始化完成:", name)
+		pan.SetHolder(p)
+		p.Pans = append(p.Pans, pan)
+	}
+}
+
+// 处理记录的网盘, 优先使用记录中保存的网盘, 否则使用第一个支持此链接的网盘
+func (p *PanHolder) panFor(record TransferRecord) Pan {
+	var first Pan
+	for _, pan := range p.Pans {
+		if !pan.Support(record) {
+			continue
+		}
+		if pan.Name() == record.Name {
+			return pan
+		}
+		if first == nil {
+			first = pan
+		}
+	}
+	return first
+}
+
+// 自动转存记录的网盘, 同一网盘有多个账户时, 只由第一个自动转存的账户转存
+func (p *PanHolder) autoPan(record TransferRecord) Pan {
+	for _, pan := range p.Pans {
+		if pan.TransferType() == TRANSFER_TYPE_AUTO && pan.Support(record) {
+			return pan
+		}
+	}
+	return nil
+}
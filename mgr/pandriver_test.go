@@ -0,0 +1,178 @@
+package mgr
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+	"gopkg.in/ini.v1"
+)
+
+type fakePan struct {
+	name     string
+	root     string
+	transfer string
+	holder   *PanHolder
+	urls     []string // 转存过的链接
+	tqms     []string // 转存时的提取码
+	locked   *sync.Mutex
+}
+
+func (f *fakePan) Close() error                  { return nil }
+func (f *fakePan) Name() string                  { return f.name }
+func (f *fakePan) SetHolder(holder *PanHolder)   { f.holder = holder }
+func (f *fakePan) Init() error                   { return nil }
+func (f *fakePan) Check() error                  { return nil }
+func (f *fakePan) Support(r TransferRecord) bool { return fakeDriver.Match(r.URL) }
+func (f *fakePan) TransferType() string          { return f.transfer }
+func (f *fakePan) Transfer(_ int, r TransferRecord) error {
+	// 加入队列时不能持有元数据锁, 否则队列满时会和处理任务的协程死锁
+	if f.locked != nil {
+		if !f.locked.TryLock() {
+			return errors.New("持有元数据锁")
+		}
+		f.locked.Unlock()
+	}
+	f.urls = append(f.urls, r.URL)
+	f.tqms = append(f.tqms, r.Tqm)
+	return nil
+}
+func (f *fakePan) TransferOpt(int, *TransferRecord, PanOpt) error {
+	return nil
+}
+func (f *fakePan) IsExist(int) bool { return false }
+func (f *fakePan) Move(int) error   { return nil }
+func (f *fakePan) Delete(int) error { return nil }
+
+var fakeDriver = RegisterPanDriver(PanDriver{
+	Name:     "fake",
+	Patterns: []*regexp.Regexp{regexp.MustCompile(`^https://fake\.pan/`)},
+	New: func(name, root string, sec *ini.Section) (Pan, error) {
+		return &fakePan{name: name, root: root, transfer: sec.Key("transfer").MustString(TRANSFER_TYPE_AUTO)}, nil
+	},
+})
+
+func TestPanDriverRegistry(t *testing.T) {
+	dir := t.TempDir()
+	cfg := `
+[fake]
+enable=true
+transfer=manual
+
+[fake.main]
+transfer=auto
+
+[fake.backup]
+
+[fake.off]
+enable=false
+
+[unknown]
+enable=true
+`
+	assert.Equal(t, os.WriteFile(filepath.Join(dir, PAN_CONFIG), []byte(cfg), COMMON_FILE_MODE), nil)
+
+	ph, e := NewPanHolder(dir, nil)
+	assert.Equal(t, e, nil)
+	defer ph.Close()
+
+	// [fake] 有子配置段, 只作为公共配置
+	assert.Equal(t, len(ph.Pans), 2)
+	main, backup := ph.Pans[0].(*fakePan), ph.Pans[1].(*fakePan)
+	assert.Equal(t, main.name, "fake.main")
+	assert.Equal(t, main.transfer, TRANSFER_TYPE_AUTO)
+	assert.Equal(t, main.root, filepath.Join(dir, "fake.main"))
+	assert.Equal(t, main.holder, ph)
+	assert.Equal(t, backup.name, "fake.backup")
+	assert.Equal(t, backup.transfer, "manual") // 继承 [fake]
+
+	assert.Equal(t, ph.panFor(TransferRecord{URL: "https://fake.pan/s/1"}), Pan(main))
+	assert.Equal(t, ph.panFor(TransferRecord{URL: "https://fake.pan/s/1", Name: "fake.backup"}), Pan(backup))
+	assert.Equal(t, ph.panFor(TransferRecord{URL: "https://other.pan/s/1"}), nil)
+	assert.Equal(t, ph.panName("https://fake.pan/s/2"), "fake.main")
+
+	assert.Equal(t, panDriverOf("baidu.backup") == baiduDriver, true)
+	assert.Equal(t, panDriverOf("webhook.wechat") == nil, true)
+	assert.Equal(t, baiduDriver.Match("https://pan.baidu.com/s/1abc"), true)
+	assert.Equal(t, quarkDriver.Match("https://pan.quark.cn/s/abc"), true)
+}
+
+func TestAutoTransferIncremental(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	post := `# 资源帖
+
+##### <span id="pid0">0.[0] \<pid:0\> 2025-02-27 03:02:58 by 楼主(100)</span>
+https://fake.pan/s/1 提取码: aaaa
+`
+	assert.Equal(t, root.WriteAll(POST_MARKDOWN, []byte(post)), nil)
+	pan := &fakePan{name: "fake", transfer: TRANSFER_TYPE_AUTO}
+	ph := &PanHolder{Pans: []Pan{pan}, extract: DefaultExtractOptions()}
+
+	NewTopic(root, 1).AutoTransfer(ph)
+	assert.Equal(t, pan.urls, []string{"https://fake.pan/s/1"})
+	rs, e := readPanRecords(root)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(rs), 1)
+	assert.Equal(t, rs[0].Status, TRANSFER_STATUS_PENDING)
+	rs[0].ChangeStatus(TRANSFER_STATUS_SUCCESS, "")
+	topic := NewTopic(root, 1)
+	assert.Equal(t, topic.savePanRecords(rs), nil)
+
+	// 楼主补档, 只转存新的链接
+	post += `
+----
+##### <span id="pid11">1.[1] \<pid:11\> 2025-02-28 04:00:00 by 楼主(100)</span>
+补档 https://fake.pan/s/2 提取码: bbbb 解压密码: nga
+`
+	assert.Equal(t, root.WriteAll(POST_MARKDOWN, []byte(post)), nil)
+	topic.AutoTransfer(ph)
+	assert.Equal(t, pan.urls, []string{"https://fake.pan/s/1", "https://fake.pan/s/2"})
+	rs, e = readPanRecords(root)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(rs), 2)
+	assert.Equal(t, rs[0].Status, TRANSFER_STATUS_SUCCESS)
+	assert.Equal(t, rs[0].Pwd, "nga") // 补充缺少的解压密码
+	assert.Equal(t, rs[1].URL, "https://fake.pan/s/2")
+	assert.Equal(t, rs[1].Tqm, "bbbb")
+	assert.Equal(t, rs[1].Status, TRANSFER_STATUS_PENDING)
+
+	NewTopic(root, 1).AutoTransfer(ph)
+	assert.Equal(t, len(pan.urls), 2)
+
+	// 没有提取码而失败的链接, 补充提取码后重新转存
+	post += `
+----
+##### <span id="pid12">2.[2] \<pid:12\> 2025-03-01 05:00:00 by 楼主(100)</span>
+再补 https://fake.pan/s/3
+`
+	assert.Equal(t, root.WriteAll(POST_MARKDOWN, []byte(post)), nil)
+	topic = NewTopic(root, 1)
+	pan.locked = topic.Metadata.mutex
+	topic.AutoTransfer(ph)
+	assert.Equal(t, len(pan.urls), 3)
+	rs, _ = readPanRecords(root)
+	assert.Equal(t, rs[2].Status, TRANSFER_STATUS_PENDING)
+	rs[2].ChangeStatus(TRANSFER_STATUS_FAILED, "需要提取码")
+	assert.Equal(t, topic.savePanRecords(rs), nil)
+
+	post = strings.Replace(post, "再补 https://fake.pan/s/3", "再补 https://fake.pan/s/3 提取码: cccc", 1)
+	assert.Equal(t, root.WriteAll(POST_MARKDOWN, []byte(post)), nil)
+	topic = NewTopic(root, 1)
+	pan.locked = topic.Metadata.mutex
+	topic.AutoTransfer(ph)
+	assert.Equal(t, pan.urls[3:], []string{"https://fake.pan/s/3"})
+	assert.Equal(t, pan.tqms[3], "cccc")
+	rs, _ = readPanRecords(root)
+	assert.Equal(t, rs[2].Tqm, "cccc")
+	assert.Equal(t, rs[2].Status, TRANSFER_STATUS_PENDING)
+	assert.Equal(t, rs[2].Message, "")
+}
@@ -2,48 +2,152 @@ package mgr
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"math/rand"
+	"mime"
 	"net/http"
 	"net/http/cookiejar"
-	"os"
+	"net/url"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Copy from: https://github.com/Cp0204/quark-auto-save/blob/main/quark_auto_save.py ffe95fc class Quark:
-// Transfer by AI
-// Quark 类的 Go 实现
+// 接口参照原脚本, 请求和返回都使用结构体
+
+const (
+	QUARK_BASE_URL     = "https://drive-pc.quark.cn"
+	QUARK_BASE_URL_APP = "https://drive-m.quark.cn"
+	QUARK_ACCOUNT_URL  = "https://pan.quark.cn/account/info"
+	QUARK_PAGE_SIZE    = 50
+	QUARK_MAX_RETRY    = 3  // 被限流时的最大重试次数
+	QUARK_TASK_POLL    = 60 // 查询任务状态的最大次数
+	QUARK_OSS_UA       = "aliyun-sdk-js/6.6.1 Chrome 98.0.4758.80 on Windows 10 64-bit"
+)
+
+// 夸克网盘接口返回的错误
+type QuarkError struct {
+	Status  int    `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *QuarkError) Error() string {
+	return fmt.Sprintf("夸克网盘接口错误 %d/%d: %s", e.Status, e.Code, e.Message)
+}
+
+// 是否被限流, 限流时等待后重试
+func (e *QuarkError) rateLimited() bool {
+	return e.Status == http.StatusTooManyRequests || strings.Contains(e.Message, "频繁")
+}
+
+// 接口返回的公共结构
+type quarkResp struct {
+	QuarkError
+	Data     json.RawMessage `json:"data"`
+	Metadata struct {
+		Total    int `json:"_total"`
+		PartSize int `json:"part_size"` // 预上传返回的分片大小
+	} `json:"metadata"`
+}
+
+type QuarkAccount struct {
+	Nickname  string `json:"nickname"`
+	AvatarUri string `json:"avatarUri"`
+}
+
+type QuarkFile struct {
+	Fid           string `json:"fid"`
+	PdirFid       string `json:"pdir_fid"`
+	FileName      string `json:"file_name"`
+	Size          int64  `json:"size"`
+	Dir           bool   `json:"dir"`
+	Ban           bool   `json:"ban"`
+	ShareFidToken string `json:"share_fid_token"` // 分享中的文件才有
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
+type QuarkPathFid struct {
+	FilePath string `json:"file_path"`
+	Fid      string `json:"fid"`
+}
+
+// 异步任务, 如保存分享
+type QuarkTask struct {
+	TaskId    string `json:"task_id"`
+	TaskTitle string `json:"task_title"`
+	Status    int    `json:"status"` // 0 进行中, 2 完成
+}
+
+// 预上传的结果, 文件内容上传到其中的 OSS 地址
+type quarkUploadPre struct {
+	TaskId    string `json:"task_id"`
+	Finish    bool   `json:"finish"`
+	UploadId  string `json:"upload_id"`
+	ObjKey    string `json:"obj_key"`
+	UploadUrl string `json:"upload_url"`
+	Fid       string `json:"fid"`
+	Bucket    string `json:"bucket"`
+	AuthInfo  string `json:"auth_info"`
+	Callback  struct {
+		CallbackUrl  string `json:"callbackUrl"`
+		CallbackBody string `json:"callbackBody"`
+	} `json:"callback"`
+}
+
+// 成长信息, 包括容量和签到
+type QuarkGrowth struct {
+	VIP88          bool  `json:"88VIP"`
+	TotalCapacity  int64 `json:"total_capacity"`
+	CapComposition struct {
+		SignReward int64 `json:"sign_reward"`
+	} `json:"cap_composition"`
+	CapSign struct {
+		SignDaily       bool  `json:"sign_daily"`
+		SignDailyReward int64 `json:"sign_daily_reward"`
+		SignProgress    int   `json:"sign_progress"`
+		SignTarget      int   `json:"sign_target"`
+	} `json:"cap_sign"`
+}
+
+// 夸克网盘客户端, 使用 cookie 登录, 分享相关的接口在设置了移动端参数时使用移动端接口
 type Quark struct {
-	BaseURL     string
-	BaseURLApp  string
-	UserAgent   string
-	Cookie      string
-	Index       int
-	IsActive    bool
-	Nickname    string
-	Mparam      map[string]string
-	SavepathFid map[string]string
-	client      *http.Client
+	BaseURL    string
+	BaseURLApp string
+	AccountURL string
+	UserAgent  string
+	Cookie     string
+	IsActive   bool
+	Nickname   string
+	Mparam     map[string]string
+	SignParam  map[string]string // 配置文件中设置的移动端参数, 只用于签到和成长信息, 不改变分享接口
+	RetryDelay time.Duration     // 被限流时第一次重试前的等待时间, 之后每次加倍
+	client     *http.Client
 }
 
 // 初始化Quark实例
 func NewQuark(cookie string) *Quark {
 	jar, _ := cookiejar.New(nil)
 	q := &Quark{
-		BaseURL:     "https://drive-pc.quark.cn",
-		BaseURLApp:  "https://drive-m.quark.cn",
-		UserAgent:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) quark-cloud-drive/3.14.2 Chrome/112.0.5615.165 Electron/24.1.3.8 Safari/537.36 Channel/pckk_other_ch",
-		Cookie:      strings.TrimSpace(cookie),
-		Index:       1,
-		IsActive:    false,
-		Nickname:    "",
-		Mparam:      make(map[string]string),
-		SavepathFid: map[string]string{"/": "0"},
-		client:      &http.Client{Jar: jar, Timeout: 10 * time.Second},
+		BaseURL:    QUARK_BASE_URL,
+		BaseURLApp: QUARK_BASE_URL_APP,
+		AccountURL: QUARK_ACCOUNT_URL,
+		UserAgent:  "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) quark-cloud-drive/3.14.2 Chrome/112.0.5615.165 Electron/24.1.3.8 Safari/537.36 Channel/pckk_other_ch",
+		Cookie:     strings.TrimSpace(cookie),
+		Mparam:     make(map[string]string),
+		RetryDelay: time.Second,
+		client:     &http.Client{Jar: jar, Timeout: 10 * time.Second},
 	}
 	q.matchMparamFromCookie(cookie)
 	return q
@@ -55,472 +159,333 @@ func (q *Quark) matchMparamFromCookie(cookie string) {
 	signRegex := regexp.MustCompile(`(^|[^a-zA-Z0-9])sign=([a-zA-Z0-9%+/=]+)[;&]?`)
 	vcodeRegex := regexp.MustCompile(`(^|[^a-zA-Z0-9])vcode=([a-zA-Z0-9%+/=]+)[;&]?`)
 
-	if kpsMatch := kpsRegex.FindStringSubmatch(cookie); len(kpsMatch) > 1 {
-		if signMatch := signRegex.FindStringSubmatch(cookie); len(signMatch) > 1 {
-			if vcodeMatch := vcodeRegex.FindStringSubmatch(cookie); len(vcodeMatch) > 1 {
-				q.Mparam = map[string]string{
-					"kps":   strings.ReplaceAll(kpsMatch[1], "%25", "%"),
-					"sign":  strings.ReplaceAll(signMatch[1], "%25", "%"),
-					"vcode": strings.ReplaceAll(vcodeMatch[1], "%25", "%"),
-				}
+	if kpsMatch := kpsRegex.FindStringSubmatch(cookie); len(kpsMatch) > 2 {
+		if signMatch := signRegex.FindStringSubmatch(cookie); len(signMatch) > 2 {
+			if vcodeMatch := vcodeRegex.FindStringSubmatch(cookie); len(vcodeMatch) > 2 {
+				q.SetMparam(
+					strings.ReplaceAll(kpsMatch[2], "%25", "%"),
+					strings.ReplaceAll(signMatch[2], "%25", "%"),
+					strings.ReplaceAll(vcodeMatch[2], "%25", "%"),
+				)
 			}
 		}
 	}
 }
 
-// 发送HTTP请求
-func (q *Quark) sendRequest(method, urlStr string, params map[string]string, jsonData any, headers map[string]string) (*http.Response, error) {
-	var reqBody io.Reader
+// 设置移动端参数, 分享相关的接口会改用移动端接口
+func (q *Quark) SetMparam(kps, sign, vcode string) {
+	q.Mparam = map[string]string{"kps": kps, "sign": sign, "vcode": vcode}
+}
 
-	// 处理JSON数据
-	if jsonData != nil {
-		jsonBytes, err := json.Marshal(jsonData)
-		if err != nil {
-			return nil, err
-		}
-		reqBody = bytes.NewBuffer(jsonBytes)
+// 设置签到和成长信息使用的移动端参数, 优先于从 cookie 中提取的参数
+func (q *Quark) SetSignParam(kps, sign, vcode string) {
+	q.SignParam = map[string]string{"kps": kps, "sign": sign, "vcode": vcode}
+}
+
+// 签到使用的移动端参数, 没有设置时为空
+func (q *Quark) signParam() map[string]string {
+	if len(q.SignParam) > 0 {
+		return q.SignParam
 	}
+	return q.Mparam
+}
+
+// 移动端接口的公共参数
+var quarkAppParams = map[string]string{
+	"device_model": "M2011K2C",
+	"entry":        "default_clouddrive",
+	"_t_group":     "0%3A_s_vp%3A1",
+	"dmn":          "Mi%2B11",
+	"fr":           "android",
+	"pf":           "3300",
+	"bi":           "35937",
+	"ve":           "7.4.5.680",
+	"ss":           "411x875",
+	"mi":           "M2011K2C",
+	"nt":           "5",
+	"nw":           "0",
+	"kt":           "4",
+	"pr":           "ucpro",
+	"sv":           "release",
+	"dt":           "phone",
+	"data_from":    "ucapi",
+	"app":          "clouddrive",
+	"kkkk":         "1",
+}
 
-	// 创建请求
-	req, err := http.NewRequest(method, urlStr, reqBody)
-	if err != nil {
-		return nil, err
+func (q *Quark) newRequest(method, urlStr string, params url.Values, body []byte) (*http.Request, error) {
+	query := url.Values{}
+	for k, vs := range params {
+		query[k] = vs
+	}
+	// 分享相关的接口有移动端参数时使用移动端接口, 不需要 cookie
+	app := len(q.Mparam) > 0 && strings.Contains(urlStr, "share") && strings.HasPrefix(urlStr, q.BaseURL)
+	if app {
+		urlStr = q.BaseURLApp + strings.TrimPrefix(urlStr, q.BaseURL)
+		for k, v := range quarkAppParams {
+			query.Set(k, v)
+		}
+		for k, v := range q.Mparam {
+			query.Set(k, v)
+		}
 	}
 
-	// 设置默认头
-	req.Header.Set("cookie", q.Cookie)
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, e := http.NewRequest(method, urlStr, reader)
+	if e != nil {
+		return nil, e
+	}
+	req.URL.RawQuery = query.Encode()
 	req.Header.Set("content-type", "application/json")
 	req.Header.Set("user-agent", q.UserAgent)
-
-	// 应用自定义头
-	for k, v := range headers {
-		req.Header.Set(k, v)
+	if !app {
+		req.Header.Set("cookie", q.Cookie)
 	}
+	return req, nil
+}
 
-	// 添加查询参数
-	if params != nil {
-		query := req.URL.Query()
-		for k, v := range params {
-			query.Add(k, v)
+// 发送请求并解析公共结构, 出错时返回 QuarkError, 被限流时等待后重试
+func (q *Quark) do(method, urlStr string, params url.Values, payload any, out any) (*quarkResp, error) {
+	var body []byte
+	if payload != nil {
+		data, e := json.Marshal(payload)
+		if e != nil {
+			return nil, e
 		}
-		req.URL.RawQuery = query.Encode()
+		body = data
 	}
-
-	// 对特定URL进行处理
-	if len(q.Mparam) > 0 && strings.Contains(urlStr, "share") && strings.Contains(urlStr, q.BaseURL) {
-		urlStr = strings.ReplaceAll(urlStr, q.BaseURL, q.BaseURLApp)
-
-		// 创建新请求
-		req, err = http.NewRequest(method, urlStr, reqBody)
-		if err != nil {
-			return nil, err
+	delay := q.RetryDelay
+	for i := 0; ; i++ {
+		req, e := q.newRequest(method, urlStr, params, body)
+		if e != nil {
+			return nil, e
 		}
-
-		// 重新设置头部
-		req.Header.Set("content-type", "application/json")
-		req.Header.Set("user-agent", q.UserAgent)
-		for k, v := range headers {
-			req.Header.Set(k, v)
+		resp, e := q.client.Do(req)
+		if e != nil {
+			return nil, e
 		}
-
-		// 添加特定的参数
-		query := req.URL.Query()
-		for k, v := range params {
-			query.Add(k, v)
+		data, e := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if e != nil {
+			return nil, e
 		}
 
-		// 添加移动特有参数
-		query.Add("device_model", "M2011K2C")
-		query.Add("entry", "default_clouddrive")
-		query.Add("_t_group", "0%3A_s_vp%3A1")
-		query.Add("dmn", "Mi%2B11")
-		query.Add("fr", "android")
-		query.Add("pf", "3300")
-		query.Add("bi", "35937")
-		query.Add("ve", "7.4.5.680")
-		query.Add("ss", "411x875")
-		query.Add("mi", "M2011K2C")
-		query.Add("nt", "5")
-		query.Add("nw", "0")
-		query.Add("kt", "4")
-		query.Add("pr", "ucpro")
-		query.Add("sv", "release")
-		query.Add("dt", "phone")
-		query.Add("data_from", "ucapi")
-		query.Add("kps", q.Mparam["kps"])
-		query.Add("sign", q.Mparam["sign"])
-		query.Add("vcode", q.Mparam["vcode"])
-		query.Add("app", "clouddrive")
-		query.Add("kkkk", "1")
-
-		req.URL.RawQuery = query.Encode()
-		req.Header.Del("cookie") // 移除cookie头
-	}
-
-	// 发送请求
-	resp, err := q.client.Do(req)
-	if err != nil {
-		fmt.Printf("Send request error: %v\n", err)
-		return nil, err
-	}
-
-	return resp, nil
-}
-
-// 初始化账号
-func (q *Quark) Init() (map[string]any, error) {
-	info, err := q.GetAccountInfo()
-	if err != nil {
-		return nil, err
-	}
-	if info != nil {
-		q.IsActive = true
-		q.Nickname = info["nickname"].(string)
-		return info, nil
+		ret := &quarkResp{}
+		if e := json.Unmarshal(data, ret); e != nil {
+			if resp.StatusCode >= http.StatusBadRequest {
+				ret.Status, ret.Message = resp.StatusCode, strings.TrimSpace(string(data))
+			} else {
+				return nil, fmt.Errorf("解析夸克网盘返回失败: %s", e.Error())
+			}
+		}
+		if ret.Status == 0 || resp.StatusCode == http.StatusTooManyRequests {
+			ret.Status = resp.StatusCode
+		}
+		if ret.Code != 0 || ret.Status >= http.StatusBadRequest {
+			qe := ret.QuarkError
+			if qe.rateLimited() && i < QUARK_MAX_RETRY {
+				time.Sleep(delay)
+				delay *= 2
+				continue
+			}
+			return nil, &qe
+		}
+		if out != nil && len(ret.Data) > 0 {
+			if e := json.Unmarshal(ret.Data, out); e != nil {
+				return nil, fmt.Errorf("解析夸克网盘返回失败: %s", e.Error())
+			}
+		}
+		return ret, nil
 	}
-	return nil, nil
 }
 
-// 获取账号信息
-func (q *Quark) GetAccountInfo() (map[string]any, error) {
-	urlStr := "https://pan.quark.cn/account/info"
-	params := map[string]string{
-		"fr":       "pc",
-		"platform": "pc",
-	}
-
-	resp, err := q.sendRequest("GET", urlStr, params, nil, nil)
-	if err != nil {
-		return nil, err
+func quarkParams(kv ...string) url.Values {
+	params := url.Values{"pr": {"ucpro"}, "fr": {"pc"}, "uc_param_str": {""}}
+	for i := 0; i+1 < len(kv); i += 2 {
+		params.Set(kv[i], kv[i+1])
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, err
-	}
-	success := result["success"].(bool)
-	if !success {
-		code := result["code"].(string)
-		msg := result["msg"].(string)
-		fmt.Printf("Quark: 获取账号信息失败, code: %s, msg: %s\n", code, msg)
-		return nil, fmt.Errorf("获取账号信息失败, code: %s, msg: %s", code, msg)
-	}
-
-	if data, ok := result["data"].(map[string]any); ok {
-		return data, nil
-	}
-	return nil, nil
+	return params
 }
 
-// 获取成长信息
-func (q *Quark) GetGrowthInfo() map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/capacity/growth/info", q.BaseURLApp)
-	params := map[string]string{
-		"pr":    "ucpro",
-		"fr":    "android",
-		"kps":   q.Mparam["kps"],
-		"sign":  q.Mparam["sign"],
-		"vcode": q.Mparam["vcode"],
-	}
+// 初始化账号
+func (q *Quark) Init() (*QuarkAccount, error) {
+	info, e := q.GetAccountInfo()
+	if e != nil {
+		return nil, e
+	}
+	q.IsActive = true
+	q.Nickname = info.Nickname
+	return info, nil
+}
 
-	headers := map[string]string{
-		"content-type": "application/json",
+// 获取账号信息, 此接口的返回结构和其它接口不同
+func (q *Quark) GetAccountInfo() (*QuarkAccount, error) {
+	params := url.Values{"fr": {"pc"}, "platform": {"pc"}}
+	req, e := q.newRequest(http.MethodGet, q.AccountURL, params, nil)
+	if e != nil {
+		return nil, e
 	}
-
-	resp, err := q.sendRequest("GET", urlStr, params, nil, headers)
-	if err != nil {
-		return nil
+	resp, e := q.client.Do(req)
+	if e != nil {
+		return nil, e
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil
+	ret := struct {
+		Success bool          `json:"success"`
+		Code    string        `json:"code"`
+		Msg     string        `json:"msg"`
+		Data    *QuarkAccount `json:"data"`
+	}{}
+	if e := json.NewDecoder(resp.Body).Decode(&ret); e != nil {
+		return nil, fmt.Errorf("解析夸克网盘返回失败: %d, %s", resp.StatusCode, e.Error())
 	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil
+	if !ret.Success {
+		return nil, fmt.Errorf("获取账号信息失败, code: %s, msg: %s", ret.Code, ret.Msg)
 	}
-
-	if data, ok := result["data"].(map[string]any); ok {
-		return data
+	if ret.Data == nil {
+		return nil, fmt.Errorf("获取账号信息失败, 用户未处于登录状态")
 	}
-	return nil
+	return ret.Data, nil
 }
 
-// 每日签到
-func (q *Quark) GetGrowthSign() (bool, any) {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/capacity/growth/sign", q.BaseURLApp)
-	params := map[string]string{
-		"pr":    "ucpro",
-		"fr":    "android",
-		"kps":   q.Mparam["kps"],
-		"sign":  q.Mparam["sign"],
-		"vcode": q.Mparam["vcode"],
-	}
-
-	payload := map[string]any{
-		"sign_cyclic": true,
-	}
-
-	headers := map[string]string{
-		"content-type": "application/json",
-	}
+func (q *Quark) mobileParams() (url.Values, error) {
+	mparam := q.signParam()
+	if len(mparam) == 0 {
+		return nil, fmt.Errorf("移动端参数未设置")
+	}
+	return url.Values{
+		"pr":    {"ucpro"},
+		"fr":    {"android"},
+		"kps":   {mparam["kps"]},
+		"sign":  {mparam["sign"]},
+		"vcode": {mparam["vcode"]},
+	}, nil
+}
 
-	resp, err := q.sendRequest("POST", urlStr, params, payload, headers)
-	if err != nil {
-		return false, err.Error()
+// 获取成长信息, 需要移动端参数
+func (q *Quark) GetGrowthInfo() (*QuarkGrowth, error) {
+	params, e := q.mobileParams()
+	if e != nil {
+		return nil, e
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, err.Error()
+	info := &QuarkGrowth{}
+	if _, e := q.do(http.MethodGet, q.BaseURLApp+"/1/clouddrive/capacity/growth/info", params, nil, info); e != nil {
+		return nil, e
 	}
+	return info, nil
+}
 
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return false, err.Error()
+// 每日签到, 返回签到获得的空间, 需要移动端参数
+func (q *Quark) GetGrowthSign() (int64, error) {
+	params, e := q.mobileParams()
+	if e != nil {
+		return 0, e
 	}
-
-	if data, ok := result["data"].(map[string]any); ok {
-		return true, data["sign_daily_reward"]
+	ret := struct {
+		SignDailyReward int64 `json:"sign_daily_reward"`
+	}{}
+	if _, e := q.do(http.MethodPost, q.BaseURLApp+"/1/clouddrive/capacity/growth/sign", params, map[string]any{"sign_cyclic": true}, &ret); e != nil {
+		return 0, e
 	}
-	return false, result["message"]
+	return ret.SignDailyReward, nil
 }
 
 // 获取分享token
-func (q *Quark) GetStoken(pwdID, passcode string) (bool, string) {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/share/sharepage/token", q.BaseURL)
-	params := map[string]string{
-		"pr": "ucpro",
-		"fr": "pc",
-	}
-
-	payload := map[string]string{
-		"pwd_id":   pwdID,
-		"passcode": passcode,
-	}
-
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return false, err.Error()
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return false, err.Error()
-	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return false, err.Error()
-	}
-
-	if result["status"].(float64) == 200 {
-		data := result["data"].(map[string]any)
-		return true, data["stoken"].(string)
-	}
-	return false, result["message"].(string)
+func (q *Quark) GetStoken(pwdID, passcode string) (string, error) {
+	ret := struct {
+		Stoken string `json:"stoken"`
+	}{}
+	payload := map[string]string{"pwd_id": pwdID, "passcode": passcode}
+	if _, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/share/sharepage/token", quarkParams(), payload, &ret); e != nil {
+		return "", e
+	}
+	if ret.Stoken == "" {
+		return "", fmt.Errorf("获取分享 %s 的 token 失败", pwdID)
+	}
+	return ret.Stoken, nil
 }
 
-// 获取分享详情
-func (q *Quark) GetDetail(pwdID, stoken, pdirFid string, fetchShare int) map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/share/sharepage/detail", q.BaseURL)
-	listMerge := []any{}
-	page := 1
-
-	for {
-		params := map[string]string{
-			"pr":            "ucpro",
-			"fr":            "pc",
-			"pwd_id":        pwdID,
-			"stoken":        stoken,
-			"pdir_fid":      pdirFid,
-			"force":         "0",
-			"_page":         fmt.Sprintf("%d", page),
-			"_size":         "50",
-			"_fetch_banner": "0",
-			"_fetch_share":  fmt.Sprintf("%d", fetchShare),
-			"_fetch_total":  "1",
-			"_sort":         "file_type:asc,updated_at:desc",
-		}
-
-		resp, err := q.sendRequest("GET", urlStr, params, nil, nil)
-		if err != nil {
-			break
-		}
-
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			break
-		}
-
-		var result map[string]any
-		if err := json.Unmarshal(body, &result); err != nil {
-			break
-		}
-
-		data := result["data"].(map[string]any)
-		fileList := data["list"].([]any)
-
-		if len(fileList) > 0 {
-			listMerge = append(listMerge, fileList...)
-			page++
-		} else {
-			break
-		}
-
-		metadata := result["metadata"].(map[string]any)
-		if len(listMerge) >= int(metadata["_total"].(float64)) {
-			break
+// 分页获取全部文件, 直到获取的数量达到总数或者某页为空
+func (q *Quark) pages(urlStr string, params url.Values) ([]QuarkFile, error) {
+	files := make([]QuarkFile, 0)
+	params.Set("_size", strconv.Itoa(QUARK_PAGE_SIZE))
+	params.Set("_fetch_total", "1")
+	params.Set("_sort", "file_type:asc,updated_at:desc")
+	for page := 1; ; page++ {
+		params.Set("_page", strconv.Itoa(page))
+		data := struct {
+			List []QuarkFile `json:"list"`
+		}{}
+		ret, e := q.do(http.MethodGet, urlStr, params, nil, &data)
+		if e != nil {
+			return nil, e
+		}
+		files = append(files, data.List...)
+		if len(data.List) == 0 || len(files) >= ret.Metadata.Total {
+			return files, nil
 		}
 	}
-
-	result := make(map[string]any)
-	result["list"] = listMerge
-	return result
 }
 
-// 获取文件ID列表
-func (q *Quark) GetFids(filePaths []string) []map[string]any {
-	var fids []map[string]any
+// 获取分享中目录下的文件
+func (q *Quark) GetDetail(pwdID, stoken, pdirFid string) ([]QuarkFile, error) {
+	return q.pages(q.BaseURL+"/1/clouddrive/share/sharepage/detail", quarkParams(
+		"pwd_id", pwdID,
+		"stoken", stoken,
+		"pdir_fid", pdirFid,
+		"force", "0",
+		"_fetch_banner", "0",
+		"_fetch_share", "0",
+	))
+}
 
+// 获取路径对应的文件ID, 不存在的路径不会返回
+func (q *Quark) GetFids(filePaths []string) ([]QuarkPathFid, error) {
+	fids := make([]QuarkPathFid, 0, len(filePaths))
 	for len(filePaths) > 0 {
-		var batch []string
-		if len(filePaths) > 50 {
-			batch = filePaths[:50]
-			filePaths = filePaths[50:]
-		} else {
-			batch = filePaths
-			filePaths = []string{}
-		}
-
-		urlStr := fmt.Sprintf("%s/1/clouddrive/file/info/path_list", q.BaseURL)
-		params := map[string]string{
-			"pr": "ucpro",
-			"fr": "pc",
-		}
-
-		payload := map[string]any{
-			"file_path": batch,
-			"namespace": "0",
-		}
+		batch := filePaths[:min(len(filePaths), QUARK_PAGE_SIZE)]
+		filePaths = filePaths[len(batch):]
 
-		resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-		if err != nil {
-			fmt.Printf("获取目录ID：失败, %v\n", err)
-			break
-		}
-		defer resp.Body.Close()
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("获取目录ID：失败, %v\n", err)
-			break
-		}
-
-		var result map[string]any
-		if err := json.Unmarshal(body, &result); err != nil {
-			fmt.Printf("获取目录ID：失败, %v\n", err)
-			break
-		}
-
-		if result["code"].(float64) == 0 {
-			data := result["data"].([]any)
-			for _, item := range data {
-				fids = append(fids, item.(map[string]any))
-			}
-		} else {
-			fmt.Printf("获取目录ID：失败, %s\n", result["message"])
-			break
+		data := make([]QuarkPathFid, 0)
+		payload := map[string]any{"file_path": batch, "namespace": "0"}
+		if _, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/info/path_list", quarkParams(), payload, &data); e != nil {
+			return nil, e
 		}
+		fids = append(fids, data...)
 	}
-
-	return fids
+	return fids, nil
 }
 
-// 列出目录内容
-func (q *Quark) LsDir(pdirFid string, fetchFullPath int) []map[string]any {
-	var fileList []map[string]any
-	if pdirFid == "" {
-		return fileList
-	}
-
-	page := 1
-	for {
-		urlStr := fmt.Sprintf("%s/1/clouddrive/file/sort", q.BaseURL)
-		params := map[string]string{
-			"pr":               "ucpro",
-			"fr":               "pc",
-			"uc_param_str":     "",
-			"pdir_fid":         pdirFid,
-			"_page":            fmt.Sprintf("%d", page),
-			"_size":            "50",
-			"_fetch_total":     "1",
-			"_fetch_sub_dirs":  "0",
-			"_sort":            "file_type:asc,updated_at:desc",
-			"_fetch_full_path": fmt.Sprintf("%d", fetchFullPath),
-		}
-
-		resp, err := q.sendRequest("GET", urlStr, params, nil, nil)
-		if err != nil {
-			break
-		}
-
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			break
-		}
-
-		var result map[string]any
-		if err := json.Unmarshal(body, &result); err != nil {
-			break
-		}
-
-		data := result["data"].(map[string]any)
-		files := data["list"].([]any)
-
-		if len(files) > 0 {
-			for _, file := range files {
-				fileList = append(fileList, file.(map[string]any))
-			}
-			page++
-		} else {
-			break
-		}
-
-		metadata := result["metadata"].(map[string]any)
-		if len(fileList) >= int(metadata["_total"].(float64)) {
-			break
-		}
+// 获取路径对应的文件ID, 不存在时返回空字符串
+func (q *Quark) GetFid(filePath string) (string, error) {
+	fids, e := q.GetFids([]string{filePath})
+	if e != nil || len(fids) == 0 {
+		return "", e
 	}
+	return fids[0].Fid, nil
+}
 
-	return fileList
+// 列出目录内容
+func (q *Quark) LsDir(pdirFid string) ([]QuarkFile, error) {
+	return q.pages(q.BaseURL+"/1/clouddrive/file/sort", quarkParams(
+		"pdir_fid", pdirFid,
+		"_fetch_sub_dirs", "0",
+		"_fetch_full_path", "0",
+	))
 }
 
-// 保存分享文件
-func (q *Quark) SaveFile(fidList []string, fidTokenList []string, toPdirFid, pwdID, stoken string) map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/share/sharepage/save", q.BaseURL)
-	params := map[string]string{
-		"pr":           "ucpro",
-		"fr":           "pc",
-		"uc_param_str": "",
-		"app":          "clouddrive",
-		"__dt":         fmt.Sprintf("%d", int(rand.Float64()*4+1)*60*1000),
-		"__t":          fmt.Sprintf("%.0f", float64(time.Now().UnixNano())/1e6),
-	}
+func quarkTimeParams(params url.Values) url.Values {
+	params.Set("__dt", strconv.Itoa(int(rand.Float64()*4+1)*60*1000))
+	params.Set("__t", strconv.FormatInt(time.Now().UnixMilli(), 10))
+	return params
+}
 
+// 保存分享中的文件, 返回保存任务的ID
+func (q *Quark) SaveFile(fidList []string, fidTokenList []string, toPdirFid, pwdID, stoken string) (string, error) {
 	payload := map[string]any{
 		"fid_list":       fidList,
 		"fid_token_list": fidTokenList,
@@ -530,287 +495,263 @@ func (q *Quark) SaveFile(fidList []string, fidTokenList []string, toPdirFid, pwd
 		"pdir_fid":       "0",
 		"scene":          "link",
 	}
-
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	task := QuarkTask{}
+	params := quarkTimeParams(quarkParams("app", "clouddrive"))
+	if _, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/share/sharepage/save", params, payload, &task); e != nil {
+		return "", e
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
-	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
-	}
-
-	return result
+	return task.TaskId, nil
 }
 
-// 查询任务
-func (q *Quark) QueryTask(taskID string) map[string]any {
-	retryIndex := 0
-
-	for {
-		urlStr := fmt.Sprintf("%s/1/clouddrive/task", q.BaseURL)
-		params := map[string]string{
-			"pr":           "ucpro",
-			"fr":           "pc",
-			"uc_param_str": "",
-			"task_id":      taskID,
-			"retry_index":  fmt.Sprintf("%d", retryIndex),
-			"__dt":         fmt.Sprintf("%d", int(rand.Float64()*4+1)*60*1000),
-			"__t":          fmt.Sprintf("%.0f", float64(time.Now().UnixNano())/1e6),
-		}
-
-		resp, err := q.sendRequest("GET", urlStr, params, nil, nil)
-		if err != nil {
-			return map[string]any{"code": 500, "message": err.Error()}
-		}
-
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return map[string]any{"code": 500, "message": err.Error()}
-		}
-
-		var result map[string]any
-		if err := json.Unmarshal(body, &result); err != nil {
-			return map[string]any{"code": 500, "message": err.Error()}
+// 等待任务完成
+func (q *Quark) QueryTask(taskID string) (*QuarkTask, error) {
+	for i := 0; i < QUARK_TASK_POLL; i++ {
+		task := &QuarkTask{}
+		params := quarkTimeParams(quarkParams("task_id", taskID, "retry_index", strconv.Itoa(i)))
+		if _, e := q.do(http.MethodGet, q.BaseURL+"/1/clouddrive/task", params, nil, task); e != nil {
+			return nil, e
 		}
-
-		data := result["data"].(map[string]any)
-		if data["status"].(float64) != 0 {
-			if retryIndex > 0 {
-				fmt.Println()
-			}
-			return result
-		} else {
-			if retryIndex == 0 {
-				fmt.Printf("正在等待[%s]执行结果", data["task_title"])
-			} else {
-				fmt.Print(".")
-			}
-			retryIndex++
-			time.Sleep(500 * time.Millisecond)
+		if task.Status != 0 {
+			return task, nil
 		}
+		time.Sleep(500 * time.Millisecond)
 	}
+	return nil, fmt.Errorf("等待任务 %s 超时", taskID)
 }
 
-// 下载文件
-func (q *Quark) Download(fids []string) (map[string]any, string) {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/file/download", q.BaseURL)
-	params := map[string]string{
-		"pr":           "ucpro",
-		"fr":           "pc",
-		"uc_param_str": "",
-	}
-
-	payload := map[string]any{
-		"fids": fids,
-	}
-
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}, ""
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}, ""
-	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}, ""
-	}
-
-	// 获取cookies
-	setCookies := resp.Cookies()
-	var cookieStrParts []string
-	for _, cookie := range setCookies {
-		cookieStrParts = append(cookieStrParts, fmt.Sprintf("%s=%s", cookie.Name, cookie.Value))
-	}
-	cookieStr := strings.Join(cookieStrParts, "; ")
-
-	return result, cookieStr
-}
-
-// 创建目录
-func (q *Quark) Mkdir(dirPath string) map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/file", q.BaseURL)
-	params := map[string]string{
-		"pr":           "ucpro",
-		"fr":           "pc",
-		"uc_param_str": "",
-	}
-
+// 创建目录, 会同时创建上级目录, 返回目录ID
+func (q *Quark) Mkdir(dirPath string) (string, error) {
 	payload := map[string]any{
 		"pdir_fid":      "0",
 		"file_name":     "",
 		"dir_path":      dirPath,
 		"dir_init_lock": false,
 	}
-
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	data := struct {
+		Fid string `json:"fid"`
+	}{}
+	if _, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file", quarkParams(), payload, &data); e != nil {
+		return "", e
 	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
-	}
-
-	return result
+	return data.Fid, nil
 }
 
 // 重命名文件
-func (q *Quark) Rename(fid, fileName string) map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/file/rename", q.BaseURL)
-	params := map[string]string{
-		"pr":           "ucpro",
-		"fr":           "pc",
-		"uc_param_str": "",
-	}
+func (q *Quark) Rename(fid, fileName string) error {
+	payload := map[string]any{"fid": fid, "file_name": fileName}
+	_, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/rename", quarkParams(), payload, nil)
+	return e
+}
 
+// 删除文件到回收站
+func (q *Quark) Delete(fileList []string) error {
 	payload := map[string]any{
-		"fid":       fid,
-		"file_name": fileName,
+		"action_type":  2,
+		"filelist":     fileList,
+		"exclude_fids": []string{},
 	}
+	_, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/delete", quarkParams(), payload, nil)
+	return e
+}
 
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+// 移动文件到目录
+func (q *Quark) Move(fileList []string, toPdirFid string) error {
+	payload := map[string]any{
+		"action_type":  1,
+		"exclude_fids": []string{},
+		"filelist":     fileList,
+		"to_pdir_fid":  toPdirFid,
 	}
-	defer resp.Body.Close()
+	_, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/move", quarkParams(), payload, nil)
+	return e
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+// 上传文件到目录, 已有同名文件时先删除, files 为目录中已有的文件
+func (q *Quark) UploadReplace(pdirFid string, files []QuarkFile, fileName string, data []byte) error {
+	for _, f := range files {
+		if f.FileName == fileName {
+			if e := q.Delete([]string{f.Fid}); e != nil {
+				return fmt.Errorf("删除文件 %s 失败, %s", fileName, e.Error())
+			}
+		}
 	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	if _, e := q.Upload(pdirFid, fileName, data); e != nil {
+		return fmt.Errorf("上传文件 %s 失败, %s", fileName, e.Error())
 	}
-
-	return result
+	return nil
 }
 
-// 删除文件
-func (q *Quark) Delete(fileList []string) map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/file/delete", q.BaseURL)
-	params := map[string]string{
-		"pr":           "ucpro",
-		"fr":           "pc",
-		"uc_param_str": "",
+// 上传文件到目录, 返回文件ID, 同名文件不会被覆盖
+func (q *Quark) Upload(pdirFid, fileName string, data []byte) (string, error) {
+	mimeType := mime.TypeByExtension(path.Ext(fileName))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
 	}
-
+	now := time.Now().UnixMilli()
 	payload := map[string]any{
-		"action_type":  2,
-		"filelist":     fileList,
-		"exclude_fids": []string{},
+		"ccp_hash_update": true,
+		"pdir_fid":        pdirFid,
+		"dir_name":        "",
+		"file_name":       fileName,
+		"format_type":     mimeType,
+		"size":            len(data),
+		"l_created_at":    now,
+		"l_updated_at":    now,
 	}
-
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	pre := &quarkUploadPre{}
+	ret, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/upload/pre", quarkParams(), payload, pre)
+	if e != nil {
+		return "", e
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	if pre.Finish {
+		return pre.Fid, nil
 	}
 
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	// 网盘中已有相同的文件时秒传
+	md5Sum, sha1Sum := md5.Sum(data), sha1.Sum(data)
+	hash := struct {
+		Finish bool `json:"finish"`
+	}{}
+	payload = map[string]any{"md5": hex.EncodeToString(md5Sum[:]), "sha1": hex.EncodeToString(sha1Sum[:]), "task_id": pre.TaskId}
+	if _, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/update/hash", quarkParams(), payload, &hash); e != nil {
+		return "", e
 	}
-
-	return result
-}
-
-// 回收站列表
-func (q *Quark) RecycleList(page, size int) []map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/file/recycle/list", q.BaseURL)
-	params := map[string]string{
-		"_page":        fmt.Sprintf("%d", page),
-		"_size":        fmt.Sprintf("%d", size),
-		"pr":           "ucpro",
-		"fr":           "pc",
-		"uc_param_str": "",
+	if hash.Finish {
+		return pre.Fid, nil
 	}
 
-	resp, err := q.sendRequest("GET", urlStr, params, nil, nil)
-	if err != nil {
-		return nil
+	partSize := ret.Metadata.PartSize
+	if partSize <= 0 {
+		partSize = max(len(data), 1)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil
+	etags := make([]string, 0)
+	for i := 0; i == 0 || i < len(data); i += partSize {
+		etag, e := q.uploadPart(pre, mimeType, len(etags)+1, data[i:min(i+partSize, len(data))])
+		if e != nil {
+			return "", e
+		}
+		etags = append(etags, etag)
 	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil
+	if e := q.uploadCommit(pre, etags); e != nil {
+		return "", e
 	}
 
-	data := result["data"].(map[string]any)
-	fileList := data["list"].([]any)
-
-	var resultList []map[string]any
-	for _, file := range fileList {
-		resultList = append(resultList, file.(map[string]any))
+	fin := struct {
+		Fid string `json:"fid"`
+	}{}
+	payload = map[string]any{"obj_key": pre.ObjKey, "task_id": pre.TaskId}
+	if _, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/upload/finish", quarkParams(), payload, &fin); e != nil {
+		return "", e
 	}
-
-	return resultList
+	if fin.Fid != "" {
+		return fin.Fid, nil
+	}
+	return pre.Fid, nil
 }
 
-// 清空回收站
-func (q *Quark) RecycleRemove(recordList []string) map[string]any {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/file/recycle/remove", q.BaseURL)
-	params := map[string]string{
-		"uc_param_str": "",
-		"fr":           "pc",
-		"pr":           "ucpro",
+// 获取 OSS 请求的签名
+func (q *Quark) uploadAuth(pre *quarkUploadPre, meta string) (string, error) {
+	ret := struct {
+		AuthKey string `json:"auth_key"`
+	}{}
+	payload := map[string]any{"auth_info": pre.AuthInfo, "auth_meta": meta, "task_id": pre.TaskId}
+	if _, e := q.do(http.MethodPost, q.BaseURL+"/1/clouddrive/file/upload/auth", quarkParams(), payload, &ret); e != nil {
+		return "", e
 	}
+	return ret.AuthKey, nil
+}
 
-	payload := map[string]any{
-		"select_mode": 2,
-		"record_list": recordList,
+// 发送 OSS 请求, 成功时返回响应头
+func (q *Quark) ossRequest(method string, pre *quarkUploadPre, query url.Values, header map[string]string, body []byte) (http.Header, error) {
+	u, e := url.Parse(pre.UploadUrl)
+	if e != nil {
+		return nil, fmt.Errorf("上传地址 %s 无效: %s", pre.UploadUrl, e.Error())
 	}
-
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	ossURL := fmt.Sprintf("https://%s.%s/%s?%s", pre.Bucket, u.Host, pre.ObjKey, query.Encode())
+	req, e := http.NewRequest(method, ossURL, bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Referer", "https://pan.quark.cn/")
+	req.Header.Set("x-oss-user-agent", QUARK_OSS_UA)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, e := q.client.Do(req)
+	if e != nil {
+		return nil, e
 	}
 	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("上传文件失败: %d, %s", resp.StatusCode, strings.TrimSpace(string(data)))
 	}
+	return resp.Header, nil
+}
 
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return map[string]any{"code": 500, "message": err.Error()}
-	}
+// 上传分片, 返回分片的 ETag
+func (q *Quark) uploadPart(pre *quarkUploadPre, mimeType string, partNumber int, part []byte) (string, error) {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	meta := fmt.Sprintf("PUT\n\n%s\n%s\nx-oss-date:%s\nx-oss-user-agent:%s\n/%s/%s?partNumber=%d&uploadId=%s",
+		mimeType, date, date, QUARK_OSS_UA, pre.Bucket, pre.ObjKey, partNumber, pre.UploadId)
+	auth, e := q.uploadAuth(pre, meta)
+	if e != nil {
+		return "", e
+	}
+	query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {pre.UploadId}}
+	header, e := q.ossRequest(http.MethodPut, pre, query, map[string]string{
+		"Authorization": auth,
+		"Content-Type":  mimeType,
+		"x-oss-date":    date,
+	}, part)
+	if e != nil {
+		return "", e
+	}
+	return header.Get("ETag"), nil
+}
 
-	return result
+type quarkUploadPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// 合并分片
+func (q *Quark) uploadCommit(pre *quarkUploadPre, etags []string) error {
+	parts := struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []quarkUploadPart `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		parts.Parts = append(parts.Parts, quarkUploadPart{i + 1, etag})
+	}
+	body, e := xml.Marshal(parts)
+	if e != nil {
+		return e
+	}
+	body = append([]byte(xml.Header), body...)
+	sum := md5.Sum(body)
+	contentMD5 := base64.StdEncoding.EncodeToString(sum[:])
+	callback, e := json.Marshal(pre.Callback)
+	if e != nil {
+		return e
+	}
+	callbackB64 := base64.StdEncoding.EncodeToString(callback)
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	meta := fmt.Sprintf("POST\n%s\napplication/xml\n%s\nx-oss-callback:%s\nx-oss-date:%s\nx-oss-user-agent:%s\n/%s/%s?uploadId=%s",
+		contentMD5, date, callbackB64, date, QUARK_OSS_UA, pre.Bucket, pre.ObjKey, pre.UploadId)
+	auth, e := q.uploadAuth(pre, meta)
+	if e != nil {
+		return e
+	}
+	_, e = q.ossRequest(http.MethodPost, pre, url.Values{"uploadId": {pre.UploadId}}, map[string]string{
+		"Authorization":  auth,
+		"Content-MD5":    contentMD5,
+		"Content-Type":   "application/xml",
+		"x-oss-callback": callbackB64,
+		"x-oss-date":     date,
+	}, body)
+	return e
 }
 
 // 从URL获取分享ID
@@ -840,168 +781,6 @@ func (q *Quark) GetIDFromURL(shareURL string) (string, string, string) {
 	return "", "", ""
 }
 
-// 更新保存路径FID字典
-func (q *Quark) UpdateSavepathFid(tasklist []map[string]any) bool {
-	var dirPaths []string
-
-	// 获取所有需要的路径
-	for _, task := range tasklist {
-		savePath := task["savepath"].(string)
-		savePath = regexp.MustCompile(`/{2,}`).ReplaceAllString("/"+savePath, "/")
-
-		// 检查任务是否过期
-		if endDate, ok := task["enddate"]; ok && endDate.(string) != "" {
-			endDateTime, err := time.Parse("2006-01-02", endDate.(string))
-			if err == nil && time.Now().After(endDateTime) {
-				continue
-			}
-		}
-
-		dirPaths = append(dirPaths, savePath)
-	}
-
-	if len(dirPaths) == 0 {
-		return false
-	}
-
-	// 获取已存在的目录FID
-	dirPathsExistArr := q.GetFids(dirPaths)
-	var dirPathsExist []string
-	for _, item := range dirPathsExistArr {
-		dirPathsExist = append(dirPathsExist, item["file_path"].(string))
-	}
-
-	// 找出不存在的目录并创建它们
-	for _, dirPath := range dirPaths {
-		if dirPath == "/" {
-			continue
-		}
-
-		exists := false
-		for _, existPath := range dirPathsExist {
-			if dirPath == existPath {
-				exists = true
-				break
-			}
-		}
-
-		if !exists {
-			mkdirReturn := q.Mkdir(dirPath)
-			if mkdirReturn["code"].(float64) == 0 {
-				newDir := mkdirReturn["data"].(map[string]any)
-				dirPathsExistArr = append(dirPathsExistArr, map[string]any{
-					"file_path": dirPath,
-					"fid":       newDir["fid"].(string),
-				})
-				fmt.Printf("创建文件夹：%s\n", dirPath)
-			} else {
-				fmt.Printf("创建文件夹：%s 失败, %s\n", dirPath, mkdirReturn["message"].(string))
-			}
-		}
-	}
-
-	// 保存目录的FID
-	for _, dirPath := range dirPathsExistArr {
-		q.SavepathFid[dirPath["file_path"].(string)] = dirPath["fid"].(string)
-	}
-
-	return true
-}
-
-// 测试保存功能
-func (q *Quark) DoSaveCheck(shareURL, savePath string) map[string]any {
-	pwdID, passcode, pdirFid := q.GetIDFromURL(shareURL)
-	isSharing, stoken := q.GetStoken(pwdID, passcode)
-
-	if !isSharing {
-		return nil
-	}
-
-	shareDetail := q.GetDetail(pwdID, stoken, pdirFid, 0)
-	shareFileList := shareDetail["list"].([]any)
-
-	if len(shareFileList) == 0 {
-		return nil
-	}
-
-	var fidList []string
-	var fidTokenList []string
-	var fileNameList []string
-
-	for _, file := range shareFileList {
-		fileMap := file.(map[string]any)
-		fidList = append(fidList, fileMap["fid"].(string))
-		fidTokenList = append(fidTokenList, fileMap["share_fid_token"].(string))
-		fileNameList = append(fileNameList, fileMap["file_name"].(string))
-	}
-
-	// 获取目标目录FID
-	getFids := q.GetFids([]string{savePath})
-	var toPdirFid string
-
-	if len(getFids) > 0 {
-		toPdirFid = getFids[0]["fid"].(string)
-	} else {
-		mkdirResult := q.Mkdir(savePath)
-		if mkdirResult["code"].(float64) == 0 {
-			toPdirFid = mkdirResult["data"].(map[string]any)["fid"].(string)
-		} else {
-			return nil
-		}
-	}
-
-	// 保存文件
-	saveFile := q.SaveFile(fidList, fidTokenList, toPdirFid, pwdID, stoken)
-
-	if saveFile["code"].(float64) == 41017 {
-		return nil
-	} else if saveFile["code"].(float64) == 0 {
-		// 获取目标目录下的文件列表
-		dirFileList := q.LsDir(toPdirFid, 0)
-		var delList []string
-
-		// 找出刚保存的文件
-		now := time.Now().Unix()
-		for _, file := range dirFileList {
-			fileName := file["file_name"].(string)
-			createdAt := int64(file["created_at"].(float64))
-
-			// 检查文件名是否在要保存的列表中，且创建时间在60秒内
-			for _, saveFileName := range fileNameList {
-				if fileName == saveFileName && (now-createdAt < 60) {
-					delList = append(delList, file["fid"].(string))
-					break
-				}
-			}
-		}
-
-		// 删除文件并清空回收站
-		if len(delList) > 0 {
-			q.Delete(delList)
-			recycleList := q.RecycleList(1, 30)
-			var recordIDList []string
-
-			for _, item := range recycleList {
-				fid := item["fid"].(string)
-				for _, delFid := range delList {
-					if fid == delFid {
-						recordIDList = append(recordIDList, item["record_id"].(string))
-						break
-					}
-				}
-			}
-
-			if len(recordIDList) > 0 {
-				q.RecycleRemove(recordIDList)
-			}
-		}
-
-		return saveFile
-	}
-
-	return nil
-}
-
 // 格式化字节大小
 func FormatBytes(sizeBytes float64) string {
 	units := []string{"B", "KB", "MB", "GB", "TB", "PB", "EB", "ZB", "YB"}
@@ -1015,113 +794,57 @@ func FormatBytes(sizeBytes float64) string {
 	return fmt.Sprintf("%.2f %s", sizeBytes, units[i])
 }
 
-// 执行签到
-func DoSign(account *Quark) {
-	if len(account.Mparam) == 0 {
-		fmt.Println("⏭️ 移动端参数未设置，跳过签到")
-		fmt.Println()
-		return
-	}
-
-	// 获取成长信息
-	growthInfo := account.GetGrowthInfo()
-	if growthInfo != nil {
-		// 判断是否为VIP
-		isVip := false
-		if vipStatus, ok := growthInfo["88VIP"].(bool); ok {
-			isVip = vipStatus
-		}
-
-		// 总空间
-		totalCapacity := growthInfo["total_capacity"].(float64)
-
-		// 签到获得空间
-		var signReward float64
-		if capComp, ok := growthInfo["cap_composition"].(map[string]any); ok {
-			if reward, ok := capComp["sign_reward"].(float64); ok {
-				signReward = reward
-			}
-		}
-
-		growthMessage := fmt.Sprintf("💾 %s 总空间：%s，签到累计获得：%s",
-			map[bool]string{true: "88VIP", false: "普通用户"}[isVip],
-			FormatBytes(totalCapacity),
-			FormatBytes(signReward))
-
-		// 签到信息
-		capSign := growthInfo["cap_sign"].(map[string]any)
-		signDaily := capSign["sign_daily"].(bool)
-		signDailyReward := capSign["sign_daily_reward"].(float64)
-		signProgress := int(capSign["sign_progress"].(float64))
-		signTarget := int(capSign["sign_target"].(float64))
-
-		if signDaily {
-			// 已经签到
-			signMessage := fmt.Sprintf("📅 签到记录: 今日已签到+%dMB，连签进度(%d/%d)✅",
-				int(signDailyReward/1024/1024),
-				signProgress,
-				signTarget)
-
-			message := fmt.Sprintf("%s\n%s", signMessage, growthMessage)
-			fmt.Println(message)
-		} else {
-			// 执行签到
-			sign, signReturn := account.GetGrowthSign()
-			if sign {
-				signRewardMB := int(signReturn.(float64) / 1024 / 1024)
-				signMessage := fmt.Sprintf("📅 执行签到: 今日签到+%dMB，连签进度(%d/%d)✅",
-					signRewardMB,
-					signProgress+1,
-					signTarget)
-
-				message := fmt.Sprintf("%s\n%s", signMessage, growthMessage)
-
-				// 检查是否需要推送通知
-				signNotify := os.Getenv("QUARK_SIGN_NOTIFY")
-				if signNotify == "false" {
-					fmt.Println(message)
-				} else {
-					// 这里应该实现推送通知的功能
-					message = strings.Replace(message, "今日", fmt.Sprintf("[%s]今日", account.Nickname), 1)
-					fmt.Println(message) // 临时简单输出
-				}
-			} else {
-				fmt.Printf("📅 签到异常: %v\n", signReturn)
-			}
-		}
-	}
-	fmt.Println()
+// 签到结果, 签到失败时只有 Pan, Message 和 Time
+type QuarkSignResult struct {
+	Pan       string // 网盘实例名称
+	Nickname  string
+	Success   bool
+	Signed    bool  // 是否为本次签到, 否则今日已签到过
+	Reward    int64 // 今日签到获得的空间
+	Progress  int   // 连签进度
+	Target    int   // 连签目标
+	Capacity  int64 // 总空间
+	SignTotal int64 // 签到累计获得的空间
+	VIP88     bool
+	Message   string
+	Time      CustomTime
 }
 
-func (q *Quark) Move(srcId, dstId string) (map[string]any, error) {
-	urlStr := fmt.Sprintf("%s/1/clouddrive/file/move", q.BaseURL)
-	params := map[string]string{
-		"pr":           "ucpro",
-		"fr":           "pc",
-		"uc_param_str": "",
-	}
-
-	payload := map[string]any{
-		"action_type":  1,
-		"exclude_fids": make([]string, 0),
-		"filelist":     []string{srcId},
-		"to_pdir_fid":  dstId,
-	}
-
-	resp, err := q.sendRequest("POST", urlStr, params, payload, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var result map[string]any
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, err
-	}
-	return result, nil
+// 每日签到, 今日已签到时只返回签到信息, 需要移动端参数
+func (q *Quark) Sign() (*QuarkSignResult, error) {
+	info, e := q.GetGrowthInfo()
+	if e != nil {
+		return nil, fmt.Errorf("获取成长信息失败: %s", e.Error())
+	}
+	r := &QuarkSignResult{
+		Nickname:  q.Nickname,
+		Success:   true,
+		Reward:    info.CapSign.SignDailyReward,
+		Progress:  info.CapSign.SignProgress,
+		Target:    info.CapSign.SignTarget,
+		Capacity:  info.TotalCapacity,
+		SignTotal: info.CapComposition.SignReward,
+		VIP88:     info.VIP88,
+	}
+	if !info.CapSign.SignDaily {
+		reward, e := q.GetGrowthSign()
+		if e != nil {
+			return nil, fmt.Errorf("签到失败: %s", e.Error())
+		}
+		r.Signed = true
+		r.Reward = reward
+		r.Progress++
+		r.SignTotal += reward
+	}
+	state, user := "今日签到", "普通用户"
+	if !r.Signed {
+		state = "今日已签到"
+	}
+	if r.VIP88 {
+		user = "88VIP"
+	}
+	r.Message = fmt.Sprintf("%s+%s, 连签进度(%d/%d), %s 总空间 %s, 签到累计获得 %s",
+		state, FormatBytes(float64(r.Reward)), r.Progress, r.Target,
+		user, FormatBytes(float64(r.Capacity)), FormatBytes(float64(r.SignTotal)))
+	return r, nil
 }
@@ -0,0 +1,470 @@
+package mgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+// 夸克网盘接口的本地模拟, 列表每页只返回 2 条, 上传分片大小为 4, 以测试分页和分片
+type quarkStub struct {
+	mutex    sync.Mutex
+	files    map[string]*QuarkFile // 完整路径 -> 文件
+	contents map[string]string     // 上传的文件内容
+	uploads  map[string]*quarkStubUpload
+	shared   []QuarkFile
+	seq      int
+	limited  int // 接下来被限流的请求数
+	requests int
+	saves    int
+	parts    int  // 上传的分片数
+	signed   bool // 今日是否已签到
+}
+
+type quarkStubUpload struct {
+	dir, name string
+	md5       string
+	parts     map[int][]byte
+}
+
+func (s *quarkStub) add(p string, dir bool, size int64) *QuarkFile {
+	if f, has := s.files[p]; has {
+		return f
+	}
+	pdir := "0"
+	if d := path.Dir(p); d != "/" {
+		pdir = s.add(d, true, 0).Fid
+	}
+	s.seq++
+	f := &QuarkFile{Fid: fmt.Sprintf("f%d", s.seq), PdirFid: pdir, FileName: path.Base(p), Size: size, Dir: dir}
+	s.files[p] = f
+	return f
+}
+
+func (s *quarkStub) pathOf(fid string) string {
+	for p, f := range s.files {
+		if f.Fid == fid {
+			return p
+		}
+	}
+	return ""
+}
+
+func (s *quarkStub) finish(up *quarkStubUpload, data string) *QuarkFile {
+	p := up.dir + "/" + up.name
+	f := s.add(p, false, int64(len(data)))
+	s.contents[p] = data
+	return f
+}
+
+// OSS 的分片上传和合并
+func (s *quarkStub) serveOSS(w http.ResponseWriter, r *http.Request) {
+	up := s.uploads[r.URL.Query().Get("uploadId")]
+	if up == nil || r.Host != "bucket.oss.test" || r.Header.Get("Authorization") != "auth" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.Method == http.MethodPut {
+		n, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		up.parts[n] = body
+		s.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"etag%d"`, n))
+		return
+	}
+	sum := md5.Sum(body)
+	if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) || r.Header.Get("x-oss-callback") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	parts := struct {
+		Parts []quarkUploadPart `xml:"Part"`
+	}{}
+	xml.Unmarshal(body, &parts)
+	var data bytes.Buffer
+	for _, p := range parts.Parts {
+		if p.ETag != fmt.Sprintf(`"etag%d"`, p.PartNumber) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data.Write(up.parts[p.PartNumber])
+	}
+	up.parts = map[int][]byte{0: data.Bytes()}
+}
+
+func (s *quarkStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+
+	reply := func(data any, total int) {
+		json.NewEncoder(w).Encode(map[string]any{"status": 200, "code": 0, "message": "ok", "data": data, "metadata": map[string]int{"_total": total}})
+	}
+	fail := func(status, code int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]any{"status": status, "code": code, "message": msg})
+	}
+	page := func(list []QuarkFile) {
+		p, _ := strconv.Atoi(r.URL.Query().Get("_page"))
+		start, end := min((p-1)*2, len(list)), min(p*2, len(list))
+		reply(map[string]any{"list": list[start:end]}, len(list))
+	}
+	if strings.HasSuffix(r.Host, "oss.test") {
+		s.serveOSS(w, r)
+		return
+	}
+	if s.limited > 0 {
+		s.limited--
+		fail(http.StatusTooManyRequests, 0, "请求过于频繁")
+		return
+	}
+	if r.URL.Path == "/account/info" {
+		if r.Header.Get("cookie") != "c" {
+			fmt.Fprint(w, `{"success":true,"code":"OK","data":null}`)
+			return
+		}
+		fmt.Fprint(w, `{"success":true,"code":"OK","data":{"nickname":"测试"}}`)
+		return
+	}
+	var body map[string]any
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	strs := func(key string) []string {
+		ret := make([]string, 0)
+		for _, v := range body[key].([]any) {
+			ret = append(ret, v.(string))
+		}
+		return ret
+	}
+	q := r.URL.Query()
+	switch r.URL.Path {
+	case "/1/clouddrive/share/sharepage/token":
+		if body["pwd_id"] != "abc" {
+			fail(http.StatusNotFound, 41006, "分享不存在")
+			return
+		}
+		if body["passcode"] != "1234" {
+			fail(http.StatusBadRequest, 41008, "提取码错误")
+			return
+		}
+		reply(map[string]string{"stoken": "st"}, 0)
+	case "/1/clouddrive/share/sharepage/detail":
+		if q.Get("stoken") != "st" {
+			fail(http.StatusBadRequest, 41010, "token 无效")
+			return
+		}
+		page(s.shared)
+	case "/1/clouddrive/file/info/path_list":
+		list := make([]QuarkPathFid, 0)
+		for _, p := range strs("file_path") {
+			if f, has := s.files[p]; has {
+				list = append(list, QuarkPathFid{p, f.Fid})
+			}
+		}
+		reply(list, 0)
+	case "/1/clouddrive/file":
+		reply(map[string]string{"fid": s.add(body["dir_path"].(string), true, 0).Fid}, 0)
+	case "/1/clouddrive/file/sort":
+		list := make([]QuarkFile, 0)
+		for _, f := range s.files {
+			if f.PdirFid == q.Get("pdir_fid") {
+				list = append(list, *f)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].FileName < list[j].FileName })
+		page(list)
+	case "/1/clouddrive/share/sharepage/save":
+		dir := s.pathOf(body["to_pdir_fid"].(string))
+		if dir == "" {
+			fail(http.StatusBadRequest, 41013, "目录不存在")
+			return
+		}
+		for _, fid := range strs("fid_list") {
+			for _, f := range s.shared {
+				if f.Fid == fid {
+					s.add(dir+"/"+f.FileName, f.Dir, f.Size)
+				}
+			}
+		}
+		s.saves++
+		reply(map[string]string{"task_id": "t1"}, 0)
+	case "/1/clouddrive/capacity/growth/info", "/1/clouddrive/capacity/growth/sign":
+		if q.Get("kps") != "k" || q.Get("sign") != "s" || q.Get("vcode") != "v" {
+			fail(http.StatusUnauthorized, 31001, "请先登录")
+			return
+		}
+		if r.URL.Path == "/1/clouddrive/capacity/growth/sign" {
+			if s.signed {
+				fail(http.StatusBadRequest, 44210, "今日已签到")
+				return
+			}
+			s.signed = true
+			reply(map[string]int64{"sign_daily_reward": 20 << 20}, 0)
+			return
+		}
+		growth := QuarkGrowth{TotalCapacity: 10 << 30}
+		growth.CapComposition.SignReward = 100 << 20
+		growth.CapSign.SignDaily, growth.CapSign.SignProgress, growth.CapSign.SignTarget = s.signed, 2, 7
+		if s.signed {
+			growth.CapSign.SignDailyReward = 20 << 20
+		}
+		reply(growth, 0)
+	case "/1/clouddrive/task":
+		reply(QuarkTask{TaskId: q.Get("task_id"), Status: 2}, 0)
+	case "/1/clouddrive/file/upload/pre":
+		dir := s.pathOf(body["pdir_fid"].(string))
+		if dir == "" {
+			fail(http.StatusBadRequest, 41013, "目录不存在")
+			return
+		}
+		task := fmt.Sprintf("u%d", len(s.uploads)+1)
+		s.uploads[task] = &quarkStubUpload{dir: dir, name: body["file_name"].(string), parts: map[int][]byte{}}
+		json.NewEncoder(w).Encode(map[string]any{"status": 200, "code": 0, "metadata": map[string]int{"part_size": 4},
+			"data": quarkUploadPre{TaskId: task, UploadId: task, ObjKey: "obj/" + task, UploadUrl: "http://oss.test", Bucket: "bucket", AuthInfo: "info"}})
+	case "/1/clouddrive/file/update/hash":
+		up := s.uploads[body["task_id"].(string)]
+		up.md5 = body["md5"].(string)
+		for p, c := range s.contents {
+			if sum := md5.Sum([]byte(c)); hex.EncodeToString(sum[:]) == up.md5 {
+				s.finish(up, s.contents[p])
+				reply(map[string]bool{"finish": true}, 0)
+				return
+			}
+		}
+		reply(map[string]bool{"finish": false}, 0)
+	case "/1/clouddrive/file/upload/auth":
+		if body["auth_info"] != "info" || s.uploads[body["task_id"].(string)] == nil {
+			fail(http.StatusBadRequest, 41014, "上传任务不存在")
+			return
+		}
+		reply(map[string]string{"auth_key": "auth"}, 0)
+	case "/1/clouddrive/file/upload/finish":
+		up := s.uploads[body["task_id"].(string)]
+		data := string(up.parts[0])
+		if sum := md5.Sum([]byte(data)); hex.EncodeToString(sum[:]) != up.md5 {
+			fail(http.StatusBadRequest, 41015, "文件校验失败")
+			return
+		}
+		reply(map[string]string{"fid": s.finish(up, data).Fid}, 0)
+	case "/1/clouddrive/file/delete", "/1/clouddrive/file/move":
+		to := ""
+		if body["to_pdir_fid"] != nil {
+			to = s.pathOf(body["to_pdir_fid"].(string))
+		}
+		for _, fid := range strs("filelist") {
+			src := s.pathOf(fid)
+			if src == "" {
+				fail(http.StatusNotFound, 41012, "文件不存在")
+				return
+			}
+			for p, f := range s.files {
+				if p != src && !strings.HasPrefix(p, src+"/") {
+					continue
+				}
+				delete(s.files, p)
+				if to != "" {
+					if p == src {
+						f.PdirFid = body["to_pdir_fid"].(string)
+					}
+					s.files[to+"/"+path.Base(src)+strings.TrimPrefix(p, src)] = f
+				}
+			}
+		}
+		reply(nil, 0)
+	default:
+		fail(http.StatusNotFound, 404, "not found")
+	}
+}
+
+func newQuarkStub() (*quarkStub, *httptest.Server, *Quark) {
+	stub := &quarkStub{
+		files:    map[string]*QuarkFile{},
+		contents: map[string]string{},
+		uploads:  map[string]*quarkStubUpload{},
+		shared: []QuarkFile{
+			{Fid: "s1", FileName: "a.zip", Size: 10, ShareFidToken: "t1"},
+			{Fid: "s2", FileName: "b.zip", Size: 20, ShareFidToken: "t2"},
+			{Fid: "s3", FileName: "c", Dir: true, ShareFidToken: "t3"},
+			{Fid: "s4", FileName: "ban.zip", Size: 30, ShareFidToken: "t4", Ban: true},
+		},
+	}
+	// OSS 的地址为 https://bucket.oss.test, 所有连接都转到本地
+	ts := httptest.NewTLSServer(stub)
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.InsecureSkipVerify = true
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+	quark := NewQuark("c")
+	quark.client.Transport = tr
+	quark.BaseURL, quark.BaseURLApp, quark.AccountURL = ts.URL, ts.URL, ts.URL+"/account/info"
+	quark.RetryDelay = time.Millisecond
+	return stub, ts, quark
+}
+
+func TestQuarkClient(t *testing.T) {
+	stub, ts, quark := newQuarkStub()
+	defer ts.Close()
+
+	info, e := quark.Init()
+	assert.Equal(t, e, nil)
+	assert.Equal(t, info.Nickname, "测试")
+	assert.Equal(t, quark.IsActive, true)
+
+	pwdID, passcode, pdirFid := quark.GetIDFromURL("https://pan.quark.cn/s/abc?pwd=1234")
+	assert.Equal(t, []string{pwdID, passcode, pdirFid}, []string{"abc", "1234", "0"})
+	_, e = quark.GetStoken("abc", "0000")
+	assert.Equal(t, e.(*QuarkError).Code, 41008)
+	assert.Equal(t, e.Error(), "夸克网盘接口错误 400/41008: 提取码错误")
+	stoken, e := quark.GetStoken(pwdID, passcode)
+	assert.Equal(t, e, nil)
+
+	files, e := quark.GetDetail(pwdID, stoken, pdirFid)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 4)
+	assert.Equal(t, files[3].Ban, true)
+
+	fid, e := quark.GetFid("/x/y")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, fid, "")
+	fid, e = quark.Mkdir("/x/y")
+	assert.Equal(t, e, nil)
+	fids, e := quark.GetFids([]string{"/x", "/x/y", "/z"})
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(fids), 2)
+	assert.Equal(t, fids[1], QuarkPathFid{"/x/y", fid})
+
+	taskId, e := quark.SaveFile([]string{"s1", "s2", "s3"}, []string{"t1", "t2", "t3"}, fid, pwdID, stoken)
+	assert.Equal(t, e, nil)
+	task, e := quark.QueryTask(taskId)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, task.Status, 2)
+	files, e = quark.LsDir(fid)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 3)
+
+	// 分片上传, 相同内容再次上传时秒传
+	ufid, e := quark.Upload(fid, "readme.txt", []byte("hello world"))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, stub.parts, 3)
+	assert.Equal(t, stub.contents["/x/y/readme.txt"], "hello world")
+	assert.Equal(t, stub.files["/x/y/readme.txt"].Fid, ufid)
+	_, e = quark.Upload(fid, "copy.txt", []byte("hello world"))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, stub.parts, 3)
+	assert.Equal(t, stub.contents["/x/y/copy.txt"], "hello world")
+	assert.Equal(t, quark.Delete([]string{ufid}), nil)
+	_, e = quark.Upload(fid, "empty.txt", nil)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, stub.parts, 4)
+	fids, e = quark.GetFids([]string{"/x/y/copy.txt", "/x/y/empty.txt"})
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(fids), 2)
+	assert.Equal(t, quark.Delete([]string{fids[0].Fid, fids[1].Fid}), nil)
+
+	// 被限流时重试, 超过次数后返回错误
+	stub.limited = QUARK_MAX_RETRY
+	files, e = quark.LsDir(fid)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 3)
+	stub.limited = QUARK_MAX_RETRY + 1
+	_, e = quark.LsDir(fid)
+	assert.Equal(t, e.(*QuarkError).Status, http.StatusTooManyRequests)
+	stub.limited = 0
+
+	zid, e := quark.Mkdir("/z")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, quark.Move([]string{fid}, zid), nil)
+	fid, e = quark.GetFid("/z/y/a.zip")
+	assert.Equal(t, e, nil)
+	assert.NotEqual(t, fid, "")
+	assert.Equal(t, quark.Delete([]string{zid}), nil)
+	fid, e = quark.GetFid("/z/y/a.zip")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, fid, "")
+
+	// 未登录时账号信息为空
+	quark.Cookie = ""
+	_, e = quark.GetAccountInfo()
+	assert.Equal(t, e.Error(), "获取账号信息失败, 用户未处于登录状态")
+}
+
+func TestQuarkPanTransfer(t *testing.T) {
+	stub, ts, quark := newQuarkStub()
+	defer ts.Close()
+
+	topic := NewTopic(nil, 100)
+	topic.Title, topic.Author = "资源帖", "楼主"
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	srv.cache.topics.Put(100, topic)
+
+	q := NewQuarkPan(QuarkCfg{Name: "quark", Root: t.TempDir(), Readme: true})
+	q.quark = quark
+	q.SetHolder(&PanHolder{msgCh: make(chan string, 9), srv: srv})
+	assert.Equal(t, q.Init(), nil)
+	defer q.Close()
+	assert.Equal(t, q.Check(), nil)
+	assert.Equal(t, q.moveDestFid, "")
+	assert.Equal(t, q.IsExist(100), false)
+
+	record := TransferRecord{URL: "https://pan.quark.cn/s/abc", Tqm: "1234", Pwd: "nga"}
+	assert.Equal(t, q.doTransfer(quarkTask{100, record, PAN_OPT_SAVE}), nil)
+	assert.Equal(t, q.IsExist(100), true)
+	files, e := q.Ls(q.topicDir(100))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 5)
+	dir := q.topicDir(100)
+	assert.Equal(t, stub.contents[dir+"/"+PAN_PWD_FILE], "nga")
+	assert.Equal(t, stub.contents[dir+"/"+PAN_README_FILE], "标题: 资源帖\n作者: 楼主\n")
+
+	// 同名文件被替换
+	fid, e := quark.GetFid(dir)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, quark.UploadReplace(fid, files, PAN_PWD_FILE, []byte("new")), nil)
+	assert.Equal(t, stub.contents[dir+"/"+PAN_PWD_FILE], "new")
+	files, e = q.Ls(dir)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 5)
+
+	e = q.doTransfer(quarkTask{100, record, PAN_OPT_SAVE})
+	assert.Equal(t, e.Error(), "QuarkPan: 文件都已存在")
+	assert.Equal(t, stub.saves, 1)
+
+	// 提取码错误时不创建目录
+	e = q.doTransfer(quarkTask{101, TransferRecord{URL: "https://pan.quark.cn/s/abc?pwd=0000"}, PAN_OPT_SAVE})
+	assert.Equal(t, strings.HasPrefix(e.Error(), "QuarkPan: 获取分享"), true)
+	assert.Equal(t, q.IsExist(101), false)
+
+	assert.Equal(t, q.Move(100).Error(), "QuarkPan: 移动目标目录未设置")
+	q.moveDestFid, e = quark.Mkdir(q.cfg.MoveDest)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, q.Move(100), nil)
+	assert.Equal(t, q.IsExist(100), false)
+	files, e = q.Ls(fmt.Sprintf("%s/%d", q.cfg.MoveDest, 100))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(files), 5)
+
+	assert.Equal(t, q.doTransfer(quarkTask{102, record, PAN_OPT_SAVE}), nil)
+	assert.Equal(t, q.Delete(102), nil)
+	assert.Equal(t, q.IsExist(102), false)
+	assert.NotEqual(t, q.Delete(102), nil)
+}
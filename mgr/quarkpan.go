@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 
 	"github.com/i2534/ngamm/mgr/log"
 
+	"github.com/robfig/cron/v3"
 	"gopkg.in/ini.v1"
 )
 
@@ -16,6 +18,7 @@ var (
 	QuarkUserINI          = "user.ini"
 	QuarkBaseTransferDest = "/来自：分享"
 	QuarkBaseMoveDest     = "/Tidy"
+	QuarkSignCron         = "0 8 * * *" // 默认每天 8 点签到
 )
 
 type quarkTask struct {
@@ -24,13 +27,38 @@ type quarkTask struct {
 	opt     PanOpt
 }
 
+var quarkDriver = RegisterPanDriver(PanDriver{
+	Name:     "quark",
+	Patterns: []*regexp.Regexp{regexp.MustCompile(`pan\.quark\.cn`)},
+	New: func(name, root string, sec *ini.Section) (Pan, error) {
+		qc := new(QuarkCfg)
+		if e := sec.MapTo(qc); e != nil {
+			return nil, e
+		}
+		if qc.Transfer == "" {
+			qc.Transfer = TRANSFER_TYPE_AUTO
+		}
+		if !sec.HasKey("sign_cron") {
+			qc.SignCron = QuarkSignCron
+		}
+		qc.Name, qc.Root = name, root
+		return NewQuarkPan(*qc), nil
+	},
+})
+
 type QuarkCfg struct {
+	Name         string // 网盘实例名称, 即配置段名称
 	Root         string // 工作目录
 	Enable       bool   `ini:"enable"`    // 是否启用
 	Transfer     string `ini:"transfer"`  // 转存方式: auto, manual
 	TransferDest string `ini:"directory"` // 转存的根目录
 	MoveDest     string `ini:"move_dir"`  // 移动的根目录
 	Cookie       string `ini:"cookie"`    // 夸克网盘 cookie
+	Readme       bool   `ini:"readme"`    // 是否在帖子目录中生成 README.txt
+	SignCron     string `ini:"sign_cron"` // 签到时间, cron 表达式, 为空时不签到
+	Kps          string `ini:"kps"`       // 移动端参数, 只用于签到, 不设置时从 cookie 中提取
+	Sign         string `ini:"sign"`
+	Vcode        string `ini:"vcode"`
 }
 
 type QuarkPan struct {
@@ -41,12 +69,16 @@ type QuarkPan struct {
 	tasks       chan quarkTask
 	holder      *PanHolder
 	moveDestFid string
+	cron        *cron.Cron
+	signId      cron.EntryID
+	signResult  *QuarkSignResult // 最近一次的签到结果
 }
 
 func NewQuarkPan(cfg QuarkCfg) *QuarkPan {
 	q := &QuarkPan{
 		cfg:   cfg,
 		mutex: &sync.Mutex{},
+		cron:  cron.New(cron.WithLocation(TIME_LOC)),
 	}
 	if q.cfg.TransferDest == "" {
 		q.cfg.TransferDest = QuarkBaseTransferDest
@@ -58,7 +90,10 @@ func NewQuarkPan(cfg QuarkCfg) *QuarkPan {
 }
 
 func (q *QuarkPan) Name() string {
-	return "quark"
+	if q.cfg.Name == "" {
+		return quarkDriver.Name
+	}
+	return q.cfg.Name
 }
 
 func (q *QuarkPan) SetHolder(holder *PanHolder) {
@@ -82,44 +117,46 @@ func (q *QuarkPan) Init() error {
 		q.root = root
 	}
 
-	cookie := q.cfg.Cookie
-	if cookie == "" {
-		fp := filepath.Join(q.root, QuarkUserINI)
-		cfg, e := ini.Load(fp)
-		if e != nil {
-			return fmt.Errorf("QuarkPan: 读取配置文件 %s 出现问题: %s", fp, e.Error())
+	if q.quark == nil {
+		cookie := q.cfg.Cookie
+		if cookie == "" {
+			fp := filepath.Join(q.root, QuarkUserINI)
+			cfg, e := ini.Load(fp)
+			if e != nil {
+				return fmt.Errorf("QuarkPan: 读取配置文件 %s 出现问题: %s", fp, e.Error())
+			}
+			cookie = cfg.Section("").Key("cookie").String()
 		}
-		cookie = cfg.Section("").Key("cookie").String()
-	}
-
-	quark := NewQuark(cookie)
-	info, err := quark.Init()
-	if err != nil {
-		return fmt.Errorf("QuarkPan: 初始化失败: %s", err.Error())
+		q.quark = NewQuark(cookie)
 	}
-	if info == nil {
-		return fmt.Errorf("QuarkPan: 初始化失败")
+	if q.cfg.Kps != "" && q.cfg.Sign != "" && q.cfg.Vcode != "" {
+		q.quark.SetSignParam(q.cfg.Kps, q.cfg.Sign, q.cfg.Vcode)
 	}
 
-	if !quark.IsActive {
-		return fmt.Errorf("QuarkPan: 用户未处于登录状态")
+	if _, e := q.quark.Init(); e != nil {
+		return fmt.Errorf("QuarkPan: 初始化失败: %s", e.Error())
 	}
-
-	q.quark = quark
 	log.Printf("QuarkPan: 登录成功, 用户名: %s\n", q.quark.Nickname)
 
 	if q.cfg.MoveDest != "" {
-		fids := q.quark.GetFids([]string{q.cfg.MoveDest})
-		if len(fids) > 0 {
-			q.moveDestFid = ToString(fids[0]["fid"], "")
+		fid, e := q.quark.GetFid(q.cfg.MoveDest)
+		if e != nil {
+			return fmt.Errorf("QuarkPan: 获取目录 %s 失败: %s", q.cfg.MoveDest, e.Error())
 		}
+		q.moveDestFid = fid
+	}
+
+	if e := q.initSign(); e != nil {
+		return e
 	}
 
 	if q.tasks == nil {
 		q.tasks = make(chan quarkTask, 99)
+		// Close 会把 q.tasks 置空, 协程中使用局部变量
+		tasks := q.tasks
 		go func() {
 			log.Println("QuarkPan: 启动任务处理协程")
-			for task := range q.tasks {
+			for task := range tasks {
 				var e error
 				var status string
 				switch task.opt {
@@ -146,19 +183,23 @@ func (q *QuarkPan) Init() error {
 	return nil
 }
 
+func (q *QuarkPan) Check() error {
+	if q.quark == nil {
+		return fmt.Errorf("QuarkPan: 未初始化")
+	}
+	if _, e := q.quark.GetAccountInfo(); e != nil {
+		return fmt.Errorf("QuarkPan: %s", e.Error())
+	}
+	return nil
+}
+
 func (q QuarkPan) Support(record TransferRecord) bool {
-	return strings.Contains(record.URL, "pan.quark.cn")
+	return quarkDriver.Match(record.URL)
 }
 func (q QuarkPan) TransferType() string {
 	return q.cfg.Transfer
 }
 
-type quarkFile struct {
-	fid      string
-	fidToken string
-	size     float64
-}
-
 func (q *QuarkPan) topicDir(topicId int) string {
 	return fmt.Sprintf("%s/%d", q.cfg.TransferDest, topicId)
 }
@@ -170,31 +211,23 @@ func (q *QuarkPan) doTransfer(task quarkTask) error {
 		url = fmt.Sprintf("%s?pwd=%s", url, task.record.Tqm)
 	}
 	log.Group(groupPan).Printf("QuarkPan: 处理转存任务: %d, %s\n", task.topicId, url)
-	// copy from DoSaveCheck
 	pwdID, passcode, pdirFid := quark.GetIDFromURL(url)
-	isSharing, stoken := quark.GetStoken(pwdID, passcode)
-	if !isSharing {
-		return fmt.Errorf("QuarkPan: %s 不是分享链接", url)
+	stoken, e := quark.GetStoken(pwdID, passcode)
+	if e != nil {
+		return fmt.Errorf("QuarkPan: 获取分享 %s 失败, %s", url, e.Error())
 	}
 
-	shareDetail := quark.GetDetail(pwdID, stoken, pdirFid, 0)
-	shareFileList := shareDetail["list"].([]any)
-
-	fs := make(map[string]quarkFile)
-	for _, file := range shareFileList {
-		fileMap := file.(map[string]any)
-
-		ban := ToBool(fileMap["ban"], false)
-		name := ToString(fileMap["file_name"], "")
-		if ban {
-			log.Group(groupPan).Printf("QuarkPan: 文件 %s 被 Ban, 跳过", name)
+	shareFiles, e := quark.GetDetail(pwdID, stoken, pdirFid)
+	if e != nil {
+		return fmt.Errorf("QuarkPan: 获取分享文件列表失败, %s", e.Error())
+	}
+	fs := make(map[string]QuarkFile)
+	for _, file := range shareFiles {
+		if file.Ban {
+			log.Group(groupPan).Printf("QuarkPan: 文件 %s 被 Ban, 跳过", file.FileName)
 			continue
 		}
-		fs[name] = quarkFile{
-			fid:      ToString(fileMap["fid"], ""),
-			fidToken: ToString(fileMap["share_fid_token"], ""),
-			size:     ToFloat(fileMap["size"], 0),
-		}
+		fs[file.FileName] = file
 	}
 	if len(fs) == 0 {
 		return fmt.Errorf("QuarkPan: 分享链接 %s 中没有有效文件", url)
@@ -202,28 +235,24 @@ func (q *QuarkPan) doTransfer(task quarkTask) error {
 
 	// 获取目标目录FID
 	dir := q.topicDir(task.topicId)
-	var toPdirFid string
-
-	getFids := quark.GetFids([]string{dir})
-	if len(getFids) > 0 {
-		toPdirFid = ToString(getFids[0]["fid"], "")
-	} else {
-		mkdirResult := quark.Mkdir(dir)
-		if ToFloat(mkdirResult["code"], -1) == 0 {
-			toPdirFid = ToString(mkdirResult["data"].(map[string]any)["fid"], "")
-		} else {
-			return fmt.Errorf("QuarkPan: 创建目录 %s 失败, %s", dir, ToString(mkdirResult["message"], ""))
+	toPdirFid, e := quark.GetFid(dir)
+	if e != nil {
+		return fmt.Errorf("QuarkPan: 获取目录 %s 失败, %s", dir, e.Error())
+	}
+	if toPdirFid == "" {
+		if toPdirFid, e = quark.Mkdir(dir); e != nil {
+			return fmt.Errorf("QuarkPan: 创建目录 %s 失败, %s", dir, e.Error())
 		}
 	}
 
-	dirFileList := quark.LsDir(toPdirFid, 0)
-	for _, file := range dirFileList {
-		fileName := ToString(file["file_name"], "")
-		if f, ok := fs[fileName]; ok {
-			if f.size == ToFloat(file["size"], 0) {
-				log.Group(groupPan).Printf("QuarkPan: 文件 %s 已存在, 跳过", fileName)
-				delete(fs, fileName)
-			}
+	dirFiles, e := quark.LsDir(toPdirFid)
+	if e != nil {
+		return fmt.Errorf("QuarkPan: 列出目录 %s 失败, %s", dir, e.Error())
+	}
+	for _, file := range dirFiles {
+		if f, ok := fs[file.FileName]; ok && f.Size == file.Size {
+			log.Group(groupPan).Printf("QuarkPan: 文件 %s 已存在, 跳过", file.FileName)
+			delete(fs, file.FileName)
 		}
 	}
 	if len(fs) == 0 {
@@ -233,35 +262,70 @@ func (q *QuarkPan) doTransfer(task quarkTask) error {
 	var fidList []string
 	var fidTokenList []string
 	for _, v := range fs {
-		fidList = append(fidList, v.fid)
-		fidTokenList = append(fidTokenList, v.fidToken)
-	}
-	// 保存文件
-	saveFile := quark.SaveFile(fidList, fidTokenList, toPdirFid, pwdID, stoken)
-	if ToFloat(saveFile["code"], -1) != 0 {
-		if len(dirFileList) == 0 { // 保存前为空目录, 保存又失败, 再次判断目录是否为空
-			if dirFileList = quark.LsDir(toPdirFid, 0); len(dirFileList) == 0 {
+		fidList = append(fidList, v.Fid)
+		fidTokenList = append(fidTokenList, v.ShareFidToken)
+	}
+	// 保存文件并等待保存完成
+	taskId, e := quark.SaveFile(fidList, fidTokenList, toPdirFid, pwdID, stoken)
+	if e == nil {
+		_, e = quark.QueryTask(taskId)
+	}
+	if e != nil {
+		if len(dirFiles) == 0 { // 保存前为空目录, 保存又失败, 再次判断目录是否为空
+			if files, le := quark.LsDir(toPdirFid); le == nil && len(files) == 0 {
 				log.Group(groupPan).Printf("QuarkPan: 目录 %s 为空, 删除", dir)
-				// 删除目录
 				quark.Delete([]string{toPdirFid})
 			}
 		}
-		return fmt.Errorf("QuarkPan: 保存文件失败, %s", ToString(saveFile["message"], ""))
+		return fmt.Errorf("QuarkPan: 保存文件失败, %s", e.Error())
+	}
+
+	// 解压密码和说明文件可能有变化, 替换已有的文件
+	if task.record.Pwd != "" {
+		if e := quark.UploadReplace(toPdirFid, dirFiles, PAN_PWD_FILE, []byte(task.record.Pwd)); e != nil {
+			log.Printf("QuarkPan: 上传解压密码文件出现问题: %s", e.Error())
+		}
+	}
+	if q.cfg.Readme && q.holder != nil {
+		if readme := q.holder.topicReadme(task.topicId); readme != "" {
+			if e := quark.UploadReplace(toPdirFid, dirFiles, PAN_README_FILE, []byte(readme)); e != nil {
+				log.Printf("QuarkPan: 上传说明文件出现问题: %s", e.Error())
+			}
+		}
 	}
 
 	log.Group(groupPan).Printf("QuarkPan: 处理转存任务完成: %d, %s\n", task.topicId, url)
 	return nil
 }
 
-func (q *QuarkPan) Ls(dir string) (any, error) {
-	quark := q.quark
-	fids := quark.GetFids([]string{dir})
-	if len(fids) == 0 {
+func (q *QuarkPan) Ls(dir string) ([]QuarkFile, error) {
+	fid, e := q.quark.GetFid(dir)
+	if e != nil {
+		return nil, fmt.Errorf("QuarkPan: %s", e.Error())
+	}
+	if fid == "" {
 		return nil, fmt.Errorf("QuarkPan: 目录 %s 不存在", dir)
 	}
-	fid := ToString(fids[0]["fid"], "")
-	list := quark.LsDir(fid, 0)
-	return list, nil
+	return q.quark.LsDir(fid)
+}
+
+// 通过获取分享 token 检查链接是否有效
+func (q *QuarkPan) CheckShare(record TransferRecord) error {
+	if q.quark == nil {
+		return fmt.Errorf("QuarkPan: 未初始化")
+	}
+	url := record.URL
+	if !strings.Contains(url, "?pwd=") && record.Tqm != "" {
+		url = fmt.Sprintf("%s?pwd=%s", url, record.Tqm)
+	}
+	pwdID, passcode, _ := q.quark.GetIDFromURL(url)
+	if _, e := q.quark.GetStoken(pwdID, passcode); e != nil {
+		if qe, ok := e.(*QuarkError); ok {
+			return shareError(qe.Message)
+		}
+		return e
+	}
+	return nil
 }
 
 func (q *QuarkPan) Transfer(topicId int, record TransferRecord) error {
@@ -278,11 +342,11 @@ func (q *QuarkPan) Transfer(topicId int, record TransferRecord) error {
 
 // 获取 Topic 目录 FID
 func (q *QuarkPan) getTopicDirFid(topicId int) string {
-	fids := q.quark.GetFids([]string{q.topicDir(topicId)})
-	if len(fids) == 0 {
-		return ""
+	fid, e := q.quark.GetFid(q.topicDir(topicId))
+	if e != nil {
+		log.Group(groupPan).Printf("QuarkPan: 获取帖子 %d 的目录失败: %s\n", topicId, e.Error())
 	}
-	return ToString(fids[0]["fid"], "")
+	return fid
 }
 
 func (q *QuarkPan) IsExist(topicId int) bool {
@@ -298,12 +362,8 @@ func (q *QuarkPan) Move(topicId int) error {
 	if srcFid == "" {
 		return fmt.Errorf("QuarkPan: 获取 Topic 目录 FID 失败")
 	}
-	ret, err := q.quark.Move(srcFid, q.moveDestFid)
-	if err != nil {
-		return fmt.Errorf("QuarkPan: 移动文件失败, %s", err.Error())
-	}
-	if ToFloat(ret["code"], -1) != 0 {
-		return fmt.Errorf("QuarkPan: 移动文件失败, %s", ToString(ret["message"], ""))
+	if e := q.quark.Move([]string{srcFid}, q.moveDestFid); e != nil {
+		return fmt.Errorf("QuarkPan: 移动文件失败, %s", e.Error())
 	}
 	return nil
 }
@@ -313,9 +373,8 @@ func (q *QuarkPan) Delete(topicId int) error {
 	if srcFid == "" {
 		return fmt.Errorf("QuarkPan: 获取 Topic 目录 FID 失败")
 	}
-	ret := q.quark.Delete([]string{srcFid})
-	if ToFloat(ret["code"], -1) != 0 {
-		return fmt.Errorf("QuarkPan: 移动文件失败, %s", ToString(ret["message"], ""))
+	if e := q.quark.Delete([]string{srcFid}); e != nil {
+		return fmt.Errorf("QuarkPan: 删除文件失败, %s", e.Error())
 	}
 	return nil
 }
@@ -329,7 +388,12 @@ func (q *QuarkPan) TransferOpt(topicId int, record *TransferRecord, opt PanOpt)
 	return nil
 }
 
+func (q *QuarkPan) queueLen() int {
+	return len(q.tasks)
+}
+
 func (q *QuarkPan) Close() error {
+	q.cron.Stop()
 	if q.tasks != nil {
 		close(q.tasks)
 		q.tasks = nil
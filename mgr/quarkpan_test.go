@@ -43,11 +43,14 @@ func TestQuarkDelete(t *testing.T) {
 	if info == nil {
 		t.Fatalf("Failed to initialize Quark: %v", info)
 	}
-	getFids := quark.GetFids([]string{"/test/aaaa"})
-	f0 := getFids[0]
-	t.Logf("Fid: %+v", f0)
-	r := quark.Delete([]string{f0["fid"].(string)})
-	t.Logf("Result: %+v", r)
+	fid, err := quark.GetFid("/test/aaaa")
+	if err != nil || fid == "" {
+		t.Fatalf("Failed to get fid: %v", err)
+	}
+	t.Logf("Fid: %s", fid)
+	if err := quark.Delete([]string{fid}); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
 }
 
 func TestQuarkInit(t *testing.T) {
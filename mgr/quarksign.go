@@ -0,0 +1,122 @@
+package mgr
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/i2534/ngamm/mgr/log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 添加每日签到任务, 没有移动端参数时不签到
+func (q *QuarkPan) initSign() error {
+	if q.signId != 0 || q.cfg.SignCron == "" {
+		return nil
+	}
+	if len(q.quark.signParam()) == 0 {
+		log.Printf("QuarkPan: %s 未设置移动端参数, 不执行签到\n", q.Name())
+		return nil
+	}
+	id, e := q.cron.AddFunc(q.cfg.SignCron, func() { q.Sign() })
+	if e != nil {
+		return fmt.Errorf("QuarkPan: 签到时间 %s 无效: %s", q.cfg.SignCron, e.Error())
+	}
+	q.signId = id
+	q.cron.Start()
+	log.Printf("QuarkPan: %s 签到任务已添加: %s\n", q.Name(), q.cfg.SignCron)
+	return nil
+}
+
+// 执行签到, 结果通过 webhook 和事件发送
+func (q *QuarkPan) Sign() *QuarkSignResult {
+	var r *QuarkSignResult
+	if q.quark == nil {
+		r = &QuarkSignResult{Message: "未初始化"}
+	} else if ret, e := q.quark.Sign(); e != nil {
+		r = &QuarkSignResult{Nickname: q.quark.Nickname, Message: e.Error()}
+	} else {
+		r = ret
+	}
+	r.Pan, r.Time = q.Name(), Now()
+
+	q.mutex.Lock()
+	q.signResult = r
+	q.mutex.Unlock()
+
+	msg := fmt.Sprintf("夸克网盘 %s 签到", q.Name())
+	if r.Nickname != "" {
+		msg = fmt.Sprintf("夸克网盘 %s (%s) 签到", q.Name(), r.Nickname)
+	}
+	if r.Success {
+		msg += ": " + r.Message
+	} else {
+		msg += "失败: " + r.Message
+	}
+	log.Group(groupPan).Println(msg)
+	if q.holder != nil {
+		if q.holder.msgCh != nil {
+			q.holder.msgCh <- msg
+		}
+		q.holder.srv.publish(EVENT_PAN_SIGN, 0, r)
+	}
+	return r
+}
+
+// 最近一次的签到结果, 没有签到过时为 nil
+func (q *QuarkPan) LastSign() *QuarkSignResult {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.signResult
+}
+
+type quarkSignStatus struct {
+	Pan    string
+	Cron   string           // 签到时间, 为空时不签到
+	Next   *CustomTime      `json:",omitempty"` // 下次签到时间
+	Result *QuarkSignResult `json:",omitempty"` // 最近一次的签到结果
+}
+
+func (srv *Server) quarkPans() []*QuarkPan {
+	qs := make([]*QuarkPan, 0)
+	if srv.cache.pans == nil {
+		return qs
+	}
+	for _, pan := range srv.cache.pans.Pans {
+		if q, ok := pan.(*QuarkPan); ok {
+			qs = append(qs, q)
+		}
+	}
+	return qs
+}
+
+// 所有夸克网盘的签到状态
+func (srv *Server) quarkSignList() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		list := make([]quarkSignStatus, 0)
+		for _, q := range srv.quarkPans() {
+			status := quarkSignStatus{Pan: q.Name(), Result: q.LastSign()}
+			if q.signId != 0 {
+				status.Cron = q.cfg.SignCron
+				next := CustomTime{q.cron.Entry(q.signId).Next}
+				status.Next = &next
+			}
+			list = append(list, status)
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// 立即执行签到
+func (srv *Server) quarkSignRun() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		for _, q := range srv.quarkPans() {
+			if q.Name() == name {
+				c.JSON(http.StatusOK, q.Sign())
+				return
+			}
+		}
+		c.JSON(http.StatusNotFound, toErr("未找到夸克网盘 "+name))
+	}
+}
@@ -0,0 +1,114 @@
+package mgr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+	"github.com/robfig/cron/v3"
+)
+
+func TestQuarkMparam(t *testing.T) {
+	quark := NewQuark("a=1; kps=abc%25d; sign=xyz; vcode=123")
+	assert.Equal(t, quark.Mparam, map[string]string{"kps": "abc%d", "sign": "xyz", "vcode": "123"})
+	quark = NewQuark("a=1; kps=abc")
+	assert.Equal(t, len(quark.Mparam), 0)
+}
+
+func TestQuarkSign(t *testing.T) {
+	_, ts, quark := newQuarkStub()
+	defer ts.Close()
+
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}, events: newEventHub()}
+	ph := &PanHolder{msgCh: make(chan string, 9), srv: srv}
+	srv.cache.pans = ph
+	events := srv.events.Subscribe()
+	defer srv.events.Unsubscribe(events)
+	// 签到结果同时发送到 webhook 和事件
+	signed := func() *QuarkSignResult {
+		ev := <-events
+		assert.Equal(t, ev.Type, EVENT_PAN_SIGN)
+		assert.Equal(t, len(ph.msgCh), 1)
+		<-ph.msgCh
+		return ev.Data.(*QuarkSignResult)
+	}
+
+	q := NewQuarkPan(QuarkCfg{Name: "quark", Root: t.TempDir(), SignCron: QuarkSignCron, Kps: "k", Sign: "s", Vcode: "v"})
+	q.quark = quark
+	assert.Equal(t, q.Init(), nil)
+	defer q.Close()
+	q.SetHolder(ph)
+	ph.Pans = []Pan{q}
+	assert.NotEqual(t, q.signId, cron.EntryID(0))
+	// 配置的签到参数不改变分享接口
+	assert.Equal(t, len(quark.Mparam), 0)
+	assert.Equal(t, quark.SignParam, map[string]string{"kps": "k", "sign": "s", "vcode": "v"})
+	assert.Equal(t, q.LastSign() == nil, true)
+
+	r := q.Sign()
+	assert.Equal(t, r.Success, true)
+	assert.Equal(t, r.Signed, true)
+	assert.Equal(t, r.Reward, int64(20<<20))
+	assert.Equal(t, r.Progress, 3)
+	assert.Equal(t, r.SignTotal, int64(120<<20))
+	assert.Equal(t, signed(), r)
+	assert.Equal(t, r.Message, "今日签到+20.00 MB, 连签进度(3/7), 普通用户 总空间 10.00 GB, 签到累计获得 120.00 MB")
+
+	// 今日已签到时只返回签到信息
+	r = q.Sign()
+	assert.Equal(t, r.Success, true)
+	assert.Equal(t, r.Signed, false)
+	assert.Equal(t, r.Reward, int64(20<<20))
+	assert.Equal(t, signed(), r)
+	assert.Equal(t, r.Message, "今日已签到+20.00 MB, 连签进度(2/7), 普通用户 总空间 10.00 GB, 签到累计获得 100.00 MB")
+	assert.Equal(t, q.LastSign(), r)
+
+	// 移动端参数错误时签到失败
+	quark.SetSignParam("k", "s", "x")
+	r = q.Sign()
+	assert.Equal(t, r.Success, false)
+	assert.Equal(t, signed(), r)
+	assert.Equal(t, r.Message, "获取成长信息失败: 夸克网盘接口错误 401/31001: 请先登录")
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/sign", nil)
+	srv.quarkSignList()(c)
+	assert.Equal(t, w.Code, http.StatusOK)
+	var list []quarkSignStatus
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &list), nil)
+	assert.Equal(t, len(list), 1)
+	assert.Equal(t, list[0].Cron, QuarkSignCron)
+	assert.NotEqual(t, list[0].Next, nil)
+	assert.Equal(t, list[0].Result.Success, false)
+
+	quark.SetSignParam("k", "s", "v")
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/sign/quark", nil)
+	c.Params = gin.Params{{Key: "name", Value: "quark"}}
+	srv.quarkSignRun()(c)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, signed().Success, true)
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "name", Value: "other"}}
+	srv.quarkSignRun()(c)
+	assert.Equal(t, w.Code, http.StatusNotFound)
+
+	// 没有移动端参数时不添加签到任务
+	q2 := NewQuarkPan(QuarkCfg{Name: "quark.2", Root: t.TempDir(), SignCron: QuarkSignCron})
+	q2.quark = NewQuark("c")
+	q2.quark.AccountURL = quark.AccountURL
+	q2.quark.client = quark.client
+	assert.Equal(t, q2.Init(), nil)
+	defer q2.Close()
+	assert.Equal(t, q2.signId, cron.EntryID(0))
+	// 没有服务时只记录结果
+	q2.SetHolder(&PanHolder{})
+	assert.Equal(t, q2.Sign(), q2.LastSign())
+}
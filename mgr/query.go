@@ -0,0 +1,288 @@
+package mgr
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TOPIC_PAGE_SIZE     = 20  // 默认每页数量
+	TOPIC_PAGE_SIZE_MAX = 500 // 最大每页数量
+	DELETED_KEEP_TIME   = 7 * 24 * time.Hour
+)
+
+// 帖子列表的查询条件
+type topicQuery struct {
+	page      int
+	size      int
+	paged     bool
+	sort      string
+	desc      bool
+	keyword   string // 搜索 ID, 标题, 作者, 标签, 文件夹和备注
+	author    string
+	uid       int
+	abandoned *bool
+	failed    *bool
+	hasPan    *bool
+	tags      []string
+	folder    string
+	cursor    *time.Time // 增量同步, 只返回之后修改的帖子
+}
+
+func parseBoolQuery(values url.Values, key string) (*bool, error) {
+	v := values.Get(key)
+	if v == "" {
+		return nil, nil
+	}
+	b, e := strconv.ParseBool(v)
+	if e != nil {
+		return nil, fmt.Errorf("无效的参数 %s: %s", key, v)
+	}
+	return &b, nil
+}
+
+// 解析查询条件, 批量操作的过滤表达式使用相同的格式
+func parseTopicQuery(values url.Values) (*topicQuery, error) {
+	q := &topicQuery{
+		page:    1,
+		size:    TOPIC_PAGE_SIZE,
+		sort:    "id",
+		desc:    true,
+		keyword: strings.ToLower(strings.TrimSpace(values.Get("q"))),
+		author:  strings.ToLower(strings.TrimSpace(values.Get("author"))),
+		tags:    values["tag"],
+		folder:  values.Get("folder"),
+	}
+
+	var e error
+	if v := values.Get("page"); v != "" {
+		if q.page, e = strconv.Atoi(v); e != nil || q.page < 1 {
+			return nil, fmt.Errorf("无效的页码: %s", v)
+		}
+		q.paged = true
+	}
+	if v := values.Get("size"); v != "" {
+		if q.size, e = strconv.Atoi(v); e != nil || q.size < 1 {
+			return nil, fmt.Errorf("无效的每页数量: %s", v)
+		}
+		q.size = min(q.size, TOPIC_PAGE_SIZE_MAX)
+		q.paged = true
+	}
+	if v := values.Get("sort"); v != "" {
+		// 以 - 开头表示倒序
+		key, desc := strings.CutPrefix(v, "-")
+		key = strings.ToLower(key)
+		if _, has := topicSorters[key]; !has {
+			return nil, fmt.Errorf("不支持的排序: %s", key)
+		}
+		q.sort = key
+		q.desc = desc
+	}
+	switch strings.ToLower(values.Get("order")) {
+	case "asc":
+		q.desc = false
+	case "desc":
+		q.desc = true
+	}
+	if v := values.Get("uid"); v != "" {
+		if q.uid, e = strconv.Atoi(v); e != nil {
+			return nil, fmt.Errorf("无效的用户 ID: %s", v)
+		}
+	}
+	if q.abandoned, e = parseBoolQuery(values, "abandoned"); e != nil {
+		return nil, e
+	}
+	if q.failed, e = parseBoolQuery(values, "failed"); e != nil {
+		return nil, e
+	}
+	if q.hasPan, e = parseBoolQuery(values, "hasPan"); e != nil {
+		return nil, e
+	}
+	if values.Has("cursor") {
+		v := values.Get("cursor")
+		t := time.Time{}
+		if v != "" {
+			n, e := strconv.ParseInt(v, 36, 64)
+			if e != nil {
+				return nil, fmt.Errorf("无效的游标: %s", v)
+			}
+			t = time.Unix(0, n)
+		}
+		q.cursor = &t
+	}
+	return q, nil
+}
+
+// 是否有实际的过滤条件, 分页和排序不算
+func (q *topicQuery) filtered() bool {
+	return q.keyword != "" || q.author != "" || q.uid != 0 || len(q.tags) > 0 || q.folder != "" ||
+		q.abandoned != nil || q.failed != nil || q.hasPan != nil || q.cursor != nil
+}
+
+func encodeCursor(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 36)
+}
+
+func (t *Topic) HasPan() bool {
+	if t.root == nil {
+		return t.hasPan // 从索引中读取的帖子
+	}
+	return t.root.IsExist(PAN_JSON)
+}
+
+func (t *Topic) isFailed() bool {
+	return !t.Result.Success && !t.Result.Time.IsZero()
+}
+
+func (q *topicQuery) match(t *Topic) bool {
+	if q.uid != 0 && t.Uid != q.uid {
+		return false
+	}
+	if q.author != "" && !strings.Contains(strings.ToLower(t.Author), q.author) {
+		return false
+	}
+	if q.abandoned != nil && t.Metadata.Abandon != *q.abandoned {
+		return false
+	}
+	if q.failed != nil && t.isFailed() != *q.failed {
+		return false
+	}
+	if q.hasPan != nil && t.HasPan() != *q.hasPan {
+		return false
+	}
+	if q.keyword != "" && !t.contains(q.keyword) {
+		return false
+	}
+	return true
+}
+
+// 关键词是否出现在帖子的 ID, 标题, 作者, 标签, 文件夹或备注中
+func (t *Topic) contains(keyword string) bool {
+	if strings.Contains(strconv.Itoa(t.Id), keyword) ||
+		strings.Contains(strings.ToLower(t.Title), keyword) ||
+		strings.Contains(strings.ToLower(t.Author), keyword) {
+		return true
+	}
+	md := t.Metadata
+	md.mutex.Lock()
+	defer md.mutex.Unlock()
+	for _, tag := range md.Tags {
+		if strings.Contains(strings.ToLower(tag), keyword) {
+			return true
+		}
+	}
+	return strings.Contains(strings.ToLower(md.Folder), keyword) ||
+		strings.Contains(strings.ToLower(md.Note), keyword)
+}
+
+var topicSorters = map[string]func(a, b *Topic) int{
+	"id":       func(a, b *Topic) int { return cmp.Compare(a.Id, b.Id) },
+	"create":   func(a, b *Topic) int { return a.Create.Compare(b.Create.Time) },
+	"modat":    func(a, b *Topic) int { return a.modAt.Compare(b.modAt.Time) },
+	"maxfloor": func(a, b *Topic) int { return cmp.Compare(a.MaxFloor, b.MaxFloor) },
+	"title":    func(a, b *Topic) int { return strings.Compare(a.Title, b.Title) },
+	"author":   func(a, b *Topic) int { return strings.Compare(a.Author, b.Author) },
+	"updated":  func(a, b *Topic) int { return a.Result.Time.Compare(b.Result.Time.Time) },
+	"storage":  func(a, b *Topic) int { return cmp.Compare(a.storageTotal(), b.storageTotal()) },
+}
+
+// 过滤并排序, 相同时按 ID 排序, 保证分页稳定
+func (q *topicQuery) apply(topics []*Topic) []*Topic {
+	ret := make([]*Topic, 0, len(topics))
+	for _, t := range filterTopics(topics, q.tags, q.folder) {
+		if q.cursor != nil && !t.modAt.After(*q.cursor) {
+			continue
+		}
+		if q.match(t) {
+			ret = append(ret, t)
+		}
+	}
+	sorter := topicSorters[q.sort]
+	slices.SortFunc(ret, func(a, b *Topic) int {
+		r := sorter(a, b)
+		if r == 0 {
+			r = cmp.Compare(a.Id, b.Id)
+		}
+		if q.desc {
+			r = -r
+		}
+		return r
+	})
+	return ret
+}
+
+// 根据帖子的 ID 和修改时间计算 ETag
+func topicsETag(topics []*Topic, extra string) string {
+	h := fnv.New64a()
+	h.Write([]byte(extra))
+	for _, t := range topics {
+		h.Write([]byte(strconv.Itoa(t.Id)))
+		h.Write([]byte(strconv.FormatInt(t.modAt.UnixNano(), 36)))
+	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum64())
+}
+
+// 删除的帖子, 用于增量同步
+func (srv *Server) deletedSince(t time.Time) []int {
+	ret := make([]int, 0)
+	expired := make([]int, 0)
+	srv.cache.deleted.Each(func(id int, at time.Time) {
+		if time.Since(at) > DELETED_KEEP_TIME {
+			expired = append(expired, id)
+		} else if at.After(t) && !srv.cache.topics.Has(id) {
+			ret = append(ret, id)
+		}
+	})
+	for _, id := range expired {
+		srv.cache.deleted.Delete(id)
+	}
+	slices.Sort(ret)
+	return ret
+}
+
+func (srv *Server) topicQuery(c *gin.Context) {
+	start := time.Now()
+	q, e := parseTopicQuery(c.Request.URL.Query())
+	if e != nil {
+		c.JSON(http.StatusBadRequest, toErr(e.Error()))
+		return
+	}
+
+	topics := q.apply(srv.indexedTopics())
+	etag := topicsETag(topics, c.Request.URL.RawQuery)
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	ret := gin.H{
+		"Total":  len(topics),
+		"Cursor": encodeCursor(start),
+	}
+	if q.cursor != nil {
+		ret["Deleted"] = srv.deletedSince(*q.cursor)
+	}
+	if q.paged {
+		// 先比较再相乘, 页码过大时不会溢出
+		from := len(topics)
+		if q.page-1 <= len(topics)/q.size {
+			from = min((q.page-1)*q.size, len(topics))
+		}
+		to := min(from+q.size, len(topics))
+		topics = topics[from:to]
+		ret["Page"] = q.page
+		ret["Size"] = q.size
+	}
+	ret["Items"] = topics
+	c.JSON(http.StatusOK, ret)
+}
@@ -0,0 +1,134 @@
+package mgr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+)
+
+func queryValues(query string) url.Values {
+	values, _ := url.ParseQuery(query)
+	return values
+}
+
+func TestParseTopicQuery(t *testing.T) {
+	q, e := parseTopicQuery(queryValues(""))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, q.paged, false)
+	assert.Equal(t, q.sort, "id")
+	assert.Equal(t, q.desc, true)
+
+	q, e = parseTopicQuery(queryValues("page=2&size=1000&sort=-MaxFloor&q=+AbC+&failed=true"))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, q.paged, true)
+	assert.Equal(t, q.page, 2)
+	assert.Equal(t, q.size, TOPIC_PAGE_SIZE_MAX)
+	assert.Equal(t, q.sort, "maxfloor")
+	assert.Equal(t, q.desc, true)
+	assert.Equal(t, q.keyword, "abc")
+	assert.Equal(t, *q.failed, true)
+	assert.Equal(t, q.abandoned == nil, true)
+
+	q, _ = parseTopicQuery(queryValues("sort=title&order=desc"))
+	assert.Equal(t, q.desc, true)
+
+	now := time.Now()
+	q, e = parseTopicQuery(queryValues("cursor=" + encodeCursor(now)))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, q.cursor.Equal(now), true)
+
+	for _, query := range []string{"page=0", "size=x", "sort=unknown", "uid=x", "hasPan=maybe", "cursor=!"} {
+		_, e = parseTopicQuery(queryValues(query))
+		assert.NotEqual(t, e, nil)
+	}
+}
+
+func TestTopicQueryApply(t *testing.T) {
+	base := time.Now()
+	newTopic := func(id int, title string, floor int, abandon bool) *Topic {
+		topic := &Topic{Id: id, Title: title, Author: "作者", MaxFloor: floor, Metadata: NewMetadata()}
+		topic.Metadata.Abandon = abandon
+		topic.modAt = FromTime(base.Add(time.Duration(id) * time.Minute))
+		return topic
+	}
+	topics := []*Topic{
+		newTopic(1, "攻略 一", 5, false),
+		newTopic(2, "闲聊", 10, true),
+		newTopic(3, "攻略 二", 5, false),
+	}
+	topics[2].Metadata.SetNote("精华")
+	ids := func(topics []*Topic) []int {
+		ret := make([]int, 0)
+		for _, topic := range topics {
+			ret = append(ret, topic.Id)
+		}
+		return ret
+	}
+	apply := func(query string) []int {
+		q, e := parseTopicQuery(queryValues(query))
+		assert.Equal(t, e, nil)
+		return ids(q.apply(topics))
+	}
+
+	assert.Equal(t, apply(""), []int{3, 2, 1})
+	// 相同时按 ID 排序
+	assert.Equal(t, apply("sort=maxfloor"), []int{1, 3, 2})
+	assert.Equal(t, apply("sort=-maxfloor"), []int{2, 3, 1})
+	assert.Equal(t, apply("q=攻略&order=asc"), []int{1, 3})
+	assert.Equal(t, apply("q=精华"), []int{3})
+	assert.Equal(t, apply("abandoned=true"), []int{2})
+	assert.Equal(t, apply("cursor="+encodeCursor(base.Add(90*time.Second))), []int{3, 2})
+
+	etag := topicsETag(topics, "")
+	assert.Equal(t, etag, topicsETag(topics, ""))
+	assert.NotEqual(t, etag, topicsETag(topics, "page=2"))
+	topics[0].modAt = Now()
+	assert.NotEqual(t, etag, topicsETag(topics, ""))
+}
+
+func TestDeletedSince(t *testing.T) {
+	srv := &Server{cache: &cache{
+		topics:  NewSyncMap[int, *Topic](),
+		deleted: NewSyncMap[int, time.Time](),
+	}}
+	now := time.Now()
+	srv.cache.deleted.Put(1, now.Add(-time.Hour))
+	srv.cache.deleted.Put(2, now)
+	srv.cache.deleted.Put(3, now.Add(-DELETED_KEEP_TIME-time.Hour))
+	// 删除后又重新添加的帖子
+	srv.cache.deleted.Put(4, now)
+	srv.cache.topics.Put(4, &Topic{Id: 4})
+
+	assert.Equal(t, srv.deletedSince(now.Add(-2*time.Hour)), []int{1, 2})
+	assert.Equal(t, srv.deletedSince(now.Add(-time.Minute)), []int{2})
+	assert.Equal(t, srv.cache.deleted.Has(3), false)
+}
+
+func TestTopicQueryPage(t *testing.T) {
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	for id := 1; id <= 3; id++ {
+		srv.cache.topics.Put(id, &Topic{Id: id, Metadata: NewMetadata()})
+	}
+	gin.SetMode(gin.TestMode)
+	items := func(query string) int {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/topic?"+query, nil)
+		srv.topicQuery(c)
+		assert.Equal(t, w.Code, http.StatusOK)
+		ret := struct{ Items []*Topic }{}
+		assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &ret), nil)
+		return len(ret.Items)
+	}
+	assert.Equal(t, items("page=2&size=2"), 1)
+	assert.Equal(t, items("page=3&size=2"), 0)
+	// 页码过大时不能溢出
+	assert.Equal(t, items("page=9223372036854775807&size=2"), 0)
+	assert.Equal(t, items("page=4611686018427387905&size=100"), 0)
+}
@@ -0,0 +1,385 @@
+package mgr
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/i2534/ngamm/mgr/log"
+)
+
+type Bookmark struct {
+	Floor int
+	Note  string `json:",omitempty"`
+	Time  CustomTime
+}
+
+// 阅读进度
+type Reading struct {
+	LastFloor int        // 最后阅读的楼层
+	Read      bool       // 是否已读, 有新楼层时自动变为未读
+	ReadAt    CustomTime `json:",omitzero"`  // 最后阅读时间
+	MarkedAt  CustomTime `json:",omitzero"`  // 最后标记时间
+	MarkDays  []string   `json:",omitempty"` // 标记过的日期, 用于导出以前的标记格式
+	Bookmarks []Bookmark `json:",omitempty"`
+}
+
+// 标记过的日期, 兼容只有标记时间的旧数据
+func (r *Reading) markDays() []string {
+	if len(r.MarkDays) == 0 && !r.MarkedAt.IsZero() {
+		return []string{r.MarkedAt.In(TIME_LOC).Format("2006-01-02")}
+	}
+	return r.MarkDays
+}
+
+// 记录标记的日期, 已经记录过时返回 false
+func (r *Reading) addMarkDay(t time.Time) bool {
+	day := t.In(TIME_LOC).Format("2006-01-02")
+	days := r.markDays()
+	if slices.Contains(days, day) {
+		return false
+	}
+	r.MarkDays = append(slices.Clone(days), day)
+	slices.Sort(r.MarkDays)
+	return true
+}
+
+func (m *Metadata) reading() *Reading {
+	if m.Reading == nil {
+		m.Reading = &Reading{LastFloor: -1}
+	}
+	return m.Reading
+}
+
+// 记录阅读位置, 到达最后一层时视为已读
+func (m *Metadata) SetProgress(floor, maxFloor int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.reading()
+	r.LastFloor = floor
+	r.ReadAt = Now()
+	if floor >= maxFloor {
+		r.Read = true
+	}
+}
+
+func (m *Metadata) SetRead(read bool, maxFloor int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.reading()
+	r.Read = read
+	if read {
+		r.LastFloor = max(r.LastFloor, maxFloor)
+		r.ReadAt = Now()
+	}
+}
+
+// 标记帖子, 同时视为已读
+func (m *Metadata) Mark(maxFloor int) {
+	m.SetRead(true, maxFloor)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := Now()
+	m.Reading.addMarkDay(now.Time)
+	m.Reading.MarkedAt = now
+}
+
+func (m *Metadata) SetBookmark(floor int, note string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.reading()
+	note = strings.TrimSpace(note)
+	for i, b := range r.Bookmarks {
+		if b.Floor == floor {
+			r.Bookmarks[i].Note = note
+			r.Bookmarks[i].Time = Now()
+			return
+		}
+	}
+	r.Bookmarks = append(r.Bookmarks, Bookmark{Floor: floor, Note: note, Time: Now()})
+	slices.SortFunc(r.Bookmarks, func(a, b Bookmark) int {
+		return a.Floor - b.Floor
+	})
+}
+
+func (m *Metadata) RemoveBookmark(floor int) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.Reading == nil {
+		return false
+	}
+	size := len(m.Reading.Bookmarks)
+	m.Reading.Bookmarks = slices.DeleteFunc(m.Reading.Bookmarks, func(b Bookmark) bool {
+		return b.Floor == floor
+	})
+	return size != len(m.Reading.Bookmarks)
+}
+
+// 有新楼层时变为未读
+func (m *Metadata) onNewFloors(maxFloor int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if r := m.Reading; r != nil && r.Read && r.LastFloor < maxFloor {
+		r.Read = false
+	}
+}
+
+// 计算未读的楼层数量, 从未阅读过的帖子全部楼层都是未读
+func (t *Topic) countUnread() {
+	m := t.Metadata
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	r := m.Reading
+	switch {
+	case r == nil:
+		t.Unread = max(t.MaxFloor+1, 0)
+	case r.Read:
+		t.Unread = 0
+	default:
+		t.Unread = max(t.MaxFloor-r.LastFloor, 0)
+	}
+}
+
+func (srv *Server) readingTopic(c *gin.Context) *Topic {
+	id, e := strconv.Atoi(c.Param("id"))
+	if e != nil {
+		c.JSON(http.StatusBadRequest, toErr("无效的帖子 ID"))
+		return nil
+	}
+	topic, has := srv.cache.topics.Get(id)
+	if !has {
+		c.JSON(http.StatusNotFound, toErr("未找到帖子"))
+		return nil
+	}
+	return topic
+}
+
+// 保存阅读进度并返回最新的状态
+func (srv *Server) saveReading(c *gin.Context, topic *Topic) {
+	topic.countUnread()
+	topic.Modify()
+	if e := topic.SaveMeta(); e != nil {
+		c.JSON(http.StatusInternalServerError, toErr(e.Error()))
+		return
+	}
+	srv.publish(EVENT_TOPIC_METADATA, topic.Id, topic.Metadata)
+	srv.readingState(c, topic)
+}
+
+func (srv *Server) readingState(c *gin.Context, topic *Topic) {
+	md := topic.Metadata
+	md.mutex.Lock()
+	r := Reading{LastFloor: -1}
+	if md.Reading != nil {
+		r = *md.Reading
+		r.Bookmarks = slices.Clone(r.Bookmarks)
+	}
+	md.mutex.Unlock()
+
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, gin.H{
+		"Id":       topic.Id,
+		"MaxFloor": topic.MaxFloor,
+		"Unread":   topic.Unread,
+		"Reading":  r,
+	})
+}
+
+func (srv *Server) readingGet() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if topic := srv.readingTopic(c); topic != nil {
+			srv.readingState(c, topic)
+		}
+	}
+}
+
+func (srv *Server) readingUpdate() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		topic := srv.readingTopic(c)
+		if topic == nil {
+			return
+		}
+		req := struct {
+			Floor *int
+			Read  *bool
+		}{}
+		if e := c.ShouldBindJSON(&req); e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
+			return
+		}
+		if req.Floor != nil {
+			if *req.Floor < 0 {
+				c.JSON(http.StatusBadRequest, toErr("无效的楼层"))
+				return
+			}
+			topic.Metadata.SetProgress(*req.Floor, topic.MaxFloor)
+		}
+		if req.Read != nil {
+			topic.Metadata.SetRead(*req.Read, topic.MaxFloor)
+		}
+		srv.saveReading(c, topic)
+	}
+}
+
+func (srv *Server) bookmarkSet() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		topic := srv.readingTopic(c)
+		if topic == nil {
+			return
+		}
+		floor, e := strconv.Atoi(c.Param("floor"))
+		if e != nil || floor < 0 {
+			c.JSON(http.StatusBadRequest, toErr("无效的楼层"))
+			return
+		}
+		req := struct {
+			Note string
+		}{}
+		if c.Request.ContentLength != 0 {
+			if e := c.ShouldBindJSON(&req); e != nil {
+				c.JSON(http.StatusBadRequest, toErr("无效的请求数据"))
+				return
+			}
+		}
+		topic.Metadata.SetBookmark(floor, req.Note)
+		srv.saveReading(c, topic)
+	}
+}
+
+func (srv *Server) bookmarkDel() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		topic := srv.readingTopic(c)
+		if topic == nil {
+			return
+		}
+		floor, e := strconv.Atoi(c.Param("floor"))
+		if e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的楼层"))
+			return
+		}
+		if !topic.Metadata.RemoveBookmark(floor) {
+			c.JSON(http.StatusNotFound, toErr("未找到书签"))
+			return
+		}
+		srv.saveReading(c, topic)
+	}
+}
+
+// 导入以前按天保存在 marks 目录下的标记
+func (srv *Server) importMarks() {
+	rootAbs, e := srv.cache.topicRoot.AbsPath()
+	if e != nil {
+		return
+	}
+	marksDir := filepath.Join(rootAbs, MARKS_DIR)
+	entries, e := os.ReadDir(marksDir)
+	if e != nil {
+		return
+	}
+	imports := make(map[int]*Topic)
+	for _, entry := range entries {
+		date, ok := strings.CutSuffix(entry.Name(), ".md")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		t, e := time.ParseInLocation("2006-01-02", date, TIME_LOC)
+		if e != nil {
+			continue
+		}
+		data, e := os.ReadFile(filepath.Join(marksDir, entry.Name()))
+		if e != nil {
+			log.Println("读取标记文件失败:", e)
+			continue
+		}
+		for line := range strings.SplitSeq(string(data), "\n") {
+			id, e := strconv.Atoi(strings.TrimSpace(line))
+			if e != nil {
+				continue
+			}
+			topic, has := srv.cache.topics.Get(id)
+			if !has {
+				continue
+			}
+			md := topic.Metadata
+			md.mutex.Lock()
+			r := md.reading()
+			// 同一个帖子可能在多天被标记, 每天的标记都需要保留
+			added := r.addMarkDay(t)
+			if added {
+				r.Read = true
+				r.LastFloor = max(r.LastFloor, topic.MaxFloor)
+				if t.After(r.MarkedAt.Time) {
+					r.MarkedAt = FromTime(t)
+				}
+			}
+			md.mutex.Unlock()
+			if added {
+				imports[id] = topic
+			}
+		}
+	}
+	if len(imports) > 0 {
+		topics := make([]*Topic, 0, len(imports))
+		for _, topic := range imports {
+			topic.countUnread()
+			go topic.SaveMeta()
+			topics = append(topics, topic)
+		}
+		if srv.index != nil {
+			if e := srv.index.Put(topics...); e != nil {
+				log.Println("更新索引失败:", e)
+			}
+		}
+		log.Println("已导入", len(topics), "个帖子的标记")
+	}
+}
+
+// 以前的标记格式: 每天一个文件, 每行一个帖子 ID
+func (srv *Server) exportMarks(date string) (string, []byte, error) {
+	days := make(map[string][]*Topic)
+	srv.cache.topics.Each(func(_ int, topic *Topic) {
+		md := topic.Metadata
+		md.mutex.Lock()
+		defer md.mutex.Unlock()
+		if r := md.Reading; r != nil {
+			for _, day := range r.markDays() {
+				days[day] = append(days[day], topic)
+			}
+		}
+	})
+	if len(days) == 0 {
+		return "", nil, fmt.Errorf("暂无标记")
+	}
+	if date == "" {
+		for day := range days {
+			date = max(date, day)
+		}
+	}
+	topics, has := days[date]
+	if !has {
+		return "", nil, fmt.Errorf("%s 没有标记", date)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Metadata.Reading.MarkedAt.Before(topics[j].Metadata.Reading.MarkedAt.Time)
+	})
+	var b strings.Builder
+	for _, topic := range topics {
+		b.WriteString(strconv.Itoa(topic.Id))
+		b.WriteString("\n")
+	}
+	return date, []byte(b.String()), nil
+}
@@ -0,0 +1,110 @@
+package mgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestReading(t *testing.T) {
+	topic := &Topic{Id: 1, MaxFloor: 10, Metadata: NewMetadata()}
+	md := topic.Metadata
+
+	// 从未阅读过的帖子, 包括主楼都是未读
+	topic.countUnread()
+	assert.Equal(t, topic.Unread, 11)
+
+	md.SetProgress(4, topic.MaxFloor)
+	topic.countUnread()
+	assert.Equal(t, topic.Unread, 6)
+	assert.Equal(t, md.Reading.Read, false)
+
+	md.SetProgress(10, topic.MaxFloor)
+	topic.countUnread()
+	assert.Equal(t, topic.Unread, 0)
+	assert.Equal(t, md.Reading.Read, true)
+
+	// 更新后有新楼层
+	topic.MaxFloor = 15
+	md.onNewFloors(topic.MaxFloor)
+	topic.countUnread()
+	assert.Equal(t, md.Reading.Read, false)
+	assert.Equal(t, topic.Unread, 5)
+
+	md.SetRead(true, topic.MaxFloor)
+	topic.countUnread()
+	assert.Equal(t, topic.Unread, 0)
+	assert.Equal(t, md.Reading.LastFloor, 15)
+
+	md.SetBookmark(8, "重点")
+	md.SetBookmark(3, "")
+	md.SetBookmark(8, " 修改 ")
+	assert.Equal(t, len(md.Reading.Bookmarks), 2)
+	assert.Equal(t, md.Reading.Bookmarks[0].Floor, 3)
+	assert.Equal(t, md.Reading.Bookmarks[1].Note, "修改")
+	assert.Equal(t, md.RemoveBookmark(3), true)
+	assert.Equal(t, md.RemoveBookmark(3), false)
+}
+
+func TestExportMarks(t *testing.T) {
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	_, _, e := srv.exportMarks("")
+	assert.NotEqual(t, e, nil)
+
+	for _, id := range []int{3, 1, 2} {
+		topic := &Topic{Id: id, Metadata: NewMetadata()}
+		topic.Metadata.Mark(topic.MaxFloor)
+		srv.cache.topics.Put(id, topic)
+	}
+	today := Now().In(TIME_LOC).Format("2006-01-02")
+
+	date, data, e := srv.exportMarks("")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, date, today)
+	assert.Equal(t, len(data), len("3\n1\n2\n"))
+
+	_, _, e = srv.exportMarks("2000-01-01")
+	assert.NotEqual(t, e, nil)
+}
+
+func TestImportMarks(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	srv := &Server{cache: &cache{topicRoot: root, topics: NewSyncMap[int, *Topic]()}}
+	for _, id := range []int{1, 2} {
+		srv.cache.topics.Put(id, &Topic{Id: id, MaxFloor: 5, root: root, Metadata: NewMetadata()})
+	}
+	// 同一个帖子在两天都被标记
+	assert.Equal(t, os.MkdirAll(filepath.Join(dir, MARKS_DIR), COMMON_DIR_MODE), nil)
+	os.WriteFile(filepath.Join(dir, MARKS_DIR, "2025-03-01.md"), []byte("1\n2\n"), COMMON_FILE_MODE)
+	os.WriteFile(filepath.Join(dir, MARKS_DIR, "2025-03-02.md"), []byte("1\n"), COMMON_FILE_MODE)
+
+	srv.importMarks()
+	topic, _ := srv.cache.topics.Get(1)
+	assert.Equal(t, topic.Metadata.Reading.MarkDays, []string{"2025-03-01", "2025-03-02"})
+	assert.Equal(t, topic.Metadata.Reading.MarkedAt.In(TIME_LOC).Format("2006-01-02"), "2025-03-02")
+	assert.Equal(t, topic.Metadata.Reading.Read, true)
+
+	date, data, e := srv.exportMarks("")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, date, "2025-03-02")
+	assert.Equal(t, string(data), "1\n")
+	_, data, e = srv.exportMarks("2025-03-01")
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(data), len("1\n2\n"))
+
+	// 重复导入不会重复记录
+	srv.importMarks()
+	assert.Equal(t, len(topic.Metadata.Reading.MarkDays), 2)
+
+	// 只有标记时间的旧数据保留原来的日期
+	old := &Reading{MarkedAt: FromTime(time.Date(2025, 2, 1, 8, 0, 0, 0, TIME_LOC))}
+	assert.Equal(t, old.addMarkDay(time.Date(2025, 3, 1, 8, 0, 0, 0, TIME_LOC)), true)
+	assert.Equal(t, old.MarkDays, []string{"2025-02-01", "2025-03-01"})
+}
@@ -0,0 +1,257 @@
+package mgr
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/i2534/ngamm/mgr/log"
+)
+
+// 回收站中的帖子
+type recycleItem struct {
+	Id        int
+	Title     string
+	DeletedAt CustomTime
+	Size      int64
+	dir       string
+}
+
+// 解析回收站保留时间, 支持 72h, 30m 以及 7d 这样的格式, 为空时使用 DELETE_TIME, 0 表示不自动清理
+func ParseRetention(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return time.Duration(DELETE_TIME) * time.Hour, nil
+	}
+	if s == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, e := strconv.ParseFloat(days, 64)
+		if e != nil || n < 0 {
+			return 0, fmt.Errorf("无效的保留时间: %s", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, e := time.ParseDuration(s)
+	if e != nil || d < 0 {
+		return 0, fmt.Errorf("无效的保留时间: %s", s)
+	}
+	return d, nil
+}
+
+func newRecycleKeep(cfg *Config) time.Duration {
+	raw := ""
+	if cfg != nil {
+		raw = cfg.RecycleKeep
+	}
+	d, e := ParseRetention(raw)
+	if e != nil {
+		log.Println("解析 RecycleKeep 失败:", e)
+		return time.Duration(DELETE_TIME) * time.Hour
+	}
+	return d
+}
+
+func (srv *Server) recycleDir() (string, error) {
+	return srv.cache.topicRoot.AbsPath(DIR_RECYCLE_BIN)
+}
+
+// 读取回收站中的帖子, measure 为是否统计占用
+func (srv *Server) recycleItems(measure bool) ([]*recycleItem, error) {
+	recycles, e := srv.recycleDir()
+	if e != nil {
+		return nil, e
+	}
+	files, e := os.ReadDir(recycles)
+	if e != nil {
+		if os.IsNotExist(e) {
+			return []*recycleItem{}, nil
+		}
+		return nil, e
+	}
+	ret := make([]*recycleItem, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		id, e := strconv.Atoi(file.Name())
+		if e != nil {
+			continue
+		}
+		item, e := readRecycleItem(filepath.Join(recycles, file.Name()), id, measure)
+		if e != nil {
+			log.Println("读取回收站帖子失败:", id, e)
+			continue
+		}
+		ret = append(ret, item)
+	}
+	return ret, nil
+}
+
+func readRecycleItem(dir string, id int, measure bool) (*recycleItem, error) {
+	item := &recycleItem{Id: id, dir: dir}
+	data, e := os.ReadFile(filepath.Join(dir, DELETE_FLAG))
+	if e != nil {
+		return nil, e
+	}
+	t, e := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if e != nil {
+		return nil, e
+	}
+	item.DeletedAt = FromTime(t)
+
+	root, e := OpenRoot(dir)
+	if e != nil {
+		return nil, e
+	}
+	defer root.Close()
+
+	topic := NewTopic(root, id)
+	if seq, e := topic.readPostCore(); e == nil {
+		for line := range seq {
+			item.Title = strings.TrimLeft(line, "# ")
+			break
+		}
+	}
+	if measure {
+		if u, e := measureStorage(root); e == nil {
+			item.Size = u.Total
+		}
+	}
+	return item, nil
+}
+
+// 永久删除回收站中的帖子
+func (srv *Server) purgeRecycle(item *recycleItem) error {
+	log.Println("删除回收站帖子", item.Id)
+	if e := os.RemoveAll(item.dir); e != nil {
+		return e
+	}
+	srv.publish(EVENT_RECYCLE_PURGED, item.Id, gin.H{"Title": item.Title})
+	return nil
+}
+
+func (srv *Server) checkRecycleBin() {
+	if srv.recycleKeep <= 0 {
+		return
+	}
+	log.Println("检查回收站...")
+	items, e := srv.recycleItems(false)
+	if e != nil {
+		log.Println("读取回收站失败:", e)
+		return
+	}
+	for _, item := range items {
+		if time.Since(item.DeletedAt.Time) > srv.recycleKeep {
+			if e := srv.purgeRecycle(item); e != nil {
+				log.Println("删除回收站帖子失败:", e)
+			}
+		}
+	}
+}
+
+// 将回收站中的帖子移回帖子目录, 网盘转存记录随目录一起恢复, 不会再次转存
+func (srv *Server) restoreRecycle(id int) (*Topic, int, error) {
+	cache := srv.cache
+	if cache.topics.Has(id) {
+		return nil, http.StatusConflict, fmt.Errorf("帖子已存在")
+	}
+	recycles, e := srv.recycleDir()
+	if e != nil {
+		return nil, http.StatusInternalServerError, e
+	}
+	src := filepath.Join(recycles, strconv.Itoa(id))
+	if !IsExist(src) {
+		return nil, http.StatusNotFound, fmt.Errorf("回收站中未找到帖子")
+	}
+	dst, e := cache.topicRoot.AbsPath(strconv.Itoa(id))
+	if e != nil {
+		return nil, http.StatusInternalServerError, e
+	}
+	if IsExist(dst) {
+		return nil, http.StatusConflict, fmt.Errorf("帖子目录已存在")
+	}
+
+	log.Println("从回收站恢复帖子:", src)
+	if e := os.Rename(src, dst); e != nil {
+		return nil, http.StatusInternalServerError, e
+	}
+	os.Remove(filepath.Join(dst, DELETE_FLAG))
+
+	topic, e := LoadTopic(cache.topicRoot, id, srv.nga)
+	if e != nil {
+		return nil, http.StatusInternalServerError, e
+	}
+	srv.updateStorage(topic, nil)
+	srv.registerTopic(topic)
+	cache.deleted.Delete(id)
+	srv.publish(EVENT_TOPIC_ADDED, id, nil)
+	return topic, http.StatusOK, nil
+}
+
+func (srv *Server) recycleList() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		items, e := srv.recycleItems(true)
+		if e != nil {
+			c.JSON(http.StatusInternalServerError, toErr(e.Error()))
+			return
+		}
+		slices.SortFunc(items, func(a, b *recycleItem) int {
+			return cmp.Compare(b.DeletedAt.Unix(), a.DeletedAt.Unix())
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"Keep":  srv.recycleKeep.String(),
+			"Items": items,
+		})
+	}
+}
+
+func (srv *Server) recycleRestore() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, e := strconv.Atoi(c.Param("id"))
+		if e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的帖子 ID"))
+			return
+		}
+		topic, code, e := srv.restoreRecycle(id)
+		if e != nil {
+			log.Println("恢复帖子失败:", id, e)
+			c.JSON(code, toErr(e.Error()))
+			return
+		}
+		c.JSON(http.StatusOK, topic)
+	}
+}
+
+func (srv *Server) recyclePurge() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, e := strconv.Atoi(c.Param("id"))
+		if e != nil {
+			c.JSON(http.StatusBadRequest, toErr("无效的帖子 ID"))
+			return
+		}
+		recycles, e := srv.recycleDir()
+		if e != nil {
+			c.JSON(http.StatusInternalServerError, toErr(e.Error()))
+			return
+		}
+		item := &recycleItem{Id: id, dir: filepath.Join(recycles, strconv.Itoa(id))}
+		if !IsExist(item.dir) {
+			c.JSON(http.StatusNotFound, toErr("回收站中未找到帖子"))
+			return
+		}
+		if e := srv.purgeRecycle(item); e != nil {
+			c.JSON(http.StatusInternalServerError, toErr(e.Error()))
+			return
+		}
+		c.JSON(http.StatusOK, id)
+	}
+}
@@ -0,0 +1,88 @@
+package mgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-playground/assert/v2"
+	"github.com/robfig/cron/v3"
+)
+
+func TestParseRetention(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":     time.Duration(DELETE_TIME) * time.Hour,
+		"0":    0,
+		"72h":  72 * time.Hour,
+		"30m":  30 * time.Minute,
+		"3d":   72 * time.Hour,
+		"1.5D": 36 * time.Hour,
+	}
+	for s, d := range cases {
+		v, e := ParseRetention(s)
+		assert.Equal(t, e, nil)
+		assert.Equal(t, v, d)
+	}
+	for _, s := range []string{"abc", "-1h", "xd"} {
+		_, e := ParseRetention(s)
+		assert.NotEqual(t, e, nil)
+	}
+}
+
+func TestRecycleBin(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	recycle := func(id, title string, at time.Time) {
+		tar := filepath.Join(dir, DIR_RECYCLE_BIN, id)
+		assert.Equal(t, os.MkdirAll(tar, COMMON_DIR_MODE), nil)
+		os.WriteFile(filepath.Join(tar, POST_MARKDOWN), []byte("# "+title+"\n"), COMMON_FILE_MODE)
+		os.WriteFile(filepath.Join(tar, PROCESS_INI), []byte("[local]\nmax_page = 1\nmax_floor = 3\n"), COMMON_FILE_MODE)
+		os.WriteFile(filepath.Join(tar, PAN_JSON), []byte("[]"), COMMON_FILE_MODE)
+		os.WriteFile(filepath.Join(tar, DELETE_FLAG), []byte(at.Format(time.RFC3339)), COMMON_FILE_MODE)
+	}
+	recycle("1", "第一", time.Now().Add(-time.Hour))
+	recycle("2", "第二", time.Now().Add(-48*time.Hour))
+
+	srv := &Server{
+		cache: &cache{
+			topicRoot: root,
+			topics:    NewSyncMap[int, *Topic](),
+			deleted:   NewSyncMap[int, time.Time](),
+			queue:     make(chan int, 10),
+		},
+		cron:        cron.New(),
+		recycleKeep: 24 * time.Hour,
+	}
+
+	items, e := srv.recycleItems(true)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, items[0].Title, "第一")
+	assert.NotEqual(t, items[0].Size, int64(0))
+
+	// 超过保留时间的帖子被清理
+	srv.checkRecycleBin()
+	items, _ = srv.recycleItems(false)
+	assert.Equal(t, len(items), 1)
+	assert.Equal(t, items[0].Id, 1)
+
+	// 恢复后网盘记录仍在, 删除标记被移除
+	srv.cache.deleted.Put(1, time.Now())
+	topic, _, e := srv.restoreRecycle(1)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, topic.Title, "第一")
+	assert.Equal(t, srv.cache.topics.Has(1), true)
+	assert.Equal(t, srv.cache.deleted.Has(1), false)
+	assert.Equal(t, IsExist(filepath.Join(dir, "1", PAN_JSON)), true)
+	assert.Equal(t, IsExist(filepath.Join(dir, "1", DELETE_FLAG)), false)
+
+	_, code, e := srv.restoreRecycle(1)
+	assert.NotEqual(t, e, nil)
+	assert.Equal(t, code, 409)
+	_, code, _ = srv.restoreRecycle(3)
+	assert.Equal(t, code, 404)
+}
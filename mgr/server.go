@@ -2,15 +2,14 @@ package mgr
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	gl "log"
-	"math/rand/v2"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/i2534/ngamm/mgr/log"
@@ -31,7 +30,7 @@ var (
 	DEFAULT_MAX_RETRY = 3
 	QUEUE_SIZE        = 9999
 	AUTHOR_ID         = 0
-	DELETE_TIME       = 7 * 24
+	DELETE_TIME       = 7 * 24 // 回收站默认保留时间, 单位小时
 	TIME_LOC          = Local()
 	groupGin          = log.GROUP_GIN
 )
@@ -50,6 +49,68 @@ type cache struct {
 	queue     chan int              // adding or update topic id
 	smile     *Smile
 	pans      *PanHolder
+	loaded    atomic.Bool              // 帖子是否已加载完成
+	deleted   *SyncMap[int, time.Time] // 最近删除的帖子, 用于增量同步
+	pending   *pendingSet              // 排队和正在下载的帖子
+}
+
+// 排队和正在下载的帖子及其次数, 对账时跳过这些帖子
+type pendingSet struct {
+	lock  sync.Mutex
+	count map[int]int
+}
+
+func newPendingSet() *pendingSet {
+	return &pendingSet{count: make(map[int]int)}
+}
+
+func (p *pendingSet) add(id int) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.count[id]++
+}
+
+func (p *pendingSet) done(id int) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.count[id] <= 1 {
+		delete(p.count, id)
+	} else {
+		p.count[id]--
+	}
+}
+
+func (p *pendingSet) has(id int) bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.count[id] > 0
+}
+
+// 将帖子加入下载队列, 队列已满时阻塞
+func (c *cache) enqueue(id int) {
+	c.pending.add(id)
+	c.queue <- id
+}
+
+// 将帖子加入下载队列, 队列已满时返回 false
+func (c *cache) tryEnqueue(id int) bool {
+	c.pending.add(id)
+	select {
+	case c.queue <- id:
+		return true
+	default:
+		c.pending.done(id)
+		return false
+	}
 }
 
 func (c *cache) Close() error {
@@ -64,13 +125,22 @@ func (c *cache) Close() error {
 }
 
 type Server struct {
-	Raw      *http.Server
-	Cfg      *SrvCfg
-	nga      *Client
-	cache    *cache
-	cron     *cron.Cron
-	stopChan chan struct{}
-	stopOnce sync.Once
+	Raw         *http.Server
+	Cfg         *SrvCfg
+	nga         *Client
+	cache       *cache
+	cron        *cron.Cron
+	health      *healthChecker
+	events      *eventHub
+	notifier    *notifier
+	index       *topicIndex // 帖子元数据索引, 打开失败时为空
+	quota       storageQuota
+	recycleKeep time.Duration // 回收站保留时间, 0 表示不自动清理
+	expired     atomic.Bool   // NGA cookie 是否已失效
+
+	reconciling atomic.Bool // 是否正在与文件系统对账
+	stopChan    chan struct{}
+	stopOnce    sync.Once
 }
 
 func customLogFormatter(param gin.LogFormatterParams) string {
@@ -117,8 +187,8 @@ func NewServer(cfg *SrvCfg, nga *Client) (*Server, error) {
 	}
 
 	engine := gin.New()
-	middlewares := make([]gin.HandlerFunc, 0, 2)
-	middlewares = append(middlewares, gin.Recovery())
+	middlewares := make([]gin.HandlerFunc, 0, 3)
+	middlewares = append(middlewares, gin.Recovery(), metricsMiddleware())
 	if log.IsLog(groupGin) {
 		middlewares = append(middlewares, gin.LoggerWithFormatter(customLogFormatter))
 	}
@@ -129,19 +199,39 @@ func NewServer(cfg *SrvCfg, nga *Client) (*Server, error) {
 			Addr:    cfg.Addr,
 			Handler: engine,
 		},
-		Cfg:      cfg,
-		nga:      nga,
-		stopChan: make(chan struct{}),
-		stopOnce: sync.Once{},
-		cron:     cron.New(cron.WithLocation(TIME_LOC)),
+		Cfg:         cfg,
+		nga:         nga,
+		stopChan:    make(chan struct{}),
+		stopOnce:    sync.Once{},
+		cron:        cron.New(cron.WithLocation(TIME_LOC)),
+		health:      newHealthChecker(),
+		quota:       newStorageQuota(cfg.Config),
+		recycleKeep: newRecycleKeep(cfg.Config),
+		events:      newEventHub(),
 		cache: &cache{
 			lock:      &sync.RWMutex{},
 			topics:    NewSyncMap[int, *Topic](),
+			deleted:   NewSyncMap[int, time.Time](),
 			queue:     make(chan int, QUEUE_SIZE),
+			pending:   newPendingSet(),
 			topicRoot: tr,
 		},
 	}
 
+	if path, e := indexPath(tr); e != nil {
+		log.Println("获取索引路径失败:", e)
+	} else if idx, e := openTopicIndex(path); e != nil {
+		log.Println(e)
+	} else {
+		srv.index = idx
+	}
+
+	if n, e := newNotifier(cfg.Config.raw); e != nil {
+		log.Println("初始化通知失败:", e)
+	} else {
+		srv.notifier = n
+	}
+
 	if e := srv.init(engine); e != nil {
 		return nil, e
 	}
@@ -151,6 +241,8 @@ func NewServer(cfg *SrvCfg, nga *Client) (*Server, error) {
 
 	nga.srv = srv
 
+	registerSrvCollector(srv)
+
 	return srv, nil
 }
 
@@ -160,94 +252,33 @@ func (srv *Server) init(_ *gin.Engine) error {
 	return nil
 }
 
+// 先从索引加载帖子, 然后在后台与文件系统对账
 func (srv *Server) loadTopics() {
 	cache := srv.cache
-	cache.lock.Lock()
-	defer cache.lock.Unlock()
-
-	files, e := cache.topicRoot.ReadDir()
-	if e != nil {
-		log.Println("读取帖子根目录失败:", e)
-	} else {
-		cache.topics = NewSyncMap[int, *Topic]()
-		for _, file := range files {
-			if !file.IsDir() {
-				continue
-			}
-			name := file.Name()
-			id, e := strconv.Atoi(name)
-			if e != nil {
-				log.Println("不是帖子目录:", name)
-				continue
-			}
-
-			topic, e := LoadTopic(cache.topicRoot, id, srv.nga)
-			if e != nil {
-				log.Println("加载帖子失败:", e)
-				continue
-			}
-
-			cache.topics.Put(id, topic)
-
-			if topic.Metadata.Abandon {
-				log.Group(groupTopic).Printf("帖子 %d 已放弃更新\n", id)
-				continue
-			}
-
-			next := srv.addCron(topic)
-			// 在第一次更新时间段(必须超过30分钟)的一半内随机更新一次
-			if !next.IsZero() {
-				d := time.Until(next)
-				if d > time.Minute*30 {
-					d = time.Duration(rand.Int64N(int64(d) / 2))
-					log.Group(groupTopic).Printf("随机更新帖子 <%s> 在 %s 后\n", topic.Title, d)
-					timer := time.AfterFunc(d, func() {
-						log.Group(groupTopic).Println("随机更新帖子", topic.Title)
-						cache.queue <- id
-						topic.timers.Delete(d)
-					})
-					topic.timers.Put(d, timer)
-				}
-			}
+	if srv.index != nil {
+		if n := srv.loadIndex(); n > 0 {
+			log.Println("从索引加载", n, "个帖子")
+			cache.loaded.Store(true)
 		}
-		log.Println("已加载", cache.topics.Size(), "个帖子")
 	}
+
+	srv.reconcile()
+	log.Println("已加载", cache.topics.Size(), "个帖子")
+
+	srv.importMarks()
+	cache.loaded.Store(true)
 }
 
-func (srv *Server) checkRecycleBin() {
-	log.Println("检查回收站...")
-	recycles, e := srv.cache.topicRoot.AbsPath(DIR_RECYCLE_BIN)
-	if e != nil {
-		log.Println("获取回收站绝对路径失败:", e)
-		return
-	}
-	files, e := os.ReadDir(recycles)
-	if e != nil {
-		log.Println("读取回收站失败:", e)
+// 定期检查 NGA cookie, 在由有效变为失效时发布事件
+func (srv *Server) checkCookie() {
+	e := srv.nga.CheckCookie()
+	if e == nil {
+		srv.expired.Store(false)
 		return
 	}
-	for _, file := range files {
-		if !file.IsDir() {
-			continue
-		}
-		name := file.Name()
-		tar := filepath.Join(recycles, name)
-		data, e := os.ReadFile(filepath.Join(tar, DELETE_FLAG))
-		if e != nil {
-			log.Println("读取", DELETE_FLAG, "失败:", e)
-			continue
-		}
-		t, e := time.Parse(time.RFC3339, string(data))
-		if e != nil {
-			log.Println("解析", DELETE_FLAG, "失败:", e)
-			continue
-		}
-		if time.Since(t).Hours() > float64(DELETE_TIME) {
-			log.Println("删除回收站帖子", name)
-			if e := os.RemoveAll(tar); e != nil {
-				log.Println("删除回收站帖子失败:", e)
-			}
-		}
+	log.Println("检查 NGA cookie 失败:", e)
+	if errors.Is(e, ErrCookieExpired) && !srv.expired.Swap(true) {
+		srv.publish(EVENT_COOKIE_EXPIRED, 0, e.Error())
 	}
 }
 
@@ -262,7 +293,7 @@ func (srv *Server) addCron(topic *Topic) time.Time {
 		}
 		id, e := srv.cron.AddFunc(uc, func() {
 			log.Group(groupTopic).Println("为帖子添加处理任务", topic.Id)
-			srv.cache.queue <- topic.Id
+			srv.cache.enqueue(topic.Id)
 		})
 		if e != nil {
 			log.Println("添加定时任务失败:", e)
@@ -286,12 +317,14 @@ func (srv *Server) process() {
 		old, has := cache.topics.Get(id)
 		if !has {
 			log.Println("未找到帖子", id, "，是否已删除？")
+			cache.pending.done(id)
 			continue
 		}
 
 		// 检查是否已放弃更新
 		if old.Metadata.Abandon {
 			log.Group(groupTopic).Printf("帖子 %d 已放弃更新\n", id)
+			cache.pending.done(id)
 			continue
 		}
 
@@ -319,7 +352,12 @@ max_floor = -1`
 			}
 		}
 
-		ok, msg := srv.nga.DownTopic(id)
+		srv.publish(EVENT_DOWN_STARTED, id, nil)
+
+		before := topLevelSizes(dir)
+		start := time.Now()
+		ok, msg := srv.nga.DownTopic(id, !srv.overQuota(old))
+		observeDownTopic(ok, start)
 		if ok {
 			topic, e := LoadTopic(cache.topicRoot, id, srv.nga)
 			if e != nil {
@@ -330,14 +368,27 @@ max_floor = -1`
 					Time:    Now(),
 				}
 				topic.Metadata.retryCount = 0
+				srv.downStorage(topic, old, before)
+				if topic.MaxFloor > old.MaxFloor {
+					topic.Metadata.LastMaxFloor = old.MaxFloor
+					topic.Metadata.onNewFloors(topic.MaxFloor)
+					topic.countUnread()
+					go topic.SaveMeta()
+				}
 
 				cache.topics.Put(id, topic)
+				over := srv.checkQuota(topic)
+				srv.publish(EVENT_DOWN_FINISHED, id, topic.Result)
 
 				if cache.pans != nil {
 					go topic.AutoTransfer(cache.pans)
 				}
 
-				go topic.TryFixAssets(srv.nga)
+				if over {
+					log.Printf("帖子 %d 超过存储配额, 跳过附件下载\n", id)
+				} else {
+					go topic.TryFixAssets(srv.nga)
+				}
 			}
 		} else {
 			if topic, has := cache.topics.Get(id); has {
@@ -347,6 +398,7 @@ max_floor = -1`
 					Time:    Now(),
 				}
 				topic.Modify()
+				srv.publish(EVENT_DOWN_FINISHED, id, topic.Result)
 
 				md := topic.Metadata
 				if md.MaxRetryCount >= 0 {
@@ -365,10 +417,12 @@ max_floor = -1`
 						log.Printf("放弃更新帖子 %d\n", id)
 						md.Abandon = true
 						go topic.SaveMeta()
+						srv.publish(EVENT_TOPIC_ABANDONED, id, md.retryCount)
 					}
 				}
 			}
 		}
+		cache.pending.done(id)
 	}
 }
 
@@ -403,10 +457,16 @@ func (srv *Server) Run() {
 	log.Println("服务器已启动，监听端口", srv.Cfg.Addr)
 
 	srv.cron.AddFunc("@every 12h", srv.checkRecycleBin)
+	srv.cron.AddFunc("@every 6h", srv.checkCookie)
+	srv.cron.AddFunc("@every 12h", srv.reconcile)
 	srv.cron.Start()
 
 	go srv.process()
 
+	if srv.notifier != nil {
+		go srv.notifier.run(srv)
+	}
+
 	// 等待中断信号以关闭服务器
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
@@ -432,8 +492,12 @@ func (srv *Server) Stop() {
 	log.Println("正在停止服务器...")
 
 	srv.stopOnce.Do(func() {
+		srv.events.Close()
 		srv.cron.Stop()
 		srv.cache.Close()
+		if srv.index != nil {
+			srv.index.Close()
+		}
 		srv.nga.Close()
 
 		close(srv.stopChan)
@@ -0,0 +1,196 @@
+package mgr
+
+import (
+	"cmp"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	STATS_DAYS     = 30  // 默认统计最近多少天添加的帖子
+	STATS_MAX_DAYS = 366 // 最多统计的天数
+	STATS_TOP      = 10  // 默认显示的作者和帖子数量
+	STATS_MAX_TOP  = 100
+)
+
+type dailyStats struct {
+	Date  string
+	Count int
+}
+
+type authorStats struct {
+	Author string
+	Uid    int `json:",omitempty"`
+	Topics int
+	Floors int
+}
+
+// 成功率统计, Pending 为还没有结果的数量, 不计入成功率
+type rateStats struct {
+	Name    string `json:",omitempty"`
+	Total   int
+	Success int
+	Failed  int
+	Pending int
+	Rate    float64 // 成功 / (成功 + 失败)
+}
+
+func (r *rateStats) count(status string) {
+	r.Total++
+	switch status {
+	case TRANSFER_STATUS_SUCCESS:
+		r.Success++
+	case TRANSFER_STATUS_FAILED:
+		r.Failed++
+	default:
+		r.Pending++
+	}
+}
+
+func (r *rateStats) rate() {
+	if done := r.Success + r.Failed; done > 0 {
+		r.Rate = float64(r.Success) / float64(done)
+	}
+}
+
+type topicStats struct {
+	Topics    int
+	Floors    int
+	AvgFloors float64
+	Daily     []dailyStats  // 每天添加的帖子数量, 按帖子的创建时间
+	Authors   []authorStats // 帖子最多的作者
+	Download  rateStats     // 最近一次下载的结果
+	Pans      []*rateStats  // 每个网盘的转存结果
+	Storage   []gin.H       // 占用最多的帖子
+	Time      CustomTime
+}
+
+func clampQuery(c *gin.Context, key string, def, max int) int {
+	v, e := strconv.Atoi(c.Query(key))
+	if e != nil || v <= 0 {
+		return def
+	}
+	return min(v, max)
+}
+
+// 网盘记录的名称和状态, 旧记录按网盘记录接口的方式处理, 没有匹配的网盘时根据链接判断
+func (srv *Server) panNameStatus(r TransferRecord) (string, string) {
+	srv.cache.pans.normalizeRecord(&r)
+	if r.Name != "" {
+		return r.Name, r.Status
+	}
+	if u, e := url.Parse(r.URL); e == nil && u.Hostname() != "" {
+		return u.Hostname(), r.Status
+	}
+	return "unknown", r.Status
+}
+
+func (srv *Server) computeStats(days, top int, now time.Time) *topicStats {
+	topics := srv.indexedTopics()
+	st := &topicStats{
+		Topics: len(topics),
+		Time:   FromTime(now),
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, TIME_LOC)
+	start := today.AddDate(0, 0, 1-days)
+	daily := make(map[string]int)
+	authors := make(map[string]*authorStats)
+	pans := make(map[string]*rateStats)
+
+	for _, topic := range topics {
+		st.Floors += topic.MaxFloor
+
+		if t := topic.Create.Time; !t.IsZero() && !t.Before(start) {
+			daily[t.In(TIME_LOC).Format(time.DateOnly)]++
+		}
+
+		if topic.Author != "" {
+			a, has := authors[topic.Author]
+			if !has {
+				a = &authorStats{Author: topic.Author, Uid: topic.Uid}
+				authors[topic.Author] = a
+			}
+			a.Topics++
+			a.Floors += topic.MaxFloor
+		}
+
+		switch {
+		case topic.Result.Time.IsZero():
+			st.Download.count("")
+		case topic.Result.Success:
+			st.Download.count(TRANSFER_STATUS_SUCCESS)
+		default:
+			st.Download.count(TRANSFER_STATUS_FAILED)
+		}
+
+		for _, r := range topic.panSummary() {
+			name, status := srv.panNameStatus(r)
+			p, has := pans[name]
+			if !has {
+				p = &rateStats{Name: name}
+				pans[name] = p
+			}
+			p.count(status)
+		}
+	}
+
+	if st.Topics > 0 {
+		st.AvgFloors = float64(st.Floors) / float64(st.Topics)
+	}
+	st.Download.rate()
+
+	st.Daily = make([]dailyStats, 0, days)
+	for d := start; !d.After(today); d = d.AddDate(0, 0, 1) {
+		date := d.Format(time.DateOnly)
+		st.Daily = append(st.Daily, dailyStats{Date: date, Count: daily[date]})
+	}
+
+	st.Authors = make([]authorStats, 0, len(authors))
+	for _, a := range authors {
+		st.Authors = append(st.Authors, *a)
+	}
+	slices.SortFunc(st.Authors, func(a, b authorStats) int {
+		return cmp.Or(cmp.Compare(b.Topics, a.Topics), cmp.Compare(b.Floors, a.Floors), cmp.Compare(a.Author, b.Author))
+	})
+	st.Authors = st.Authors[:min(len(st.Authors), top)]
+
+	st.Pans = make([]*rateStats, 0, len(pans))
+	for _, p := range pans {
+		p.rate()
+		st.Pans = append(st.Pans, p)
+	}
+	slices.SortFunc(st.Pans, func(a, b *rateStats) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	slices.SortFunc(topics, func(a, b *Topic) int {
+		return cmp.Compare(b.storageTotal(), a.storageTotal())
+	})
+	st.Storage = make([]gin.H, 0, top)
+	for _, topic := range topics[:min(len(topics), top)] {
+		if topic.Storage == nil {
+			break
+		}
+		st.Storage = append(st.Storage, gin.H{
+			"Id":    topic.Id,
+			"Title": topic.Title,
+			"Total": topic.Storage.Total,
+		})
+	}
+	return st
+}
+
+// 帖子统计, days 为统计每天添加帖子的天数, top 为作者和占用排行的数量
+func (srv *Server) topicStats() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		days := clampQuery(c, "days", STATS_DAYS, STATS_MAX_DAYS)
+		top := clampQuery(c, "top", STATS_TOP, STATS_MAX_TOP)
+		c.JSON(http.StatusOK, srv.computeStats(days, top, time.Now()))
+	}
+}
@@ -0,0 +1,131 @@
+package mgr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/assert/v2"
+)
+
+func TestComputeStats(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	now := time.Date(2025, 3, 10, 12, 0, 0, 0, TIME_LOC)
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	add := func(id int, author string, floor int, create time.Time, result DownResult, size int64) *Topic {
+		topic := &Topic{Id: id, Author: author, MaxFloor: floor, Create: FromTime(create), Result: result, Metadata: NewMetadata()}
+		if size > 0 {
+			topic.Storage = &StorageUsage{Total: size}
+		}
+		srv.cache.topics.Put(id, topic)
+		return topic
+	}
+	ok := DownResult{Success: true, Time: FromTime(now)}
+	failed := DownResult{Success: false, Time: FromTime(now)}
+	add(1, "甲", 10, now, ok, 300)
+	add(2, "甲", 20, now.AddDate(0, 0, -1), ok, 100)
+	add(3, "乙", 30, now.AddDate(0, 0, -5), failed, 0)
+	pan := add(4, "丙", 0, now.AddDate(0, -2, 0), DownResult{}, 200)
+
+	os.MkdirAll(filepath.Join(dir, "4"), COMMON_DIR_MODE)
+	os.WriteFile(filepath.Join(dir, "4", PAN_JSON), []byte(`[
+		{"Name": "baidu", "URL": "https://pan.baidu.com/s/1", "Status": "success"},
+		{"Name": "baidu", "URL": "https://pan.baidu.com/s/2", "Status": "failed"},
+		{"URL": "https://pan.quark.cn/s/3", "Saved": true}
+	]`), COMMON_FILE_MODE)
+	pan.root, e = root.SafeOpenRoot("4")
+	assert.Equal(t, e, nil)
+
+	st := srv.computeStats(7, 2, now)
+	assert.Equal(t, st.Topics, 4)
+	assert.Equal(t, st.Floors, 60)
+	assert.Equal(t, st.AvgFloors, 15.0)
+
+	assert.Equal(t, len(st.Daily), 7)
+	assert.Equal(t, st.Daily[6], dailyStats{Date: "2025-03-10", Count: 1})
+	assert.Equal(t, st.Daily[5].Count, 1)
+	assert.Equal(t, st.Daily[1].Count, 1)
+	assert.Equal(t, st.Daily[0].Date, "2025-03-04")
+
+	assert.Equal(t, len(st.Authors), 2)
+	assert.Equal(t, st.Authors[0], authorStats{Author: "甲", Topics: 2, Floors: 30})
+	assert.Equal(t, st.Authors[1].Author, "乙")
+
+	assert.Equal(t, st.Download.Success, 2)
+	assert.Equal(t, st.Download.Failed, 1)
+	assert.Equal(t, st.Download.Pending, 1)
+
+	assert.Equal(t, len(st.Pans), 2)
+	assert.Equal(t, st.Pans[0].Name, "baidu")
+	assert.Equal(t, st.Pans[0].Rate, 0.5)
+	assert.Equal(t, st.Pans[1].Name, "pan.quark.cn")
+	assert.Equal(t, st.Pans[1].Success, 1)
+
+	// 从索引中读取的帖子使用索引中的网盘记录
+	srv.cache.topics.Put(5, &Topic{Id: 5, Metadata: NewMetadata(), pans: []TransferRecord{
+		{URL: "https://pan.quark.cn/s/5", Status: TRANSFER_STATUS_FAILED},
+	}})
+	st = srv.computeStats(7, 2, now)
+	assert.Equal(t, st.Pans[1].Name, "pan.quark.cn")
+	assert.Equal(t, st.Pans[1].Total, 2)
+	assert.Equal(t, st.Pans[1].Failed, 1)
+
+	assert.Equal(t, len(st.Storage), 2)
+	assert.Equal(t, st.Storage[0]["Id"], 1)
+	assert.Equal(t, st.Storage[1]["Id"], 4)
+}
+
+func TestStatsAfterTransfer(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	os.MkdirAll(filepath.Join(dir, "1"), COMMON_DIR_MODE)
+	os.WriteFile(filepath.Join(dir, "1", POST_MARKDOWN), []byte("# 标题\n"), COMMON_FILE_MODE)
+	os.WriteFile(filepath.Join(dir, "1", PROCESS_INI), []byte("[local]\nmax_page = 1\nmax_floor = 1\n"), COMMON_FILE_MODE)
+	os.WriteFile(filepath.Join(dir, "1", PAN_JSON), []byte(`[
+		{"Name": "baidu", "URL": "https://pan.baidu.com/s/1", "Status": "pending"},
+		{"Name": "baidu", "URL": "https://pan.baidu.com/s/2", "Status": "pending"}
+	]`), COMMON_FILE_MODE)
+
+	path, e := indexPath(root)
+	assert.Equal(t, e, nil)
+	idx, e := openTopicIndex(path)
+	assert.Equal(t, e, nil)
+	defer idx.Close()
+
+	srv := &Server{cache: &cache{topicRoot: root, topics: NewSyncMap[int, *Topic]()}, index: idx}
+	topic, e := LoadTopic(root, 1, nil)
+	assert.Equal(t, e, nil)
+	srv.cache.topics.Put(1, topic)
+	srv.indexTopic(topic)
+	ph := &PanHolder{msgCh: make(chan string, 1), srv: srv}
+
+	// 转存完成后索引中的网盘记录是最新的状态
+	ph.notify(1, "https://pan.baidu.com/s/1", TRANSFER_STATUS_SUCCESS, "")
+	ph.notify(1, "https://pan.baidu.com/s/2", TRANSFER_STATUS_FAILED, "链接已失效")
+
+	r := gin.New()
+	r.GET("/stats", srv.topicStats())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	var st topicStats
+	assert.Equal(t, json.Unmarshal(w.Body.Bytes(), &st), nil)
+	assert.Equal(t, len(st.Pans), 1)
+	assert.Equal(t, st.Pans[0].Name, "baidu")
+	assert.Equal(t, st.Pans[0].Success, 1)
+	assert.Equal(t, st.Pans[0].Failed, 1)
+	assert.Equal(t, <-ph.msgCh, "链接已失效")
+}
@@ -0,0 +1,331 @@
+package mgr
+
+import (
+	"cmp"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/i2534/ngamm/mgr/log"
+)
+
+const (
+	STORAGE_TOP_SIZE = 20 // 统计中显示占用最多的帖子数量
+
+	QUOTA_SCOPE_TOPIC = "topic" // 单个帖子的配额
+	QUOTA_SCOPE_TOTAL = "total" // 所有帖子的配额
+)
+
+var (
+	videoExts = []string{".mp4", ".webm", ".mov", ".mkv", ".m4v", ".avi", ".flv"}
+	imageExts = []string{".jpg", ".jpeg", ".png", ".gif", ".webp", ".bmp", ".avif"}
+)
+
+// 帖子占用的磁盘空间, 单位字节
+type StorageUsage struct {
+	Markdown   int64
+	Attachment int64 // 图片等附件
+	Video      int64
+	Other      int64 // 进度, 元数据等文件
+	Total      int64
+	Files      int
+	Time       CustomTime
+	OverQuota  bool `json:",omitempty"` // 是否超过配额, 超过后不再下载媒体文件
+}
+
+func (u *StorageUsage) add(name string, size int64) {
+	u.change(name, size, 1)
+}
+
+// 按文件类型修改大小和文件数, 文件变小或被删除时为负数
+func (u *StorageUsage) change(name string, size int64, files int) {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case ext == ".md":
+		u.Markdown += size
+	case slices.Contains(videoExts, ext):
+		u.Video += size
+	case slices.Contains(imageExts, ext), strings.HasPrefix(filepath.ToSlash(name), ATTACH_DIR+"/"):
+		u.Attachment += size
+	default:
+		u.Other += size
+	}
+	u.Total += size
+	u.Files += files
+}
+
+func (u *StorageUsage) merge(o *StorageUsage) {
+	u.Markdown += o.Markdown
+	u.Attachment += o.Attachment
+	u.Video += o.Video
+	u.Other += o.Other
+	u.Total += o.Total
+	u.Files += o.Files
+}
+
+// 统计帖子目录下所有文件的大小
+func measureStorage(root *ExtRoot) (*StorageUsage, error) {
+	u := &StorageUsage{Time: Now()}
+	e := fs.WalkDir(root.FS(), ".", func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			return e
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, e := d.Info()
+		if e != nil {
+			return nil // 统计期间被删除
+		}
+		u.add(path, fi.Size())
+		return nil
+	})
+	return u, e
+}
+
+// 帖子目录下顶层文件的大小, 下载帖子时 ngapost2md 只修改这些文件
+func topLevelSizes(root *ExtRoot) map[string]int64 {
+	ret := make(map[string]int64)
+	entries, e := root.ReadDir()
+	if e != nil {
+		return ret
+	}
+	for _, d := range entries {
+		if d.IsDir() {
+			continue
+		}
+		if fi, e := d.Info(); e == nil {
+			ret[d.Name()] = fi.Size()
+		}
+	}
+	return ret
+}
+
+// 1.5GB, 500M, 1024 等格式, 以 1024 为单位
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	num := strings.TrimRight(strings.TrimSuffix(s, "B"), "KMGT")
+	unit := strings.TrimSuffix(strings.TrimPrefix(s, num), "B")
+	n, e := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if e != nil || n < 0 {
+		return 0, fmt.Errorf("无效的大小: %s", s)
+	}
+	i := -1
+	if unit != "" {
+		if i = strings.Index("KMGT", unit); len(unit) > 1 || i < 0 {
+			return 0, fmt.Errorf("无效的大小单位: %s", s)
+		}
+	}
+	for ; i >= 0; i-- {
+		n *= 1024
+	}
+	return int64(n), nil
+}
+
+func FormatSize(size int64) string {
+	const units = "KMGT"
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	n := float64(size)
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", n, units[i])
+}
+
+// 存储配额, 0 表示不限制
+type storageQuota struct {
+	topic int64
+	total int64
+}
+
+func newStorageQuota(cfg *Config) storageQuota {
+	q := storageQuota{}
+	if cfg == nil {
+		return q
+	}
+	var e error
+	if q.topic, e = ParseSize(cfg.TopicQuota); e != nil {
+		log.Println("解析 TopicQuota 失败:", e)
+	}
+	if q.total, e = ParseSize(cfg.TotalQuota); e != nil {
+		log.Println("解析 TotalQuota 失败:", e)
+	}
+	return q
+}
+
+func (srv *Server) totalStorage() int64 {
+	total := int64(0)
+	srv.cache.topics.Each(func(_ int, topic *Topic) {
+		if u := topic.Storage; u != nil {
+			total += u.Total
+		}
+	})
+	return total
+}
+
+// 检查帖子是否超过配额, 由未超过变为超过时发布事件
+func (srv *Server) checkQuota(topic *Topic) bool {
+	u := topic.Storage
+	if u == nil {
+		return false
+	}
+	q := srv.quota
+	scope, usage, quota := "", int64(0), int64(0)
+	if q.topic > 0 && u.Total >= q.topic {
+		scope, usage, quota = QUOTA_SCOPE_TOPIC, u.Total, q.topic
+	} else if q.total > 0 {
+		if total := srv.totalStorage(); total >= q.total {
+			scope, usage, quota = QUOTA_SCOPE_TOTAL, total, q.total
+		}
+	}
+
+	over := scope != ""
+	if over && !u.OverQuota {
+		log.Printf("帖子 %d 占用 %s 超过配额 %s (%s), 不再下载媒体文件\n", topic.Id, FormatSize(usage), FormatSize(quota), scope)
+		srv.publish(EVENT_STORAGE_QUOTA, topic.Id, gin.H{
+			"Scope":      scope,
+			"Usage":      FormatSize(usage),
+			"Quota":      FormatSize(quota),
+			"UsageBytes": usage,
+			"QuotaBytes": quota,
+		})
+	}
+	u.OverQuota = over
+	return over
+}
+
+// 重新统计帖子的占用, old 为之前加载的帖子, 用于保留配额状态
+func (srv *Server) updateStorage(topic, old *Topic) {
+	u, e := measureStorage(topic.root)
+	if e != nil {
+		log.Printf("统计帖子 %d 的占用失败: %s\n", topic.Id, e)
+		return
+	}
+	if old != nil && old.Storage != nil {
+		u.OverQuota = old.Storage.OverQuota
+	}
+	topic.Storage = u
+}
+
+// 下载帖子后按顶层文件的变化更新占用, before 为下载前的 topLevelSizes.
+// 没有统计过时才遍历整个目录, 附件的占用由 addStorage 增加
+func (srv *Server) downStorage(topic, old *Topic, before map[string]int64) {
+	if old == nil || old.Storage == nil {
+		srv.updateStorage(topic, old)
+		return
+	}
+	md := old.Metadata
+	md.mutex.Lock()
+	u := *old.Storage
+	md.mutex.Unlock()
+
+	after := topLevelSizes(topic.root)
+	for name, size := range after {
+		if prev, has := before[name]; has {
+			u.change(name, size-prev, 0)
+		} else {
+			u.change(name, size, 1)
+		}
+	}
+	for name, size := range before {
+		if _, has := after[name]; !has {
+			u.change(name, -size, -1)
+		}
+	}
+	u.Time = Now()
+	topic.Storage = &u
+}
+
+// 下载附件后增加帖子的占用, 返回是否超过配额
+func (srv *Server) addStorage(topic *Topic, name string, size int64) bool {
+	md := topic.Metadata
+	md.mutex.Lock()
+	u := &StorageUsage{}
+	if topic.Storage != nil {
+		*u = *topic.Storage
+	}
+	u.add(name, size)
+	u.Time = Now()
+	topic.Storage = u
+	md.mutex.Unlock()
+	return srv.checkQuota(topic)
+}
+
+// 删除文件后减少帖子的占用, 调用方可能持有元数据锁, 因此只替换统计结果
+func (srv *Server) removeStorage(topic *Topic, name string, size int64) {
+	u := &StorageUsage{}
+	if topic.Storage != nil {
+		*u = *topic.Storage
+	}
+	u.change(name, -size, -1)
+	u.Time = Now()
+	topic.Storage = u
+}
+
+func (srv *Server) overQuota(topic *Topic) bool {
+	u := topic.Storage
+	return u != nil && u.OverQuota
+}
+
+func (srv *Server) storageStats() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		total := &StorageUsage{Time: Now()}
+		topics := srv.indexedTopics()
+		measured, over := 0, 0
+		for _, topic := range topics {
+			if u := topic.Storage; u != nil {
+				total.merge(u)
+				measured++
+				if u.OverQuota {
+					over++
+				}
+			}
+		}
+
+		slices.SortFunc(topics, func(a, b *Topic) int {
+			return cmp.Compare(b.storageTotal(), a.storageTotal())
+		})
+		top := make([]gin.H, 0, STORAGE_TOP_SIZE)
+		for _, topic := range topics[:min(len(topics), STORAGE_TOP_SIZE)] {
+			if topic.Storage == nil {
+				break
+			}
+			top = append(top, gin.H{
+				"Id":      topic.Id,
+				"Title":   topic.Title,
+				"Storage": topic.Storage,
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"Total":     total,
+			"Topics":    len(topics),
+			"Measured":  measured,
+			"OverQuota": over,
+			"Quota": gin.H{
+				"Topic": srv.quota.topic,
+				"Total": srv.quota.total,
+			},
+			"Top": top,
+		})
+	}
+}
+
+func (t *Topic) storageTotal() int64 {
+	if t.Storage == nil {
+		return -1
+	}
+	return t.Storage.Total
+}
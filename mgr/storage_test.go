@@ -0,0 +1,121 @@
+package mgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"":      0,
+		"1024":  1024,
+		"10B":   10,
+		"2k":    2048,
+		"1.5GB": 1536 * 1024 * 1024,
+		"500 M": 500 * 1024 * 1024,
+	}
+	for s, n := range cases {
+		v, e := ParseSize(s)
+		assert.Equal(t, e, nil)
+		assert.Equal(t, v, n)
+	}
+	for _, s := range []string{"abc", "1PB", "-1G", "1KMB"} {
+		_, e := ParseSize(s)
+		assert.NotEqual(t, e, nil)
+	}
+	assert.Equal(t, FormatSize(100), "100 B")
+	assert.Equal(t, FormatSize(1536*1024), "1.5 MB")
+}
+
+func TestStorageQuota(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), COMMON_DIR_MODE)
+		os.WriteFile(filepath.Join(dir, name), make([]byte, size), COMMON_FILE_MODE)
+	}
+	write(POST_MARKDOWN, 100)
+	write("12_abc.jpg", 200)
+	write(ATTACH_DIR+"/xyz", 300)
+	write("video.mp4", 400)
+	write(PROCESS_INI, 50)
+
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	u, e := measureStorage(root)
+	assert.Equal(t, e, nil)
+	assert.Equal(t, u.Markdown, int64(100))
+	assert.Equal(t, u.Attachment, int64(500))
+	assert.Equal(t, u.Video, int64(400))
+	assert.Equal(t, u.Other, int64(50))
+	assert.Equal(t, u.Total, int64(1050))
+	assert.Equal(t, u.Files, 5)
+
+	srv := &Server{
+		cache: &cache{topics: NewSyncMap[int, *Topic]()},
+		quota: storageQuota{topic: 1100},
+	}
+	topic := &Topic{Id: 1, root: root, Metadata: NewMetadata()}
+	srv.cache.topics.Put(1, topic)
+	srv.updateStorage(topic, nil)
+	assert.Equal(t, srv.checkQuota(topic), false)
+
+	// 下载附件后超过配额
+	assert.Equal(t, srv.addStorage(topic, ATTACH_DIR+"/new.png", 100), true)
+	assert.Equal(t, srv.overQuota(topic), true)
+	assert.Equal(t, topic.Storage.Attachment, int64(600))
+
+	// 重新统计时保留配额状态
+	next := &Topic{Id: 1, root: root, Metadata: NewMetadata()}
+	srv.updateStorage(next, topic)
+	assert.Equal(t, next.Storage.OverQuota, true)
+	assert.Equal(t, srv.checkQuota(next), false)
+
+	// 总配额
+	srv.quota = storageQuota{total: 2000}
+	other := &Topic{Id: 2, Metadata: NewMetadata(), Storage: &StorageUsage{Total: 1000}}
+	srv.cache.topics.Put(1, next)
+	srv.cache.topics.Put(2, other)
+	assert.Equal(t, srv.checkQuota(other), true)
+}
+
+func TestDownStorage(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, size int) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), COMMON_DIR_MODE)
+		os.WriteFile(filepath.Join(dir, name), make([]byte, size), COMMON_FILE_MODE)
+	}
+	write(POST_MARKDOWN, 100)
+	write(PROCESS_INI, 50)
+	write(ATTACH_DIR+"/xyz", 300)
+
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+
+	srv := &Server{cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	old := &Topic{Id: 1, root: root, Metadata: NewMetadata()}
+	// 没有统计过时统计整个目录
+	srv.downStorage(old, nil, nil)
+	assert.Equal(t, old.Storage.Total, int64(450))
+
+	before := topLevelSizes(root)
+	write(POST_MARKDOWN, 250)
+	write(POST_MARKDOWN_1ST, 20)
+	os.Remove(filepath.Join(dir, PROCESS_INI))
+	// 子目录的变化由 addStorage 统计
+	write(ATTACH_DIR+"/new", 1000)
+
+	topic := &Topic{Id: 1, root: root, Metadata: NewMetadata()}
+	srv.downStorage(topic, old, before)
+	assert.Equal(t, topic.Storage.Markdown, int64(270))
+	assert.Equal(t, topic.Storage.Other, int64(0))
+	assert.Equal(t, topic.Storage.Attachment, int64(300))
+	assert.Equal(t, topic.Storage.Total, int64(570))
+	assert.Equal(t, topic.Storage.Files, 3)
+	assert.Equal(t, old.Storage.Total, int64(450))
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,7 +31,12 @@ type Metadata struct {
 	retryCount    int
 	UpdateCron    string
 	mutex         *sync.Mutex
-	Abandon       bool // 已达到最大重试次数, 放弃更新
+	Abandon       bool     // 已达到最大重试次数, 放弃更新
+	LastMaxFloor  int      // 最近一次有新楼层的下载之前的最大楼层, 用于生成新楼层的订阅源
+	Tags          []string `json:",omitempty"` // 标签
+	Folder        string   `json:",omitempty"` // 所在文件夹, 多级用 / 分隔
+	Note          string   `json:",omitempty"` // 备注
+	Reading       *Reading `json:",omitempty"` // 阅读进度和书签
 }
 
 func NewMetadata() *Metadata {
@@ -48,6 +54,75 @@ func (m *Metadata) Merge(n *Metadata) {
 	m.Abandon = n.Abandon
 }
 
+// 整理标签, 去掉空白和重复的标签
+func normalizeTags(tags []string) []string {
+	ret := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.Contains(ret, tag) {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// 整理文件夹路径, 如 " a / /b/ " 整理为 "a/b"
+func normalizeFolder(folder string) string {
+	parts := make([]string, 0)
+	for p := range strings.SplitSeq(folder, "/") {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func (m *Metadata) HasTag(tag string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return slices.Contains(m.Tags, tag)
+}
+
+// 是否在指定的文件夹或其子文件夹中
+func (m *Metadata) InFolder(folder string) bool {
+	folder = normalizeFolder(folder)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Folder == folder || strings.HasPrefix(m.Folder, folder+"/")
+}
+
+func (m *Metadata) SetTags(tags []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Tags = normalizeTags(tags)
+}
+
+func (m *Metadata) AddTags(tags ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Tags = normalizeTags(append(slices.Clone(m.Tags), tags...))
+}
+
+func (m *Metadata) RemoveTags(tags ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Tags = slices.DeleteFunc(m.Tags, func(tag string) bool {
+		return slices.Contains(tags, tag)
+	})
+}
+
+func (m *Metadata) SetFolder(folder string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Folder = normalizeFolder(folder)
+}
+
+func (m *Metadata) SetNote(note string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Note = strings.TrimSpace(note)
+}
+
 type DownResult struct {
 	Success bool
 	Message string
@@ -67,7 +142,11 @@ type Topic struct {
 	Create   CustomTime
 	modAt    CustomTime
 	Result   DownResult
-	closed   bool // 是否已关闭
+	Unread   int              // 未读楼层数量
+	Storage  *StorageUsage    `json:",omitempty"` // 占用的磁盘空间
+	closed   bool             // 是否已关闭
+	hasPan   bool             // 是否有网盘记录, 只用于从索引中读取的帖子
+	pans     []TransferRecord // 网盘记录的摘要, 只用于从索引中读取的帖子
 }
 
 func NewTopic(root *ExtRoot, id int) *Topic {
@@ -226,6 +305,7 @@ func LoadTopic(root *ExtRoot, id int, nga *Client) (*Topic, error) {
 		log.Group(groupTopic).Println("解析帖子元数据失败:", e)
 	}
 	topic.Metadata = md
+	topic.countUnread()
 
 	topic.Modify()
 
@@ -279,7 +359,33 @@ func (t *Topic) ContentPart(index int) (string, bool, error) {
 	return "", false, errors.New("未找到帖子内容")
 }
 
-var regexFloorHead = regexp.MustCompile(`(\d+)\.\[`)
+var (
+	regexFloorHead = regexp.MustCompile(`(\d+)\.\[`)
+	// 完整的楼层头, 在 regexFloorHead 之后依次为 pid, 时间, 作者和 uid
+	regexFloorInfo = regexp.MustCompile(regexFloorHead.String() + `\d+\]\s*\\?<pid:(\d+)\\?>\s+(\d{4}-\d{2}-\d{2}\s+\d{2}:\d{2}:\d{2})\s+by\s+([^(<]+?)\s*(?:\((\d+)\))?\s*<`)
+)
+
+// 解析楼层头, 不是楼层头时返回 false, 楼层头不完整时只有楼层号
+func parseFloorHead(line string) (Floor, bool) {
+	if !strings.HasPrefix(line, "##### ") {
+		return Floor{}, false
+	}
+	if m := regexFloorInfo.FindStringSubmatch(line); m != nil {
+		f := Floor{Author: m[4]}
+		f.Floor, _ = strconv.Atoi(m[1])
+		f.Pid, _ = strconv.Atoi(m[2])
+		f.Uid, _ = strconv.Atoi(m[5])
+		if tm, e := time.ParseInLocation("2006-01-02 15:04:05", m[3], TIME_LOC); e == nil {
+			f.Time = FromTime(tm)
+		}
+		return f, true
+	}
+	if m := regexFloorHead.FindStringSubmatch(line); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return Floor{Floor: n}, true
+	}
+	return Floor{}, false
+}
 
 // ContentFloor 返回指定楼层的 markdown 块（楼层从 0 开始，0 为主楼）
 func (t *Topic) ContentFloor(floor int) (string, error) {
@@ -291,13 +397,8 @@ func (t *Topic) ContentFloor(floor int) (string, error) {
 	var buf strings.Builder
 	inBlock := false
 	for _, line := range lines {
-		if strings.HasPrefix(line, "##### ") {
-			m := regexFloorHead.FindStringSubmatch(line)
-			n := -1
-			if len(m) > 1 {
-				n, _ = strconv.Atoi(m[1])
-			}
-			if n == floor {
+		if head, ok := parseFloorHead(line); ok {
+			if head.Floor == floor {
 				inBlock = true
 				buf.Reset()
 				buf.WriteString(line)
@@ -318,6 +419,51 @@ func (t *Topic) ContentFloor(floor int) (string, error) {
 	return strings.TrimSuffix(buf.String(), "\n"), nil
 }
 
+// 楼层信息
+type Floor struct {
+	Floor   int
+	Pid     int
+	Uid     int
+	Author  string
+	Time    CustomTime
+	Content string // 楼层的 markdown, 不含楼层头
+}
+
+// Floors 解析帖子的全部楼层, 包括主楼
+func (t *Topic) Floors() ([]Floor, error) {
+	full, e := t.fullContent()
+	if e != nil {
+		return nil, e
+	}
+	return parseFloors(full), nil
+}
+
+func parseFloors(content string) []Floor {
+	ret := make([]Floor, 0)
+	var cur *Floor
+	var buf strings.Builder
+	flush := func() {
+		if cur != nil {
+			cur.Content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(buf.String()), "----"))
+			ret = append(ret, *cur)
+		}
+		buf.Reset()
+	}
+	for line := range strings.SplitSeq(content, "\n") {
+		if head, ok := parseFloorHead(line); ok {
+			flush()
+			cur = &head
+			continue
+		}
+		if cur != nil {
+			buf.WriteString(line)
+			buf.WriteString("\n")
+		}
+	}
+	flush()
+	return ret
+}
+
 func (t *Topic) fullContent() (string, error) {
 	if !t.root.IsExist(POST_MARKDOWN_1ST) {
 		return t.ContentCore()
@@ -0,0 +1,219 @@
+package mgr
+
+import (
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	USER_FLOORS_SIZE   = 200 // 用户在其他帖子中的回复最多返回的数量
+	USER_FLOOR_PREVIEW = 200 // 回复内容预览的字数
+)
+
+// 用户在其他帖子中的回复
+type userFloor struct {
+	TopicId int
+	Title   string
+	Floor   int
+	Pid     int
+	Time    CustomTime
+	Content string
+}
+
+type userSubscription struct {
+	Subscribed bool
+	Filter     []string
+	Tags       []string
+}
+
+type userProfile struct {
+	Uid          int
+	Name         string
+	Profile      *User  `json:",omitempty"` // 缓存的用户信息
+	ProfileError string `json:",omitempty"`
+	Names        []UserName
+	Subscription userSubscription
+	Topics       []*Topic
+	Floors       []userFloor
+	FloorsTotal  int
+	View         string // 查看帖子的地址前缀
+}
+
+func preview(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
+
+// 帖子中一层的作者, 用于查找用户的回复
+type floorAuthor struct {
+	Floor  int
+	Uid    int
+	Author string
+}
+
+type floorAuthors struct {
+	topic   *Topic
+	modAt   CustomTime
+	authors []floorAuthor
+}
+
+// 每个帖子各楼层的作者, 避免每次查看用户时都解析全部帖子
+var floorAuthorCache = NewSyncMap[int, *floorAuthors]()
+
+// 帖子各楼层的作者, 帖子重新加载或修改后重新解析
+func (t *Topic) floorAuthors() ([]floorAuthor, error) {
+	if c, has := floorAuthorCache.Get(t.Id); has && c.topic == t && c.modAt.Equal(t.modAt.Time) {
+		return c.authors, nil
+	}
+	floors, e := t.Floors()
+	if e != nil {
+		return nil, e
+	}
+	authors := make([]floorAuthor, 0, len(floors))
+	for _, f := range floors {
+		authors = append(authors, floorAuthor{Floor: f.Floor, Uid: f.Uid, Author: f.Author})
+	}
+	floorAuthorCache.Put(t.Id, &floorAuthors{t, t.modAt, authors})
+	return authors, nil
+}
+
+// 用户在其他人帖子中的回复, 按时间倒序
+func (srv *Server) userFloors(uid int, name string) ([]userFloor, int) {
+	// 匿名或旧格式的楼层没有 uid, 只能按用户名匹配
+	match := func(fuid int, author string) bool {
+		return fuid == uid || (fuid == 0 && name != "" && author == name)
+	}
+	ret := make([]userFloor, 0)
+	for _, topic := range srv.cache.topics.Values() {
+		if topic.Uid == uid || topic.root == nil {
+			continue
+		}
+		authors, e := topic.floorAuthors()
+		if e != nil {
+			continue
+		}
+		// 只解析有该用户回复的帖子
+		if !slices.ContainsFunc(authors, func(a floorAuthor) bool { return a.Floor != 0 && match(a.Uid, a.Author) }) {
+			continue
+		}
+		floors, e := topic.Floors()
+		if e != nil {
+			continue
+		}
+		for _, f := range floors {
+			if f.Floor == 0 {
+				continue
+			}
+			if match(f.Uid, f.Author) {
+				ret = append(ret, userFloor{
+					TopicId: topic.Id,
+					Title:   topic.Title,
+					Floor:   f.Floor,
+					Pid:     f.Pid,
+					Time:    f.Time,
+					Content: preview(f.Content, USER_FLOOR_PREVIEW),
+				})
+			}
+		}
+	}
+	slices.SortFunc(ret, func(a, b userFloor) int {
+		return b.Time.Compare(a.Time.Time)
+	})
+	total := len(ret)
+	return ret[:min(total, USER_FLOORS_SIZE)], total
+}
+
+func (srv *Server) buildUserProfile(uid int) *userProfile {
+	p := &userProfile{
+		Uid:    uid,
+		Names:  []UserName{},
+		Topics: make([]*Topic, 0),
+	}
+	if srv.nga != nil {
+		if u, e := srv.nga.GetUserById(uid); e == nil {
+			p.Profile = &u
+			p.Name = u.Name
+			p.Names = slices.Clone(u.Names)
+			p.Subscription.Subscribed = u.Subscribed
+			if u.SubFilter != nil {
+				p.Subscription.Filter = *u.SubFilter
+			}
+			if u.SubTags != nil {
+				p.Subscription.Tags = *u.SubTags
+			}
+		} else {
+			p.ProfileError = e.Error()
+		}
+	}
+
+	for _, topic := range srv.indexedTopics() {
+		if topic.Uid == uid {
+			p.Topics = append(p.Topics, topic)
+		}
+	}
+	slices.SortFunc(p.Topics, func(a, b *Topic) int {
+		return b.Create.Compare(a.Create.Time)
+	})
+	if p.Name == "" && len(p.Topics) > 0 {
+		p.Name = p.Topics[0].Author
+	}
+
+	p.Floors, p.FloorsTotal = srv.userFloors(uid, p.Name)
+	return p
+}
+
+func (srv *Server) userInfo() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		uid, e := strconv.Atoi(c.Param("uid"))
+		if e != nil || uid <= 0 {
+			c.JSON(http.StatusBadRequest, toErr("无效的用户 ID"))
+			return
+		}
+		p := srv.buildUserProfile(uid)
+		token := srv.Cfg.tokenHash
+		if token == "" {
+			token = "-"
+		}
+		p.View = "/view/" + token + "/"
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// 用户页面, 数据由页面通过 /user/:uid 获取
+func (srv *Server) userPage() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		uid, e := strconv.Atoi(strings.TrimSpace(c.Param("uid")))
+		if e != nil || uid <= 0 {
+			c.String(http.StatusBadRequest, "无效的用户 ID")
+			return
+		}
+		tmpl, e := template.ParseFS(efs, "assets/user.html")
+		if e != nil {
+			c.String(http.StatusInternalServerError, "加载用户页面失败")
+			return
+		}
+		data := struct {
+			Uid      int
+			HasToken bool
+			BaseUrl  string
+			Version  string
+		}{
+			Uid:      uid,
+			HasToken: srv.Cfg.Config.Token != "",
+			BaseUrl:  srv.nga.BaseURL(),
+			Version:  srv.Cfg.GitHash,
+		}
+		c.Header("Content-Type", HTML_HEADER)
+		if e := tmpl.Execute(c.Writer, data); e != nil {
+			c.String(http.StatusInternalServerError, "渲染用户页面失败")
+		}
+	}
+}
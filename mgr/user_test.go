@@ -0,0 +1,91 @@
+package mgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-playground/assert/v2"
+)
+
+func TestUserRename(t *testing.T) {
+	u := &User{Id: 1, Name: "UID1", saved: true}
+	assert.Equal(t, u.rename("甲"), true)
+	assert.Equal(t, len(u.Names), 0) // UIDxxx 不记入曾用名
+	assert.Equal(t, u.rename("甲"), false)
+	assert.Equal(t, u.rename(""), false)
+	assert.Equal(t, u.rename("乙"), true)
+	assert.Equal(t, u.Name, "乙")
+	assert.Equal(t, u.saved, false)
+	assert.Equal(t, len(u.Names), 1)
+	assert.Equal(t, u.Names[0].Name, "甲")
+}
+
+func TestUserProfile(t *testing.T) {
+	dir := t.TempDir()
+	root, e := OpenRoot(dir)
+	assert.Equal(t, e, nil)
+	defer root.Close()
+	userDir, e := root.SafeOpenRoot(USER_DIR)
+	assert.Equal(t, e, nil)
+
+	nga := &Client{users: newUsers(userDir)}
+	filter := []string{"攻略"}
+	nga.users.PutAndSave(&User{Id: 100, Name: "甲", Subscribed: true, SubFilter: &filter})
+	nga.SetTopicUser(100, "乙")
+
+	write := func(id, content string) *ExtRoot {
+		assert.Equal(t, os.MkdirAll(filepath.Join(dir, id), COMMON_DIR_MODE), nil)
+		os.WriteFile(filepath.Join(dir, id, POST_MARKDOWN), []byte(content), COMMON_FILE_MODE)
+		r, e := root.SafeOpenRoot(id)
+		assert.Equal(t, e, nil)
+		return r
+	}
+	srv := &Server{nga: nga, cache: &cache{topics: NewSyncMap[int, *Topic]()}}
+	own := NewTopic(write("1", "# 自己的帖子\n"), 1)
+	own.Uid, own.Author = 100, "乙"
+	other := NewTopic(write("2", `# 别人的帖子
+
+##### <span id="pid0">0.[0] \<pid:0\> 2025-02-27 03:02:58 by 丙(200)</span>
+主楼
+
+----
+##### <span id="pid11">1.[1] \<pid:11\> 2025-02-27 04:00:00 by 乙(100)</span>
+第一条回复
+
+----
+##### <span id="pid12">2.[2] \<pid:12\> 2025-02-27 05:00:00 by 丙(200)</span>
+无关
+
+----
+##### <span id="pid13">3.[3] \<pid:13\> 2025-02-27 06:00:00 by 乙(100)</span>
+第二条回复
+`), 2)
+	other.Uid, other.Author = 200, "丙"
+	srv.cache.topics.Put(1, own)
+	srv.cache.topics.Put(2, other)
+
+	p := srv.buildUserProfile(100)
+	assert.Equal(t, p.Name, "乙")
+	assert.Equal(t, len(p.Names), 1)
+	assert.Equal(t, p.Names[0].Name, "甲")
+	assert.Equal(t, p.Subscription.Subscribed, true)
+	assert.Equal(t, p.Subscription.Filter, filter)
+	assert.Equal(t, len(p.Topics), 1)
+	assert.Equal(t, p.Topics[0].Id, 1)
+	assert.Equal(t, p.FloorsTotal, 2)
+	assert.Equal(t, p.Floors[0].Pid, 13)
+	assert.Equal(t, p.Floors[0].Content, "第二条回复")
+	assert.Equal(t, p.Floors[1].TopicId, 2)
+
+	// 楼层作者按修改时间缓存, 帖子修改前不重新解析
+	cached, _ := floorAuthorCache.Get(2)
+	assert.Equal(t, len(cached.authors), 4)
+	os.WriteFile(filepath.Join(dir, "2", POST_MARKDOWN), []byte("# 别人的帖子\n"), COMMON_FILE_MODE)
+	again, _ := other.floorAuthors()
+	assert.Equal(t, len(again), 4)
+	other.Modify()
+	again, _ = other.floorAuthors()
+	assert.Equal(t, len(again), 0)
+	assert.Equal(t, srv.buildUserProfile(100).FloorsTotal, 0)
+}